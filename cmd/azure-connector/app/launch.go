@@ -14,6 +14,7 @@ package app
 
 import (
 	"context"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
@@ -21,6 +22,7 @@ import (
 
 	"github.com/pkg/errors"
 
+	"github.com/ThreeDotsLabs/watermill"
 	"github.com/ThreeDotsLabs/watermill/message"
 	"github.com/eclipse-kanto/suite-connector/config"
 	"github.com/eclipse-kanto/suite-connector/connector"
@@ -28,9 +30,30 @@ import (
 	"github.com/eclipse-kanto/suite-connector/routing"
 
 	azurecfg "github.com/eclipse-kanto/azure-connector/config"
+	"github.com/eclipse-kanto/azure-connector/fileupload"
+	"github.com/eclipse-kanto/azure-connector/health"
+	"github.com/eclipse-kanto/azure-connector/metrics"
 	azurerouting "github.com/eclipse-kanto/azure-connector/routing"
 	routingbus "github.com/eclipse-kanto/azure-connector/routing/bus"
 	"github.com/eclipse-kanto/azure-connector/routing/message/handlers"
+	"github.com/eclipse-kanto/azure-connector/tracing"
+)
+
+const (
+	tracingServiceName = "azure-connector"
+	// tracingShutdownTimeout bounds the export of the remaining spans on exit.
+	tracingShutdownTimeout = 5 * time.Second
+
+	// localAckTimeout bounds the wait for the local broker to accept the C2D messages,
+	// it has to be shorter than the acknowledgement timeout of the Azure IoT Hub subscriber.
+	localAckTimeout = 10 * time.Second
+	// localRetryTimeout bounds the retrying of the messages produced from a C2D message before they are stored in the inbox,
+	// together with localAckTimeout, it has to be shorter than the acknowledgement timeout of the Azure IoT Hub subscriber.
+	localRetryTimeout = 5 * time.Second
+
+	// hubAckTimeout bounds the wait for the Azure IoT Hub to accept the device-to-cloud messages published while online,
+	// so that the queued messages are kept for retry instead of being buffered by the MQTT client while offline.
+	hubAckTimeout = 30 * time.Second
 )
 
 func startRouter(
@@ -40,25 +63,43 @@ func startRouter(
 	statusPub message.Publisher,
 	telemetryHandlers []handlers.TelemetryHandler,
 	commandHandlers []handlers.CommandHandler,
+	status *health.Status,
+	connMetrics *metrics.ConnectorMetrics,
+	tracer *tracing.Tracer,
+	delivered *routingbus.DeliveredMessages,
 	done chan bool,
 	logger logger.Logger,
-) (*message.Router, error) {
+) (_ *message.Router, err error) {
 	cloudClient, err := config.CreateCloudConnection(&settings.LocalConnectionSettings, false, logger)
 	if err != nil {
-		return nil, errors.Wrap(err, "cannot create mosquitto connection")
+		return nil, azurecfg.NewConfigurationError(errors.Wrap(err, "cannot create mosquitto connection"))
 	}
+	defer func() {
+		if err != nil {
+			cloudClient.Disconnect()
+		}
+	}()
 
 	azureClient, err := azurecfg.CreateAzureHubConnection(settings, connSettings, logger)
 	if err != nil {
-		routing.SendStatus(routing.StatusConnectionError, statusPub, logger)
 		return nil, errors.Wrap(err, "cannot create Hub connection")
 	}
+	defer func() {
+		if err != nil {
+			azureClient.Disconnect()
+		}
+	}()
 
 	logger.Info("Starting messages router...", nil)
 	router, err := message.NewRouter(message.RouterConfig{}, logger)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to create router")
 	}
+	router.AddMiddleware(connMetrics.Middleware)
+	if tracer != nil {
+		tracedHandlers := append(telemetryHandlerNames(telemetryHandlers), routingbus.CommandBusHandlerName)
+		router.AddMiddleware(tracer.Middleware(tracedHandlers...))
+	}
 
 	paramsPub := connector.NewPublisher(localClient, connector.QosAtMostOnce, logger, nil)
 	paramsSub := connector.NewSubscriber(cloudClient, connector.QosAtMostOnce, false, logger, nil)
@@ -67,25 +108,134 @@ func startRouter(
 	routing.ParamsBus(router, gwParams, paramsPub, paramsSub, logger)
 	routing.SendGwParams(gwParams, false, paramsPub, logger)
 
-	azurePub := connector.NewPublisher(azureClient, connector.QosAtLeastOnce, logger, nil)
-	azureSub := connector.NewSubscriber(azureClient, connector.QosAtMostOnce, false, logger, nil)
+	azurePub := connMetrics.PublisherDecorator(connector.NewPublisher(azureClient, connector.QosAtLeastOnce, logger, nil))
+	// the C2D messages are acknowledged to the Azure IoT Hub once they are accepted by the local broker
+	azureSub := connector.NewSubscriber(azureClient, connector.QosAtLeastOnce, false, logger, nil)
 	mosquittoSub := connector.NewSubscriber(cloudClient, connector.QosAtLeastOnce, false, router.Logger(), nil)
+	// the packet identifiers of the telemetry messages are bound to the local connection
+	epoch := &routingbus.ConnectionEpoch{}
+	cloudClient.AddConnectionListener(epoch)
+
+	handlerCtx := handlers.NewHandlerContext(&connSettings.RemoteConnectionInfo, router.Logger())
+	handlerCtx.LocalPublisher = func(qos connector.Qos) message.Publisher {
+		return connector.NewPublisher(cloudClient, qos, router.Logger(), nil)
+	}
+	handlerCtx.HubPublisher = func(qos connector.Qos) message.Publisher {
+		return connMetrics.PublisherDecorator(connector.NewPublisher(azureClient, qos, router.Logger(), nil))
+	}
+	handlerCtx.StatusPublisher = statusPub
+	handlerCtx.GwParams = gwParams
+
+	sizeLimit := &routingbus.SizeLimitOptions{
+		MaxSize:        settings.MaxMessageSize,
+		Policy:         settings.MessageSizePolicy,
+		ErrorPublisher: statusPub,
+	}
+	var uploader *fileupload.Client
+	if settings.MessageSizePolicy == azurecfg.MessageSizeOffload || settings.FileUpload.Enabled {
+		uploader, err = fileupload.NewClient(settings, connSettings, logger)
+		if err != nil {
+			return nil, azurecfg.NewConfigurationError(errors.Wrap(err, "cannot create file upload client"))
+		}
+		if settings.MessageSizePolicy == azurecfg.MessageSizeOffload {
+			sizeLimit.Uploader = uploader
+		}
+	}
+
+	// the queued messages and the batches are kept while the Azure IoT Hub is disconnected
+	hubPub := connMetrics.PublisherDecorator(connector.NewOnlinePublisher(azureClient, connector.QosAtLeastOnce, hubAckTimeout, logger, nil))
+	var lanes *routingbus.PriorityLanes
+	if len(settings.Priorities) > 0 {
+		lanes = routingbus.NewPriorityLanes(hubPub, settings.Priorities, connMetrics, logger)
+		defer func() {
+			if err != nil {
+				lanes.Close()
+			}
+		}()
+	}
+
+	var responses *routingbus.CommandResponses
+	if responseTimeout, _ := settings.CommandResponseTimeout(); responseTimeout > 0 {
+		var responsePub message.Publisher = azurePub
+		if lanes != nil {
+			responsePub = lanes
+		}
+		responses = routingbus.NewCommandResponses(responsePub, connSettings.DeviceID, responseTimeout, router.Logger())
+	}
 
-	routingbus.TelemetryBus(router, azurePub, mosquittoSub, &connSettings.RemoteConnectionInfo, telemetryHandlers)
+	initTelemetryHandlers := routingbus.TelemetryBusWithOptions(router, azurePub, mosquittoSub, &connSettings.RemoteConnectionInfo, telemetryHandlers,
+		&routingbus.TelemetryBusOptions{
+			Context:        handlerCtx,
+			Routes:         settings.Routes.Telemetry,
+			SizeLimit:      sizeLimit,
+			MessageIDs:     &routingbus.MessageIDOptions{Source: settings.MessageIDSource, DedupWindow: settings.DedupWindow, Epoch: epoch},
+			Filters:        settings.TelemetryFilters,
+			Rules:          settings.Rules,
+			Metrics:        connMetrics,
+			Lanes:          lanes,
+			BatchPublisher: hubPub,
+			Responses:      responses,
+		},
+	)
+	defer func() {
+		if err != nil {
+			closeHandlers(initTelemetryHandlers, nil, logger)
+		}
+	}()
 
-	cloudPub := connector.NewPublisher(cloudClient, connector.QosAtLeastOnce, router.Logger(), nil)
-	routingbus.CommandBus(router, cloudPub, azureSub, &connSettings.RemoteConnectionInfo, commandHandlers)
+	cloudPub := connMetrics.PublisherDecorator(connector.NewPublisher(cloudClient, connector.QosAtLeastOnce, router.Logger(), nil))
+	localPub := connector.NewSyncPublisher(cloudClient, connector.QosAtLeastOnce, localAckTimeout, router.Logger(), nil)
+	// the C2D messages are not acknowledged until the local broker accepts the produced messages or the inbox stores them
+	inbox, err := routingbus.NewInbox(routingbus.NewRetryPublisher(localPub, localRetryTimeout, router.Logger()), &routingbus.InboxOptions{
+		Dir:         settings.InboxDir,
+		MaxMessages: settings.InboxMaxMessages,
+		Metrics:     connMetrics,
+		Status:      status,
+	}, router.Logger())
+	if err != nil {
+		return nil, azurecfg.NewConfigurationError(err)
+	}
+	commandPub := connMetrics.PublisherDecorator(inbox)
+	// the failed C2D messages are acknowledged as well, so the dead letters not accepted by the local broker are stored in the inbox
+	initCommandHandlers := routingbus.CommandBusWithOptions(router, commandPub, azureSub, &connSettings.RemoteConnectionInfo, commandHandlers,
+		&routingbus.CommandBusOptions{
+			Dispatch:            settings.Handlers.CommandDispatch,
+			Context:             handlerCtx,
+			Routes:              settings.Routes.Command,
+			DeadLetter:          &settings.CommandDeadLetter,
+			DeadLetterPublisher: inbox,
+			Metrics:             connMetrics,
+			Responses:           responses,
+			Delivered:           delivered,
+		},
+	)
+
+	var uploadHandler *routingbus.FileUploadHandler
+	if settings.FileUpload.Enabled {
+		uploadHandler = routingbus.FileUploadBus(router, cloudPub, mosquittoSub, uploader, &settings.FileUpload)
+	}
+
+	status.SetProvisioningSource(connSettings.ProvisioningSource)
+	status.SetHandlers(telemetryHandlerNames(telemetryHandlers), commandHandlerNames(commandHandlers))
 
 	go func() {
+		// done is signalled once the router, the handlers and the connections are released,
+		// so that the next router start does not initialize the same handlers while they are still closing
+		defer func() {
+			done <- true
+		}()
+
 		ctx, cancel := context.WithCancel(context.Background())
-		defer cancel()
+		listenersStopped := make(chan struct{})
 
 		go func() {
-			defer func() {
-				done <- true
-			}()
+			defer close(listenersStopped)
 
-			<-router.Running()
+			select {
+			case <-router.Running():
+			case <-ctx.Done():
+				return
+			}
 
 			statusHandler := &routing.ConnectionStatusHandler{
 				Pub:    statusPub,
@@ -106,18 +256,76 @@ func startRouter(
 			}
 			azureClient.AddConnectionListener(connHandler)
 
-			errorsHandler := &routing.ErrorsHandler{
-				StatusPub: statusPub,
-				Logger:    logger,
+			errorsHandler := &hubErrorsHandler{
+				ErrorsHandler: routing.ErrorsHandler{
+					StatusPub: statusPub,
+					Logger:    logger,
+				},
+				status: status,
 			}
 			azureClient.AddConnectionListener(errorsHandler)
 
+			hubStatusListener := status.HubConnectionListener()
+			azureClient.AddConnectionListener(hubStatusListener)
+			defer azureClient.RemoveConnectionListener(hubStatusListener)
+
+			hubReconnectsListener := connMetrics.ConnectionListener(metrics.ConnectionHub)
+			azureClient.AddConnectionListener(hubReconnectsListener)
+			defer azureClient.RemoveConnectionListener(hubReconnectsListener)
+
+			cloudClient.AddConnectionListener(inbox)
+			defer cloudClient.RemoveConnectionListener(inbox)
+
+			if lanes != nil {
+				azureClient.AddConnectionListener(lanes)
+				defer azureClient.RemoveConnectionListener(lanes)
+			}
+
+			for _, handler := range initTelemetryHandlers {
+				if listener, ok := handler.(connector.ConnectionListener); ok {
+					azureClient.AddConnectionListener(listener)
+					defer azureClient.RemoveConnectionListener(listener)
+				}
+			}
+
+			for _, handler := range initCommandHandlers {
+				if listener, ok := handler.(connector.ConnectionListener); ok {
+					azureClient.AddConnectionListener(listener)
+					defer azureClient.RemoveConnectionListener(listener)
+				}
+			}
+
+			status.SetRouterRunning(true)
+			defer status.SetRouterRunning(false)
+
+			// the listeners are removed and the connections are released also if the Azure IoT Hub connection fails
+			defer func() {
+				azureClient.RemoveConnectionListener(errorsHandler)
+				azureClient.RemoveConnectionListener(connHandler)
+				cloudClient.RemoveConnectionListener(reconnectHandler)
+				cloudClient.RemoveConnectionListener(statusHandler)
+
+				defer routing.SendStatus(routing.StatusConnectionClosed, statusPub, logger)
+
+				defer azureClient.Disconnect()
+
+				cloudClient.Disconnect()
+			}()
+
 			if err := config.HonoConnect(nil, statusPub, azureClient, logger); err != nil {
+				logger.Error("Cannot connect to Azure IoT Hub, closing messages router", err, nil)
+				status.SetError(err)
 				router.Close()
 				return
 			}
 
+			if _, err := health.Notify(health.NotifyReady); err != nil {
+				logger.Warn("Cannot notify systemd for readiness", err, nil)
+			}
+
 			if connSettings.SharedAccessKey != nil {
+				status.SetTokenExpiry(time.Now().Add(connSettings.TokenValidity))
+
 				tokenRefreshPeriod := int64(connSettings.TokenValidity.Seconds() * azurecfg.SASTokenValidityFactor)
 				go func() {
 					for {
@@ -128,9 +336,13 @@ func startRouter(
 							routing.SendStatus(azurerouting.StatusConnectionTokenExpired, statusPub, logger)
 
 							if err := config.HonoConnect(nil, statusPub, azureClient, logger); err != nil {
+								logger.Error("Cannot reconnect to Azure IoT Hub, closing messages router", err, nil)
+								status.SetError(err)
 								router.Close()
 								return
 							}
+							status.SetTokenExpiry(time.Now().Add(connSettings.TokenValidity))
+							connMetrics.TokenRefreshes.Inc()
 						case <-ctx.Done():
 							return
 						}
@@ -139,23 +351,30 @@ func startRouter(
 			}
 
 			<-ctx.Done()
+		}()
 
-			azureClient.RemoveConnectionListener(errorsHandler)
-			azureClient.RemoveConnectionListener(connHandler)
-			cloudClient.RemoveConnectionListener(reconnectHandler)
-			cloudClient.RemoveConnectionListener(statusHandler)
+		if err := router.Run(context.Background()); err != nil {
+			logger.Error("Failed to create cloud router", err, nil)
+		}
 
-			defer routing.SendStatus(routing.StatusConnectionClosed, statusPub, logger)
+		if uploadHandler != nil {
+			uploadHandler.Close()
+		}
 
-			defer azureClient.Disconnect()
+		// the handlers are initialized again with the new connection info on the next router start
+		closeHandlers(initTelemetryHandlers, initCommandHandlers, logger)
 
-			cloudClient.Disconnect()
-		}()
+		if responses != nil {
+			responses.Close()
+		}
 
-		if err := router.Run(context.Background()); err != nil {
-			logger.Error("Failed to create cloud router", err, nil)
+		if lanes != nil {
+			lanes.Close()
 		}
 
+		cancel()
+		<-listenersStopped
+
 		logger.Info("Messages router stopped", nil)
 	}()
 
@@ -164,38 +383,168 @@ func startRouter(
 
 // MainLoop is the main loop of the application
 func MainLoop(settings *azurecfg.AzureSettings, log logger.Logger, idScopeProvider azurecfg.IDScopeProvider, telemetryHandlers []handlers.TelemetryHandler, commandHandlers []handlers.CommandHandler) error {
+	status := health.NewStatus()
+	registry := metrics.NewRegistry()
+	connMetrics := metrics.NewConnectorMetrics(registry)
+
+	var tracer *tracing.Tracer
+	if len(settings.TracingEndpoint) > 0 {
+		provider, err := tracing.NewOTLPTracerProvider(settings.TracingEndpoint, tracingServiceName, log)
+		if err != nil {
+			return azurecfg.NewConfigurationError(err)
+		}
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), tracingShutdownTimeout)
+			defer cancel()
+
+			if err := provider.Shutdown(ctx); err != nil {
+				log.Warn("Cannot export the remaining tracing spans", err, nil)
+			}
+		}()
+		tracer = tracing.NewTracer(provider)
+	}
+
+	servers, err := startLocalServers(settings, status, registry, log)
+	if err != nil {
+		return azurecfg.NewConfigurationError(err)
+	}
+	defer func() {
+		for _, server := range servers {
+			server.Close()
+		}
+	}()
+
 	localClient, err := config.CreateLocalConnection(&settings.LocalConnectionSettings, log)
 	if err != nil {
 		return errors.Wrap(err, "cannot create mosquitto connection")
 	}
+	localStatusListener := status.LocalConnectionListener()
+	localClient.AddConnectionListener(localStatusListener)
+	defer localClient.RemoveConnectionListener(localStatusListener)
+
+	localReconnectsListener := connMetrics.ConnectionListener(metrics.ConnectionLocal)
+	localClient.AddConnectionListener(localReconnectsListener)
+	defer localClient.RemoveConnectionListener(localReconnectsListener)
+
 	if err := config.LocalConnect(context.Background(), localClient, log); err != nil {
 		return errors.Wrap(err, "cannot connect to mosquitto")
 	}
 	defer localClient.Disconnect()
 
+	// the readiness is notified once the Azure IoT Hub connection is established
+	defer health.Notify(health.NotifyStopping)
+
+	watchdogCtx, stopWatchdog := context.WithCancel(context.Background())
+	defer stopWatchdog()
+	go health.Watchdog(watchdogCtx, status)
+
 	statusPub := connector.NewPublisher(localClient, connector.QosAtLeastOnce, log, nil)
 	defer statusPub.Close()
 
-	connSettings, err := azurecfg.PrepareAzureConnectionSettings(settings, idScopeProvider, log)
-	if err != nil {
-		return errors.Wrap(err, "cannot create Azure IoT Hub device connection settings")
+	// the delivered C2D message IDs are kept across the router restarts
+	delivered := routingbus.NewDeliveredMessages()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	s := newSupervisor(
+		func() (*azurecfg.AzureConnectionSettings, error) {
+			connSettings, err := azurecfg.PrepareAzureConnectionSettings(settings, idScopeProvider, log)
+			status.SetError(err)
+			return connSettings, err
+		},
+		func(connSettings *azurecfg.AzureConnectionSettings, done chan bool) (*message.Router, error) {
+			router, err := startRouter(localClient, settings, connSettings, statusPub, telemetryHandlers, commandHandlers, status, connMetrics, tracer, delivered, done, log)
+			status.SetError(err)
+			return router, err
+		},
+		statusPub,
+		log,
+	)
+	return s.run(sigs)
+}
+
+// startLocalServers starts the configured local HTTP servers, sharing a server if the health and metrics addresses are the same.
+func startLocalServers(settings *azurecfg.AzureSettings, status *health.Status, registry *metrics.Registry, log logger.Logger) ([]*http.Server, error) {
+	muxes := map[string]*http.ServeMux{}
+	addresses := []string{}
+	muxFor := func(address string) *http.ServeMux {
+		if mux, ok := muxes[address]; ok {
+			return mux
+		}
+		mux := http.NewServeMux()
+		muxes[address] = mux
+		addresses = append(addresses, address)
+		return mux
 	}
 
-	done := make(chan bool, 1)
-	azureRouter, err := startRouter(localClient, settings, connSettings, statusPub, telemetryHandlers, commandHandlers, done, log)
-	if err != nil {
-		log.Error("Failed to create message bus", err, nil)
+	if len(settings.HealthAddress) > 0 {
+		health.AddHandlers(muxFor(settings.HealthAddress), status)
+	}
+	if len(settings.MetricsAddress) > 0 {
+		registry.AddHandlers(muxFor(settings.MetricsAddress))
 	}
 
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-	<-sigs
+	servers := make([]*http.Server, 0, len(addresses))
+	for _, address := range addresses {
+		server, err := health.Serve(address, muxes[address], log)
+		if err != nil {
+			for _, started := range servers {
+				started.Close()
+			}
+			return nil, errors.Wrapf(err, "cannot start local HTTP server on %s", address)
+		}
+		servers = append(servers, server)
+	}
+	return servers, nil
+}
 
-	stopRouter(azureRouter, done)
+func telemetryHandlerNames(telemetryHandlers []handlers.TelemetryHandler) []string {
+	names := make([]string, len(telemetryHandlers))
+	for i, handler := range telemetryHandlers {
+		names[i] = handler.Name()
+	}
+	return names
+}
 
-	return nil
+func commandHandlerNames(commandHandlers []handlers.CommandHandler) []string {
+	names := make([]string, len(commandHandlers))
+	for i, handler := range commandHandlers {
+		names[i] = handler.Name()
+	}
+	return names
+}
+
+func closeHandlers(telemetryHandlers []handlers.TelemetryHandler, commandHandlers []handlers.CommandHandler, logger logger.Logger) {
+	for _, handler := range telemetryHandlers {
+		if err := handlers.CloseHandler(handler); err != nil {
+			logger.Error("Cannot close telemetry handler", err, watermill.LogFields{"handler_name": handler.Name()})
+		}
+	}
+	for _, handler := range commandHandlers {
+		if err := handlers.CloseHandler(handler); err != nil {
+			logger.Error("Cannot close command handler", err, watermill.LogFields{"handler_name": handler.Name()})
+		}
+	}
+}
+
+// hubErrorsHandler publishes the Azure IoT Hub connection errors and records them as the last connector error.
+type hubErrorsHandler struct {
+	routing.ErrorsHandler
+
+	status *health.Status
+}
+
+// Connected publishes and records the error of a lost or refused Azure IoT Hub connection.
+func (h *hubErrorsHandler) Connected(connected bool, err error) {
+	h.ErrorsHandler.Connected(connected, err)
+	if !connected && err != nil {
+		h.status.SetError(errors.Wrap(err, "Azure IoT Hub connection error"))
+	}
 }
 
+// stopRouter closes the router and waits until the router handlers are closed and the connections are released.
 func stopRouter(router *message.Router, done <-chan bool) {
 	if router != nil {
 		router.Close()
@@ -0,0 +1,93 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package app
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/pkg/errors"
+
+	"github.com/eclipse-kanto/suite-connector/logger"
+	"github.com/eclipse-kanto/suite-connector/routing"
+	"github.com/eclipse-kanto/suite-connector/testutil"
+
+	azurecfg "github.com/eclipse-kanto/azure-connector/config"
+	"github.com/eclipse-kanto/azure-connector/health"
+	"github.com/eclipse-kanto/azure-connector/metrics"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStartLocalServersDisabled(t *testing.T) {
+	servers, err := startLocalServers(&azurecfg.AzureSettings{}, health.NewStatus(), metrics.NewRegistry(), testutil.NewLogger("app", logger.INFO, t))
+	require.NoError(t, err)
+	assert.Empty(t, servers)
+}
+
+func TestStartLocalServersShared(t *testing.T) {
+	settings := &azurecfg.AzureSettings{
+		HealthAddress:  "localhost:0",
+		MetricsAddress: "localhost:0",
+	}
+	servers, err := startLocalServers(settings, health.NewStatus(), metrics.NewRegistry(), testutil.NewLogger("app", logger.INFO, t))
+	require.NoError(t, err)
+	require.Len(t, servers, 1)
+	defer servers[0].Close()
+
+	for _, path := range []string{health.PathLiveness, metrics.PathMetrics} {
+		resp, err := http.Get("http://" + servers[0].Addr + path)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+}
+
+func TestStartLocalServersSeparate(t *testing.T) {
+	settings := &azurecfg.AzureSettings{
+		HealthAddress:  "localhost:0",
+		MetricsAddress: "127.0.0.1:0",
+	}
+	servers, err := startLocalServers(settings, health.NewStatus(), metrics.NewRegistry(), testutil.NewLogger("app", logger.INFO, t))
+	require.NoError(t, err)
+	require.Len(t, servers, 2)
+	for _, server := range servers {
+		server.Close()
+	}
+
+	settings.MetricsAddress = "invalid:address:0"
+	_, err = startLocalServers(settings, health.NewStatus(), metrics.NewRegistry(), testutil.NewLogger("app", logger.INFO, t))
+	assert.Error(t, err)
+}
+
+func TestHubErrorsHandler(t *testing.T) {
+	statusPub := &statusRecorder{}
+	status := health.NewStatus()
+	handler := &hubErrorsHandler{
+		ErrorsHandler: routing.ErrorsHandler{StatusPub: statusPub, Logger: testutil.NewLogger("app", logger.ERROR, t)},
+		status:        status,
+	}
+
+	handler.Connected(true, nil)
+	handler.Connected(false, nil)
+	assert.Empty(t, status.Report().LastError)
+
+	handler.Connected(false, packets.ErrorRefusedBadUsernameOrPassword)
+	assert.Contains(t, status.Report().LastError, packets.ErrorRefusedBadUsernameOrPassword.Error())
+
+	handler.Connected(false, errors.New("connection lost"))
+	assert.Equal(t, "Azure IoT Hub connection error: connection lost", status.Report().LastError)
+	assert.Equal(t, []string{routing.StatusConnectionNotAuthenticated, routing.StatusConnectionError}, statusPub.recorded())
+}
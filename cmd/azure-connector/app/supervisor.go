@@ -0,0 +1,146 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package app
+
+import (
+	"os"
+	"time"
+
+	"github.com/cenkalti/backoff/v3"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/eclipse-kanto/suite-connector/logger"
+	"github.com/eclipse-kanto/suite-connector/routing"
+
+	azurecfg "github.com/eclipse-kanto/azure-connector/config"
+)
+
+const (
+	supervisorInitialInterval = 5 * time.Second
+	supervisorMaxInterval     = 5 * time.Minute
+	supervisorStablePeriod    = 10 * time.Minute
+)
+
+type settingsPreparer func() (*azurecfg.AzureConnectionSettings, error)
+
+// routerStarter starts the messages router, signalling done once the router has stopped and its handlers and connections are released.
+type routerStarter func(connSettings *azurecfg.AzureConnectionSettings, done chan bool) (*message.Router, error)
+
+// supervisor keeps the messages router running by retrying the connection settings preparation and
+// the router start with backoff until a signal is received or a configuration error occurs.
+type supervisor struct {
+	prepare settingsPreparer
+	start   routerStarter
+
+	statusPub message.Publisher
+	backoff   backoff.BackOff
+	logger    logger.Logger
+
+	stablePeriod time.Duration
+}
+
+func newSupervisor(prepare settingsPreparer, start routerStarter, statusPub message.Publisher, logger logger.Logger) *supervisor {
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = supervisorInitialInterval
+	b.MaxInterval = supervisorMaxInterval
+	b.MaxElapsedTime = 0
+	b.Reset()
+
+	return &supervisor{
+		prepare:      prepare,
+		start:        start,
+		statusPub:    statusPub,
+		backoff:      b,
+		logger:       logger,
+		stablePeriod: supervisorStablePeriod,
+	}
+}
+
+// run blocks until a signal is received or a non-recoverable configuration error occurs.
+func (s *supervisor) run(sigs <-chan os.Signal) error {
+	for attempt := 1; ; attempt++ {
+		logFields := watermill.LogFields{"attempt": attempt}
+		s.logger.Info("Preparing Azure IoT Hub device connection", logFields)
+		routing.SendStatus(routing.StatusProvisioningUpdate, s.statusPub, s.logger)
+
+		connSettings, err := s.prepare()
+		if err != nil {
+			if azurecfg.IsConfigurationError(err) {
+				routing.SendStatus(routing.StatusConfigError, s.statusPub, s.logger)
+				return err
+			}
+
+			s.logger.Error("Cannot create Azure IoT Hub device connection settings", err, logFields)
+			routing.SendStatus(routing.StatusProvisioningError, s.statusPub, s.logger)
+
+			if !s.wait(sigs) {
+				return nil
+			}
+			continue
+		}
+
+		done := make(chan bool, 1)
+		router, err := s.start(connSettings, done)
+		if err != nil {
+			if azurecfg.IsConfigurationError(err) {
+				routing.SendStatus(routing.StatusConfigError, s.statusPub, s.logger)
+				return err
+			}
+
+			s.logger.Error("Failed to create message bus", err, logFields)
+			routing.SendStatus(routing.StatusConnectionError, s.statusPub, s.logger)
+
+			if !s.wait(sigs) {
+				return nil
+			}
+			continue
+		}
+
+		started := time.Now()
+		select {
+		case <-sigs:
+			stopRouter(router, done)
+			return nil
+
+		case <-done:
+			router.Close()
+			s.logger.Error("Messages router stopped unexpectedly", nil, logFields)
+		}
+
+		if time.Since(started) >= s.stablePeriod {
+			s.backoff.Reset()
+		}
+
+		if !s.wait(sigs) {
+			return nil
+		}
+	}
+}
+
+// wait waits for the next backoff interval and returns false if a signal was received meanwhile.
+func (s *supervisor) wait(sigs <-chan os.Signal) bool {
+	waitTime := s.backoff.NextBackOff()
+	if waitTime == backoff.Stop {
+		waitTime = supervisorMaxInterval
+	}
+
+	s.logger.Infof("Retrying after %v", waitTime.Round(time.Second))
+
+	select {
+	case <-sigs:
+		return false
+	case <-time.After(waitTime):
+		return true
+	}
+}
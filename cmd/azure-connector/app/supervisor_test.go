@@ -0,0 +1,181 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package app
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/cenkalti/backoff/v3"
+	"github.com/pkg/errors"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/eclipse-kanto/suite-connector/logger"
+	"github.com/eclipse-kanto/suite-connector/routing"
+	"github.com/eclipse-kanto/suite-connector/testutil"
+
+	azurecfg "github.com/eclipse-kanto/azure-connector/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type statusRecorder struct {
+	lock   sync.Mutex
+	causes []string
+}
+
+func (r *statusRecorder) Publish(topic string, messages ...*message.Message) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, msg := range messages {
+		status := &routing.ConnectionStatus{}
+		if err := json.Unmarshal(msg.Payload, status); err != nil {
+			return err
+		}
+		r.causes = append(r.causes, status.Cause)
+	}
+	return nil
+}
+
+func (r *statusRecorder) Close() error {
+	return nil
+}
+
+func (r *statusRecorder) recorded() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return append([]string{}, r.causes...)
+}
+
+func newTestSupervisor(t *testing.T, prepare settingsPreparer, start routerStarter, statusPub message.Publisher) *supervisor {
+	s := newSupervisor(prepare, start, statusPub, testutil.NewLogger("app", logger.ERROR, t))
+	s.backoff = backoff.NewConstantBackOff(time.Millisecond)
+	return s
+}
+
+func newTestRouter(t *testing.T) *message.Router {
+	router, err := message.NewRouter(message.RouterConfig{}, watermill.NopLogger{})
+	require.NoError(t, err)
+	return router
+}
+
+func TestSupervisorConfigurationError(t *testing.T) {
+	statusPub := &statusRecorder{}
+	startCalls := 0
+
+	s := newTestSupervisor(t,
+		func() (*azurecfg.AzureConnectionSettings, error) {
+			return nil, azurecfg.NewConfigurationError(errors.New("malformed connection string"))
+		},
+		func(*azurecfg.AzureConnectionSettings, chan bool) (*message.Router, error) {
+			startCalls++
+			return nil, nil
+		},
+		statusPub,
+	)
+
+	err := s.run(make(chan os.Signal))
+	require.Error(t, err)
+	assert.True(t, azurecfg.IsConfigurationError(err))
+	assert.Equal(t, 0, startCalls)
+	assert.Equal(t, []string{routing.StatusProvisioningUpdate, routing.StatusConfigError}, statusPub.recorded())
+}
+
+func TestSupervisorStartConfigurationError(t *testing.T) {
+	statusPub := &statusRecorder{}
+
+	s := newTestSupervisor(t,
+		func() (*azurecfg.AzureConnectionSettings, error) {
+			return &azurecfg.AzureConnectionSettings{}, nil
+		},
+		func(*azurecfg.AzureConnectionSettings, chan bool) (*message.Router, error) {
+			return nil, azurecfg.NewConfigurationError(errors.New("invalid CA certificate"))
+		},
+		statusPub,
+	)
+
+	require.Error(t, s.run(make(chan os.Signal)))
+	assert.Equal(t, []string{routing.StatusProvisioningUpdate, routing.StatusConfigError}, statusPub.recorded())
+}
+
+func TestSupervisorRetriesTransientErrors(t *testing.T) {
+	statusPub := &statusRecorder{}
+	sigs := make(chan os.Signal, 1)
+
+	prepareCalls := 0
+	startCalls := 0
+
+	s := newTestSupervisor(t,
+		func() (*azurecfg.AzureConnectionSettings, error) {
+			prepareCalls++
+			if prepareCalls == 1 {
+				return nil, errors.New("cannot access DPS")
+			}
+			return &azurecfg.AzureConnectionSettings{}, nil
+		},
+		func(connSettings *azurecfg.AzureConnectionSettings, done chan bool) (*message.Router, error) {
+			startCalls++
+			switch startCalls {
+			case 1:
+				return nil, errors.New("cannot create Hub connection")
+			case 2:
+				// the router stops on its own, e.g. on Hub connect failure
+				done <- true
+			default:
+				sigs <- syscall.SIGTERM
+				go func() {
+					time.Sleep(10 * time.Millisecond)
+					done <- true
+				}()
+			}
+			return newTestRouter(t), nil
+		},
+		statusPub,
+	)
+
+	require.NoError(t, s.run(sigs))
+	assert.Equal(t, 4, prepareCalls)
+	assert.Equal(t, 3, startCalls)
+	assert.Equal(t, []string{
+		routing.StatusProvisioningUpdate,
+		routing.StatusProvisioningError,
+		routing.StatusProvisioningUpdate,
+		routing.StatusConnectionError,
+		routing.StatusProvisioningUpdate,
+		routing.StatusProvisioningUpdate,
+	}, statusPub.recorded())
+}
+
+func TestSupervisorStopWhileWaiting(t *testing.T) {
+	sigs := make(chan os.Signal, 1)
+
+	s := newTestSupervisor(t,
+		func() (*azurecfg.AzureConnectionSettings, error) {
+			sigs <- syscall.SIGTERM
+			return nil, errors.New("cannot access DPS")
+		},
+		nil,
+		&statusRecorder{},
+	)
+	s.backoff = backoff.NewConstantBackOff(time.Hour)
+
+	require.NoError(t, s.run(sigs))
+}
@@ -14,6 +14,7 @@ package main
 
 import (
 	"flag"
+	"io"
 	"log"
 	"os"
 
@@ -26,8 +27,14 @@ import (
 	"github.com/eclipse-kanto/azure-connector/cmd/azure-connector/app"
 	azurecfg "github.com/eclipse-kanto/azure-connector/config"
 	"github.com/eclipse-kanto/azure-connector/flags"
+	"github.com/eclipse-kanto/azure-connector/routing/bus"
 	"github.com/eclipse-kanto/azure-connector/routing/message/handlers"
 	"github.com/eclipse-kanto/azure-connector/routing/message/handlers/passthrough"
+
+	// registers the aggregate, plugin and script handler types
+	_ "github.com/eclipse-kanto/azure-connector/routing/message/handlers/aggregate"
+	_ "github.com/eclipse-kanto/azure-connector/routing/message/handlers/plugin"
+	_ "github.com/eclipse-kanto/azure-connector/routing/message/handlers/script"
 )
 
 var (
@@ -62,6 +69,9 @@ func main() {
 	if err := settings.Validate(); err != nil {
 		log.Fatal(errors.Wrap(err, "settings validation error"))
 	}
+	if err := bus.ValidateRoutes(settings.Routes.Telemetry); err != nil {
+		log.Fatal(errors.Wrap(err, "settings validation error"))
+	}
 
 	loggerOut, logger := logger.Setup("azure-connector", &settings.LogSettings)
 	defer loggerOut.Close()
@@ -69,24 +79,40 @@ func main() {
 	logger.Infof("Starting azure connector %s", version)
 	flags.ConfigCheck(logger, *fConfigFile)
 
-	telemetryHandlers := telemetryHandlers(settings)
-	commandHandlers := commandHandlers(settings)
+	telemetryHandlers, err := telemetryHandlers(settings)
+	if err != nil {
+		exitOnError(logger, loggerOut, "Cannot create telemetry handlers", err)
+	}
+	commandHandlers, err := commandHandlers(settings)
+	if err != nil {
+		exitOnError(logger, loggerOut, "Cannot create command handlers", err)
+	}
 
 	if err := app.MainLoop(settings, logger, nil, telemetryHandlers, commandHandlers); err != nil {
-		logger.Error("Init failure", err, nil)
+		exitOnError(logger, loggerOut, "Init failure", err)
+	}
+}
 
-		loggerOut.Close()
+func exitOnError(logger logger.Logger, loggerOut io.Closer, msg string, err error) {
+	logger.Error(msg, err, nil)
 
-		os.Exit(1)
-	}
+	loggerOut.Close()
+
+	os.Exit(1)
 }
 
-func telemetryHandlers(settings *azurecfg.AzureSettings) []handlers.TelemetryHandler {
-	passthroughHandler := passthrough.CreateDefaultTelemetryHandler()
-	return []handlers.TelemetryHandler{passthroughHandler}
+func telemetryHandlers(settings *azurecfg.AzureSettings) ([]handlers.TelemetryHandler, error) {
+	handlersSettings := settings.Handlers.Telemetry
+	if handlersSettings == nil {
+		handlersSettings = []azurecfg.HandlerSettings{{Type: passthrough.HandlerType}}
+	}
+	return handlers.CreateTelemetryHandlers(handlersSettings)
 }
 
-func commandHandlers(settings *azurecfg.AzureSettings) []handlers.CommandHandler {
-	passthroughHandler := passthrough.CreateDefaultCommandHandler()
-	return []handlers.CommandHandler{passthroughHandler}
+func commandHandlers(settings *azurecfg.AzureSettings) ([]handlers.CommandHandler, error) {
+	handlersSettings := settings.Handlers.Command
+	if handlersSettings == nil {
+		handlersSettings = []azurecfg.HandlerSettings{{Type: passthrough.HandlerType}}
+	}
+	return handlers.CreateCommandHandlers(handlersSettings)
 }
@@ -35,6 +35,15 @@ const (
 	propertyKeyHostName        = "HostName"
 	propertyKeyDeviceID        = "DeviceId"
 	propertyKeySharedAccessKey = "SharedAccessKey"
+
+	// ProvisioningSourceSharedAccessKey defines connection settings created from a connection string with a shared access key.
+	ProvisioningSourceSharedAccessKey = "sharedAccessKey"
+	// ProvisioningSourceCertificate defines connection settings created from a connection string and a device certificate.
+	ProvisioningSourceCertificate = "certificate"
+	// ProvisioningSourceDPS defines connection settings retrieved from the Azure Device Provisioning service.
+	ProvisioningSourceDPS = "dps"
+	// ProvisioningSourceFile defines connection settings read from the local provisioning file.
+	ProvisioningSourceFile = "provisioningFile"
 )
 
 // RemoteConnectionInfo contains properties related to the remote connection that may not be known at the start of the connector.
@@ -53,39 +62,43 @@ type AzureConnectionSettings struct {
 	TokenValidity time.Duration
 
 	SharedAccessKey []byte
+
+	ProvisioningSource string
 }
 
 // PrepareAzureConnectionSettings prepares the configuration data for establishing connection to the Azure IoT Hub, allowing usage of IDScopeProvider.
 func PrepareAzureConnectionSettings(settings *AzureSettings, idScopeProvider IDScopeProvider, log logger.Logger) (*AzureConnectionSettings, error) {
 	connProps, err := parseConnectionString(settings.ConnectionString)
 	if err != nil {
-		return nil, err
+		return nil, NewConfigurationError(err)
 	}
 	if len(connProps[propertyKeySharedAccessKey]) > 0 {
-		return CreateAzureSASTokenConnectionSettings(connProps, settings, log)
+		connSettings, err := CreateAzureSASTokenConnectionSettings(connProps, settings, log)
+		return connSettings, NewConfigurationError(err)
 	}
 
 	if !util.DeviceCertificatesArePresent(settings.Cert, settings.Key) {
-		return nil, util.GenerateCertKeyError("connectionString", settings.Cert, settings.Key)
+		return nil, NewConfigurationError(util.GenerateCertKeyError("connectionString", settings.Cert, settings.Key))
 	}
 
 	hasDeviceID := len(connProps[propertyKeyDeviceID]) > 0
 	hasHostName := len(connProps[propertyKeyHostName]) > 0
 
 	if hasDeviceID && !hasHostName {
-		return nil, errors.New("the HostName is required")
+		return nil, NewConfigurationError(errors.New("the HostName is required"))
 	}
 
 	if !hasDeviceID && hasHostName {
-		return nil, errors.New("the DeviceId is required")
+		return nil, NewConfigurationError(errors.New("the DeviceId is required"))
 	}
 
 	certFileReader, keyFileReader, err := createDeviceCertReaders(settings)
 	if err != nil {
-		return nil, err
+		return nil, NewConfigurationError(err)
 	}
 	if hasDeviceID && hasHostName {
-		return PrepareAzureCertificateConnectionSettings(connProps, certFileReader, keyFileReader)
+		connSettings, err := PrepareAzureCertificateConnectionSettings(connProps, certFileReader, keyFileReader)
+		return connSettings, NewConfigurationError(err)
 	}
 
 	useProvisioningClient := !conn.FileExists(provisioningJSONConfig)
@@ -93,11 +106,12 @@ func PrepareAzureConnectionSettings(settings *AzureSettings, idScopeProvider IDS
 	if err != nil {
 		return nil, err
 	}
+	defer provisioningFile.Close()
 
 	connSettings, err := PrepareAzureProvisioningConnectionSettings(
 		settings,
 		idScopeProvider,
-		NewProvisioningService(log),
+		NewProvisioningServiceForTransport(settings.ProvisioningTransport, log),
 		provisioningFile,
 		useProvisioningClient,
 		certFileReader,
@@ -129,6 +143,7 @@ func PrepareAzureCertificateConnectionSettings(
 	if err != nil {
 		return nil, err
 	}
+	connSettings.ProvisioningSource = ProvisioningSourceCertificate
 
 	return connSettings, nil
 }
@@ -146,14 +161,14 @@ func PrepareAzureProvisioningConnectionSettings(
 	connSettings := &AzureConnectionSettings{}
 	err := attachCertificateInfo(connSettings, certFileReader, keyFileReader)
 	if err != nil {
-		return nil, err
+		return nil, NewConfigurationError(err)
 	}
 
 	var client ProvisioningHTTPClient
 	if useProvisioningClient {
 		client, err = initDeviceProvisioningClient(connSettings)
 		if err != nil {
-			return nil, err
+			return nil, NewConfigurationError(err)
 		}
 	}
 	provisioningService.Init(client, provisioningFile)
@@ -180,6 +195,11 @@ func PrepareAzureProvisioningConnectionSettings(
 	// op2: add config per idScopeRequestURL and verificationCodeRequestURL
 	connSettings.HostName = azureDeviceData.AssignedHub
 	connSettings.DeviceID = azureDeviceData.DeviceID
+	if useProvisioningClient {
+		connSettings.ProvisioningSource = ProvisioningSourceDPS
+	} else {
+		connSettings.ProvisioningSource = ProvisioningSourceFile
+	}
 	return connSettings, nil
 }
 
@@ -214,6 +234,7 @@ func CreateAzureSASTokenConnectionSettings(
 		return nil, errors.New("the SharedAccessKey is not base64 encoded")
 	}
 	connSettings.SharedAccessKey = sharedAccessKeyDecoded
+	connSettings.ProvisioningSource = ProvisioningSourceSharedAccessKey
 
 	if tokenValidity, err := ParseSASTokenValidity(settings.SASTokenValidity); err != nil {
 		logger.Warn("The default SAS token validity period will be set.", err, nil)
@@ -47,6 +47,7 @@ func TestParseMalformedConnectionString(t *testing.T) {
 	logger := logger.NewLogger(log.New(io.Discard, "", log.Ldate), logger.INFO)
 	_, err := config.PrepareAzureConnectionSettings(settings, nil, logger)
 	require.Error(t, err)
+	assert.True(t, config.IsConfigurationError(err))
 }
 
 func TestCreateTokenConnectionSettings(t *testing.T) {
@@ -64,6 +65,7 @@ func TestCreateTokenConnectionSettings(t *testing.T) {
 	assert.Equal(t, time.Hour, connSettings.TokenValidity)
 	assert.Equal(t, "", connSettings.DeviceCert)
 	assert.Equal(t, "", connSettings.DeviceKey)
+	assert.Equal(t, config.ProvisioningSourceSharedAccessKey, connSettings.ProvisioningSource)
 }
 
 func TestMalformedSharedAccessKey(t *testing.T) {
@@ -186,6 +188,7 @@ func TestCreateCertificateConnectionSettings(t *testing.T) {
 	assert.Equal(t, 0*time.Second, connSettings.TokenValidity)
 	assert.Equal(t, test.DeviceCertificate(), connSettings.DeviceCert)
 	assert.Equal(t, test.CertificateKey(), connSettings.DeviceKey)
+	assert.Equal(t, config.ProvisioningSourceCertificate, connSettings.ProvisioningSource)
 }
 
 func TestCertificateConnectionSettingsInvalidHostName(t *testing.T) {
@@ -332,6 +335,7 @@ func TestCreateProvisioningConnectionSettings(t *testing.T) {
 	assert.Equal(t, 0*time.Second, connSettings.TokenValidity)
 	assert.Equal(t, test.DeviceCertificate(), connSettings.DeviceCert)
 	assert.Equal(t, test.CertificateKey(), connSettings.DeviceKey)
+	assert.Equal(t, config.ProvisioningSourceDPS, connSettings.ProvisioningSource)
 }
 
 func TestCreateProvisioningConnectionSettingsWithIdScope(t *testing.T) {
@@ -382,6 +386,7 @@ func TestCreateProvisioningConnectionSettingsExistingProvisioningFile(t *testing
 	assert.Equal(t, 0*time.Second, connSettings.TokenValidity)
 	assert.Equal(t, test.DeviceCertificate(), connSettings.DeviceCert)
 	assert.Equal(t, test.CertificateKey(), connSettings.DeviceKey)
+	assert.Equal(t, config.ProvisioningSourceFile, connSettings.ProvisioningSource)
 	assert.Equal(t, 0*time.Second, connSettings.TokenValidity)
 }
 
@@ -395,6 +400,7 @@ func TestProvisioningConnectionSettingsErrorGetDeviceData(t *testing.T) {
 	_, err := config.PrepareAzureProvisioningConnectionSettings(&config.AzureSettings{}, nil, provisioningService, nil, true, certFileReader, keyFileReader)
 
 	require.Error(t, err)
+	assert.False(t, config.IsConfigurationError(err))
 }
 
 func TestProvisioningConnectionSettingsInvalidCertAndKey(t *testing.T) {
@@ -34,7 +34,7 @@ func CreateAzureHubConnection(
 ) (*connector.MQTTConnection, error) {
 	configuration, connErr := createMQTTConfiguration(settings, connSettings, logger)
 	if connErr != nil {
-		return nil, errors.Wrap(connErr, "cannot establish MQTT connection to Azure IoT Hub")
+		return nil, NewConfigurationError(errors.Wrap(connErr, "cannot establish MQTT connection to Azure IoT Hub"))
 	}
 	provider := func() (string, string) {
 		var pass string
@@ -79,6 +79,7 @@ func createMQTTConfiguration(
 
 	configuration.TLSConfig = tlsConfig
 	configuration.ConnectRetryInterval = 0
+	setHubSession(configuration)
 
 	configuration.BackoffMultiplier = 2
 	configuration.MinReconnectInterval = time.Minute
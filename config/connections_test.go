@@ -45,5 +45,6 @@ func TestCreateAzureClientNoCacert(t *testing.T) {
 	logger := logger.NewLogger(log.New(io.Discard, "", log.Ldate), logger.INFO)
 	azureClient, err := config.CreateAzureHubConnection(settings, connSettings, logger)
 	require.Error(t, err)
+	assert.True(t, config.IsConfigurationError(err))
 	assert.Nil(t, azureClient)
 }
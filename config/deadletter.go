@@ -0,0 +1,68 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package config
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultCommandRetryInterval is the interval before the first retry of a failed C2D message, if not configured.
+const DefaultCommandRetryInterval = 100 * time.Millisecond
+
+// CommandDeadLetterSettings configures the handling of the C2D messages that cannot be processed.
+// A failed message is retried first, then published to the local dead-letter topic and, if enabled,
+// reported to the Azure IoT Hub as a command rejected event. Otherwise, the failed messages are dropped.
+type CommandDeadLetterSettings struct {
+	// Topic is the local MQTT topic of the failed C2D messages, not published locally if not set.
+	Topic string `json:"topic"`
+	// Report enables sending a command rejected device-to-cloud event for the failed C2D messages.
+	Report bool `json:"report"`
+	// Retries is the max number of retries of a failed C2D message, not retried if 0.
+	// The messages, which no command handler accepts, are not retried.
+	Retries int `json:"retries"`
+	// RetryInterval is the interval before the first retry, doubled on each following retry.
+	RetryInterval string `json:"retryInterval"`
+}
+
+// Enabled returns true if the failed C2D messages are published locally or reported to the Azure IoT Hub.
+func (settings *CommandDeadLetterSettings) Enabled() bool {
+	return len(settings.Topic) > 0 || settings.Report
+}
+
+// InitialRetryInterval returns the parsed interval before the first retry.
+func (settings *CommandDeadLetterSettings) InitialRetryInterval() (time.Duration, error) {
+	if len(settings.RetryInterval) == 0 {
+		return DefaultCommandRetryInterval, nil
+	}
+	interval, err := time.ParseDuration(settings.RetryInterval)
+	if err != nil || interval <= 0 {
+		return 0, errors.Errorf("invalid command retry interval '%s'", settings.RetryInterval)
+	}
+	return interval, nil
+}
+
+// Validate validates the command dead-letter settings.
+func (settings *CommandDeadLetterSettings) Validate() error {
+	if len(settings.Topic) > 0 {
+		if err := validateTopic(settings.Topic); err != nil {
+			return errors.Errorf("invalid command dead-letter topic '%s'", settings.Topic)
+		}
+	}
+	if settings.Retries < 0 {
+		return errors.Errorf("negative command retries %d", settings.Retries)
+	}
+	_, err := settings.InitialRetryInterval()
+	return err
+}
@@ -0,0 +1,47 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package config
+
+import "github.com/pkg/errors"
+
+// ErrInvalidConfiguration marks errors that are caused by invalid configuration and cannot be recovered by retrying.
+var ErrInvalidConfiguration = errors.New("invalid configuration")
+
+type configurationError struct {
+	err error
+}
+
+func (e *configurationError) Error() string {
+	return e.err.Error()
+}
+
+func (e *configurationError) Unwrap() error {
+	return e.err
+}
+
+func (e *configurationError) Is(target error) bool {
+	return target == ErrInvalidConfiguration
+}
+
+// NewConfigurationError marks the given error as a configuration error, i.e. errors.Is(err, ErrInvalidConfiguration) returns true.
+func NewConfigurationError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &configurationError{err: err}
+}
+
+// IsConfigurationError returns true if the error is caused by invalid configuration.
+func IsConfigurationError(err error) bool {
+	return errors.Is(err, ErrInvalidConfiguration)
+}
@@ -0,0 +1,56 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package config
+
+import (
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// MinUploadBlockSize is the minimum size in bytes of the blocks of the chunked file uploads.
+	MinUploadBlockSize = 64 * 1024
+	// MaxUploadBlockSize is the maximum size in bytes of a blob storage block.
+	MaxUploadBlockSize = 100 * 1024 * 1024
+)
+
+// FileUploadSettings configures the file uploads requested by the local applications.
+type FileUploadSettings struct {
+	// Enabled enables the local file upload requests.
+	Enabled bool `json:"enabled"`
+	// Dirs are the absolute paths of the directories, whose files are allowed to be uploaded.
+	// Only inline data can be uploaded if no directories are configured.
+	Dirs []string `json:"dirs"`
+	// BlockSize is the size in bytes of the blocks of the chunked uploads.
+	BlockSize int `json:"blockSize"`
+	// Retries is the number of retries of a failed blob storage request.
+	Retries *int `json:"retries"`
+}
+
+// Validate validates the file upload settings.
+func (settings *FileUploadSettings) Validate() error {
+	for _, dir := range settings.Dirs {
+		if !filepath.IsAbs(dir) {
+			return errors.Errorf("file upload directory '%s' is not an absolute path", dir)
+		}
+	}
+	if settings.BlockSize != 0 && (settings.BlockSize < MinUploadBlockSize || settings.BlockSize > MaxUploadBlockSize) {
+		return errors.Errorf("file upload block size %d must be between %d and %d bytes",
+			settings.BlockSize, MinUploadBlockSize, MaxUploadBlockSize)
+	}
+	if settings.Retries != nil && *settings.Retries < 0 {
+		return errors.Errorf("negative file upload retries %d", *settings.Retries)
+	}
+	return nil
+}
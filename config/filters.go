@@ -0,0 +1,117 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package config
+
+import (
+	"math"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// TelemetryFilter limits the forwarding of the telemetry messages received on the local topics matching the topic filter.
+// The first filter matching the local topic in the configuration order is applied.
+type TelemetryFilter struct {
+	// Topic is the local MQTT topic filter.
+	Topic string `json:"topic"`
+	// Rate is the max number of messages per second forwarded from all local topics matching the filter, not limited if 0.
+	Rate float64 `json:"rate"`
+	// Burst is the max number of messages forwarded at once within the rate limit, the rate rounded up if not set.
+	Burst int `json:"burst"`
+	// Deadband forwards the messages only if a numeric value changed enough since the last forwarded message on the local topic.
+	Deadband *DeadbandSettings `json:"deadband"`
+	// Sample is the interval, in which only the first message received on a local topic is forwarded.
+	Sample string `json:"sample"`
+	// LastValue is the interval, at the end of which only the last message received on a local topic is forwarded.
+	LastValue string `json:"lastValue"`
+}
+
+// DeadbandSettings configures forwarding the messages with numeric JSON values changed by more than a threshold.
+type DeadbandSettings struct {
+	// Paths are the dot separated paths of the numeric values in the JSON payload, the payload itself is the value if not set.
+	Paths []string `json:"paths"`
+	// Threshold is the absolute change of a value, which has to be exceeded.
+	Threshold float64 `json:"threshold"`
+}
+
+// RateBurst returns the max number of messages forwarded at once within the rate limit.
+func (filter *TelemetryFilter) RateBurst() int {
+	if filter.Burst > 0 {
+		return filter.Burst
+	}
+	return int(math.Ceil(filter.Rate))
+}
+
+// SampleInterval returns the parsed sampling interval, 0 if not configured.
+func (filter *TelemetryFilter) SampleInterval() (time.Duration, error) {
+	return filterInterval("sample", filter.Sample)
+}
+
+// LastValueInterval returns the parsed last value interval, 0 if not configured.
+func (filter *TelemetryFilter) LastValueInterval() (time.Duration, error) {
+	return filterInterval("last value", filter.LastValue)
+}
+
+func filterInterval(name, value string) (time.Duration, error) {
+	if len(value) == 0 {
+		return 0, nil
+	}
+	interval, err := time.ParseDuration(value)
+	if err != nil || interval <= 0 {
+		return 0, errors.Errorf("invalid %s interval '%s'", name, value)
+	}
+	return interval, nil
+}
+
+func validateTelemetryFilters(filters []TelemetryFilter) error {
+	for _, filter := range filters {
+		if err := filter.validate(); err != nil {
+			return errors.Wrapf(err, "invalid telemetry filter '%s'", filter.Topic)
+		}
+	}
+	return nil
+}
+
+func (filter *TelemetryFilter) validate() error {
+	if err := validateTopicFilter(filter.Topic); err != nil {
+		return err
+	}
+	if filter.Rate < 0 || filter.Burst < 0 {
+		return errors.New("negative rate limit")
+	}
+	sample, err := filter.SampleInterval()
+	if err != nil {
+		return err
+	}
+	lastValue, err := filter.LastValueInterval()
+	if err != nil {
+		return err
+	}
+	if sample > 0 && lastValue > 0 {
+		return errors.New("sampling cannot be combined with last value")
+	}
+	if filter.Deadband != nil {
+		if filter.Deadband.Threshold < 0 {
+			return errors.New("negative deadband threshold")
+		}
+		for _, path := range filter.Deadband.Paths {
+			if len(path) == 0 {
+				return errors.New("empty deadband path")
+			}
+		}
+	}
+	if filter.Rate == 0 && filter.Deadband == nil && sample == 0 && lastValue == 0 {
+		return errors.New("no limits")
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/eclipse-kanto/suite-connector/config"
+)
+
+func TestTelemetryFiltersConfig(t *testing.T) {
+	settings := DefaultSettings()
+	require.NoError(t, config.ReadConfig("testdata/filters.json", settings))
+	require.NoError(t, validateTelemetryFilters(settings.TelemetryFilters))
+
+	require.Len(t, settings.TelemetryFilters, 2)
+	assert.Equal(t, TelemetryFilter{
+		Topic:    "sensors/+/temperature",
+		Rate:     0.5,
+		Deadband: &DeadbandSettings{Paths: []string{"value", "meta.offset"}, Threshold: 0.2},
+	}, settings.TelemetryFilters[0])
+	assert.Equal(t, 1, settings.TelemetryFilters[0].RateBurst())
+
+	lastValue, err := settings.TelemetryFilters[1].LastValueInterval()
+	require.NoError(t, err)
+	assert.Equal(t, 10*time.Second, lastValue)
+	sample, err := settings.TelemetryFilters[1].SampleInterval()
+	require.NoError(t, err)
+	assert.Zero(t, sample)
+
+	assert.Equal(t, 5, (&TelemetryFilter{Rate: 10, Burst: 5}).RateBurst())
+}
+
+func TestTelemetryFiltersConfigInvalid(t *testing.T) {
+	invalid := []TelemetryFilter{
+		{Rate: 1},
+		{Topic: "sensors/#/x", Rate: 1},
+		{Topic: "sensors/#"},
+		{Topic: "sensors/#", Rate: -1},
+		{Topic: "sensors/#", Rate: 1, Burst: -1},
+		{Topic: "sensors/#", Sample: "often"},
+		{Topic: "sensors/#", LastValue: "-1s"},
+		{Topic: "sensors/#", Sample: "1s", LastValue: "1s"},
+		{Topic: "sensors/#", Deadband: &DeadbandSettings{Threshold: -1}},
+		{Topic: "sensors/#", Deadband: &DeadbandSettings{Paths: []string{""}}},
+	}
+	for _, filter := range invalid {
+		assert.Error(t, validateTelemetryFilters([]TelemetryFilter{filter}), filter)
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DispatchFirstMatch passes a C2D message to the command handlers in order until one of them handles it.
+	DispatchFirstMatch = "first-match"
+	// DispatchFanOut passes a C2D message to all applicable command handlers.
+	DispatchFanOut = "fan-out"
+	// DispatchChain passes a C2D message through the command handlers in order, each handler processing the messages produced by the previous one.
+	DispatchChain = "chain"
+)
+
+const (
+	// BatchChunkSize is the Azure IoT Hub message metering unit, the batch size must be a multiple of it.
+	BatchChunkSize = 4 * 1024
+	// BatchMaxSize is the maximum size of an Azure IoT Hub device-to-cloud message.
+	BatchMaxSize = 256 * 1024
+	// DefaultBatchWindow is the batch window used if not configured.
+	DefaultBatchWindow = "5s"
+)
+
+// HandlersSettings lists the telemetry and command handlers to be instantiated.
+// The default handlers are used if a list is not provided at all.
+type HandlersSettings struct {
+	Telemetry []HandlerSettings `json:"telemetry"`
+	Command   []HandlerSettings `json:"command"`
+
+	CommandDispatch string `json:"commandDispatch"`
+}
+
+// MatchSettings defines the messages that a command handler is applicable for.
+// The topics are comma separated MQTT topic filters matched against the C2D message topic and
+// the properties are matched against the C2D message properties, where '*' matches any present value.
+type MatchSettings struct {
+	Topics     string            `json:"topics"`
+	Properties map[string]string `json:"properties"`
+}
+
+// BatchSettings enables packing the device-to-cloud messages produced by a telemetry handler into batches per destination.
+// A batch is sent when it reaches the maximum size in bytes or when the window since its first message elapses.
+// The size defaults to a single metering unit and the window to DefaultBatchWindow.
+type BatchSettings struct {
+	MaxSize int    `json:"maxSize"`
+	Window  string `json:"window"`
+}
+
+// BatchSize returns the maximum batch size in bytes.
+func (settings *BatchSettings) BatchSize() int {
+	if settings.MaxSize == 0 {
+		return BatchChunkSize
+	}
+	return settings.MaxSize
+}
+
+// BatchWindow returns the parsed batch window.
+func (settings *BatchSettings) BatchWindow() (time.Duration, error) {
+	value := settings.Window
+	if len(value) == 0 {
+		value = DefaultBatchWindow
+	}
+	window, err := time.ParseDuration(value)
+	if err != nil || window <= 0 {
+		return 0, errors.Errorf("invalid batch window '%s'", value)
+	}
+	return window, nil
+}
+
+// HandlerSettings contains the configuration of a single message handler.
+type HandlerSettings struct {
+	Type    string          `json:"type"`
+	Name    string          `json:"name"`
+	Topics  string          `json:"topics"`
+	QoS     *int            `json:"qos"`
+	Order   int             `json:"order"`
+	Match   *MatchSettings  `json:"match"`
+	Batch   *BatchSettings  `json:"batch"`
+	Options json.RawMessage `json:"options"`
+}
+
+// DecodeOptions decodes the handler type specific options into the given value, rejecting unknown fields.
+func (settings *HandlerSettings) DecodeOptions(v interface{}) error {
+	if len(settings.Options) == 0 {
+		return nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(settings.Options))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return errors.Wrapf(err, "invalid options of handler type '%s'", settings.Type)
+	}
+	return nil
+}
+
+// Validate validates the handlers settings.
+func (settings *HandlersSettings) Validate() error {
+	switch settings.CommandDispatch {
+	case "", DispatchFirstMatch, DispatchFanOut, DispatchChain:
+	default:
+		return errors.Errorf("unsupported command dispatch mode '%s'", settings.CommandDispatch)
+	}
+
+	for _, handler := range settings.Telemetry {
+		if handler.Match != nil {
+			return errors.Errorf("invalid telemetry handler of type '%s': match is not supported", handler.Type)
+		}
+		if err := handler.validate(); err != nil {
+			return errors.Wrap(err, "invalid telemetry handler")
+		}
+		if handler.Batch != nil {
+			if err := handler.Batch.validate(); err != nil {
+				return errors.Wrapf(err, "invalid telemetry handler of type '%s'", handler.Type)
+			}
+		}
+	}
+	for _, handler := range settings.Command {
+		if len(handler.Topics) > 0 {
+			return errors.Errorf("invalid command handler of type '%s': topics are not supported", handler.Type)
+		}
+		if handler.Batch != nil {
+			return errors.Errorf("invalid command handler of type '%s': batch is not supported", handler.Type)
+		}
+		if err := handler.validate(); err != nil {
+			return errors.Wrap(err, "invalid command handler")
+		}
+	}
+	return nil
+}
+
+func (settings *HandlerSettings) validate() error {
+	if len(settings.Type) == 0 {
+		return errors.New("the handler type is required")
+	}
+	if settings.QoS != nil && (*settings.QoS < 0 || *settings.QoS > 1) {
+		return errors.Errorf("unsupported QoS %d of handler type '%s'", *settings.QoS, settings.Type)
+	}
+	return nil
+}
+
+func (settings *BatchSettings) validate() error {
+	if size := settings.BatchSize(); size < 0 || size > BatchMaxSize || size%BatchChunkSize != 0 {
+		return errors.Errorf("batch size %d must be a multiple of %d up to %d bytes", size, BatchChunkSize, BatchMaxSize)
+	}
+	_, err := settings.BatchWindow()
+	return err
+}
@@ -0,0 +1,99 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/eclipse-kanto/suite-connector/config"
+)
+
+func TestHandlersConfig(t *testing.T) {
+	settings := DefaultSettings()
+	assert.Nil(t, settings.Handlers.Telemetry)
+	assert.Nil(t, settings.Handlers.Command)
+
+	require.NoError(t, config.ReadConfig("testdata/handlers.json", settings))
+	require.NoError(t, settings.Handlers.Validate())
+
+	require.Len(t, settings.Handlers.Telemetry, 2)
+	alarms := settings.Handlers.Telemetry[0]
+	assert.Equal(t, "passthrough", alarms.Type)
+	assert.Equal(t, "alarms", alarms.Name)
+	assert.Equal(t, "event/alarm/#", alarms.Topics)
+	require.NotNil(t, alarms.QoS)
+	assert.Equal(t, 1, *alarms.QoS)
+	assert.Equal(t, 1, alarms.Order)
+	require.NotNil(t, alarms.Batch)
+	assert.Equal(t, 2*BatchChunkSize, alarms.Batch.BatchSize())
+	window, err := alarms.Batch.BatchWindow()
+	require.NoError(t, err)
+	assert.Equal(t, 2*time.Second, window)
+
+	custom := settings.Handlers.Telemetry[1]
+	options := struct {
+		Field string `json:"field"`
+	}{}
+	require.NoError(t, custom.DecodeOptions(&options))
+	assert.Equal(t, "value", options.Field)
+	assert.Error(t, custom.DecodeOptions(&struct{}{}))
+	assert.NoError(t, alarms.DecodeOptions(&struct{}{}))
+
+	assert.Equal(t, DispatchFanOut, settings.Handlers.CommandDispatch)
+	require.Len(t, settings.Handlers.Command, 1)
+	assert.Equal(t, 0, *settings.Handlers.Command[0].QoS)
+	match := settings.Handlers.Command[0].Match
+	require.NotNil(t, match)
+	assert.Equal(t, "devices/+/messages/devicebound/#", match.Topics)
+	assert.Equal(t, map[string]string{"subject": "*"}, match.Properties)
+}
+
+func TestHandlersConfigInvalid(t *testing.T) {
+	qos := 2
+	invalid := []HandlersSettings{
+		{Telemetry: []HandlerSettings{{}}},
+		{Telemetry: []HandlerSettings{{Type: "passthrough", QoS: &qos}}},
+		{Command: []HandlerSettings{{Type: "passthrough", Topics: "command/#"}}},
+		{Command: []HandlerSettings{{}}},
+		{CommandDispatch: "random"},
+		{Telemetry: []HandlerSettings{{Type: "passthrough", Match: &MatchSettings{Topics: "command/#"}}}},
+		{Telemetry: []HandlerSettings{{Type: "passthrough", Batch: &BatchSettings{MaxSize: 1000}}}},
+		{Telemetry: []HandlerSettings{{Type: "passthrough", Batch: &BatchSettings{MaxSize: BatchMaxSize + BatchChunkSize}}}},
+		{Telemetry: []HandlerSettings{{Type: "passthrough", Batch: &BatchSettings{MaxSize: -BatchChunkSize}}}},
+		{Telemetry: []HandlerSettings{{Type: "passthrough", Batch: &BatchSettings{Window: "0s"}}}},
+		{Telemetry: []HandlerSettings{{Type: "passthrough", Batch: &BatchSettings{Window: "soon"}}}},
+		{Command: []HandlerSettings{{Type: "passthrough", Batch: &BatchSettings{}}}},
+	}
+	for _, handlers := range invalid {
+		settings := DefaultSettings()
+		settings.CACert = ""
+		settings.Handlers = handlers
+		assert.Error(t, settings.Validate())
+	}
+
+	batch := &BatchSettings{}
+	assert.NoError(t, batch.validate())
+	assert.Equal(t, BatchChunkSize, batch.BatchSize())
+	window, err := batch.BatchWindow()
+	require.NoError(t, err)
+	assert.Equal(t, 5*time.Second, window)
+
+	for _, qos := range []int{-1, 2} {
+		handlers := HandlersSettings{Command: []HandlerSettings{{Type: "passthrough", QoS: &qos}}}
+		assert.Error(t, handlers.Validate())
+	}
+}
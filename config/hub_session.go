@@ -0,0 +1,24 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package config
+
+import (
+	"github.com/eclipse-kanto/suite-connector/connector"
+)
+
+// setHubSession configures the Azure IoT Hub connection with a persistent session,
+// which keeps the unacknowledged C2D messages for redelivery after a reconnect.
+// The device ID is used as the client ID, so that the session is resumed by the next connection.
+func setHubSession(configuration *connector.Configuration) {
+	configuration.CleanSession = false
+}
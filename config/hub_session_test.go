@@ -0,0 +1,48 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHubClientOptions(t *testing.T) {
+	for _, env := range []string{"HUB_CONNECT_INIT", "HUB_CONNECT_MAX", "HUB_CONNECT_MUL"} {
+		t.Setenv(env, "")
+	}
+	settings := DefaultSettings()
+	settings.CACert = "testdata/certificate.pem"
+	connSettings := &AzureConnectionSettings{
+		RemoteConnectionInfo: RemoteConnectionInfo{
+			DeviceID: "dummy-device",
+			HostName: "dummy-hub.azure-devices.net",
+			HubName:  "dummy-hub",
+		},
+		SharedAccessKey: []byte("key"),
+	}
+
+	configuration, err := createMQTTConfiguration(settings, connSettings, watermill.NopLogger{})
+	require.NoError(t, err)
+	assert.False(t, configuration.CleanSession)
+	assert.Equal(t, "tls://dummy-hub.azure-devices.net:8883", configuration.URL)
+	assert.NotNil(t, configuration.TLSConfig)
+	assert.Equal(t, time.Duration(0), configuration.ConnectRetryInterval)
+	assert.Equal(t, time.Minute, configuration.MinReconnectInterval)
+	assert.Equal(t, 4*time.Minute, configuration.MaxReconnectInterval)
+}
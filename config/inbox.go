@@ -0,0 +1,27 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package config
+
+import (
+	"github.com/pkg/errors"
+)
+
+// DefaultInboxMaxMessages is the max number of the C2D messages stored in the local inbox, if not configured.
+const DefaultInboxMaxMessages = 1000
+
+func validateInbox(maxMessages int) error {
+	if maxMessages < 0 {
+		return errors.Errorf("negative inbox max messages %d", maxMessages)
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package config
+
+import (
+	"github.com/pkg/errors"
+)
+
+const (
+	// MaxMessageSize is the maximum size in bytes of an Azure IoT Hub device-to-cloud message, including its properties.
+	// It is also used if the max message size is not configured.
+	MaxMessageSize = 256 * 1024
+
+	// MessageSizeReject drops the oversized device-to-cloud messages and reports them with a local error event.
+	MessageSizeReject = "reject"
+	// MessageSizeSplit sends the payload of an oversized device-to-cloud message in multiple parts.
+	MessageSizeSplit = "split"
+	// MessageSizeOffload uploads the payload of an oversized device-to-cloud message to the storage account
+	// linked to the Azure IoT Hub and sends a reference message instead.
+	MessageSizeOffload = "offload"
+)
+
+func validateMessageSize(policy string, maxSize int) error {
+	switch policy {
+	case "", MessageSizeReject, MessageSizeSplit, MessageSizeOffload:
+	default:
+		return errors.Errorf("unsupported message size policy '%s'", policy)
+	}
+	if maxSize < 0 || maxSize > MaxMessageSize {
+		return errors.Errorf("max message size %d must not exceed %d bytes", maxSize, MaxMessageSize)
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package config
+
+import (
+	"github.com/pkg/errors"
+)
+
+const (
+	// MessageIDRandom assigns a random message ID to each device-to-cloud message.
+	MessageIDRandom = "random"
+	// MessageIDPacket derives the message ID from the local topic and the identifier of the incoming message,
+	// i.e. the MQTT packet identifier of the messages received from the local broker. The packet identifiers are reused
+	// on each local connection, so the derived IDs are stable only within a connection. The QoS 0 messages have no packet
+	// identifier and get random IDs, which are not checked for duplicates.
+	MessageIDPacket = "packet"
+	// MessageIDCorrelation derives the message ID from the Ditto correlation ID of the incoming message,
+	// The messages without a correlation ID get random IDs, which are not checked for duplicates.
+	MessageIDCorrelation = "correlation-id"
+	// MessageIDContent derives the message ID from the local topic and the payload of the incoming message.
+	MessageIDContent = "content"
+
+	// DefaultDedupWindow is the number of the recently forwarded message IDs used for the duplicates detection, if not configured.
+	DefaultDedupWindow = 1000
+)
+
+func validateMessageIDs(source string, dedupWindow int) error {
+	switch source {
+	case "", MessageIDRandom, MessageIDPacket, MessageIDCorrelation, MessageIDContent:
+	default:
+		return errors.Errorf("unsupported message ID source '%s'", source)
+	}
+	if dedupWindow < 0 {
+		return errors.Errorf("negative dedup window %d", dedupWindow)
+	}
+	return nil
+}
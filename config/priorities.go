@@ -0,0 +1,103 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package config
+
+import (
+	"github.com/pkg/errors"
+)
+
+const (
+	// OverflowBlock makes the handlers wait for space in a full priority queue, so that no messages are dropped.
+	OverflowBlock = "block"
+	// OverflowDropOldest drops the oldest queued message when a priority queue is full.
+	OverflowDropOldest = "drop-oldest"
+	// OverflowDropNewest drops the new message when a priority queue is full.
+	OverflowDropNewest = "drop-newest"
+
+	// DefaultPriorityClass is the name of the lowest priority class of the messages not matching any configured class.
+	DefaultPriorityClass = "default"
+	// DefaultPriorityQueueSize is the max number of queued messages of a priority class, if not configured.
+	DefaultPriorityQueueSize = 1000
+)
+
+// PriorityClass assigns the device-to-cloud messages to a priority queue by their local topic and properties.
+// The classes are ordered by priority, the first matching class in the configuration order is assigned.
+type PriorityClass struct {
+	// Name is the name of the class.
+	Name string `json:"name"`
+	// Topic is the local MQTT topic filter of the messages in the class, any topic if not set.
+	Topic string `json:"topic"`
+	// Properties are matched against the device-to-cloud message properties, where '*' matches any present value.
+	Properties map[string]string `json:"properties"`
+	// Weight is the number of messages published from the class queue in a scheduling round, 1 if not set.
+	Weight int `json:"weight"`
+	// MaxQueued is the max number of queued messages, DefaultPriorityQueueSize if not set.
+	MaxQueued int `json:"maxQueued"`
+	// Overflow is the handling of the messages when the queue is full, OverflowBlock if not set.
+	Overflow string `json:"overflow"`
+}
+
+// ClassWeight returns the number of messages published from the class queue in a scheduling round.
+func (class *PriorityClass) ClassWeight() int {
+	if class.Weight == 0 {
+		return 1
+	}
+	return class.Weight
+}
+
+// QueueSize returns the max number of queued messages of the class.
+func (class *PriorityClass) QueueSize() int {
+	if class.MaxQueued == 0 {
+		return DefaultPriorityQueueSize
+	}
+	return class.MaxQueued
+}
+
+// OverflowPolicy returns the handling of the messages when the queue is full.
+func (class *PriorityClass) OverflowPolicy() string {
+	if len(class.Overflow) == 0 {
+		return OverflowBlock
+	}
+	return class.Overflow
+}
+
+func validatePriorities(classes []PriorityClass) error {
+	names := map[string]bool{DefaultPriorityClass: true}
+	for _, class := range classes {
+		if len(class.Name) == 0 {
+			return errors.New("invalid priority class: name is missing")
+		}
+		if names[class.Name] {
+			return errors.Errorf("invalid priority class '%s': duplicate name", class.Name)
+		}
+		names[class.Name] = true
+
+		if len(class.Topic) == 0 && len(class.Properties) == 0 {
+			return errors.Errorf("invalid priority class '%s': no topic or properties", class.Name)
+		}
+		if len(class.Topic) > 0 {
+			if err := validateTopicFilter(class.Topic); err != nil {
+				return errors.Wrapf(err, "invalid priority class '%s'", class.Name)
+			}
+		}
+		if class.Weight < 0 || class.MaxQueued < 0 {
+			return errors.Errorf("invalid priority class '%s': negative weight or queue size", class.Name)
+		}
+		switch class.OverflowPolicy() {
+		case OverflowBlock, OverflowDropOldest, OverflowDropNewest:
+		default:
+			return errors.Errorf("invalid priority class '%s': unsupported overflow policy '%s'", class.Name, class.Overflow)
+		}
+	}
+	return nil
+}
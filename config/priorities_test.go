@@ -0,0 +1,49 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPriorityClassDefaults(t *testing.T) {
+	class := &PriorityClass{Name: "alarm", Topic: "alarm/#"}
+	assert.NoError(t, validatePriorities([]PriorityClass{*class}))
+	assert.Equal(t, 1, class.ClassWeight())
+	assert.Equal(t, DefaultPriorityQueueSize, class.QueueSize())
+	assert.Equal(t, OverflowBlock, class.OverflowPolicy())
+
+	class = &PriorityClass{Name: "bulk", Properties: map[string]string{"type": "*"}, Weight: 3, MaxQueued: 10, Overflow: OverflowDropOldest}
+	assert.NoError(t, validatePriorities([]PriorityClass{*class}))
+	assert.Equal(t, 3, class.ClassWeight())
+	assert.Equal(t, 10, class.QueueSize())
+	assert.Equal(t, OverflowDropOldest, class.OverflowPolicy())
+}
+
+func TestPriorityClassInvalid(t *testing.T) {
+	invalid := [][]PriorityClass{
+		{{Topic: "alarm/#"}},
+		{{Name: "default", Topic: "alarm/#"}},
+		{{Name: "alarm", Topic: "alarm/#"}, {Name: "alarm", Topic: "fire"}},
+		{{Name: "alarm"}},
+		{{Name: "alarm", Topic: "alarm/#/x"}},
+		{{Name: "alarm", Topic: "alarm/#", Weight: -1}},
+		{{Name: "alarm", Topic: "alarm/#", MaxQueued: -1}},
+		{{Name: "alarm", Topic: "alarm/#", Overflow: "drop-all"}},
+	}
+	for _, classes := range invalid {
+		assert.Error(t, validatePriorities(classes), classes)
+	}
+}
@@ -0,0 +1,310 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+
+	"github.com/eclipse-kanto/suite-connector/connector"
+	"github.com/eclipse-kanto/suite-connector/logger"
+)
+
+const (
+	// ProvisioningTransportHTTPS defines the Azure DPS registration over HTTPS.
+	ProvisioningTransportHTTPS = "https"
+	// ProvisioningTransportMQTT defines the Azure DPS registration over MQTT.
+	ProvisioningTransportMQTT = "mqtt"
+
+	azureDPSMQTTBrokerURL   = "tls://global.azure-devices-provisioning.net:8883"
+	azureDPSMQTTUserFmt     = "%s/registrations/%s/api-version=2019-03-31"
+	azureDPSMQTTRegisterFmt = "$dps/registrations/PUT/iotdps-register/?$rid=%d"
+	azureDPSMQTTStatusFmt   = "$dps/registrations/GET/iotdps-get-operationstatus/?$rid=%d&operationId=%s"
+	azureDPSMQTTResponses   = "$dps/registrations/res/#"
+	azureDPSMQTTResPrefix   = "$dps/registrations/res/"
+
+	dpsMQTTRetryAfterKey     = "retry-after"
+	dpsMQTTRequestIDKey      = "$rid"
+	dpsDefaultRetryAfter     = 3 * time.Second
+	dpsDefaultMQTTTimeout    = 2 * time.Minute
+	dpsStatusAssigning       = "assigning"
+	dpsStatusUnassigned      = "unassigned"
+	dpsMQTTConnectTimeout    = 30 * time.Second
+	dpsMQTTPublishAckTimeout = 15 * time.Second
+)
+
+// dpsMQTTSession represents an established MQTT session towards the Azure DPS.
+type dpsMQTTSession struct {
+	pub       message.Publisher
+	responses <-chan *message.Message
+	close     func()
+}
+
+// MQTTProvisioningOptions contains the optional settings of the Azure DPS registration over MQTT.
+type MQTTProvisioningOptions struct {
+	// BrokerURL is the Azure DPS MQTT endpoint, the global endpoint if not set.
+	BrokerURL string
+	// Timeout limits the whole registration, including the waiting for the device assignment, 2 minutes if not set.
+	Timeout time.Duration
+}
+
+type mqttProvisioningService struct {
+	defProvisioningService
+
+	brokerURL string
+	timeout   time.Duration
+}
+
+// NewMQTTProvisioningService is a creator method for instantiating a provisioning service instance
+// that registers the device in the Azure DPS using the MQTT protocol.
+func NewMQTTProvisioningService(logger logger.Logger) ProvisioningService {
+	return NewMQTTProvisioningServiceWithOptions(nil, logger)
+}
+
+// NewMQTTProvisioningServiceWithOptions is a creator method for instantiating a provisioning service instance
+// that registers the device in the Azure DPS using the MQTT protocol and the given options.
+func NewMQTTProvisioningServiceWithOptions(options *MQTTProvisioningOptions, logger logger.Logger) ProvisioningService {
+	service := &mqttProvisioningService{
+		defProvisioningService: defProvisioningService{
+			logger: logger,
+		},
+		brokerURL: azureDPSMQTTBrokerURL,
+		timeout:   dpsDefaultMQTTTimeout,
+	}
+	if options != nil {
+		if len(options.BrokerURL) > 0 {
+			service.brokerURL = options.BrokerURL
+		}
+		if options.Timeout > 0 {
+			service.timeout = options.Timeout
+		}
+	}
+	return service
+}
+
+// NewProvisioningServiceForTransport is a creator method for instantiating a provisioning service instance
+// that uses the given transport protocol, i.e. https or mqtt.
+func NewProvisioningServiceForTransport(transport string, logger logger.Logger) ProvisioningService {
+	if transport == ProvisioningTransportMQTT {
+		return NewMQTTProvisioningService(logger)
+	}
+	return NewProvisioningService(logger)
+}
+
+func (p *mqttProvisioningService) GetDeviceData(idScope string, connSettings *AzureConnectionSettings) (*AzureDeviceData, error) {
+	deviceData, err := p.getDeviceDataFromDisk()
+	if err != nil {
+		return nil, err
+	}
+	if deviceData != nil {
+		return deviceData, nil
+	}
+
+	if len(idScope) == 0 {
+		return nil, errors.New("idScope cannot be empty")
+	}
+
+	session, err := dialDPSMQTT(p.brokerURL, idScope, connSettings, p.logger)
+	if err != nil {
+		return nil, errors.Wrap(err, "error on connecting to AzureDPS")
+	}
+	defer session.close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+
+	azureDeviceInfo, err := registerAzureDeviceInDPSOverMQTT(ctx, session, connSettings)
+	if err != nil {
+		return nil, err
+	}
+	if err = p.persistDeviceInfoToDisk(azureDeviceInfo); err != nil {
+		p.logger.Warn("Error occurred while writing file to disk", err, nil)
+	}
+
+	return extractDeviceDataFromResponse(azureDeviceInfo)
+}
+
+func registerAzureDeviceInDPSOverMQTT(
+	ctx context.Context, session *dpsMQTTSession, connSettings *AzureConnectionSettings,
+) (*AzureDpsDeviceInfoResponse, error) {
+	jsonBody, err := json.Marshal(&AzureDpsRegisterDeviceRequest{RegistrationID: connSettings.DeviceID})
+	if err != nil {
+		return nil, errors.Wrap(err, "error on marshalling register to AzureDPS request body")
+	}
+
+	rid := 1
+	topic := fmt.Sprintf(azureDPSMQTTRegisterFmt, rid)
+	for {
+		msg := message.NewMessage(watermill.NewUUID(), jsonBody)
+		if err := session.pub.Publish(topic, msg); err != nil {
+			return nil, errors.Wrap(err, "error on publishing AzureDPS request")
+		}
+
+		status, retryAfter, payload, err := awaitDPSResponse(ctx, session.responses, rid)
+		if err != nil {
+			return nil, err
+		}
+
+		if status >= 300 {
+			resError := &ResponseError{}
+			if err := json.Unmarshal(payload, resError); err != nil {
+				return nil, errors.Errorf("unexpected AzureDPS response status %d", status)
+			}
+			return nil, errors.Errorf("unexpected AzureDPS response status %d, message: %s%s",
+				status, resError.Message, resError.Detail)
+		}
+
+		deviceInfo := &AzureDpsDeviceInfoResponse{}
+		if err := json.Unmarshal(payload, deviceInfo); err != nil {
+			return nil, errors.Wrap(err, "error on unmarshalling AzureDPS response")
+		}
+
+		if deviceInfo.Status != dpsStatusAssigning && deviceInfo.Status != dpsStatusUnassigned {
+			return deviceInfo, nil
+		}
+
+		if len(deviceInfo.OperationID) == 0 {
+			return nil, errors.New("missing operationId in AzureDPS response")
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, errors.Wrap(ctx.Err(), "error on waiting for AzureDPS assignment")
+		case <-time.After(retryAfter):
+		}
+
+		rid++
+		topic = fmt.Sprintf(azureDPSMQTTStatusFmt, rid, url.QueryEscape(deviceInfo.OperationID))
+		jsonBody = []byte{}
+	}
+}
+
+func awaitDPSResponse(ctx context.Context, responses <-chan *message.Message, rid int) (int, time.Duration, []byte, error) {
+	for {
+		select {
+		case <-ctx.Done():
+			return 0, 0, nil, errors.Wrap(ctx.Err(), "error on waiting for AzureDPS response")
+
+		case msg, ok := <-responses:
+			if !ok {
+				return 0, 0, nil, errors.New("AzureDPS connection closed")
+			}
+			msg.Ack()
+
+			topic, _ := connector.TopicFromCtx(msg.Context())
+			status, params, err := parseDPSResponseTopic(topic)
+			if err != nil {
+				return 0, 0, nil, err
+			}
+			if params.Get(dpsMQTTRequestIDKey) != strconv.Itoa(rid) {
+				continue
+			}
+
+			retryAfter := dpsDefaultRetryAfter
+			if seconds, err := strconv.Atoi(params.Get(dpsMQTTRetryAfterKey)); err == nil && seconds >= 0 {
+				retryAfter = time.Duration(seconds) * time.Second
+			}
+			return status, retryAfter, msg.Payload, nil
+		}
+	}
+}
+
+// parseDPSResponseTopic parses response topics in the format $dps/registrations/res/{status}/?$rid={rid}&retry-after={seconds}.
+func parseDPSResponseTopic(topic string) (int, url.Values, error) {
+	if !strings.HasPrefix(topic, azureDPSMQTTResPrefix) {
+		return 0, nil, errors.Errorf("unexpected AzureDPS response topic '%s'", topic)
+	}
+
+	parts := strings.SplitN(topic[len(azureDPSMQTTResPrefix):], "/", 2)
+	status, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, nil, errors.Wrapf(err, "invalid AzureDPS response topic '%s'", topic)
+	}
+
+	params := url.Values{}
+	if len(parts) == 2 {
+		if params, err = url.ParseQuery(strings.TrimPrefix(parts[1], "?")); err != nil {
+			return 0, nil, errors.Wrapf(err, "invalid AzureDPS response topic '%s'", topic)
+		}
+	}
+	return status, params, nil
+}
+
+func dialDPSMQTT(brokerURL, idScope string, connSettings *AzureConnectionSettings, logger logger.Logger) (*dpsMQTTSession, error) {
+	configuration, err := connector.NewMQTTClientConfig(brokerURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create MQTT client configuration")
+	}
+
+	tlsConfig, err := createProvisioningTLSConfig(connSettings)
+	if err != nil {
+		return nil, err
+	}
+
+	configuration.TLSConfig = tlsConfig
+	configuration.CleanSession = true
+	configuration.ConnectRetryInterval = 0
+	configuration.MinReconnectInterval = 0
+	configuration.MaxReconnectInterval = 0
+	configuration.Credentials.UserName = fmt.Sprintf(azureDPSMQTTUserFmt, idScope, connSettings.DeviceID)
+
+	dpsClient, err := connector.NewMQTTConnection(configuration, connSettings.DeviceID, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sub := connector.NewSubscriber(dpsClient, connector.QosAtLeastOnce, false, logger, nil)
+	responses, err := sub.Subscribe(ctx, azureDPSMQTTResponses)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	future := dpsClient.Connect()
+	select {
+	case <-future.Done():
+	case <-time.After(dpsMQTTConnectTimeout):
+		cancel()
+		sub.Close()
+		return nil, errors.New("timeout on connecting to AzureDPS")
+	}
+	if err := future.Error(); err != nil {
+		cancel()
+		sub.Close()
+		return nil, err
+	}
+
+	pub := connector.NewSyncPublisher(dpsClient, connector.QosAtLeastOnce, dpsMQTTPublishAckTimeout, logger, nil)
+
+	return &dpsMQTTSession{
+		pub:       pub,
+		responses: responses,
+		close: func() {
+			cancel()
+			sub.Close()
+			pub.Close()
+			dpsClient.Disconnect()
+		},
+	}, nil
+}
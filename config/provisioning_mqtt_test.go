@@ -0,0 +1,263 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package config_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-co/mqtt/server"
+	"github.com/mochi-co/mqtt/server/events"
+	"github.com/mochi-co/mqtt/server/listeners"
+
+	"github.com/eclipse-kanto/suite-connector/logger"
+
+	"github.com/eclipse-kanto/azure-connector/config"
+	test "github.com/eclipse-kanto/azure-connector/config/internal/testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	dpsTestIDScope     = "0ne00000000"
+	dpsTestDeviceID    = "test-demo-device"
+	dpsTestAssignedHub = "test-iot.azure-devices.net"
+	dpsTestOperationID = "5.b4ba454a90f38510.17d1dba6-67df-4b6c-bbdd-bf94a5507404"
+
+	dpsTestRequestPrefix  = "$dps/registrations/"
+	dpsTestResponsePrefix = "$dps/registrations/res/"
+)
+
+// dpsBroker is an in-process MQTT broker replying to the published DPS requests with the configured responses.
+type dpsBroker struct {
+	server *mqtt.Server
+	url    string
+
+	lock     sync.Mutex
+	replies  []dpsReply
+	requests []string
+}
+
+type dpsReply struct {
+	status     string
+	retryAfter string
+	payload    string
+}
+
+// freeAddress returns a local address without a listener.
+func freeAddress(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	address := l.Addr().String()
+	require.NoError(t, l.Close())
+	return address
+}
+
+func newDPSBroker(t *testing.T, replies ...dpsReply) *dpsBroker {
+	address := freeAddress(t)
+	b := &dpsBroker{
+		server:  mqtt.New(),
+		url:     "tcp://" + address,
+		replies: replies,
+	}
+	require.NoError(t, b.server.AddListener(listeners.NewTCP("dps", address), nil))
+	b.server.Events.OnMessage = b.onMessage
+	require.NoError(t, b.server.Serve())
+	t.Cleanup(func() {
+		b.server.Close()
+	})
+	return b
+}
+
+func (b *dpsBroker) onMessage(cl events.Client, pk events.Packet) (events.Packet, error) {
+	if !strings.HasPrefix(pk.TopicName, dpsTestRequestPrefix) || strings.HasPrefix(pk.TopicName, dpsTestResponsePrefix) {
+		return pk, nil
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.requests = append(b.requests, pk.TopicName)
+	if len(b.replies) == 0 {
+		return pk, nil
+	}
+	reply := b.replies[0]
+	b.replies = b.replies[1:]
+
+	rid := pk.TopicName[strings.Index(pk.TopicName, "$rid=")+len("$rid="):]
+	if i := strings.Index(rid, "&"); i >= 0 {
+		rid = rid[:i]
+	}
+	resTopic := fmt.Sprintf("%s%s/?$rid=%s", dpsTestResponsePrefix, reply.status, rid)
+	if len(reply.retryAfter) > 0 {
+		resTopic = resTopic + "&retry-after=" + reply.retryAfter
+	}
+
+	// response to an unrelated request must be skipped
+	if err := b.server.Publish(dpsTestResponsePrefix+"200/?$rid=100", []byte("{}"), false); err != nil {
+		return pk, err
+	}
+	return pk, b.server.Publish(resTopic, []byte(reply.payload), false)
+}
+
+func (b *dpsBroker) publishedRequests() []string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return append([]string{}, b.requests...)
+}
+
+func newTestMQTTProvisioningService(brokerURL string, timeout time.Duration, file io.ReadWriter) config.ProvisioningService {
+	service := config.NewMQTTProvisioningServiceWithOptions(
+		&config.MQTTProvisioningOptions{BrokerURL: brokerURL, Timeout: timeout},
+		logger.NewLogger(log.New(io.Discard, "", log.Ldate), logger.INFO),
+	)
+	service.Init(nil, file)
+	return service
+}
+
+func dpsConnectionSettings() *config.AzureConnectionSettings {
+	connSettings := &config.AzureConnectionSettings{}
+	connSettings.DeviceID = dpsTestDeviceID
+	connSettings.DeviceCert = test.DeviceCertificate()
+	connSettings.DeviceKey = test.CertificateKey()
+	return connSettings
+}
+
+func assignedResponse() string {
+	res := &config.AzureDpsDeviceInfoResponse{
+		OperationID: dpsTestOperationID,
+		Status:      "assigned",
+		RegistrationState: config.AzureDpsRegistrationState{
+			RegistrationID: dpsTestDeviceID,
+			AssignedHub:    dpsTestAssignedHub,
+			DeviceID:       dpsTestDeviceID,
+			Status:         "assigned",
+		},
+	}
+	payload, _ := json.Marshal(res)
+	return string(payload)
+}
+
+func TestMQTTProvisioningAssigned(t *testing.T) {
+	broker := newDPSBroker(t,
+		dpsReply{status: "202", retryAfter: "0", payload: `{"operationId":"` + dpsTestOperationID + `","status":"assigning"}`},
+		dpsReply{status: "202", retryAfter: "0", payload: `{"operationId":"` + dpsTestOperationID + `","status":"assigning"}`},
+		dpsReply{status: "200", payload: assignedResponse()},
+	)
+
+	var file bytes.Buffer
+	service := newTestMQTTProvisioningService(broker.url, 5*time.Second, &file)
+
+	deviceData, err := service.GetDeviceData(dpsTestIDScope, dpsConnectionSettings())
+	require.NoError(t, err)
+	assert.Equal(t, dpsTestAssignedHub, deviceData.AssignedHub)
+	assert.Equal(t, dpsTestDeviceID, deviceData.DeviceID)
+	assert.Equal(t, `{"assignedHub":"test-iot.azure-devices.net","deviceId":"test-demo-device"}`, file.String())
+
+	requests := broker.publishedRequests()
+	require.Equal(t, 3, len(requests))
+	assert.Equal(t, "$dps/registrations/PUT/iotdps-register/?$rid=1", requests[0])
+	assert.True(t, strings.HasPrefix(requests[1], "$dps/registrations/GET/iotdps-get-operationstatus/?$rid=2&operationId="))
+	assert.True(t, strings.HasPrefix(requests[2], "$dps/registrations/GET/iotdps-get-operationstatus/?$rid=3&operationId="))
+}
+
+func TestMQTTProvisioningAssignedImmediately(t *testing.T) {
+	broker := newDPSBroker(t, dpsReply{status: "200", payload: assignedResponse()})
+
+	service := newTestMQTTProvisioningService(broker.url, 5*time.Second, &bytes.Buffer{})
+
+	deviceData, err := service.GetDeviceData(dpsTestIDScope, dpsConnectionSettings())
+	require.NoError(t, err)
+	assert.Equal(t, dpsTestAssignedHub, deviceData.AssignedHub)
+	assert.Equal(t, 1, len(broker.publishedRequests()))
+}
+
+func TestMQTTProvisioningErrorResponses(t *testing.T) {
+	var testData = []struct {
+		name  string
+		reply dpsReply
+	}{
+		{"Unauthorized", dpsReply{status: "401", payload: `{"message":"unauthorized"}`}},
+		{"MalformedError", dpsReply{status: "500", payload: "malformed"}},
+		{"MalformedResponse", dpsReply{status: "200", payload: "malformed"}},
+		{"MalformedStatus", dpsReply{status: "ok", payload: assignedResponse()}},
+		{"Failed", dpsReply{status: "200", payload: `{"operationId":"dummy","status":"failed"}`}},
+		{"MissingOperationID", dpsReply{status: "202", payload: `{"status":"assigning"}`}},
+	}
+	for _, testValues := range testData {
+		t.Run(testValues.name, func(t *testing.T) {
+			broker := newDPSBroker(t, testValues.reply)
+			service := newTestMQTTProvisioningService(broker.url, 5*time.Second, &bytes.Buffer{})
+
+			_, err := service.GetDeviceData(dpsTestIDScope, dpsConnectionSettings())
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestMQTTProvisioningTimeout(t *testing.T) {
+	broker := newDPSBroker(t)
+	service := newTestMQTTProvisioningService(broker.url, 100*time.Millisecond, &bytes.Buffer{})
+
+	_, err := service.GetDeviceData(dpsTestIDScope, dpsConnectionSettings())
+	require.Error(t, err)
+	assert.Equal(t, 1, len(broker.publishedRequests()))
+}
+
+func TestMQTTProvisioningConnectError(t *testing.T) {
+	service := newTestMQTTProvisioningService("tcp://"+freeAddress(t), 5*time.Second, &bytes.Buffer{})
+
+	_, err := service.GetDeviceData(dpsTestIDScope, dpsConnectionSettings())
+	require.Error(t, err)
+}
+
+func TestMQTTProvisioningInvalidCertificate(t *testing.T) {
+	broker := newDPSBroker(t)
+	service := newTestMQTTProvisioningService(broker.url, 5*time.Second, &bytes.Buffer{})
+
+	connSettings := dpsConnectionSettings()
+	connSettings.DeviceKey = test.MalformedCertificateKey()
+	_, err := service.GetDeviceData(dpsTestIDScope, connSettings)
+	require.Error(t, err)
+	assert.Empty(t, broker.publishedRequests())
+}
+
+func TestMQTTProvisioningFromDisk(t *testing.T) {
+	broker := newDPSBroker(t)
+	file := bytes.NewBufferString(`{"assignedHub":"test-iot.azure-devices.net","deviceId":"test-demo-device"}`)
+	service := newTestMQTTProvisioningService(broker.url, 5*time.Second, file)
+
+	deviceData, err := service.GetDeviceData("", &config.AzureConnectionSettings{})
+	require.NoError(t, err)
+	assert.Equal(t, dpsTestAssignedHub, deviceData.AssignedHub)
+	assert.Empty(t, broker.publishedRequests())
+}
+
+func TestMQTTProvisioningNoIDScope(t *testing.T) {
+	broker := newDPSBroker(t)
+	service := newTestMQTTProvisioningService(broker.url, 5*time.Second, &bytes.Buffer{})
+
+	_, err := service.GetDeviceData("", dpsConnectionSettings())
+	require.Error(t, err)
+	assert.Empty(t, broker.publishedRequests())
+}
@@ -0,0 +1,32 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package config
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// CommandResponseTimeout returns the parsed time to wait for the response of a forwarded command,
+// 0 if the command responses are not correlated.
+func (settings *AzureSettings) CommandResponseTimeout() (time.Duration, error) {
+	if len(settings.ResponseTimeout) == 0 {
+		return 0, nil
+	}
+	timeout, err := time.ParseDuration(settings.ResponseTimeout)
+	if err != nil || timeout <= 0 {
+		return 0, errors.Errorf("invalid command response timeout '%s'", settings.ResponseTimeout)
+	}
+	return timeout, nil
+}
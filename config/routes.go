@@ -0,0 +1,165 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package config
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// RoutesSettings contains the routing table of the telemetry and C2D messages.
+// The first matching route in the configuration order is applied.
+type RoutesSettings struct {
+	Telemetry []TelemetryRoute `json:"telemetry"`
+	Command   []CommandRoute   `json:"command"`
+}
+
+// TelemetryRoute maps the messages received on a local topic to an Azure IoT Hub destination.
+// The property values, the output name and the reported path are templates, where {1}, {2}, ... are replaced
+// with the topic levels captured by the wildcards of the topic filter and {deviceId} with the device ID.
+type TelemetryRoute struct {
+	// Topic is the local MQTT topic filter.
+	Topic string `json:"topic"`
+	// Properties are added to the device-to-cloud message properties.
+	Properties map[string]string `json:"properties"`
+	// Output is the module output name of the device-to-cloud message.
+	Output string `json:"output"`
+	// Reported is the dot separated path of the device twin reported property updated with the message payload.
+	Reported string `json:"reported"`
+	// Compression enables compressing the device-to-cloud message payloads.
+	Compression *CompressionSettings `json:"compression"`
+	// Schema enables validating the device-to-cloud message payloads against a JSON Schema.
+	Schema *SchemaSettings `json:"schema"`
+}
+
+// CompressionSettings configures compressing the payloads exceeding a size threshold.
+// The encoding is either gzip or deflate, gzip by default, and the threshold defaults to DefaultCompressionThreshold bytes.
+type CompressionSettings struct {
+	Encoding  string `json:"encoding"`
+	Threshold *int   `json:"threshold"`
+}
+
+// DefaultCompressionThreshold is the minimum size in bytes of the compressed payloads, if not configured.
+const DefaultCompressionThreshold = 1024
+
+const (
+	encodingGzip    = "gzip"
+	encodingDeflate = "deflate"
+)
+
+// ContentEncoding returns the configured compression encoding.
+func (settings *CompressionSettings) ContentEncoding() string {
+	if len(settings.Encoding) == 0 {
+		return encodingGzip
+	}
+	return settings.Encoding
+}
+
+// validate checks that the configured compression encoding is supported and the threshold is not negative.
+func (settings *CompressionSettings) validate() error {
+	switch strings.ToLower(settings.ContentEncoding()) {
+	case encodingGzip, encodingDeflate:
+	default:
+		return errors.Errorf("unsupported compression '%s'", settings.Encoding)
+	}
+	if settings.MinSize() < 0 {
+		return errors.New("negative compression threshold")
+	}
+	return nil
+}
+
+// MinSize returns the minimum size in bytes of the compressed payloads.
+func (settings *CompressionSettings) MinSize() int {
+	if settings.Threshold == nil {
+		return DefaultCompressionThreshold
+	}
+	return *settings.Threshold
+}
+
+// SchemaSettings configures the JSON Schema validation of the payloads, diverting the invalid messages to a local dead-letter topic.
+type SchemaSettings struct {
+	// File is the path of the JSON Schema file.
+	File string `json:"file"`
+	// DeadLetter is the local MQTT topic of the invalid messages, DefaultDeadLetterTopic if not set.
+	DeadLetter string `json:"deadLetter"`
+}
+
+// DefaultDeadLetterTopic is the local MQTT topic of the messages failing the schema validation or their telemetry route, if not configured.
+const DefaultDeadLetterTopic = "azure/deadletter"
+
+// DeadLetterTopic returns the local MQTT topic of the invalid messages.
+func (settings *SchemaSettings) DeadLetterTopic() string {
+	if len(settings.DeadLetter) == 0 {
+		return DefaultDeadLetterTopic
+	}
+	return settings.DeadLetter
+}
+
+// validate checks that the schema file contains a JSON document and the dead-letter topic has no wildcards.
+// The schema itself is compiled and validated on the telemetry bus setup.
+func (settings *SchemaSettings) validate() error {
+	data, err := ioutil.ReadFile(settings.File)
+	if err != nil {
+		return errors.Wrapf(err, "cannot read JSON schema '%s'", settings.File)
+	}
+	if !json.Valid(data) {
+		return errors.Errorf("invalid JSON schema '%s'", settings.File)
+	}
+	if err := validateTopic(settings.DeadLetterTopic()); err != nil {
+		return errors.Errorf("invalid dead-letter topic '%s'", settings.DeadLetter)
+	}
+	return nil
+}
+
+// CommandRoute maps the C2D messages with the given properties to a local topic.
+// The topic is a template, where {deviceId} is replaced with the device ID and {name} with the value of the C2D message property name.
+type CommandRoute struct {
+	// Properties are matched against the C2D message properties, where '*' matches any present value.
+	Properties map[string]string `json:"properties"`
+	// Topic is the local MQTT topic template.
+	Topic string `json:"topic"`
+}
+
+// Validate validates the routes settings.
+func (settings *RoutesSettings) Validate() error {
+	for _, route := range settings.Telemetry {
+		if err := validateTopicFilter(route.Topic); err != nil {
+			return errors.Wrap(err, "invalid telemetry route")
+		}
+		if len(route.Reported) > 0 && (len(route.Properties) > 0 || len(route.Output) > 0 || route.Compression != nil) {
+			return errors.Errorf("invalid telemetry route '%s': reported path cannot be combined with properties, output or compression", route.Topic)
+		}
+		if len(route.Reported) == 0 && len(route.Properties) == 0 && len(route.Output) == 0 && route.Compression == nil && route.Schema == nil {
+			return errors.Errorf("invalid telemetry route '%s': no destination", route.Topic)
+		}
+		if route.Schema != nil {
+			if err := route.Schema.validate(); err != nil {
+				return errors.Wrapf(err, "invalid telemetry route '%s'", route.Topic)
+			}
+		}
+		if route.Compression != nil {
+			if err := route.Compression.validate(); err != nil {
+				return errors.Wrapf(err, "invalid telemetry route '%s'", route.Topic)
+			}
+		}
+	}
+	for _, route := range settings.Command {
+		if len(route.Topic) == 0 {
+			return errors.New("invalid command route: topic is missing")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/eclipse-kanto/suite-connector/config"
+)
+
+func TestRoutesConfig(t *testing.T) {
+	settings := DefaultSettings()
+	require.NoError(t, config.ReadConfig("testdata/routes.json", settings))
+	require.NoError(t, settings.Routes.Validate())
+
+	require.Len(t, settings.Routes.Telemetry, 4)
+	assert.Equal(t, TelemetryRoute{
+		Topic:      "event/+/alarm/#",
+		Properties: map[string]string{"room": "{1}"},
+		Output:     "alarms",
+	}, settings.Routes.Telemetry[0])
+	compression := settings.Routes.Telemetry[1].Compression
+	require.NotNil(t, compression)
+	assert.Equal(t, "deflate", compression.ContentEncoding())
+	assert.Equal(t, 512, compression.MinSize())
+	assert.Equal(t, "sensors.{1}", settings.Routes.Telemetry[2].Reported)
+	assert.Equal(t, &SchemaSettings{
+		File:       "testdata/telemetry-schema.json",
+		DeadLetter: "deadletter/telemetry",
+	}, settings.Routes.Telemetry[3].Schema)
+	assert.Equal(t, "deadletter/telemetry", settings.Routes.Telemetry[3].Schema.DeadLetterTopic())
+
+	require.Len(t, settings.Routes.Command, 1)
+	assert.Equal(t, CommandRoute{
+		Properties: map[string]string{"subject": "*"},
+		Topic:      "command/{deviceId}/{subject}",
+	}, settings.Routes.Command[0])
+}
+
+func TestRoutesConfigInvalid(t *testing.T) {
+	negative := -1
+	invalid := []RoutesSettings{
+		{Telemetry: []TelemetryRoute{{Output: "out"}}},
+		{Telemetry: []TelemetryRoute{{Topic: "event/#/x", Output: "out"}}},
+		{Telemetry: []TelemetryRoute{{Topic: "event/#"}}},
+		{Telemetry: []TelemetryRoute{{Topic: "event/#", Reported: "a.b", Output: "out"}}},
+		{Telemetry: []TelemetryRoute{{Topic: "event/#", Reported: "a.b", Compression: &CompressionSettings{}}}},
+		{Telemetry: []TelemetryRoute{{Topic: "event/#", Compression: &CompressionSettings{Encoding: "br"}}}},
+		{Telemetry: []TelemetryRoute{{Topic: "event/#", Compression: &CompressionSettings{Threshold: &negative}}}},
+		{Telemetry: []TelemetryRoute{{Topic: "event/#", Schema: &SchemaSettings{File: "testdata/missing.json"}}}},
+		{Telemetry: []TelemetryRoute{{Topic: "event/#", Schema: &SchemaSettings{File: "testdata/certificate.pem"}}}},
+		{Telemetry: []TelemetryRoute{{Topic: "event/#", Schema: &SchemaSettings{File: "testdata/telemetry-schema.json", DeadLetter: "dead/#"}}}},
+		{Command: []CommandRoute{{Properties: map[string]string{"subject": "*"}}}},
+	}
+	for _, routes := range invalid {
+		settings := DefaultSettings()
+		settings.CACert = ""
+		settings.Routes = routes
+		assert.Error(t, settings.Validate())
+	}
+}
+
+func TestCompressionSettingsDefaults(t *testing.T) {
+	compression := &CompressionSettings{}
+	assert.Equal(t, "gzip", compression.ContentEncoding())
+	assert.Equal(t, DefaultCompressionThreshold, compression.MinSize())
+
+	routes := RoutesSettings{Telemetry: []TelemetryRoute{{Topic: "event/#", Compression: compression}}}
+	assert.NoError(t, routes.Validate())
+}
+
+func TestSchemaSettingsDefaults(t *testing.T) {
+	settings := &SchemaSettings{File: "testdata/telemetry-schema.json"}
+	assert.Equal(t, DefaultDeadLetterTopic, settings.DeadLetterTopic())
+
+	routes := RoutesSettings{Telemetry: []TelemetryRoute{{Topic: "event/#", Schema: settings}}}
+	assert.NoError(t, routes.Validate())
+}
@@ -0,0 +1,133 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package config
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// RuleActionAlert sends a device-to-cloud alert message.
+	RuleActionAlert = "alert"
+	// RuleActionLocal publishes a message on a local topic, e.g. a Hono command or event.
+	RuleActionLocal = "local"
+	// RuleActionReported updates a device twin reported property.
+	RuleActionReported = "reported"
+)
+
+// Rule triggers actions when a condition over a numeric value of the telemetry messages received on the matching local topics is met.
+// The actions are performed once when the condition is met and, if enabled, once when it is no longer met.
+type Rule struct {
+	// Name identifies the rule in the produced messages.
+	Name string `json:"name"`
+	// Topic is the local MQTT topic filter.
+	Topic string `json:"topic"`
+	// Condition is the condition over a value of the JSON payloads.
+	Condition RuleCondition `json:"condition"`
+	// Actions are the actions performed in the configuration order.
+	Actions []RuleAction `json:"actions"`
+}
+
+// RuleCondition compares a numeric value, or its rate of change per second, with a constant.
+type RuleCondition struct {
+	// Path is the dot separated path of the numeric value in the JSON payload, the payload itself is the value if not set.
+	Path string `json:"path"`
+	// Operator is one of '>', '>=', '<', '<=', '==' and '!='.
+	Operator string `json:"operator"`
+	// Value is the compared constant.
+	Value float64 `json:"value"`
+	// Rate compares the rate of change per second between the consecutive values on a local topic instead of the value.
+	Rate bool `json:"rate"`
+	// For is the duration, for which the condition has to hold on a local topic, met right away if not set.
+	For string `json:"for"`
+}
+
+// RuleAction is an action of a rule. The properties, the topic and the path are templates, where {rule} is replaced with the rule name,
+// {topic} with the local topic, {value} with the value and {deviceId} with the device ID.
+type RuleAction struct {
+	// Type is one of alert, local and reported.
+	Type string `json:"type"`
+	// Properties are the device-to-cloud message properties of an alert, e.g. matched by a priority class.
+	Properties map[string]string `json:"properties"`
+	// Topic is the local MQTT topic of a local action.
+	Topic string `json:"topic"`
+	// Path is the dot separated path of the reported property of a reported action.
+	Path string `json:"path"`
+	// Clear performs the action also when the condition is no longer met.
+	Clear bool `json:"clear"`
+}
+
+// Duration returns the parsed duration of the condition, 0 if not configured.
+func (condition *RuleCondition) Duration() (time.Duration, error) {
+	if len(condition.For) == 0 {
+		return 0, nil
+	}
+	duration, err := time.ParseDuration(condition.For)
+	if err != nil || duration < 0 {
+		return 0, errors.Errorf("invalid condition duration '%s'", condition.For)
+	}
+	return duration, nil
+}
+
+func validateRules(rules []Rule) error {
+	names := map[string]bool{}
+	for _, rule := range rules {
+		if len(rule.Name) == 0 {
+			return errors.New("rule name is missing")
+		}
+		if names[rule.Name] {
+			return errors.Errorf("duplicate rule '%s'", rule.Name)
+		}
+		names[rule.Name] = true
+
+		if err := rule.validate(); err != nil {
+			return errors.Wrapf(err, "invalid rule '%s'", rule.Name)
+		}
+	}
+	return nil
+}
+
+func (rule *Rule) validate() error {
+	if err := validateTopicFilter(rule.Topic); err != nil {
+		return err
+	}
+	switch rule.Condition.Operator {
+	case ">", ">=", "<", "<=", "==", "!=":
+	default:
+		return errors.Errorf("unsupported operator '%s'", rule.Condition.Operator)
+	}
+	if _, err := rule.Condition.Duration(); err != nil {
+		return err
+	}
+	if len(rule.Actions) == 0 {
+		return errors.New("no actions")
+	}
+	for _, action := range rule.Actions {
+		switch action.Type {
+		case RuleActionAlert:
+		case RuleActionLocal:
+			if len(action.Topic) == 0 {
+				return errors.New("local action topic is missing")
+			}
+		case RuleActionReported:
+			if len(action.Path) == 0 {
+				return errors.New("reported action path is missing")
+			}
+		default:
+			return errors.Errorf("unsupported action '%s'", action.Type)
+		}
+	}
+	return nil
+}
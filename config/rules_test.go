@@ -0,0 +1,72 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/eclipse-kanto/suite-connector/config"
+)
+
+func TestRulesConfig(t *testing.T) {
+	settings := DefaultSettings()
+	require.NoError(t, config.ReadConfig("testdata/rules.json", settings))
+	require.NoError(t, validateRules(settings.Rules))
+
+	require.Len(t, settings.Rules, 2)
+	overheating := settings.Rules[0]
+	assert.Equal(t, "overheating", overheating.Name)
+	assert.Equal(t, RuleCondition{Path: "value", Operator: ">", Value: 80, For: "30s"}, overheating.Condition)
+	duration, err := overheating.Condition.Duration()
+	require.NoError(t, err)
+	assert.Equal(t, 30*time.Second, duration)
+	assert.Equal(t, []RuleAction{
+		{Type: RuleActionAlert, Properties: map[string]string{"alert": "{rule}", "source": "{topic}"}},
+		{Type: RuleActionReported, Path: "alerts.{rule}", Clear: true},
+	}, overheating.Actions)
+
+	pressureDrop := settings.Rules[1]
+	assert.True(t, pressureDrop.Condition.Rate)
+	assert.Equal(t, -5.0, pressureDrop.Condition.Value)
+	duration, err = pressureDrop.Condition.Duration()
+	require.NoError(t, err)
+	assert.Zero(t, duration)
+	assert.Equal(t, []RuleAction{{Type: RuleActionLocal, Topic: "event/{deviceId}"}}, pressureDrop.Actions)
+}
+
+func TestRulesConfigInvalid(t *testing.T) {
+	alert := []RuleAction{{Type: RuleActionAlert}}
+	condition := RuleCondition{Operator: ">"}
+	invalid := [][]Rule{
+		{{Topic: "sensors/#", Condition: condition, Actions: alert}},
+		{{Name: "rule", Topic: "sensors/#/x", Condition: condition, Actions: alert}},
+		{{Name: "rule", Topic: "sensors/#", Condition: RuleCondition{Operator: "=>"}, Actions: alert}},
+		{{Name: "rule", Topic: "sensors/#", Condition: RuleCondition{Operator: ">", For: "long"}, Actions: alert}},
+		{{Name: "rule", Topic: "sensors/#", Condition: RuleCondition{Operator: ">", For: "-1s"}, Actions: alert}},
+		{{Name: "rule", Topic: "sensors/#", Condition: condition}},
+		{{Name: "rule", Topic: "sensors/#", Condition: condition, Actions: []RuleAction{{Type: "email"}}}},
+		{{Name: "rule", Topic: "sensors/#", Condition: condition, Actions: []RuleAction{{Type: RuleActionLocal}}}},
+		{{Name: "rule", Topic: "sensors/#", Condition: condition, Actions: []RuleAction{{Type: RuleActionReported}}}},
+		{
+			{Name: "rule", Topic: "sensors/#", Condition: condition, Actions: alert},
+			{Name: "rule", Topic: "other/#", Condition: condition, Actions: alert},
+		},
+	}
+	for _, rules := range invalid {
+		assert.Error(t, validateRules(rules), rules)
+	}
+}
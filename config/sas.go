@@ -48,6 +48,11 @@ func GenerateSASToken(connSettings *AzureConnectionSettings) *SharedAccessSignat
 		Now().Add(connSettings.TokenValidity))
 }
 
+// String returns the SAS token for the MQTT password and the HTTP Authorization header.
+func (sas *SharedAccessSignature) String() string {
+	return sasTokenToString(sas)
+}
+
 func sasTokenToString(sas *SharedAccessSignature) string {
 	return "SharedAccessSignature " +
 		"sr=" + url.QueryEscape(sas.Sr) +
@@ -27,6 +27,32 @@ type AzureSettings struct {
 	SASTokenValidity string `json:"sasTokenValidity"`
 	IDScope          string `json:"idScope"`
 
+	ProvisioningTransport string `json:"provisioningTransport"`
+
+	HealthAddress  string `json:"healthAddress"`
+	MetricsAddress string `json:"metricsAddress"`
+
+	TracingEndpoint string `json:"tracingEndpoint"`
+
+	MessageSizePolicy string `json:"messageSizePolicy"`
+	MaxMessageSize    int    `json:"maxMessageSize"`
+
+	MessageIDSource string `json:"messageIdSource"`
+	DedupWindow     int    `json:"dedupWindow"`
+
+	InboxDir         string `json:"inboxDir"`
+	InboxMaxMessages int    `json:"inboxMaxMessages"`
+
+	Handlers         HandlersSettings   `json:"handlers"`
+	Routes           RoutesSettings     `json:"routes"`
+	TelemetryFilters []TelemetryFilter  `json:"telemetryFilters"`
+	Priorities       []PriorityClass    `json:"priorities"`
+	Rules            []Rule             `json:"rules"`
+	FileUpload       FileUploadSettings `json:"fileUpload"`
+
+	CommandDeadLetter CommandDeadLetterSettings `json:"commandDeadLetter"`
+	ResponseTimeout   string                    `json:"commandResponseTimeout"`
+
 	config.LocalConnectionSettings
 	logger.LogSettings
 	config.TLSSettings
@@ -38,6 +64,12 @@ func DefaultSettings() *AzureSettings {
 	defAzureSettings := &AzureSettings{
 		TenantID:                "defaultTenant",
 		SASTokenValidity:        "1h",
+		ProvisioningTransport:   ProvisioningTransportHTTPS,
+		MessageSizePolicy:       MessageSizeReject,
+		MaxMessageSize:          MaxMessageSize,
+		MessageIDSource:         MessageIDRandom,
+		DedupWindow:             DefaultDedupWindow,
+		InboxMaxMessages:        DefaultInboxMaxMessages,
 		LocalConnectionSettings: def.LocalConnectionSettings,
 		TLSSettings: config.TLSSettings{
 			CACert: def.CACert,
@@ -59,6 +91,56 @@ func (settings *AzureSettings) Validate() error {
 		return err
 	}
 
+	switch settings.ProvisioningTransport {
+	case "", ProvisioningTransportHTTPS, ProvisioningTransportMQTT:
+	default:
+		return errors.Errorf("unsupported provisioning transport '%s'", settings.ProvisioningTransport)
+	}
+
+	if err := validateMessageSize(settings.MessageSizePolicy, settings.MaxMessageSize); err != nil {
+		return err
+	}
+
+	if err := validateMessageIDs(settings.MessageIDSource, settings.DedupWindow); err != nil {
+		return err
+	}
+
+	if err := validateInbox(settings.InboxMaxMessages); err != nil {
+		return err
+	}
+
+	if err := settings.Handlers.Validate(); err != nil {
+		return err
+	}
+
+	if err := settings.Routes.Validate(); err != nil {
+		return err
+	}
+
+	if err := validateTelemetryFilters(settings.TelemetryFilters); err != nil {
+		return err
+	}
+
+	if err := validatePriorities(settings.Priorities); err != nil {
+		return err
+	}
+
+	if err := validateRules(settings.Rules); err != nil {
+		return err
+	}
+
+	if err := settings.FileUpload.Validate(); err != nil {
+		return err
+	}
+
+	if err := settings.CommandDeadLetter.Validate(); err != nil {
+		return err
+	}
+
+	if _, err := settings.CommandResponseTimeout(); err != nil {
+		return err
+	}
+
 	if len(settings.CACert) > 0 && !util.FileExists(settings.CACert) {
 		return errors.New("failed to read CA certificates file")
 	}
@@ -16,6 +16,7 @@ import (
 	"io/ioutil"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/eclipse-kanto/suite-connector/config"
 	"github.com/eclipse-kanto/suite-connector/logger"
@@ -54,6 +55,96 @@ func TestConfigInvalid(t *testing.T) {
 	settings.LogFileCount = 1
 	settings.LocalAddress = ""
 	assert.Error(t, settings.Validate())
+
+	settings = DefaultSettings()
+	settings.CACert = ""
+	settings.ProvisioningTransport = "amqp"
+	assert.Error(t, settings.Validate())
+
+	settings = DefaultSettings()
+	settings.CACert = ""
+	settings.MessageSizePolicy = "truncate"
+	assert.Error(t, settings.Validate())
+
+	for _, maxSize := range []int{-1, MaxMessageSize + 1} {
+		settings = DefaultSettings()
+		settings.CACert = ""
+		settings.MaxMessageSize = maxSize
+		assert.Error(t, settings.Validate())
+	}
+
+	settings = DefaultSettings()
+	settings.CACert = ""
+	settings.InboxMaxMessages = -1
+	assert.Error(t, settings.Validate())
+
+	settings = DefaultSettings()
+	settings.CACert = ""
+	settings.MessageIDSource = "sequence"
+	assert.Error(t, settings.Validate())
+
+	settings = DefaultSettings()
+	settings.CACert = ""
+	settings.DedupWindow = -1
+	assert.Error(t, settings.Validate())
+
+	for _, timeout := range []string{"soon", "0s", "-1m"} {
+		settings = DefaultSettings()
+		settings.CACert = ""
+		settings.ResponseTimeout = timeout
+		assert.Error(t, settings.Validate())
+	}
+
+	negative := -1
+	for _, fileUpload := range []FileUploadSettings{
+		{Enabled: true, Dirs: []string{"logs"}},
+		{Enabled: true, BlockSize: 1024},
+		{Enabled: true, BlockSize: MaxUploadBlockSize + 1},
+		{Enabled: true, Retries: &negative},
+	} {
+		settings = DefaultSettings()
+		settings.CACert = ""
+		settings.FileUpload = fileUpload
+		assert.Error(t, settings.Validate())
+	}
+
+	for _, deadLetter := range []CommandDeadLetterSettings{
+		{Topic: "dead/#"},
+		{Topic: "dead/+/letter"},
+		{Retries: -1},
+		{Retries: 3, RetryInterval: "soon"},
+		{Retries: 3, RetryInterval: "0s"},
+	} {
+		settings = DefaultSettings()
+		settings.CACert = ""
+		settings.CommandDeadLetter = deadLetter
+		assert.Error(t, settings.Validate())
+	}
+}
+
+func TestCommandDeadLetterSettings(t *testing.T) {
+	settings := &CommandDeadLetterSettings{}
+	assert.NoError(t, settings.Validate())
+	assert.False(t, settings.Enabled())
+	interval, err := settings.InitialRetryInterval()
+	require.NoError(t, err)
+	assert.Equal(t, DefaultCommandRetryInterval, interval)
+
+	settings = &CommandDeadLetterSettings{Topic: "command/deadletter", Retries: 3, RetryInterval: "1s"}
+	assert.NoError(t, settings.Validate())
+	assert.True(t, settings.Enabled())
+	interval, err = settings.InitialRetryInterval()
+	require.NoError(t, err)
+	assert.Equal(t, time.Second, interval)
+
+	assert.True(t, (&CommandDeadLetterSettings{Report: true}).Enabled())
+}
+
+func TestFileUploadSettings(t *testing.T) {
+	retries := 0
+	settings := &FileUploadSettings{Enabled: true, Dirs: []string{"/var/log"}, BlockSize: MinUploadBlockSize, Retries: &retries}
+	assert.NoError(t, settings.Validate())
+	assert.NoError(t, (&FileUploadSettings{}).Validate())
 }
 
 func TestConfig(t *testing.T) {
@@ -81,6 +172,19 @@ func TestDefaults(t *testing.T) {
 	assert.Empty(t, settings.ConnectionString)
 	assert.Equal(t, "1h", settings.SASTokenValidity)
 	assert.Empty(t, settings.IDScope)
+	assert.Equal(t, "https", settings.ProvisioningTransport)
+	assert.Empty(t, settings.HealthAddress)
+	assert.Empty(t, settings.MetricsAddress)
+	assert.Empty(t, settings.TracingEndpoint)
+	assert.Equal(t, "reject", settings.MessageSizePolicy)
+	assert.Equal(t, 256*1024, settings.MaxMessageSize)
+	assert.Equal(t, "random", settings.MessageIDSource)
+	assert.Equal(t, 1000, settings.DedupWindow)
+	assert.Empty(t, settings.InboxDir)
+	assert.Equal(t, 1000, settings.InboxMaxMessages)
+	assert.Equal(t, FileUploadSettings{}, settings.FileUpload)
+	assert.Equal(t, CommandDeadLetterSettings{}, settings.CommandDeadLetter)
+	assert.Empty(t, settings.ResponseTimeout)
 
 	defConnectorSettings := config.DefaultSettings()
 	assert.Equal(t, defConnectorSettings.LocalConnectionSettings, settings.LocalConnectionSettings)
@@ -0,0 +1,53 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package config
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	wildcardSingle = "+"
+	wildcardMulti  = "#"
+)
+
+// validateTopicFilter checks that the MQTT topic filter is not empty and uses the wildcards correctly.
+func validateTopicFilter(filter string) error {
+	if len(filter) == 0 {
+		return errors.New("empty topic filter")
+	}
+
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if strings.Contains(level, wildcardMulti) && (level != wildcardMulti || i != len(levels)-1) {
+			return errors.Errorf("invalid multi-level wildcard in topic filter '%s'", filter)
+		}
+		if strings.Contains(level, wildcardSingle) && level != wildcardSingle {
+			return errors.Errorf("invalid single-level wildcard in topic filter '%s'", filter)
+		}
+	}
+	return nil
+}
+
+// validateTopic checks that the MQTT topic is not empty and contains no wildcards.
+func validateTopic(topic string) error {
+	if len(topic) == 0 {
+		return errors.New("empty topic")
+	}
+	if strings.ContainsAny(topic, wildcardSingle+wildcardMulti) {
+		return errors.Errorf("wildcards in topic '%s'", topic)
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateTopicFilter(t *testing.T) {
+	for _, filter := range []string{"event", "event/#", "#", "+", "event/+/alarm/#", "+/+"} {
+		assert.NoError(t, validateTopicFilter(filter), filter)
+	}
+	for _, filter := range []string{"", "event/#/alarm", "event#", "event/a+", "+a/b"} {
+		assert.Error(t, validateTopicFilter(filter), filter)
+	}
+}
+
+func TestValidateTopic(t *testing.T) {
+	assert.NoError(t, validateTopic("azure/deadletter"))
+	for _, topic := range []string{"", "dead/#", "dead/+/letter"} {
+		assert.Error(t, validateTopic(topic), topic)
+	}
+}
@@ -0,0 +1,368 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package fileupload
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/pkg/errors"
+
+	"github.com/eclipse-kanto/suite-connector/config"
+
+	azurecfg "github.com/eclipse-kanto/azure-connector/config"
+)
+
+const (
+	apiVersion = "2021-04-12"
+
+	headerAuthorization   = "Authorization"
+	headerContentType     = "Content-Type"
+	headerBlobType        = "x-ms-blob-type"
+	headerBlobContentType = "x-ms-blob-content-type"
+
+	contentTypeJSON = "application/json"
+	contentTypeXML  = "application/xml"
+	blobTypeBlock   = "BlockBlob"
+
+	// DefaultBlockSize is the size of the blocks of the chunked uploads, if not configured.
+	DefaultBlockSize = 4 * 1024 * 1024
+	// DefaultRetries is the number of retries of a failed blob storage request, if not configured.
+	DefaultRetries = 3
+
+	defaultRetryDelay = time.Second
+)
+
+// Uploader uploads data to the storage account linked to the Azure IoT Hub.
+type Uploader interface {
+	Upload(ctx context.Context, blobName string, data []byte, contentType string) (*Result, error)
+	UploadReader(ctx context.Context, blobName string, reader io.Reader, contentType string, progress Progress) (*Result, error)
+}
+
+// Progress is notified with the number of bytes uploaded so far.
+type Progress func(uploaded int64)
+
+// Result describes an uploaded blob.
+type Result struct {
+	HostName      string `json:"hostName"`
+	ContainerName string `json:"containerName"`
+	BlobName      string `json:"blobName"`
+	Size          int64  `json:"size"`
+}
+
+// URL returns the blob URL, without any access token.
+func (r *Result) URL() string {
+	return fmt.Sprintf("https://%s/%s/%s", r.HostName, r.ContainerName, r.BlobName)
+}
+
+// Client performs the Azure IoT Hub file upload flow: requesting a blob SAS URI, uploading the blob
+// and notifying the hub about the upload completion.
+type Client struct {
+	// HubURL is the base URL of the Azure IoT Hub HTTPS endpoint.
+	HubURL string
+	// DeviceID is the ID of the uploading device.
+	DeviceID string
+	// HubClient is the HTTP client for the Azure IoT Hub requests, authenticating with the device certificate if configured.
+	HubClient *http.Client
+	// BlobClient is the HTTP client for the blob storage requests.
+	BlobClient *http.Client
+	// Authorization returns the Authorization header of the Azure IoT Hub requests, nil for certificate authentication.
+	Authorization func() string
+	// BlockSize is the size of the blocks of the chunked uploads, the data fitting in a single block is uploaded at once.
+	// DefaultBlockSize is used if not set.
+	BlockSize int
+	// Retries is the number of retries of a blob storage request failing with a network or server error.
+	Retries int
+	// RetryDelay is the delay before the first retry, doubled on each next one. It defaults to a second.
+	RetryDelay time.Duration
+}
+
+// NewClient creates a file upload client using the Azure IoT Hub connection settings and device credentials.
+func NewClient(settings *azurecfg.AzureSettings, connSettings *azurecfg.AzureConnectionSettings, logger watermill.LoggerAdapter) (*Client, error) {
+	tlsConfig, _, err := config.NewHubTLSConfig(&settings.TLSSettings, logger)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create TLS configuration")
+	}
+
+	client := &Client{
+		HubURL:     "https://" + connSettings.HostName,
+		DeviceID:   connSettings.DeviceID,
+		HubClient:  &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}},
+		BlobClient: &http.Client{},
+		BlockSize:  settings.FileUpload.BlockSize,
+		Retries:    DefaultRetries,
+	}
+	if settings.FileUpload.Retries != nil {
+		client.Retries = *settings.FileUpload.Retries
+	}
+	if connSettings.SharedAccessKey != nil {
+		client.Authorization = func() string {
+			return azurecfg.GenerateSASToken(connSettings).String()
+		}
+	}
+	return client, nil
+}
+
+type sasRequest struct {
+	BlobName string `json:"blobName"`
+}
+
+type sasResponse struct {
+	CorrelationID string `json:"correlationId"`
+	HostName      string `json:"hostName"`
+	ContainerName string `json:"containerName"`
+	BlobName      string `json:"blobName"`
+	SASToken      string `json:"sasToken"`
+}
+
+type notification struct {
+	CorrelationID     string `json:"correlationId"`
+	IsSuccess         bool   `json:"isSuccess"`
+	StatusCode        int    `json:"statusCode"`
+	StatusDescription string `json:"statusDescription"`
+}
+
+// Upload uploads the data as a blob with the given name, which is prefixed with the device ID by the Azure IoT Hub.
+// The hub is notified about the upload result, also if the upload fails.
+func (c *Client) Upload(ctx context.Context, blobName string, data []byte, contentType string) (*Result, error) {
+	return c.UploadReader(ctx, blobName, bytes.NewReader(data), contentType, nil)
+}
+
+// UploadReader uploads the data read from the reader as a blob with the given name, like Upload.
+// Data larger than the block size is uploaded in blocks, notifying the progress after each block.
+func (c *Client) UploadReader(ctx context.Context, blobName string, reader io.Reader, contentType string, progress Progress) (*Result, error) {
+	sas, err := c.requestSAS(ctx, blobName)
+	if err != nil {
+		return nil, err
+	}
+
+	size, status, uploadErr := c.putBlob(ctx, sas, reader, contentType, progress)
+	result := notification{CorrelationID: sas.CorrelationID, IsSuccess: uploadErr == nil, StatusCode: status}
+	if uploadErr != nil {
+		result.StatusDescription = uploadErr.Error()
+	}
+	if err := c.notify(ctx, &result); err != nil {
+		if uploadErr != nil {
+			return nil, uploadErr
+		}
+		return nil, err
+	}
+	if uploadErr != nil {
+		return nil, uploadErr
+	}
+
+	return &Result{
+		HostName:      sas.HostName,
+		ContainerName: sas.ContainerName,
+		BlobName:      sas.BlobName,
+		Size:          size,
+	}, nil
+}
+
+func (c *Client) requestSAS(ctx context.Context, blobName string) (*sasResponse, error) {
+	body, err := json.Marshal(&sasRequest{BlobName: blobName})
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot encode blob SAS URI request")
+	}
+
+	res, err := c.doHub(ctx, "files", body)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot request blob SAS URI")
+	}
+	defer res.Body.Close()
+
+	if err := checkStatus(res, http.StatusOK); err != nil {
+		return nil, errors.Wrap(err, "cannot request blob SAS URI")
+	}
+
+	sas := &sasResponse{}
+	if err := json.NewDecoder(res.Body).Decode(sas); err != nil {
+		return nil, errors.Wrap(err, "invalid blob SAS URI response")
+	}
+	return sas, nil
+}
+
+type blockList struct {
+	XMLName xml.Name `xml:"BlockList"`
+	Latest  []string `xml:"Latest"`
+}
+
+// putBlob uploads the blob at once if the data fits in a single block, otherwise block by block, committing the block list at the end.
+// It returns the uploaded size and the status code of the last blob storage request.
+func (c *Client) putBlob(ctx context.Context, sas *sasResponse, reader io.Reader, contentType string, progress Progress) (int64, int, error) {
+	blobURL := fmt.Sprintf("https://%s/%s/%s%s", sas.HostName, sas.ContainerName, sas.BlobName, sas.SASToken)
+	blockSize := c.BlockSize
+	if blockSize <= 0 {
+		blockSize = DefaultBlockSize
+	}
+
+	block, err := readBlock(reader, blockSize)
+	if err != nil {
+		return 0, http.StatusBadRequest, err
+	}
+	next, err := readBlock(reader, blockSize)
+	if err != nil {
+		return 0, http.StatusBadRequest, err
+	}
+
+	if len(next) == 0 {
+		header := http.Header{}
+		header.Set(headerBlobType, blobTypeBlock)
+		if len(contentType) > 0 {
+			header.Set(headerContentType, contentType)
+		}
+		status, err := c.put(ctx, blobURL, block, header)
+		if err != nil {
+			return 0, status, errors.Wrap(err, "cannot upload blob")
+		}
+		reportProgress(progress, int64(len(block)))
+		return int64(len(block)), status, nil
+	}
+
+	var uploaded int64
+	blocks := &blockList{}
+	for len(block) > 0 {
+		blockID := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("block-%08d", len(blocks.Latest))))
+		status, err := c.put(ctx, blobURL+"&comp=block&blockid="+url.QueryEscape(blockID), block, http.Header{})
+		if err != nil {
+			return uploaded, status, errors.Wrapf(err, "cannot upload block %d", len(blocks.Latest))
+		}
+		blocks.Latest = append(blocks.Latest, blockID)
+		uploaded += int64(len(block))
+		reportProgress(progress, uploaded)
+
+		block = next
+		if next, err = readBlock(reader, blockSize); err != nil {
+			return uploaded, http.StatusBadRequest, err
+		}
+	}
+
+	body, err := xml.Marshal(blocks)
+	if err != nil {
+		return uploaded, http.StatusBadRequest, errors.Wrap(err, "cannot encode block list")
+	}
+	header := http.Header{}
+	header.Set(headerContentType, contentTypeXML)
+	if len(contentType) > 0 {
+		header.Set(headerBlobContentType, contentType)
+	}
+	status, err := c.put(ctx, blobURL+"&comp=blocklist", append([]byte(xml.Header), body...), header)
+	if err != nil {
+		return uploaded, status, errors.Wrap(err, "cannot commit block list")
+	}
+	return uploaded, status, nil
+}
+
+// put sends the blob storage PUT request, retrying it on network and server errors.
+func (c *Client) put(ctx context.Context, target string, body []byte, header http.Header) (int, error) {
+	delay := c.RetryDelay
+	if delay <= 0 {
+		delay = defaultRetryDelay
+	}
+
+	for attempt := 0; ; attempt++ {
+		status, err := c.putOnce(ctx, target, body, header)
+		if err == nil || attempt >= c.Retries || !retryable(status) {
+			return status, err
+		}
+
+		select {
+		case <-time.After(delay):
+			delay *= 2
+		case <-ctx.Done():
+			return status, err
+		}
+	}
+}
+
+func (c *Client) putOnce(ctx context.Context, target string, body []byte, header http.Header) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, target, bytes.NewReader(body))
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	res, err := c.BlobClient.Do(req)
+	if err != nil {
+		return http.StatusServiceUnavailable, err
+	}
+	defer res.Body.Close()
+
+	return res.StatusCode, checkStatus(res, http.StatusCreated)
+}
+
+func retryable(status int) bool {
+	return status >= http.StatusInternalServerError || status == http.StatusRequestTimeout || status == http.StatusTooManyRequests
+}
+
+func readBlock(reader io.Reader, size int) ([]byte, error) {
+	block, err := ioutil.ReadAll(io.LimitReader(reader, int64(size)))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read upload data")
+	}
+	return block, nil
+}
+
+func reportProgress(progress Progress, uploaded int64) {
+	if progress != nil {
+		progress(uploaded)
+	}
+}
+
+func (c *Client) notify(ctx context.Context, result *notification) error {
+	body, err := json.Marshal(result)
+	if err != nil {
+		return errors.Wrap(err, "cannot encode file upload notification")
+	}
+
+	res, err := c.doHub(ctx, "files/notifications", body)
+	if err != nil {
+		return errors.Wrap(err, "cannot send file upload notification")
+	}
+	defer res.Body.Close()
+
+	return errors.Wrap(checkStatus(res, http.StatusNoContent), "cannot send file upload notification")
+}
+
+func (c *Client) doHub(ctx context.Context, path string, body []byte) (*http.Response, error) {
+	hubURL := fmt.Sprintf("%s/devices/%s/%s?api-version=%s", c.HubURL, url.PathEscape(c.DeviceID), path, apiVersion)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hubURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(headerContentType, contentTypeJSON)
+	if c.Authorization != nil {
+		req.Header.Set(headerAuthorization, c.Authorization())
+	}
+	return c.HubClient.Do(req)
+}
+
+func checkStatus(res *http.Response, expected int) error {
+	if res.StatusCode == expected {
+		return nil
+	}
+	body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+	return errors.Errorf("expected status code %d, but got %d: %s", expected, res.StatusCode, string(body))
+}
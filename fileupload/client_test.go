@@ -0,0 +1,264 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package fileupload_test
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+
+	"github.com/eclipse-kanto/azure-connector/config"
+	"github.com/eclipse-kanto/azure-connector/fileupload"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testDeviceID  = "upload-device"
+	testToken     = "SharedAccessSignature sr=test"
+	testContainer = "uploads"
+	testSASToken  = "?sv=2018-03-28&sig=test"
+)
+
+// hubStandIn serves the Azure IoT Hub file upload endpoints and the blob storage PUT requests.
+type hubStandIn struct {
+	server *httptest.Server
+
+	lock          sync.Mutex
+	blobStatus    int
+	failures      int
+	requests      int
+	blobs         map[string][]byte
+	blocks        map[string][]byte
+	contentTypes  map[string]string
+	notifications []map[string]interface{}
+}
+
+func newHubStandIn(t *testing.T) *hubStandIn {
+	hub := &hubStandIn{
+		blobStatus:   http.StatusCreated,
+		blobs:        map[string][]byte{},
+		blocks:       map[string][]byte{},
+		contentTypes: map[string]string{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/devices/"+testDeviceID+"/files", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "2021-04-12", r.URL.Query().Get("api-version"))
+		if r.Header.Get("Authorization") != testToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		request := map[string]string{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+		json.NewEncoder(w).Encode(map[string]string{
+			"correlationId": "correlation-" + request["blobName"],
+			"hostName":      hub.server.Listener.Addr().String(),
+			"containerName": testContainer,
+			"blobName":      testDeviceID + "/" + request["blobName"],
+			"sasToken":      testSASToken,
+		})
+	})
+	mux.HandleFunc("/devices/"+testDeviceID+"/files/notifications", func(w http.ResponseWriter, r *http.Request) {
+		notification := map[string]interface{}{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&notification))
+
+		hub.lock.Lock()
+		hub.notifications = append(hub.notifications, notification)
+		hub.lock.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/"+testContainer+"/", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPut, r.Method)
+		assert.Equal(t, "test", r.URL.Query().Get("sig"))
+
+		data, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		hub.lock.Lock()
+		defer hub.lock.Unlock()
+		hub.requests++
+		if hub.failures > 0 {
+			hub.failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if hub.blobStatus != http.StatusCreated {
+			w.WriteHeader(hub.blobStatus)
+			return
+		}
+		name := strings.TrimPrefix(r.URL.Path, "/"+testContainer+"/")
+		switch r.URL.Query().Get("comp") {
+		case "block":
+			hub.blocks[r.URL.Query().Get("blockid")] = data
+		case "blocklist":
+			list := struct {
+				Latest []string `xml:"Latest"`
+			}{}
+			require.NoError(t, xml.Unmarshal(data, &list))
+			var blob []byte
+			for _, blockID := range list.Latest {
+				blob = append(blob, hub.blocks[blockID]...)
+			}
+			hub.blobs[name] = blob
+			hub.contentTypes[name] = r.Header.Get("x-ms-blob-content-type")
+		default:
+			assert.Equal(t, "BlockBlob", r.Header.Get("x-ms-blob-type"))
+			hub.blobs[name] = data
+			hub.contentTypes[name] = r.Header.Get("Content-Type")
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+
+	hub.server = httptest.NewTLSServer(mux)
+	t.Cleanup(hub.server.Close)
+	return hub
+}
+
+func (hub *hubStandIn) client(token string) *fileupload.Client {
+	return &fileupload.Client{
+		HubURL:     hub.server.URL,
+		DeviceID:   testDeviceID,
+		HubClient:  hub.server.Client(),
+		BlobClient: hub.server.Client(),
+		Authorization: func() string {
+			return token
+		},
+	}
+}
+
+func TestUpload(t *testing.T) {
+	hub := newHubStandIn(t)
+
+	result, err := hub.client(testToken).Upload(context.Background(), "logs/app.log", []byte("log data"), "text/plain")
+	require.NoError(t, err)
+	assert.Equal(t, testContainer, result.ContainerName)
+	assert.Equal(t, testDeviceID+"/logs/app.log", result.BlobName)
+	assert.Equal(t, int64(8), result.Size)
+	assert.Equal(t, "https://"+hub.server.Listener.Addr().String()+"/uploads/upload-device/logs/app.log", result.URL())
+
+	assert.Equal(t, "log data", string(hub.blobs[testDeviceID+"/logs/app.log"]))
+	assert.Equal(t, "text/plain", hub.contentTypes[testDeviceID+"/logs/app.log"])
+	require.Len(t, hub.notifications, 1)
+	assert.Equal(t, "correlation-logs/app.log", hub.notifications[0]["correlationId"])
+	assert.Equal(t, true, hub.notifications[0]["isSuccess"])
+	assert.Equal(t, float64(http.StatusCreated), hub.notifications[0]["statusCode"])
+}
+
+func TestUploadBlocks(t *testing.T) {
+	hub := newHubStandIn(t)
+	client := hub.client(testToken)
+	client.BlockSize = 1000
+
+	data := strings.Repeat("0123456789", 250)
+	var progress []int64
+	result, err := client.UploadReader(context.Background(), "snapshot.txt", strings.NewReader(data), "text/plain", func(uploaded int64) {
+		progress = append(progress, uploaded)
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)), result.Size)
+	assert.Equal(t, []int64{1000, 2000, 2500}, progress)
+
+	assert.Len(t, hub.blocks, 3)
+	assert.Equal(t, data, string(hub.blobs[testDeviceID+"/snapshot.txt"]))
+	assert.Equal(t, "text/plain", hub.contentTypes[testDeviceID+"/snapshot.txt"])
+	require.Len(t, hub.notifications, 1)
+	assert.Equal(t, true, hub.notifications[0]["isSuccess"])
+}
+
+func TestUploadRetries(t *testing.T) {
+	hub := newHubStandIn(t)
+	hub.failures = 2
+	client := hub.client(testToken)
+	client.Retries = 2
+	client.RetryDelay = time.Millisecond
+
+	_, err := client.Upload(context.Background(), "data.bin", []byte{1, 2, 3}, "")
+	require.NoError(t, err)
+	assert.Equal(t, 3, hub.requests)
+	assert.Equal(t, []byte{1, 2, 3}, hub.blobs[testDeviceID+"/data.bin"])
+
+	hub.failures = 3
+	_, err = client.Upload(context.Background(), "data.bin", []byte{1, 2, 3}, "")
+	assert.Error(t, err)
+	require.Len(t, hub.notifications, 2)
+	assert.Equal(t, float64(http.StatusServiceUnavailable), hub.notifications[1]["statusCode"])
+}
+
+func TestUploadBlobError(t *testing.T) {
+	hub := newHubStandIn(t)
+	hub.blobStatus = http.StatusForbidden
+
+	_, err := hub.client(testToken).Upload(context.Background(), "data.bin", []byte{1, 2, 3}, "")
+	assert.Error(t, err)
+	assert.Equal(t, 1, hub.requests)
+	assert.Empty(t, hub.blobs)
+	require.Len(t, hub.notifications, 1)
+	assert.Equal(t, false, hub.notifications[0]["isSuccess"])
+	assert.Equal(t, float64(http.StatusForbidden), hub.notifications[0]["statusCode"])
+}
+
+func TestUploadUnauthorized(t *testing.T) {
+	hub := newHubStandIn(t)
+
+	_, err := hub.client("invalid").Upload(context.Background(), "data.bin", []byte{1, 2, 3}, "")
+	assert.Error(t, err)
+	assert.Empty(t, hub.blobs)
+	assert.Empty(t, hub.notifications)
+}
+
+func TestNewClient(t *testing.T) {
+	hub := newHubStandIn(t)
+	caCert := filepath.Join(t.TempDir(), "ca.crt")
+	caData := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: hub.server.Certificate().Raw})
+	require.NoError(t, ioutil.WriteFile(caCert, caData, 0600))
+
+	settings := config.DefaultSettings()
+	settings.CACert = caCert
+	connSettings := &config.AzureConnectionSettings{
+		RemoteConnectionInfo: config.RemoteConnectionInfo{HostName: "hub.azure-devices.net", DeviceID: testDeviceID},
+		SharedAccessKey:      []byte("key"),
+		TokenValidity:        time.Hour,
+	}
+
+	client, err := fileupload.NewClient(settings, connSettings, watermill.NopLogger{})
+	require.NoError(t, err)
+	assert.Equal(t, "https://hub.azure-devices.net", client.HubURL)
+	assert.Equal(t, testDeviceID, client.DeviceID)
+	assert.Equal(t, fileupload.DefaultRetries, client.Retries)
+	require.NotNil(t, client.Authorization)
+	assert.True(t, strings.HasPrefix(client.Authorization(), "SharedAccessSignature sr=hub.azure-devices.net&sig="))
+
+	connSettings.SharedAccessKey = nil
+	client, err = fileupload.NewClient(settings, connSettings, watermill.NopLogger{})
+	require.NoError(t, err)
+	assert.Nil(t, client.Authorization)
+
+	settings.CACert = "missing.crt"
+	_, err = fileupload.NewClient(settings, connSettings, watermill.NopLogger{})
+	assert.Error(t, err)
+}
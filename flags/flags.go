@@ -22,10 +22,21 @@ import (
 )
 
 const (
-	flagCACert           = "caCert"
-	flagTenantID         = "tenantId"
-	flagIDScope          = "idScope"
-	flagSASTokenValidity = "sasTokenValidity"
+	flagCACert                = "caCert"
+	flagTenantID              = "tenantId"
+	flagIDScope               = "idScope"
+	flagSASTokenValidity      = "sasTokenValidity"
+	flagProvisioningTransport = "provisioningTransport"
+	flagHealthAddress         = "healthAddress"
+	flagMetricsAddress        = "metricsAddress"
+	flagTracingEndpoint       = "tracingEndpoint"
+	flagMessageSizePolicy     = "messageSizePolicy"
+	flagMaxMessageSize        = "maxMessageSize"
+	flagMessageIDSource       = "messageIdSource"
+	flagDedupWindow           = "dedupWindow"
+	flagInboxDir              = "inboxDir"
+	flagInboxMaxMessages      = "inboxMaxMessages"
+	flagResponseTimeout       = "commandResponseTimeout"
 )
 
 // AddGlobal adds the azure connector global flags.
@@ -57,6 +68,50 @@ func Add(f *flag.FlagSet, settings *config.AzureSettings) {
 	f.StringVar(&settings.IDScope, flagIDScope, def.IDScope,
 		"ID scope for Azure Device Provisioning service",
 	)
+	f.StringVar(&settings.ProvisioningTransport,
+		flagProvisioningTransport, def.ProvisioningTransport,
+		"The transport protocol for registration in Azure Device Provisioning service. Valid values are 'https' and 'mqtt'",
+	)
+	f.StringVar(&settings.HealthAddress,
+		flagHealthAddress, def.HealthAddress,
+		"Local address, e.g. 'localhost:8090', for the HTTP server exposing the health, readiness and status endpoints. The server is disabled if not set",
+	)
+	f.StringVar(&settings.MetricsAddress,
+		flagMetricsAddress, def.MetricsAddress,
+		"Local address, e.g. 'localhost:8090', for the HTTP server exposing the Prometheus metrics endpoint. The endpoint is disabled if not set",
+	)
+	f.StringVar(&settings.TracingEndpoint,
+		flagTracingEndpoint, def.TracingEndpoint,
+		"OpenTelemetry collector OTLP/HTTP endpoint, e.g. 'http://localhost:4318', for exporting the message tracing spans. The tracing is disabled if not set",
+	)
+	f.StringVar(&settings.MessageSizePolicy,
+		flagMessageSizePolicy, def.MessageSizePolicy,
+		"Handling of the device-to-cloud messages exceeding the max message size. Valid values are 'reject', 'split' and 'offload' to the storage account linked to Azure IoT Hub",
+	)
+	f.IntVar(&settings.MaxMessageSize,
+		flagMaxMessageSize, def.MaxMessageSize,
+		"Max size in bytes of a device-to-cloud message including its properties, up to the Azure IoT Hub limit of 262144 bytes",
+	)
+	f.StringVar(&settings.MessageIDSource,
+		flagMessageIDSource, def.MessageIDSource,
+		"Source of the device-to-cloud message IDs. Valid values are 'random', 'packet' for the local topic and MQTT packet identifier, 'correlation-id' for the Ditto correlation ID and 'content' for the local topic and payload",
+	)
+	f.IntVar(&settings.DedupWindow,
+		flagDedupWindow, def.DedupWindow,
+		"Number of the recently forwarded device-to-cloud message IDs, whose duplicates are not forwarded again. The duplicates detection is disabled if set to 0",
+	)
+	f.StringVar(&settings.InboxDir,
+		flagInboxDir, def.InboxDir,
+		"Directory of the inbox storing the cloud-to-device messages that cannot be delivered to the local broker, until the local connection is restored. The messages are kept in memory and lost on restart if not set",
+	)
+	f.IntVar(&settings.InboxMaxMessages,
+		flagInboxMaxMessages, def.InboxMaxMessages,
+		"Max number of the cloud-to-device messages stored in the inbox",
+	)
+	f.StringVar(&settings.ResponseTimeout,
+		flagResponseTimeout, def.ResponseTimeout,
+		"Time to wait for the response of a forwarded command, e.g. '30s'. The responses are sent to Azure IoT Hub with the correlation ID of the command message and the unanswered commands fail on timeout. The responses are not correlated if not set",
+	)
 
 	flags.AddLocalBroker(f, &settings.LocalConnectionSettings, &def.LocalConnectionSettings)
 	flags.AddLog(f, &settings.LogSettings, &def.LogSettings)
@@ -80,6 +135,12 @@ func Copy(f *flag.FlagSet) map[string]interface{} {
 			name = "TenantID"
 		} else if name == flagIDScope {
 			name = "IDScope"
+		} else if name == flagProvisioningTransport {
+			name = "ProvisioningTransport"
+		} else if name == flagMessageIDSource {
+			name = "MessageIDSource"
+		} else if name == flagResponseTimeout {
+			name = "ResponseTimeout"
 		}
 
 		m[name] = getter.Get()
@@ -18,6 +18,8 @@ import (
 	"os"
 	"testing"
 
+	"github.com/imdario/mergo"
+
 	"github.com/eclipse-kanto/azure-connector/config"
 	"github.com/eclipse-kanto/azure-connector/flags"
 
@@ -68,6 +70,17 @@ func TestFlagsSet(t *testing.T) {
 		"connectionString",
 		"sasTokenValidity",
 		"idScope",
+		"provisioningTransport",
+		"healthAddress",
+		"metricsAddress",
+		"tracingEndpoint",
+		"messageSizePolicy",
+		"maxMessageSize",
+		"messageIdSource",
+		"dedupWindow",
+		"inboxDir",
+		"inboxMaxMessages",
+		"commandResponseTimeout",
 		"localAddress",
 		"localUsername",
 		"localPassword",
@@ -86,6 +99,31 @@ func TestFlagsSet(t *testing.T) {
 	assertFlagNotExists(t, "messageMapperConfig", f)
 }
 
+func TestCopyMerge(t *testing.T) {
+	f := flag.NewFlagSet("testing", flag.ContinueOnError)
+	cli := new(config.AzureSettings)
+	flags.Add(f, cli)
+
+	args := []string{
+		"-tenantId=tenant",
+		"-idScope=scope",
+		"-provisioningTransport=mqtt",
+		"-sasTokenValidity=2h",
+		"-messageIdSource=content",
+		"-commandResponseTimeout=30s",
+	}
+	require.NoError(t, flags.Parse(f, args, "0.0.0", os.Exit))
+
+	settings := config.DefaultSettings()
+	require.NoError(t, mergo.Map(settings, flags.Copy(f), mergo.WithOverwriteWithEmptyValue))
+	assert.Equal(t, "tenant", settings.TenantID)
+	assert.Equal(t, "scope", settings.IDScope)
+	assert.Equal(t, config.ProvisioningTransportMQTT, settings.ProvisioningTransport)
+	assert.Equal(t, "2h", settings.SASTokenValidity)
+	assert.Equal(t, config.MessageIDContent, settings.MessageIDSource)
+	assert.Equal(t, "30s", settings.ResponseTimeout)
+}
+
 func assertFlagExists(t *testing.T, flagName string, f *flag.FlagSet) {
 	flg := f.Lookup(flagName)
 	assert.NotNil(t, flg)
@@ -0,0 +1,83 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package health
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/eclipse-kanto/suite-connector/logger"
+)
+
+const (
+	// PathLiveness defines the liveness endpoint path.
+	PathLiveness = "/healthz"
+	// PathReadiness defines the readiness endpoint path.
+	PathReadiness = "/readyz"
+	// PathStatus defines the JSON status endpoint path.
+	PathStatus = "/status"
+)
+
+// AddHandlers registers the health endpoints for the given status to the HTTP request multiplexer.
+func AddHandlers(mux *http.ServeMux, status *Status) {
+	mux.HandleFunc(PathLiveness, func(w http.ResponseWriter, r *http.Request) {
+		writeState(w, status.Alive())
+	})
+
+	mux.HandleFunc(PathReadiness, func(w http.ResponseWriter, r *http.Request) {
+		writeState(w, status.Ready())
+	})
+
+	mux.HandleFunc(PathStatus, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(status.Report()); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	})
+}
+
+func writeState(w http.ResponseWriter, ok bool) {
+	w.Header().Set("Content-Type", "text/plain")
+	if ok {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok\n"))
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("unavailable\n"))
+	}
+}
+
+// Serve starts a local HTTP server with the given handler on the provided address.
+func Serve(address string, handler http.Handler, logger logger.Logger) (*http.Server, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	server := &http.Server{
+		Addr:              listener.Addr().String(),
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logger.Error("Local HTTP server stopped", err, nil)
+		}
+	}()
+
+	logger.Infof("Local HTTP server listening on %s", listener.Addr())
+	return server, nil
+}
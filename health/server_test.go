@@ -0,0 +1,77 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package health_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/eclipse-kanto/suite-connector/logger"
+	"github.com/eclipse-kanto/suite-connector/testutil"
+
+	"github.com/eclipse-kanto/azure-connector/health"
+)
+
+func TestHealthEndpoints(t *testing.T) {
+	status := health.NewStatus()
+
+	mux := http.NewServeMux()
+	health.AddHandlers(mux, status)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	assertStatusCode(t, server.URL+health.PathLiveness, http.StatusOK)
+	assertStatusCode(t, server.URL+health.PathReadiness, http.StatusServiceUnavailable)
+
+	status.LocalConnectionListener().Connected(true, nil)
+	status.HubConnectionListener().Connected(true, nil)
+	status.SetRouterRunning(true)
+	assertStatusCode(t, server.URL+health.PathReadiness, http.StatusOK)
+
+	resp, err := http.Get(server.URL + health.PathStatus)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	report := &health.Report{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(report))
+	assert.True(t, report.Ready)
+	assert.True(t, report.Local.Connected)
+	assert.True(t, report.Hub.Connected)
+}
+
+func TestServe(t *testing.T) {
+	mux := http.NewServeMux()
+	health.AddHandlers(mux, health.NewStatus())
+
+	server, err := health.Serve("localhost:0", mux, testutil.NewLogger("health", logger.INFO, t))
+	require.NoError(t, err)
+	defer server.Close()
+
+	_, err = health.Serve("invalid:address:0", mux, testutil.NewLogger("health", logger.INFO, t))
+	assert.Error(t, err)
+}
+
+func assertStatusCode(t *testing.T, url string, code int) {
+	resp, err := http.Get(url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, code, resp.StatusCode, fmt.Sprintf("unexpected status code for %s", url))
+}
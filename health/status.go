@@ -0,0 +1,250 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package health
+
+import (
+	"sync"
+	"time"
+
+	"github.com/eclipse-kanto/suite-connector/connector"
+)
+
+// LivenessGracePeriod is the period for which the local broker connection can be lost before the connector is reported as not alive.
+var LivenessGracePeriod = 5 * time.Minute
+
+// ConnectionReport contains the state of a MQTT connection.
+type ConnectionReport struct {
+	Connected     bool       `json:"connected"`
+	Since         *time.Time `json:"since,omitempty"`
+	LastError     string     `json:"lastError,omitempty"`
+	LastErrorTime *time.Time `json:"lastErrorTime,omitempty"`
+}
+
+// HandlersReport contains the names of the configured message handlers.
+type HandlersReport struct {
+	Telemetry []string `json:"telemetry"`
+	Command   []string `json:"command"`
+}
+
+// Report represents the connector status exposed by the status endpoint.
+type Report struct {
+	Ready              bool             `json:"ready"`
+	Alive              bool             `json:"alive"`
+	Local              ConnectionReport `json:"local"`
+	Hub                ConnectionReport `json:"hub"`
+	LastError          string           `json:"lastError,omitempty"`
+	LastErrorTime      *time.Time       `json:"lastErrorTime,omitempty"`
+	SASTokenExpiry     *time.Time       `json:"sasTokenExpiry,omitempty"`
+	ProvisioningSource string           `json:"provisioningSource,omitempty"`
+	Handlers           HandlersReport   `json:"handlers"`
+	RouterRunning      bool             `json:"routerRunning"`
+	InboxMessages      int              `json:"inboxMessages"`
+}
+
+type connectionState struct {
+	connected     bool
+	since         time.Time
+	lastError     string
+	lastErrorTime time.Time
+}
+
+func (c *connectionState) report() ConnectionReport {
+	r := ConnectionReport{
+		Connected: c.connected,
+		LastError: c.lastError,
+	}
+	if !c.since.IsZero() {
+		since := c.since
+		r.Since = &since
+	}
+	if !c.lastErrorTime.IsZero() {
+		errTime := c.lastErrorTime
+		r.LastErrorTime = &errTime
+	}
+	return r
+}
+
+// Status tracks the connector state, i.e. connections, errors and message router state.
+type Status struct {
+	lock sync.RWMutex
+
+	local connectionState
+	hub   connectionState
+
+	lastError     string
+	lastErrorTime time.Time
+
+	tokenExpiry        time.Time
+	provisioningSource string
+
+	telemetryHandlers []string
+	commandHandlers   []string
+	routerRunning     bool
+	inboxMessages     int
+
+	localListener *connectionListener
+	hubListener   *connectionListener
+}
+
+// NewStatus creates an empty connector status.
+func NewStatus() *Status {
+	s := &Status{
+		local: connectionState{since: time.Now()},
+		hub:   connectionState{since: time.Now()},
+	}
+	s.localListener = &connectionListener{state: &s.local, status: s}
+	s.hubListener = &connectionListener{state: &s.hub, status: s}
+	return s
+}
+
+type connectionListener struct {
+	state  *connectionState
+	status *Status
+}
+
+// Connected is called to notify the status for connection status change.
+func (l *connectionListener) Connected(connected bool, err error) {
+	l.status.lock.Lock()
+	defer l.status.lock.Unlock()
+
+	now := time.Now()
+	if l.state.connected != connected {
+		l.state.since = now
+	}
+	l.state.connected = connected
+
+	if err != nil {
+		l.state.lastError = err.Error()
+		l.state.lastErrorTime = now
+		l.status.lastError = err.Error()
+		l.status.lastErrorTime = now
+	}
+}
+
+// LocalConnectionListener returns the listener that tracks the local broker connection state.
+func (s *Status) LocalConnectionListener() connector.ConnectionListener {
+	return s.localListener
+}
+
+// HubConnectionListener returns the listener that tracks the Azure IoT Hub connection state and errors.
+func (s *Status) HubConnectionListener() connector.ConnectionListener {
+	return s.hubListener
+}
+
+// SetError records the last connector error.
+func (s *Status) SetError(err error) {
+	if err == nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.lastError = err.Error()
+	s.lastErrorTime = time.Now()
+}
+
+// SetTokenExpiry records the expiry time of the SAS token in use.
+func (s *Status) SetTokenExpiry(expiry time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.tokenExpiry = expiry
+}
+
+// SetProvisioningSource records the source of the device connection settings.
+func (s *Status) SetProvisioningSource(source string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.provisioningSource = source
+}
+
+// SetHandlers records the names of the configured message handlers.
+func (s *Status) SetHandlers(telemetryHandlers, commandHandlers []string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.telemetryHandlers = append([]string{}, telemetryHandlers...)
+	s.commandHandlers = append([]string{}, commandHandlers...)
+}
+
+// SetRouterRunning records the messages router state.
+func (s *Status) SetRouterRunning(running bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.routerRunning = running
+}
+
+// SetInboxMessages records the number of the C2D messages waiting in the local inbox.
+func (s *Status) SetInboxMessages(messages int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.inboxMessages = messages
+}
+
+// Ready returns true if the connector is connected to both the local broker and Azure IoT Hub and the messages router is running.
+func (s *Status) Ready() bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.ready()
+}
+
+// Alive returns false if the local broker connection is lost for longer than the LivenessGracePeriod.
+func (s *Status) Alive() bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.alive()
+}
+
+func (s *Status) ready() bool {
+	return s.local.connected && s.hub.connected && s.routerRunning
+}
+
+func (s *Status) alive() bool {
+	return s.local.connected || time.Since(s.local.since) < LivenessGracePeriod
+}
+
+// Report returns a snapshot of the connector status.
+func (s *Status) Report() *Report {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	r := &Report{
+		Ready:              s.ready(),
+		Alive:              s.alive(),
+		Local:              s.local.report(),
+		Hub:                s.hub.report(),
+		LastError:          s.lastError,
+		ProvisioningSource: s.provisioningSource,
+		Handlers: HandlersReport{
+			Telemetry: append([]string{}, s.telemetryHandlers...),
+			Command:   append([]string{}, s.commandHandlers...),
+		},
+		RouterRunning: s.routerRunning,
+		InboxMessages: s.inboxMessages,
+	}
+	if !s.lastErrorTime.IsZero() {
+		errTime := s.lastErrorTime
+		r.LastErrorTime = &errTime
+	}
+	if !s.tokenExpiry.IsZero() {
+		expiry := s.tokenExpiry
+		r.SASTokenExpiry = &expiry
+	}
+	return r
+}
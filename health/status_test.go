@@ -0,0 +1,92 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package health_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/eclipse-kanto/azure-connector/health"
+)
+
+func TestStatusReady(t *testing.T) {
+	status := health.NewStatus()
+	assert.False(t, status.Ready())
+	assert.True(t, status.Alive())
+
+	status.LocalConnectionListener().Connected(true, nil)
+	status.HubConnectionListener().Connected(true, nil)
+	assert.False(t, status.Ready())
+
+	status.SetRouterRunning(true)
+	assert.True(t, status.Ready())
+
+	status.HubConnectionListener().Connected(false, errors.New("connection lost"))
+	assert.False(t, status.Ready())
+	assert.True(t, status.Alive())
+}
+
+func TestStatusNotAlive(t *testing.T) {
+	defer func(period time.Duration) {
+		health.LivenessGracePeriod = period
+	}(health.LivenessGracePeriod)
+	health.LivenessGracePeriod = 0
+
+	status := health.NewStatus()
+	assert.False(t, status.Alive())
+
+	status.LocalConnectionListener().Connected(true, nil)
+	assert.True(t, status.Alive())
+
+	status.LocalConnectionListener().Connected(false, nil)
+	assert.False(t, status.Alive())
+}
+
+func TestStatusReport(t *testing.T) {
+	status := health.NewStatus()
+	expiry := time.Now().Add(time.Hour)
+
+	status.LocalConnectionListener().Connected(true, nil)
+	status.HubConnectionListener().Connected(false, errors.New("not authorized"))
+	status.SetTokenExpiry(expiry)
+	status.SetProvisioningSource("dps")
+	status.SetHandlers([]string{"passthrough_telemetry_handler"}, []string{"passthrough_command_handler"})
+	status.SetRouterRunning(true)
+	status.SetInboxMessages(3)
+
+	report := status.Report()
+	assert.False(t, report.Ready)
+	assert.True(t, report.Alive)
+	assert.True(t, report.Local.Connected)
+	assert.False(t, report.Hub.Connected)
+	assert.Equal(t, "not authorized", report.Hub.LastError)
+	assert.NotNil(t, report.Hub.LastErrorTime)
+	assert.Equal(t, "not authorized", report.LastError)
+	require.NotNil(t, report.SASTokenExpiry)
+	assert.True(t, expiry.Equal(*report.SASTokenExpiry))
+	assert.Equal(t, "dps", report.ProvisioningSource)
+	assert.Equal(t, []string{"passthrough_telemetry_handler"}, report.Handlers.Telemetry)
+	assert.Equal(t, []string{"passthrough_command_handler"}, report.Handlers.Command)
+	assert.True(t, report.RouterRunning)
+	assert.Equal(t, 3, report.InboxMessages)
+
+	status.SetError(errors.New("provisioning failed"))
+	status.SetError(nil)
+	report = status.Report()
+	assert.Equal(t, "provisioning failed", report.LastError)
+	assert.Equal(t, "not authorized", report.Hub.LastError)
+}
@@ -0,0 +1,96 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package health
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	// NotifyReady notifies systemd that the service startup is finished.
+	NotifyReady = "READY=1"
+	// NotifyStopping notifies systemd that the service is beginning its shutdown.
+	NotifyStopping = "STOPPING=1"
+	// NotifyWatchdog updates the systemd watchdog timestamp.
+	NotifyWatchdog = "WATCHDOG=1"
+
+	envNotifySocket = "NOTIFY_SOCKET"
+	envWatchdogUsec = "WATCHDOG_USEC"
+	envWatchdogPID  = "WATCHDOG_PID"
+)
+
+// Notify sends the given state to the systemd notification socket.
+// It returns false without an error if the NOTIFY_SOCKET environment variable is not set.
+func Notify(state string) (bool, error) {
+	socketAddr := &net.UnixAddr{
+		Name: os.Getenv(envNotifySocket),
+		Net:  "unixgram",
+	}
+
+	if len(socketAddr.Name) == 0 {
+		return false, nil
+	}
+
+	conn, err := net.DialUnix(socketAddr.Net, nil, socketAddr)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	if _, err = conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// WatchdogInterval returns the systemd watchdog timeout or 0 if the watchdog is not enabled for this process.
+func WatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv(envWatchdogUsec), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+
+	if pid := os.Getenv(envWatchdogPID); len(pid) > 0 {
+		if p, err := strconv.Atoi(pid); err != nil || p != os.Getpid() {
+			return 0
+		}
+	}
+
+	return time.Duration(usec) * time.Microsecond
+}
+
+// Watchdog periodically pings the systemd watchdog while the connector is alive, until the context is done.
+func Watchdog(ctx context.Context, status *Status) {
+	interval := WatchdogInterval()
+	if interval == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if status.Alive() {
+				Notify(NotifyWatchdog)
+			}
+		}
+	}
+}
@@ -0,0 +1,224 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package metrics
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+
+	"github.com/eclipse-kanto/suite-connector/connector"
+)
+
+const (
+	// ResultReceived marks a message received by a handler.
+	ResultReceived = "received"
+	// ResultForwarded marks a message published by a handler.
+	ResultForwarded = "forwarded"
+	// ResultDropped marks a message that a handler consumed without producing any messages.
+	ResultDropped = "dropped"
+	// ResultFailed marks a message that a handler failed to process or publish.
+	ResultFailed = "failed"
+
+	// InboxStored marks a C2D message stored in the local inbox.
+	InboxStored = "stored"
+	// InboxReplayed marks a C2D message delivered from the local inbox.
+	InboxReplayed = "replayed"
+	// InboxExpired marks a C2D message discarded from the local inbox due to its expiry.
+	InboxExpired = "expired"
+	// InboxDropped marks a C2D message that does not fit in the local inbox or cannot be read from it.
+	InboxDropped = "dropped"
+
+	// FilterRateLimited marks a telemetry message dropped due to the rate limit.
+	FilterRateLimited = "rate_limited"
+	// FilterDeadband marks a telemetry message dropped due to the deadband.
+	FilterDeadband = "deadband"
+	// FilterSampled marks a telemetry message dropped due to the sampling.
+	FilterSampled = "sampled"
+	// FilterSuperseded marks a telemetry message replaced by a newer message within the last value interval.
+	FilterSuperseded = "superseded"
+	// FilterClosed marks a held last value telemetry message dropped as its handler is closed.
+	FilterClosed = "closed"
+
+	// DeadLetterUnhandled marks a C2D message that no command handler accepted.
+	DeadLetterUnhandled = "unhandled"
+	// DeadLetterFailed marks a C2D message that a command handler failed to process.
+	DeadLetterFailed = "failed"
+
+	// ConnectionLocal identifies the local broker connection.
+	ConnectionLocal = "local"
+	// ConnectionHub identifies the Azure IoT Hub connection.
+	ConnectionHub = "hub"
+
+	unknownHandler = "unknown"
+)
+
+type receivedTimeKey struct{}
+
+// ConnectorMetrics holds the azure connector message flow and connection metrics.
+type ConnectorMetrics struct {
+	Messages        *CounterVec
+	HandlerDuration *HistogramVec
+	PublishDuration *HistogramVec
+	InFlight        *GaugeVec
+	Reconnects      *CounterVec
+	TokenRefreshes  *CounterVec
+	InboxMessages   *GaugeVec
+	InboxEvents     *CounterVec
+	Filtered        *CounterVec
+	PriorityQueued  *GaugeVec
+	PriorityDropped *CounterVec
+	RuleActions     *CounterVec
+	SchemaRejected  *CounterVec
+	CommandRejected *CounterVec
+
+	lock      sync.Mutex
+	connected map[string]bool
+}
+
+// NewConnectorMetrics creates and registers the azure connector metrics.
+func NewConnectorMetrics(registry *Registry) *ConnectorMetrics {
+	return &ConnectorMetrics{
+		Messages: registry.NewCounterVec("azure_connector_messages_total",
+			"Number of messages processed by the message handlers, partitioned by handler and result.",
+			"handler", "result"),
+		HandlerDuration: registry.NewHistogramVec("azure_connector_handler_duration_seconds",
+			"Time spent in the message handlers.",
+			DefaultBuckets, "handler"),
+		PublishDuration: registry.NewHistogramVec("azure_connector_publish_duration_seconds",
+			"Time from receiving a message by a handler until its produced messages are published.",
+			DefaultBuckets, "handler"),
+		InFlight: registry.NewGaugeVec("azure_connector_in_flight_messages",
+			"Number of messages being processed by the message handlers.",
+			"handler"),
+		Reconnects: registry.NewCounterVec("azure_connector_reconnects_total",
+			"Number of reconnects, partitioned by connection.",
+			"connection"),
+		TokenRefreshes: registry.NewCounterVec("azure_connector_token_refreshes_total",
+			"Number of SAS token refreshes."),
+		InboxMessages: registry.NewGaugeVec("azure_connector_inbox_messages",
+			"Number of C2D messages stored in the local inbox."),
+		InboxEvents: registry.NewCounterVec("azure_connector_inbox_events_total",
+			"Number of C2D messages stored in, replayed, expired or dropped from the local inbox, partitioned by event.",
+			"event"),
+		Filtered: registry.NewCounterVec("azure_connector_filtered_messages_total",
+			"Number of telemetry messages dropped by the telemetry filters, partitioned by handler and reason.",
+			"handler", "reason"),
+		PriorityQueued: registry.NewGaugeVec("azure_connector_priority_queued_messages",
+			"Number of device-to-cloud messages waiting in the priority queues, partitioned by class.",
+			"class"),
+		PriorityDropped: registry.NewCounterVec("azure_connector_priority_dropped_total",
+			"Number of device-to-cloud messages dropped from the full priority queues, partitioned by class.",
+			"class"),
+		RuleActions: registry.NewCounterVec("azure_connector_rule_actions_total",
+			"Number of actions performed by the rules, partitioned by rule and action.",
+			"rule", "action"),
+		SchemaRejected: registry.NewCounterVec("azure_connector_schema_rejected_total",
+			"Number of device-to-cloud messages diverted to the dead-letter topics due to invalid payloads, partitioned by schema.",
+			"schema"),
+		CommandRejected: registry.NewCounterVec("azure_connector_command_rejected_total",
+			"Number of C2D messages passed to the dead-letter handling after the retries, partitioned by reason.",
+			"reason"),
+		connected: map[string]bool{},
+	}
+}
+
+// Middleware is a message router middleware that instruments the message handlers.
+func (m *ConnectorMetrics) Middleware(h message.HandlerFunc) message.HandlerFunc {
+	return func(msg *message.Message) ([]*message.Message, error) {
+		handlerName := handlerNameFromCtx(msg.Context())
+		m.Messages.Inc(handlerName, ResultReceived)
+
+		m.InFlight.Inc(handlerName)
+		defer m.InFlight.Dec(handlerName)
+
+		received := time.Now()
+		produced, err := h(msg)
+		m.HandlerDuration.Observe(time.Since(received).Seconds(), handlerName)
+
+		if err != nil {
+			m.Messages.Inc(handlerName, ResultFailed)
+			return produced, err
+		}
+
+		if len(produced) == 0 {
+			m.Messages.Inc(handlerName, ResultDropped)
+		}
+		for _, outgoing := range produced {
+			outgoing.SetContext(context.WithValue(outgoing.Context(), receivedTimeKey{}, received))
+		}
+		return produced, nil
+	}
+}
+
+// PublisherDecorator instruments the publishing of the messages produced by the message handlers.
+func (m *ConnectorMetrics) PublisherDecorator(pub message.Publisher) message.Publisher {
+	return &instrumentedPublisher{Publisher: pub, metrics: m}
+}
+
+type instrumentedPublisher struct {
+	message.Publisher
+
+	metrics *ConnectorMetrics
+}
+
+func (p *instrumentedPublisher) Publish(topic string, messages ...*message.Message) error {
+	for _, msg := range messages {
+		handlerName := handlerNameFromCtx(msg.Context())
+
+		if err := p.Publisher.Publish(topic, msg); err != nil {
+			p.metrics.Messages.Inc(handlerName, ResultFailed)
+			return err
+		}
+
+		p.metrics.Messages.Inc(handlerName, ResultForwarded)
+		if received, ok := msg.Context().Value(receivedTimeKey{}).(time.Time); ok {
+			p.metrics.PublishDuration.Observe(time.Since(received).Seconds(), handlerName)
+		}
+	}
+	return nil
+}
+
+// ConnectionListener returns a listener that counts the reconnects of the connection with the given name.
+func (m *ConnectorMetrics) ConnectionListener(connection string) connector.ConnectionListener {
+	return &reconnectsListener{metrics: m, connection: connection}
+}
+
+type reconnectsListener struct {
+	metrics    *ConnectorMetrics
+	connection string
+}
+
+func (l *reconnectsListener) Connected(connected bool, err error) {
+	if !connected {
+		return
+	}
+
+	l.metrics.lock.Lock()
+	reconnect := l.metrics.connected[l.connection]
+	l.metrics.connected[l.connection] = true
+	l.metrics.lock.Unlock()
+
+	if reconnect {
+		l.metrics.Reconnects.Inc(l.connection)
+	}
+}
+
+func handlerNameFromCtx(ctx context.Context) string {
+	if name := message.HandlerNameFromCtx(ctx); len(name) > 0 {
+		return name
+	}
+	return unknownHandler
+}
@@ -0,0 +1,139 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package metrics_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/ThreeDotsLabs/watermill/pubsub/gochannel"
+
+	"github.com/eclipse-kanto/azure-connector/metrics"
+)
+
+const testHandlerName = "test_handler"
+
+type failingPublisher struct{}
+
+func (p *failingPublisher) Publish(topic string, messages ...*message.Message) error {
+	return errors.New("publish failed")
+}
+
+func (p *failingPublisher) Close() error {
+	return nil
+}
+
+func TestMiddlewareAndPublisher(t *testing.T) {
+	connMetrics := metrics.NewConnectorMetrics(metrics.NewRegistry())
+	router, err := message.NewRouter(message.RouterConfig{}, watermill.NopLogger{})
+	require.NoError(t, err)
+	router.AddMiddleware(connMetrics.Middleware)
+
+	pubSub := gochannel.NewGoChannel(gochannel.Config{}, watermill.NopLogger{})
+	defer pubSub.Close()
+
+	out, err := pubSub.Subscribe(context.Background(), "out")
+	require.NoError(t, err)
+
+	router.AddHandler(testHandlerName, "in", pubSub, "out", connMetrics.PublisherDecorator(pubSub),
+		func(msg *message.Message) ([]*message.Message, error) {
+			if string(msg.Payload) == "drop" {
+				return nil, nil
+			}
+			return []*message.Message{message.NewMessage(watermill.NewUUID(), msg.Payload)}, nil
+		},
+	)
+
+	go router.Run(context.Background())
+	defer router.Close()
+	<-router.Running()
+
+	for _, payload := range []string{"drop", "forward"} {
+		require.NoError(t, pubSub.Publish("in", message.NewMessage(watermill.NewUUID(), []byte(payload))))
+	}
+
+	select {
+	case msg := <-out:
+		msg.Ack()
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "message not forwarded")
+	}
+
+	assert.Eventually(t, func() bool {
+		return connMetrics.PublishDuration.Count(testHandlerName) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, 2.0, connMetrics.Messages.Value(testHandlerName, metrics.ResultReceived))
+	assert.Equal(t, 1.0, connMetrics.Messages.Value(testHandlerName, metrics.ResultForwarded))
+	assert.Equal(t, 1.0, connMetrics.Messages.Value(testHandlerName, metrics.ResultDropped))
+	assert.Equal(t, uint64(2), connMetrics.HandlerDuration.Count(testHandlerName))
+}
+
+func TestHandlerFailure(t *testing.T) {
+	connMetrics := metrics.NewConnectorMetrics(metrics.NewRegistry())
+	handler := connMetrics.Middleware(func(msg *message.Message) ([]*message.Message, error) {
+		return nil, errors.New("handler failed")
+	})
+
+	_, err := handler(message.NewMessage(watermill.NewUUID(), []byte("{}")))
+	assert.Error(t, err)
+	assert.Equal(t, 1.0, connMetrics.Messages.Value("unknown", metrics.ResultReceived))
+	assert.Equal(t, 1.0, connMetrics.Messages.Value("unknown", metrics.ResultFailed))
+	assert.Equal(t, 0.0, connMetrics.Messages.Value("unknown", metrics.ResultDropped))
+}
+
+func TestPublisherFailure(t *testing.T) {
+	connMetrics := metrics.NewConnectorMetrics(metrics.NewRegistry())
+	pub := connMetrics.PublisherDecorator(&failingPublisher{})
+
+	assert.Error(t, pub.Publish("out", message.NewMessage(watermill.NewUUID(), []byte("{}"))))
+	assert.Equal(t, 1.0, connMetrics.Messages.Value("unknown", metrics.ResultFailed))
+	assert.NoError(t, pub.Close())
+}
+
+func TestInFlight(t *testing.T) {
+	connMetrics := metrics.NewConnectorMetrics(metrics.NewRegistry())
+	var inFlight float64
+	handler := connMetrics.Middleware(func(msg *message.Message) ([]*message.Message, error) {
+		inFlight = connMetrics.InFlight.Value("unknown")
+		return nil, nil
+	})
+
+	_, err := handler(message.NewMessage(watermill.NewUUID(), []byte("{}")))
+	require.NoError(t, err)
+	assert.Equal(t, 1.0, inFlight)
+	assert.Equal(t, 0.0, connMetrics.InFlight.Value("unknown"))
+}
+
+func TestReconnects(t *testing.T) {
+	connMetrics := metrics.NewConnectorMetrics(metrics.NewRegistry())
+	listener := connMetrics.ConnectionListener(metrics.ConnectionHub)
+
+	listener.Connected(true, nil)
+	assert.Equal(t, 0.0, connMetrics.Reconnects.Value(metrics.ConnectionHub))
+
+	listener.Connected(false, errors.New("connection lost"))
+	listener.Connected(true, nil)
+	assert.Equal(t, 1.0, connMetrics.Reconnects.Value(metrics.ConnectionHub))
+
+	connMetrics.ConnectionListener(metrics.ConnectionHub).Connected(true, nil)
+	assert.Equal(t, 2.0, connMetrics.Reconnects.Value(metrics.ConnectionHub))
+	assert.Equal(t, 0.0, connMetrics.Reconnects.Value(metrics.ConnectionLocal))
+}
@@ -0,0 +1,172 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// PathMetrics defines the Prometheus metrics endpoint path.
+const PathMetrics = "/metrics"
+
+// DefaultBuckets defines the default histogram buckets in seconds.
+var DefaultBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Registry holds the registered metrics and serves them in the Prometheus exposition format.
+type Registry struct {
+	registry *prometheus.Registry
+}
+
+// NewRegistry creates an empty metrics registry.
+func NewRegistry() *Registry {
+	return &Registry{registry: prometheus.NewRegistry()}
+}
+
+// AddHandlers registers the metrics endpoint to the HTTP request multiplexer.
+func (r *Registry) AddHandlers(mux *http.ServeMux) {
+	mux.Handle(PathMetrics, promhttp.HandlerFor(r.registry, promhttp.HandlerOpts{}))
+}
+
+// CounterVec is a set of monotonically increasing counters partitioned by label values.
+type CounterVec struct {
+	vec    *prometheus.CounterVec
+	labels []string
+}
+
+// NewCounterVec creates and registers a new counter.
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	vec := prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: help}, labels)
+	r.registry.MustRegister(vec)
+	return &CounterVec{vec: vec, labels: labels}
+}
+
+// Inc increments the counter for the given label values.
+func (c *CounterVec) Inc(values ...string) {
+	c.vec.WithLabelValues(values...).Inc()
+}
+
+// Add adds the given value to the counter for the given label values.
+func (c *CounterVec) Add(delta float64, values ...string) {
+	c.vec.WithLabelValues(values...).Add(delta)
+}
+
+// Value returns the current value for the given label values.
+func (c *CounterVec) Value(values ...string) float64 {
+	return lookup(c.vec, c.labels, values).GetCounter().GetValue()
+}
+
+// GaugeVec is a set of gauges partitioned by label values.
+type GaugeVec struct {
+	vec    *prometheus.GaugeVec
+	labels []string
+}
+
+// NewGaugeVec creates and registers a new gauge.
+func (r *Registry) NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	vec := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: help}, labels)
+	r.registry.MustRegister(vec)
+	return &GaugeVec{vec: vec, labels: labels}
+}
+
+// Inc increments the gauge for the given label values.
+func (g *GaugeVec) Inc(values ...string) {
+	g.vec.WithLabelValues(values...).Inc()
+}
+
+// Dec decrements the gauge for the given label values.
+func (g *GaugeVec) Dec(values ...string) {
+	g.vec.WithLabelValues(values...).Dec()
+}
+
+// Add adds the given value to the gauge for the given label values.
+func (g *GaugeVec) Add(delta float64, values ...string) {
+	g.vec.WithLabelValues(values...).Add(delta)
+}
+
+// Set sets the gauge value for the given label values.
+func (g *GaugeVec) Set(value float64, values ...string) {
+	g.vec.WithLabelValues(values...).Set(value)
+}
+
+// Value returns the current value for the given label values.
+func (g *GaugeVec) Value(values ...string) float64 {
+	return lookup(g.vec, g.labels, values).GetGauge().GetValue()
+}
+
+// HistogramVec is a set of histograms partitioned by label values.
+type HistogramVec struct {
+	vec    *prometheus.HistogramVec
+	labels []string
+}
+
+// NewHistogramVec creates and registers a new histogram with the given upper bucket bounds.
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	bounds := append([]float64{}, buckets...)
+	sort.Float64s(bounds)
+
+	vec := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: name, Help: help, Buckets: bounds}, labels)
+	r.registry.MustRegister(vec)
+	return &HistogramVec{vec: vec, labels: labels}
+}
+
+// Observe adds a single observation for the given label values.
+func (h *HistogramVec) Observe(value float64, values ...string) {
+	h.vec.WithLabelValues(values...).Observe(value)
+}
+
+// Count returns the number of observations for the given label values.
+func (h *HistogramVec) Count(values ...string) uint64 {
+	return lookup(h.vec, h.labels, values).GetHistogram().GetSampleCount()
+}
+
+// lookup returns the collected metric with the given label values, an empty one if there is none.
+// Unlike the label values lookup of the vectors, no metric is created for the missing label values.
+func lookup(collector prometheus.Collector, labels []string, values []string) *dto.Metric {
+	if len(values) != len(labels) {
+		panic(fmt.Sprintf("expected %d label values, got %d", len(labels), len(values)))
+	}
+
+	metrics := make(chan prometheus.Metric)
+	go func() {
+		collector.Collect(metrics)
+		close(metrics)
+	}()
+
+	found := &dto.Metric{}
+	for metric := range metrics {
+		value := &dto.Metric{}
+		if err := metric.Write(value); err == nil && hasLabelValues(value, labels, values) {
+			found = value
+		}
+	}
+	return found
+}
+
+func hasLabelValues(metric *dto.Metric, labels []string, values []string) bool {
+	pairs := make(map[string]string, len(metric.GetLabel()))
+	for _, pair := range metric.GetLabel() {
+		pairs[pair.GetName()] = pair.GetValue()
+	}
+	for i, label := range labels {
+		if pairs[label] != values[i] {
+			return false
+		}
+	}
+	return true
+}
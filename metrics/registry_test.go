@@ -0,0 +1,107 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package metrics_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/eclipse-kanto/azure-connector/metrics"
+)
+
+// scrape returns the metrics served by the metrics endpoint of the registry.
+func scrape(t *testing.T, registry *metrics.Registry) string {
+	mux := http.NewServeMux()
+	registry.AddHandlers(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + metrics.PathMetrics)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, resp.Header.Get("Content-Type"), "text/plain")
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return string(body)
+}
+
+func TestCounterAndGauge(t *testing.T) {
+	registry := metrics.NewRegistry()
+	counter := registry.NewCounterVec("test_total", "Test counter.", "handler")
+	gauge := registry.NewGaugeVec("test_depth", "Test gauge.")
+
+	counter.Inc("b")
+	counter.Add(2, "a")
+	counter.Inc("quote\"d")
+	gauge.Inc()
+	gauge.Inc()
+	gauge.Dec()
+
+	assert.Equal(t, 2.0, counter.Value("a"))
+	assert.Equal(t, 0.0, counter.Value("c"))
+	assert.Equal(t, 1.0, gauge.Value())
+
+	gauge.Set(5)
+	assert.Equal(t, 5.0, gauge.Value())
+
+	assert.Equal(t, "# HELP test_depth Test gauge.\n"+
+		"# TYPE test_depth gauge\n"+
+		"test_depth 5\n"+
+		"# HELP test_total Test counter.\n"+
+		"# TYPE test_total counter\n"+
+		"test_total{handler=\"a\"} 2\n"+
+		"test_total{handler=\"b\"} 1\n"+
+		"test_total{handler=\"quote\\\"d\"} 1\n", scrape(t, registry))
+}
+
+func TestHistogram(t *testing.T) {
+	registry := metrics.NewRegistry()
+	histogram := registry.NewHistogramVec("test_seconds", "Test histogram.", []float64{1, 0.5}, "handler")
+
+	histogram.Observe(0.25, "a")
+	histogram.Observe(0.75, "a")
+	histogram.Observe(2, "a")
+	assert.Equal(t, uint64(3), histogram.Count("a"))
+	assert.Equal(t, uint64(0), histogram.Count("b"))
+
+	assert.Equal(t, "# HELP test_seconds Test histogram.\n"+
+		"# TYPE test_seconds histogram\n"+
+		"test_seconds_bucket{handler=\"a\",le=\"0.5\"} 1\n"+
+		"test_seconds_bucket{handler=\"a\",le=\"1\"} 2\n"+
+		"test_seconds_bucket{handler=\"a\",le=\"+Inf\"} 3\n"+
+		"test_seconds_sum{handler=\"a\"} 3\n"+
+		"test_seconds_count{handler=\"a\"} 3\n", scrape(t, registry))
+}
+
+func TestInvalidLabelValues(t *testing.T) {
+	registry := metrics.NewRegistry()
+	counter := registry.NewCounterVec("test_total", "Test counter.", "handler")
+
+	assert.Panics(t, func() { counter.Inc() })
+	assert.Panics(t, func() { counter.Value() })
+}
+
+func TestDuplicateMetrics(t *testing.T) {
+	registry := metrics.NewRegistry()
+	registry.NewCounterVec("test_total", "Test counter.")
+
+	assert.Panics(t, func() { registry.NewCounterVec("test_total", "Test counter.") })
+}
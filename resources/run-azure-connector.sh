@@ -30,6 +30,39 @@ ARGUMENTS=""
 # ID Scope for the Azure DPS authentication, configure with parameter -idScope.
 [ -n "${ID_SCOPE+x}" ] && ARGUMENTS="$ARGUMENTS -idScope=$ID_SCOPE"
 
+# Transport protocol for the Azure DPS registration, configure with parameter -provisioningTransport (default "https").
+[ -n "${PROVISIONING_TRANSPORT+x}" ] && ARGUMENTS="$ARGUMENTS -provisioningTransport=$PROVISIONING_TRANSPORT"
+
+# Local address of the health, readiness and status HTTP endpoints, configure with parameter -healthAddress (disabled by default).
+[ -n "${HEALTH_ADDRESS+x}" ] && ARGUMENTS="$ARGUMENTS -healthAddress=$HEALTH_ADDRESS"
+
+# Local address of the Prometheus metrics HTTP endpoint, configure with parameter -metricsAddress (disabled by default).
+[ -n "${METRICS_ADDRESS+x}" ] && ARGUMENTS="$ARGUMENTS -metricsAddress=$METRICS_ADDRESS"
+
+# OpenTelemetry collector OTLP/HTTP endpoint for the message tracing, configure with parameter -tracingEndpoint (disabled by default).
+[ -n "${TRACING_ENDPOINT+x}" ] && ARGUMENTS="$ARGUMENTS -tracingEndpoint=$TRACING_ENDPOINT"
+
+# Handling of the oversized device-to-cloud messages, configure with parameter -messageSizePolicy (reject by default).
+[ -n "${MESSAGE_SIZE_POLICY+x}" ] && ARGUMENTS="$ARGUMENTS -messageSizePolicy=$MESSAGE_SIZE_POLICY"
+
+# Max size in bytes of a device-to-cloud message, configure with parameter -maxMessageSize (262144 by default).
+[ -n "${MAX_MESSAGE_SIZE+x}" ] && ARGUMENTS="$ARGUMENTS -maxMessageSize=$MAX_MESSAGE_SIZE"
+
+# Source of the device-to-cloud message IDs, configure with parameter -messageIdSource (random by default).
+[ -n "${MESSAGE_ID_SOURCE+x}" ] && ARGUMENTS="$ARGUMENTS -messageIdSource=$MESSAGE_ID_SOURCE"
+
+# Number of the recent device-to-cloud message IDs for the duplicates detection, configure with parameter -dedupWindow (1000 by default).
+[ -n "${DEDUP_WINDOW+x}" ] && ARGUMENTS="$ARGUMENTS -dedupWindow=$DEDUP_WINDOW"
+
+# Directory of the inbox for the undelivered cloud-to-device messages, configure with parameter -inboxDir (disabled by default).
+[ -n "${INBOX_DIR+x}" ] && ARGUMENTS="$ARGUMENTS -inboxDir=$INBOX_DIR"
+
+# Max number of the cloud-to-device messages in the inbox, configure with parameter -inboxMaxMessages (1000 by default).
+[ -n "${INBOX_MAX_MESSAGES+x}" ] && ARGUMENTS="$ARGUMENTS -inboxMaxMessages=$INBOX_MAX_MESSAGES"
+
+# Time to wait for the response of a forwarded command, configure with parameter -commandResponseTimeout (disabled by default).
+[ -n "${COMMAND_RESPONSE_TIMEOUT+x}" ] && ARGUMENTS="$ARGUMENTS -commandResponseTimeout=$COMMAND_RESPONSE_TIMEOUT"
+
 # User-specified tenant id, configure with parameter -tenantId (default "defaultTenant").
 [ -n "${TENANT_ID+x}" ] && ARGUMENTS="$ARGUMENTS -tenantId=$TENANT_ID"
 
@@ -0,0 +1,282 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package bus
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+
+	"github.com/eclipse-kanto/suite-connector/connector"
+
+	"github.com/eclipse-kanto/azure-connector/config"
+	"github.com/eclipse-kanto/azure-connector/routing"
+	"github.com/eclipse-kanto/azure-connector/routing/message/handlers"
+)
+
+const (
+	// PropertyBatchFormat is the device-to-cloud message property with the format of a batch message.
+	PropertyBatchFormat = "batchFormat"
+	// PropertyBatchCount is the device-to-cloud message property with the number of messages in a batch message.
+	PropertyBatchCount = "batchCount"
+	// BatchFormatJSONArray marks a batch message with a JSON array of the batched payloads.
+	// The JSON payloads are included as they are and all others as JSON strings.
+	BatchFormatJSONArray = "json-array"
+
+	keyMessageID = "$.mid"
+
+	maxPendingBatches = 100
+)
+
+// batch contains the messages for a single destination and priority class.
+type batch struct {
+	deviceID   string
+	localTopic string
+	properties url.Values
+	priority   string
+	qos        *connector.Qos
+	elements   [][]byte
+	messageIDs []string
+	size       int
+	timer      *time.Timer
+}
+
+// batcher packs the device-to-cloud messages into batches per destination and priority class and publishes them
+// when full or the window elapses. A batch is published in the priority class of its messages.
+// The batches are published directly on the given publisher, i.e. after the message ID assignment and the size limit decorators
+// of the handler. The message ID of a batch is derived from the message IDs of its elements instead, so that a retried batch
+// keeps its ID, and the size limit is applied to each batch before it is published.
+// The batches that cannot be published are kept and retried on the next flush, e.g. on reconnect. This requires a publisher
+// failing while the Azure IoT Hub is disconnected, the batches are lost with an asynchronous one.
+type batcher struct {
+	pub     message.Publisher
+	limit   *sizeLimit
+	maxSize int
+	window  time.Duration
+	logger  watermill.LoggerAdapter
+
+	lock    sync.Mutex
+	batches map[string]*batch
+	pending []*batch
+}
+
+func newBatcher(pub message.Publisher, limit *sizeLimit, settings *config.BatchSettings, logger watermill.LoggerAdapter) (*batcher, error) {
+	window, err := settings.BatchWindow()
+	if err != nil {
+		return nil, err
+	}
+	return &batcher{
+		pub:     pub,
+		limit:   limit,
+		maxSize: settings.BatchSize(),
+		window:  window,
+		logger:  logger,
+		batches: map[string]*batch{},
+	}, nil
+}
+
+// decorate batches the device-to-cloud messages produced by the handler, the other messages are returned unchanged.
+func (b *batcher) decorate(handlerFunc message.HandlerFunc) message.HandlerFunc {
+	return func(msg *message.Message) ([]*message.Message, error) {
+		produced, err := handlerFunc(msg)
+		if err != nil || len(produced) == 0 {
+			return produced, err
+		}
+
+		localTopic, _ := connector.TopicFromCtx(msg.Context())
+		var unbatched []*message.Message
+		for _, m := range produced {
+			if !b.add(localTopic, m) {
+				unbatched = append(unbatched, m)
+			}
+		}
+		return unbatched, nil
+	}
+}
+
+// add adds the message to the batch of its destination, returning false if the message cannot be batched.
+func (b *batcher) add(localTopic string, msg *message.Message) bool {
+	topic, _ := connector.TopicFromCtx(msg.Context())
+	deviceID, properties, ok := routing.ParseTelemetryTopic(topic)
+	if !ok || routing.IsCompressed(properties.Get(routing.KeyContentEncoding)) {
+		// not a device-to-cloud message or a compressed one that cannot be embedded
+		return false
+	}
+	messageID := properties.Get(keyMessageID)
+	if len(messageID) == 0 {
+		messageID = msg.UUID
+	}
+	properties.Del(keyMessageID)
+
+	element := msg.Payload
+	if !json.Valid(element) {
+		encoded, err := json.Marshal(string(element))
+		if err != nil {
+			return false
+		}
+		element = encoded
+	}
+
+	destination := deviceID + "?" + properties.Encode()
+	priority := msg.Metadata.Get(MetadataPriority)
+	key := priority + " " + destination
+	// the batch properties and the array brackets
+	overhead := len(destination) + len(PropertyBatchFormat) + len(BatchFormatJSONArray) + len(PropertyBatchCount) + 16
+	if overhead+len(element) > b.maxSize {
+		return false
+	}
+
+	b.lock.Lock()
+	current, ok := b.batches[key]
+	if ok && current.size+1+len(element) > b.maxSize {
+		b.detach(key, current)
+		b.lock.Unlock()
+		b.publish(current)
+		b.lock.Lock()
+		current, ok = b.batches[key]
+	}
+	if !ok {
+		current = &batch{deviceID: deviceID, localTopic: localTopic, properties: properties, priority: priority, size: overhead}
+		if qos, ok := connector.QosFromCtx(msg.Context()); ok {
+			current.qos = &qos
+		}
+		current.timer = time.AfterFunc(b.window, func() {
+			b.flushBatch(key, current)
+		})
+		b.batches[key] = current
+	} else {
+		current.size++
+	}
+	current.elements = append(current.elements, element)
+	current.messageIDs = append(current.messageIDs, messageID)
+	current.size += len(element)
+	b.lock.Unlock()
+	return true
+}
+
+// detach removes the batch from the open batches, the lock must be held.
+func (b *batcher) detach(key string, current *batch) {
+	current.timer.Stop()
+	if b.batches[key] == current {
+		delete(b.batches, key)
+	}
+}
+
+func (b *batcher) flushBatch(key string, current *batch) {
+	b.lock.Lock()
+	if b.batches[key] != current {
+		b.lock.Unlock()
+		return
+	}
+	b.detach(key, current)
+	b.lock.Unlock()
+
+	b.publish(current)
+}
+
+// flush publishes all open and pending batches.
+func (b *batcher) flush() {
+	b.lock.Lock()
+	all := b.pending
+	b.pending = nil
+	for key, current := range b.batches {
+		b.detach(key, current)
+		all = append(all, current)
+	}
+	b.lock.Unlock()
+
+	for _, current := range all {
+		b.publish(current)
+	}
+}
+
+func (b *batcher) publish(current *batch) {
+	properties := url.Values{}
+	for key, values := range current.properties {
+		properties[key] = values
+	}
+	properties.Set(PropertyBatchFormat, BatchFormatJSONArray)
+	properties.Set(PropertyBatchCount, strconv.Itoa(len(current.elements)))
+
+	payload := append(append([]byte{'['}, bytes.Join(current.elements, []byte{','})...), ']')
+	id := uuid.NewSHA1(messageIDNamespace, []byte(strings.Join(current.messageIDs, "\x00"))).String()
+	msg := message.NewMessage(id, payload)
+	topic := routing.CreateTelemetryTopicWithProperties(current.deviceID, msg.UUID, properties)
+	msg.SetContext(connector.SetTopicToCtx(msg.Context(), topic))
+	if current.qos != nil {
+		msg.SetContext(connector.SetQosToCtx(msg.Context(), *current.qos))
+	}
+	if len(current.priority) > 0 {
+		msg.Metadata.Set(MetadataPriority, current.priority)
+	}
+
+	messages := []*message.Message{msg}
+	if b.limit != nil {
+		if messages = b.limit.apply(current.localTopic, msg); len(messages) == 0 {
+			// rejected as oversized
+			return
+		}
+	}
+	for _, m := range messages {
+		topic, _ := connector.TopicFromCtx(m.Context())
+		if err := b.pub.Publish(topic, m); err != nil {
+			b.logger.Error("cannot publish batch, keeping it for retry", err, watermill.LogFields{"count": len(current.elements)})
+			b.retain(current)
+			return
+		}
+	}
+}
+
+func (b *batcher) retain(current *batch) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.pending = append(b.pending, current)
+	if dropped := len(b.pending) - maxPendingBatches; dropped > 0 {
+		b.logger.Error("dropping pending batches", errors.Errorf("more than %d pending batches", maxPendingBatches), watermill.LogFields{"dropped": dropped})
+		b.pending = b.pending[dropped:]
+	}
+}
+
+// batchingTelemetryHandler flushes the batches of the produced messages on reconnect and close.
+type batchingTelemetryHandler struct {
+	handlers.TelemetryHandler
+
+	batcher *batcher
+}
+
+// Connected flushes the batches when the Azure IoT Hub connection is established and notifies the wrapped handler,
+// if it listens for the connection changes.
+func (h *batchingTelemetryHandler) Connected(connected bool, err error) {
+	if connected {
+		go h.batcher.flush()
+	}
+	if listener, ok := h.TelemetryHandler.(connector.ConnectionListener); ok {
+		listener.Connected(connected, err)
+	}
+}
+
+// Close flushes the batches and closes the handler.
+func (h *batchingTelemetryHandler) Close() error {
+	h.batcher.flush()
+	return handlers.CloseHandler(h.TelemetryHandler)
+}
@@ -0,0 +1,376 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package bus
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+
+	"github.com/eclipse-kanto/suite-connector/connector"
+
+	"github.com/eclipse-kanto/azure-connector/config"
+	"github.com/eclipse-kanto/azure-connector/routing"
+	"github.com/eclipse-kanto/azure-connector/routing/message/handlers"
+
+	test "github.com/eclipse-kanto/azure-connector/routing/bus/internal/testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type batchPublisher struct {
+	lock      sync.Mutex
+	err       error
+	published []*message.Message
+}
+
+func (p *batchPublisher) Publish(topic string, messages ...*message.Message) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.err != nil {
+		return p.err
+	}
+	p.published = append(p.published, messages...)
+	return nil
+}
+
+func (p *batchPublisher) Close() error {
+	return nil
+}
+
+func (p *batchPublisher) messages() []*message.Message {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return append([]*message.Message{}, p.published...)
+}
+
+func telemetryMessage(properties map[string]string, payload string) *message.Message {
+	msg := message.NewMessage(watermill.NewUUID(), []byte(payload))
+	values := url.Values{}
+	for key, value := range properties {
+		values[key] = []string{value}
+	}
+	topic := routing.CreateTelemetryTopicWithProperties(routesDeviceID, msg.UUID, values)
+	msg.SetContext(connector.SetTopicToCtx(msg.Context(), topic))
+	return msg
+}
+
+func producing(produced ...*message.Message) message.HandlerFunc {
+	return func(msg *message.Message) ([]*message.Message, error) {
+		return produced, nil
+	}
+}
+
+func newTestBatcher(t *testing.T, pub message.Publisher, settings *config.BatchSettings) *batcher {
+	b, err := newBatcher(pub, nil, settings, watermill.NopLogger{})
+	require.NoError(t, err)
+	return b
+}
+
+func batchProperties(t *testing.T, msg *message.Message) url.Values {
+	topic, _ := connector.TopicFromCtx(msg.Context())
+	deviceID, properties, ok := routing.ParseTelemetryTopic(topic)
+	require.True(t, ok)
+	assert.Equal(t, routesDeviceID, deviceID)
+	assert.Equal(t, BatchFormatJSONArray, properties.Get(PropertyBatchFormat))
+	return properties
+}
+
+func TestBatchFlushOnWindow(t *testing.T) {
+	pub := &batchPublisher{}
+	b := newTestBatcher(t, pub, &config.BatchSettings{Window: "50ms"})
+
+	first := telemetryMessage(map[string]string{"room": "1"}, `{"temp":20}`)
+	second := telemetryMessage(map[string]string{"room": "1"}, "plain text")
+	first.SetContext(connector.SetQosToCtx(first.Context(), connector.QosAtMostOnce))
+	unbatched, err := b.decorate(producing(first, second))(topicMessage("telemetry", ""))
+	require.NoError(t, err)
+	assert.Empty(t, unbatched)
+	assert.Empty(t, pub.messages())
+
+	require.Eventually(t, func() bool {
+		return len(pub.messages()) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	msg := pub.messages()[0]
+	assert.Equal(t, `[{"temp":20},"plain text"]`, string(msg.Payload))
+	properties := batchProperties(t, msg)
+	assert.Equal(t, "2", properties.Get(PropertyBatchCount))
+	assert.Equal(t, "1", properties.Get("room"))
+	assert.Equal(t, msg.UUID, properties.Get(keyMessageID))
+	qos, ok := connector.QosFromCtx(msg.Context())
+	assert.True(t, ok)
+	assert.Equal(t, connector.QosAtMostOnce, qos)
+}
+
+func TestBatchFlushOnSize(t *testing.T) {
+	pub := &batchPublisher{}
+	b := newTestBatcher(t, pub, &config.BatchSettings{Window: "1h"})
+	handlerFunc := b.decorate(func(msg *message.Message) ([]*message.Message, error) {
+		return []*message.Message{telemetryMessage(nil, string(msg.Payload))}, nil
+	})
+
+	payload := `"` + strings.Repeat("x", 900) + `"`
+	for i := 0; i < 4; i++ {
+		_, err := handlerFunc(topicMessage("telemetry", payload))
+		require.NoError(t, err)
+	}
+	assert.Empty(t, pub.messages())
+
+	_, err := handlerFunc(topicMessage("telemetry", payload))
+	require.NoError(t, err)
+	published := pub.messages()
+	require.Len(t, published, 1)
+	assert.Equal(t, "4", batchProperties(t, published[0]).Get(PropertyBatchCount))
+	assert.LessOrEqual(t, len(published[0].Payload), config.BatchChunkSize)
+
+	b.flush()
+	published = pub.messages()
+	require.Len(t, published, 2)
+	assert.Equal(t, "1", batchProperties(t, published[1]).Get(PropertyBatchCount))
+}
+
+func TestBatchPerDestination(t *testing.T) {
+	pub := &batchPublisher{}
+	b := newTestBatcher(t, pub, &config.BatchSettings{Window: "1h"})
+
+	_, err := b.decorate(producing(
+		telemetryMessage(map[string]string{"room": "1"}, "1"),
+		telemetryMessage(map[string]string{"room": "2"}, "2"),
+		telemetryMessage(map[string]string{"room": "1"}, "3"),
+	))(topicMessage("telemetry", ""))
+	require.NoError(t, err)
+
+	b.flush()
+	published := pub.messages()
+	require.Len(t, published, 2)
+	payloads := map[string]string{}
+	for _, msg := range published {
+		payloads[batchProperties(t, msg).Get("room")] = string(msg.Payload)
+	}
+	assert.Equal(t, map[string]string{"1": "[1,3]", "2": "[2]"}, payloads)
+}
+
+func TestBatchPerPriority(t *testing.T) {
+	pub := &batchPublisher{}
+	b := newTestBatcher(t, pub, &config.BatchSettings{Window: "1h"})
+
+	_, err := b.decorate(producing(
+		prioritized("alarm", "1"),
+		prioritized("", "2"),
+		prioritized("alarm", "3"),
+	))(topicMessage("telemetry", ""))
+	require.NoError(t, err)
+
+	b.flush()
+	published := pub.messages()
+	require.Len(t, published, 2)
+	payloads := map[string]string{}
+	for _, msg := range published {
+		payloads[msg.Metadata.Get(MetadataPriority)] = string(msg.Payload)
+	}
+	assert.Equal(t, map[string]string{"alarm": "[1,3]", "": "[2]"}, payloads)
+}
+
+func TestTelemetryBusBatchingPriorities(t *testing.T) {
+	router, connInfo := setupTestRouter(routesDeviceID)
+	pub := &lanesPublisher{err: errors.New("disconnected")}
+	lanes := NewPriorityLanes(pub, []config.PriorityClass{{Name: "alarm", Topic: "alarm/#"}}, nil, watermill.NopLogger{})
+	defer lanes.Close()
+
+	batching := &batchingDummyHandler{
+		TelemetryHandler: test.NewDummyTelemetryHandler(testTelemetryHandlerName, "alarm/#", nil),
+		settings:         &config.BatchSettings{Window: "1h"},
+	}
+	initialized := TelemetryBusWithOptions(router, &batchPublisher{}, test.NewDummySubscriber(), connInfo,
+		[]handlers.TelemetryHandler{batching}, &TelemetryBusOptions{Lanes: lanes},
+	)
+	require.Len(t, initialized, 1)
+	wrapped, ok := initialized[0].(*batchingTelemetryHandler)
+	require.True(t, ok)
+
+	// the batcher is applied after the priority class assignment, as on the telemetry bus
+	handlerFunc := wrapped.batcher.decorate(lanes.decorate(producing(telemetryMessage(nil, "1"), telemetryMessage(nil, "2"))))
+	_, err := handlerFunc(topicMessage("alarm/fire", ""))
+	require.NoError(t, err)
+	require.NoError(t, handlers.CloseHandler(wrapped))
+
+	require.Eventually(t, func() bool {
+		return pub.attempted() > 0 && lanes.Len("alarm") == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 0, lanes.Len(config.DefaultPriorityClass))
+
+	pub.setErr(nil)
+	lanes.Connected(true, nil)
+	require.Eventually(t, func() bool {
+		return len(pub.payloads()) == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"[1,2]"}, pub.payloads())
+}
+
+func TestBatchPassthrough(t *testing.T) {
+	pub := &batchPublisher{}
+	b := newTestBatcher(t, pub, &config.BatchSettings{})
+
+	twin := topicMessage(routing.CreateTwinReportedTopic("1"), "{}")
+	oversized := telemetryMessage(nil, strings.Repeat("x", config.BatchChunkSize))
+	compressed := telemetryMessage(map[string]string{routing.KeyContentEncoding: routing.EncodingGzip}, "\x1f\x8b")
+	unbatched, err := b.decorate(producing(twin, oversized, compressed))(topicMessage("telemetry", ""))
+	require.NoError(t, err)
+	assert.Equal(t, []*message.Message{twin, oversized, compressed}, unbatched)
+
+	b.flush()
+	assert.Empty(t, pub.messages())
+}
+
+func TestBatchRetryAfterPublishError(t *testing.T) {
+	pub := &batchPublisher{err: errors.New("not connected")}
+	b := newTestBatcher(t, pub, &config.BatchSettings{Window: "1h"})
+	handler := &batchingTelemetryHandler{
+		TelemetryHandler: test.NewDummyTelemetryHandler(testTelemetryHandlerName, "telemetry/#", nil),
+		batcher:          b,
+	}
+
+	element := telemetryMessage(nil, "1")
+	_, err := b.decorate(producing(element))(topicMessage("telemetry", ""))
+	require.NoError(t, err)
+	b.flush()
+	assert.Empty(t, pub.messages())
+
+	pub.lock.Lock()
+	pub.err = nil
+	pub.lock.Unlock()
+
+	handler.Connected(true, nil)
+	require.Eventually(t, func() bool {
+		return len(pub.messages()) == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, "[1]", string(pub.messages()[0].Payload))
+	// the batch message ID is derived from the message IDs of the elements
+	assert.Equal(t, uuid.NewSHA1(messageIDNamespace, []byte(element.UUID)).String(), pub.messages()[0].UUID)
+}
+
+func TestBatchRetryDisconnectedHub(t *testing.T) {
+	pub := connector.NewOnlinePublisher(disconnectedHub(t), connector.QosAtLeastOnce, time.Second, watermill.NopLogger{}, nil)
+	b := newTestBatcher(t, pub, &config.BatchSettings{Window: "1h"})
+
+	_, err := b.decorate(producing(telemetryMessage(nil, "1")))(topicMessage("telemetry", ""))
+	require.NoError(t, err)
+	b.flush()
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	assert.Len(t, b.pending, 1)
+}
+
+func TestBatchSizeLimit(t *testing.T) {
+	payload := `"` + strings.Repeat("x", 300) + `"`
+
+	pub := &batchPublisher{}
+	limit := newSizeLimit(&SizeLimitOptions{MaxSize: 512, Policy: config.MessageSizeSplit}, watermill.NopLogger{})
+	b, err := newBatcher(pub, limit, &config.BatchSettings{Window: "1h"}, watermill.NopLogger{})
+	require.NoError(t, err)
+	_, err = b.decorate(producing(telemetryMessage(nil, payload), telemetryMessage(nil, payload)))(topicMessage("telemetry", ""))
+	require.NoError(t, err)
+	b.flush()
+
+	parts := pub.messages()
+	require.Len(t, parts, 2)
+	var joined []byte
+	for i, part := range parts {
+		properties := batchProperties(t, part)
+		assert.Equal(t, strconv.Itoa(i), properties.Get(PropertySplitIndex))
+		joined = append(joined, part.Payload...)
+	}
+	assert.Equal(t, "["+payload+","+payload+"]", string(joined))
+
+	pub = &batchPublisher{}
+	limit = newSizeLimit(&SizeLimitOptions{MaxSize: 512}, watermill.NopLogger{})
+	b, err = newBatcher(pub, limit, &config.BatchSettings{Window: "1h"}, watermill.NopLogger{})
+	require.NoError(t, err)
+	_, err = b.decorate(producing(telemetryMessage(nil, payload), telemetryMessage(nil, payload)))(topicMessage("telemetry", ""))
+	require.NoError(t, err)
+	b.flush()
+	// the oversized batch is rejected, not kept for retry
+	assert.Empty(t, pub.messages())
+	assert.Empty(t, b.pending)
+}
+
+func TestTelemetryBusBatching(t *testing.T) {
+	router, connInfo := setupTestRouter(routesDeviceID)
+	pub := &batchPublisher{}
+
+	batching := &batchingDummyHandler{
+		TelemetryHandler: test.NewDummyTelemetryHandler(testTelemetryHandlerName, "telemetry/#", nil),
+		settings:         &config.BatchSettings{Window: "1h"},
+	}
+	plain := test.NewDummyTelemetryHandler(testTelemetryHandlerName+"_plain", "telemetry/#", nil)
+	initialized := TelemetryBusWithOptions(router, pub, test.NewDummySubscriber(), connInfo,
+		[]handlers.TelemetryHandler{batching, plain}, nil,
+	)
+	require.Len(t, initialized, 2)
+	assert.Equal(t, plain, initialized[1])
+
+	wrapped, ok := initialized[0].(*batchingTelemetryHandler)
+	require.True(t, ok)
+	_, ok = initialized[0].(connector.ConnectionListener)
+	assert.True(t, ok)
+
+	_, err := wrapped.batcher.decorate(producing(telemetryMessage(nil, "1")))(topicMessage("telemetry", ""))
+	require.NoError(t, err)
+	require.NoError(t, handlers.CloseHandler(wrapped))
+	assert.Len(t, pub.messages(), 1)
+}
+
+type batchingDummyHandler struct {
+	handlers.TelemetryHandler
+
+	settings *config.BatchSettings
+}
+
+func (h *batchingDummyHandler) BatchSettings() *config.BatchSettings {
+	return h.settings
+}
+
+type listeningDummyHandler struct {
+	handlers.TelemetryHandler
+
+	connected []bool
+}
+
+func (h *listeningDummyHandler) Connected(connected bool, err error) {
+	h.connected = append(h.connected, connected)
+}
+
+func TestBatchConnectedForwarded(t *testing.T) {
+	listening := &listeningDummyHandler{TelemetryHandler: test.NewDummyTelemetryHandler(testTelemetryHandlerName, "telemetry/#", nil)}
+	handler := &batchingTelemetryHandler{
+		TelemetryHandler: listening,
+		batcher:          newTestBatcher(t, &batchPublisher{}, &config.BatchSettings{Window: "1h"}),
+	}
+
+	handler.Connected(true, nil)
+	handler.Connected(false, errors.New("connection lost"))
+	assert.Equal(t, []bool{true, false}, listening.connected)
+}
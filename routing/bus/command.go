@@ -15,22 +15,51 @@ package bus
 import (
 	"fmt"
 
+	"github.com/pkg/errors"
+
 	"github.com/ThreeDotsLabs/watermill"
 	"github.com/ThreeDotsLabs/watermill/message"
 	"github.com/eclipse-kanto/suite-connector/connector"
 
 	"github.com/eclipse-kanto/azure-connector/config"
+	"github.com/eclipse-kanto/azure-connector/metrics"
 	"github.com/eclipse-kanto/azure-connector/routing"
 	"github.com/eclipse-kanto/azure-connector/routing/message/handlers"
 )
 
 const (
-	commandHandlerName = "command_handler"
+	// CommandBusHandlerName is the name of the message router handler that dispatches the C2D messages to the command handlers.
+	CommandBusHandlerName = "command_handler"
 )
 
 type commandBusHandler struct {
 	logger          watermill.LoggerAdapter
 	commandHandlers []handlers.CommandHandler
+	dispatch        string
+	routes          *commandRoutes
+	delivered       *DeliveredMessages
+}
+
+// CommandBusOptions contains the optional settings of the cloud message bus.
+type CommandBusOptions struct {
+	// Dispatch is the mode of passing the C2D messages to the command handlers, first-match by default.
+	Dispatch string
+	// Context is the handler context passed on the command handlers initialization.
+	Context *handlers.HandlerContext
+	// Routes is the routing table of the C2D messages, the matching messages are not passed to the command handlers.
+	Routes []config.CommandRoute
+	// DeadLetter is the retrying and the dead-letter handling of the C2D messages that cannot be processed, if set.
+	// The dead letters are published using the local and the hub publishers of the context.
+	DeadLetter *config.CommandDeadLetterSettings
+	// DeadLetterPublisher publishes the dead letters to the local broker instead of the local publisher of the context, if set.
+	// As the failed C2D message is acknowledged anyway, it has to keep the dead letters the local broker does not accept, e.g. in the inbox.
+	DeadLetterPublisher message.Publisher
+	// Metrics counts the C2D messages passed to the dead-letter handling, if set.
+	Metrics *metrics.ConnectorMetrics
+	// Responses stores the forwarded commands for correlating their responses, if set.
+	Responses *CommandResponses
+	// Delivered keeps the IDs of the delivered C2D messages for detecting the redelivered ones, a new store is created if not set.
+	Delivered *DeliveredMessages
 }
 
 // CommandBus creates the cloud message bus for processing the C2D messages from the Azure IoT Hub device.
@@ -40,13 +69,45 @@ func CommandBus(router *message.Router,
 	connInfo *config.RemoteConnectionInfo,
 	commandHandlers []handlers.CommandHandler,
 ) {
+	CommandBusWithOptions(router, mosquittoPub, azureSub, connInfo, commandHandlers, nil)
+}
+
+// CommandBusWithOptions creates the cloud message bus for processing the C2D messages from the Azure IoT Hub device using the given options
+// and returns the initialized command handlers. The C2D messages redelivered by the Azure IoT Hub are detected by their
+// message ID and are not forwarded again, once the original message is acknowledged.
+func CommandBusWithOptions(router *message.Router,
+	mosquittoPub message.Publisher,
+	azureSub message.Subscriber,
+	connInfo *config.RemoteConnectionInfo,
+	commandHandlers []handlers.CommandHandler,
+	options *CommandBusOptions,
+) []handlers.CommandHandler {
 	//Azure IoT Hub -> Message bus -> Mosquitto Broker -> Gateway
 	initCommandHandlers := []handlers.CommandHandler{}
 	commandBusHandler := &commandBusHandler{
 		logger: router.Logger(),
 	}
+	var handlerCtx *handlers.HandlerContext
+	var deadLetterSettings *config.CommandDeadLetterSettings
+	var deadLetterPub message.Publisher
+	var connMetrics *metrics.ConnectorMetrics
+	var responses *CommandResponses
+	if options != nil {
+		commandBusHandler.dispatch = options.Dispatch
+		handlerCtx = options.Context
+		commandBusHandler.routes = newCommandRoutes(options.Routes)
+		deadLetterSettings = options.DeadLetter
+		deadLetterPub = options.DeadLetterPublisher
+		connMetrics = options.Metrics
+		responses = options.Responses
+		commandBusHandler.delivered = options.Delivered
+	}
+	if commandBusHandler.delivered == nil {
+		commandBusHandler.delivered = NewDeliveredMessages()
+	}
+	handlerCtx = busHandlerContext(handlerCtx, connInfo, router.Logger())
 	for _, commandHandler := range commandHandlers {
-		if err := commandHandler.Init(connInfo); err != nil {
+		if err := handlers.InitHandler(commandHandler, handlerCtx); err != nil {
 			logFields := watermill.LogFields{"handler_name": commandHandler.Name()}
 			router.Logger().Error("skipping command handler that cannot be initialized", err, logFields)
 			continue
@@ -54,24 +115,176 @@ func CommandBus(router *message.Router,
 		initCommandHandlers = append(initCommandHandlers, commandHandler)
 	}
 	commandBusHandler.commandHandlers = initCommandHandlers
-	router.AddHandler(commandHandlerName,
+	handlerFunc := commandBusHandler.HandleMessage
+	if responses != nil {
+		handlerFunc = responses.decorateCommands(handlerFunc)
+	}
+	if deadLetters := newCommandDeadLetters(deadLetterSettings, deadLetterPub, handlerCtx, connMetrics, router.Logger()); deadLetters != nil {
+		handlerFunc = deadLetters.decorate(handlerFunc)
+	}
+	router.AddHandler(CommandBusHandlerName,
 		routing.CreateRemoteCloudTopic(connInfo.DeviceID),
 		azureSub,
 		connector.TopicEmpty,
 		mosquittoPub,
-		commandBusHandler.HandleMessage,
+		handlerFunc,
 	)
+	return initCommandHandlers
 }
 
 func (h *commandBusHandler) HandleMessage(msg *message.Message) ([]*message.Message, error) {
+	if h.delivered != nil {
+		if messageID := cloudMessageProperty(msg, keyMessageID); len(messageID) > 0 {
+			if h.delivered.delivered(messageID) {
+				h.logger.Debug("skipping redelivered command message", watermill.LogFields{"message_id": messageID})
+				return nil, nil
+			}
+			h.delivered.track(messageID, msg)
+		}
+	}
+
+	expiry := cloudMessageProperty(msg, routing.KeyExpiryTime)
+	produced, err := h.handle(msg)
+	if len(expiry) > 0 {
+		for _, m := range produced {
+			m.Metadata.Set(MetadataExpiry, expiry)
+		}
+	}
+	return produced, err
+}
+
+func (h *commandBusHandler) handle(msg *message.Message) ([]*message.Message, error) {
+	if err := decompressCloudMessage(msg); err != nil {
+		return nil, err
+	}
+
+	if h.routes != nil {
+		if routed, ok, err := h.routes.route(msg); ok {
+			return routed, err
+		}
+	}
+
+	switch h.dispatch {
+	case config.DispatchFanOut:
+		return h.fanOut(msg)
+	case config.DispatchChain:
+		return h.chain(msg)
+	default:
+		return h.firstMatch(msg)
+	}
+}
+
+// firstMatch returns the messages produced by the first applicable handler that handles the message.
+func (h *commandBusHandler) firstMatch(msg *message.Message) ([]*message.Message, error) {
+	failed := false
+	for _, commandHandler := range h.commandHandlers {
+		if !handlers.Matches(commandHandler, msg) {
+			continue
+		}
+
+		produced, err := commandHandler.HandleMessage(msg)
+		if h.report(commandHandler, err) == handlers.ResultHandled {
+			return produced, nil
+		}
+		failed = failed || handlers.ResultOf(err) == handlers.ResultFailed
+	}
+	return nil, h.unhandledError(msg, failed)
+}
+
+// fanOut returns the messages produced by all applicable handlers that handle the message.
+func (h *commandBusHandler) fanOut(msg *message.Message) ([]*message.Message, error) {
+	var result []*message.Message
+	handled, failed := false, false
 	for _, commandHandler := range h.commandHandlers {
-		msg, err := commandHandler.HandleMessage(msg)
-		if err == nil {
-			return msg, nil
+		if !handlers.Matches(commandHandler, msg) {
+			continue
 		}
-		logFields := watermill.LogFields{"handler_name": commandHandler.Name()}
+
+		produced, err := commandHandler.HandleMessage(msg)
+		switch h.report(commandHandler, err) {
+		case handlers.ResultHandled:
+			handled = true
+			result = append(result, produced...)
+		case handlers.ResultFailed:
+			failed = true
+		}
+	}
+	if !handled {
+		return nil, h.unhandledError(msg, failed)
+	}
+	return result, nil
+}
+
+// chain passes the messages through the applicable handlers in order, each handler transforming the messages produced by the previous one.
+// A skipping handler leaves the message unchanged and a failing handler stops the chain.
+func (h *commandBusHandler) chain(msg *message.Message) ([]*message.Message, error) {
+	current := []*message.Message{msg}
+	handled := false
+	for _, commandHandler := range h.commandHandlers {
+		next := make([]*message.Message, 0, len(current))
+		for _, m := range current {
+			if !handlers.Matches(commandHandler, m) {
+				next = append(next, m)
+				continue
+			}
+
+			produced, err := commandHandler.HandleMessage(m)
+			switch h.report(commandHandler, err) {
+			case handlers.ResultHandled:
+				handled = true
+				next = append(next, produced...)
+			case handlers.ResultSkipped:
+				next = append(next, m)
+			default:
+				return nil, errors.Wrapf(err, "command handler '%s' failed", commandHandler.Name())
+			}
+		}
+		current = next
+	}
+	if !handled {
+		return nil, h.unhandledError(msg, false)
+	}
+	return current, nil
+}
+
+func (h *commandBusHandler) report(commandHandler handlers.CommandHandler, err error) handlers.Result {
+	result := handlers.ResultOf(err)
+	logFields := watermill.LogFields{"handler_name": commandHandler.Name(), "result": result.String()}
+	switch result {
+	case handlers.ResultSkipped:
+		h.logger.Debug("command message skipped by handler", logFields.Add(watermill.LogFields{"reason": err.Error()}))
+	case handlers.ResultFailed:
 		h.logger.Error("error handling command message", err, logFields)
 	}
-	return nil, fmt.Errorf("cannot handle command message '%v'", string(msg.Payload))
+	return result
+}
+
+func (h *commandBusHandler) unhandledError(msg *message.Message, failed bool) error {
+	if failed {
+		return fmt.Errorf("cannot handle command message '%v'", string(msg.Payload))
+	}
+	return handlers.Skip(fmt.Sprintf("no command handler for message '%v'", string(msg.Payload)))
+}
 
+// decompressCloudMessage replaces the compressed payload of a C2D message with the decompressed one
+// and removes the content encoding from the message topic properties.
+func decompressCloudMessage(msg *message.Message) error {
+	topic, _ := connector.TopicFromCtx(msg.Context())
+	deviceID, properties, ok := routing.ParseCloudTopic(topic)
+	if !ok {
+		return nil
+	}
+	encoding := properties.Get(routing.KeyContentEncoding)
+	if !routing.IsCompressed(encoding) {
+		return nil
+	}
+
+	payload, err := routing.Decompress(encoding, msg.Payload)
+	if err != nil {
+		return errors.Wrap(err, "cannot decompress command message")
+	}
+	msg.Payload = payload
+	properties.Del(routing.KeyContentEncoding)
+	msg.SetContext(connector.SetTopicToCtx(msg.Context(), routing.CreateCloudTopicWithProperties(deviceID, properties)))
+	return nil
 }
@@ -20,6 +20,7 @@ import (
 	"github.com/ThreeDotsLabs/watermill"
 	"github.com/ThreeDotsLabs/watermill/message"
 
+	"github.com/eclipse-kanto/azure-connector/config"
 	"github.com/eclipse-kanto/azure-connector/routing"
 	test "github.com/eclipse-kanto/azure-connector/routing/bus/internal/testing"
 	"github.com/eclipse-kanto/azure-connector/routing/message/handlers"
@@ -46,7 +47,7 @@ func TestRegisterCommandMessageHandler(t *testing.T) {
 	refHandlers := refRouter.FieldByName(fieldHandlers)
 	assert.Equal(t, 1, refHandlers.Len())
 	refHandler := refHandlers.MapIndex(refHandlers.MapKeys()[0])
-	test.AssertRouterHandler(t, commandHandlerName, routing.CreateRemoteCloudTopic("dummy-device"), "", reflect.Indirect(refHandler))
+	test.AssertRouterHandler(t, CommandBusHandlerName, routing.CreateRemoteCloudTopic("dummy-device"), "", reflect.Indirect(refHandler))
 }
 
 func TestRegisterCommandMessageHandlerInitializationError(t *testing.T) {
@@ -60,7 +61,7 @@ func TestRegisterCommandMessageHandlerInitializationError(t *testing.T) {
 	refHandlers := refRouter.FieldByName(fieldHandlers)
 	assert.Equal(t, 1, refHandlers.Len())
 	refHandler := refHandlers.MapIndex(refHandlers.MapKeys()[0])
-	test.AssertRouterHandler(t, commandHandlerName, routing.CreateRemoteCloudTopic("dummy-device"), "", reflect.Indirect(refHandler))
+	test.AssertRouterHandler(t, CommandBusHandlerName, routing.CreateRemoteCloudTopic("dummy-device"), "", reflect.Indirect(refHandler))
 }
 
 func TestInvalidCloudMessagePayload(t *testing.T) {
@@ -106,3 +107,143 @@ func TestMultipleCommandMessageHandlers(t *testing.T) {
 	assert.Equal(t, len(outgoingMessages), 1)
 	assert.Equal(t, "test_command_handler_1", outgoingMessages[0].Metadata["handler_name"])
 }
+
+type transformingCommandHandler struct {
+	name      string
+	suffix    string
+	handleErr error
+	matches   bool
+}
+
+func (h *transformingCommandHandler) Init(connInfo *config.RemoteConnectionInfo) error {
+	return nil
+}
+
+func (h *transformingCommandHandler) HandleMessage(msg *message.Message) ([]*message.Message, error) {
+	if h.handleErr != nil {
+		return nil, h.handleErr
+	}
+	return []*message.Message{message.NewMessage(watermill.NewUUID(), append(msg.Payload, h.suffix...))}, nil
+}
+
+func (h *transformingCommandHandler) Name() string {
+	return h.name
+}
+
+func (h *transformingCommandHandler) Matches(msg *message.Message) bool {
+	return h.matches
+}
+
+func payloads(messages []*message.Message) []string {
+	result := make([]string, len(messages))
+	for i, msg := range messages {
+		result[i] = string(msg.Payload)
+	}
+	return result
+}
+
+func TestFirstMatchSkipsNotMatchingHandlers(t *testing.T) {
+	busHandler := &commandBusHandler{logger: watermill.NopLogger{}, commandHandlers: []handlers.CommandHandler{
+		&transformingCommandHandler{name: "not_matching", suffix: "-1", matches: false},
+		&transformingCommandHandler{name: "skipping", handleErr: handlers.Skip("not mine"), matches: true},
+		&transformingCommandHandler{name: "matching", suffix: "-3", matches: true},
+	}}
+
+	outgoingMessages, err := busHandler.HandleMessage(message.NewMessage(watermill.NewUUID(), message.Payload("cmd")))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"cmd-3"}, payloads(outgoingMessages))
+}
+
+func TestFirstMatchResults(t *testing.T) {
+	busHandler := &commandBusHandler{logger: watermill.NopLogger{}, commandHandlers: []handlers.CommandHandler{
+		&transformingCommandHandler{name: "skipping", handleErr: handlers.Skip("not mine"), matches: true},
+	}}
+	_, err := busHandler.HandleMessage(message.NewMessage(watermill.NewUUID(), message.Payload("cmd")))
+	assert.Equal(t, handlers.ResultSkipped, handlers.ResultOf(err))
+
+	busHandler.commandHandlers = append(busHandler.commandHandlers,
+		&transformingCommandHandler{name: "failing", handleErr: errors.New("failed"), matches: true})
+	_, err = busHandler.HandleMessage(message.NewMessage(watermill.NewUUID(), message.Payload("cmd")))
+	assert.Equal(t, handlers.ResultFailed, handlers.ResultOf(err))
+}
+
+func TestFanOutDispatch(t *testing.T) {
+	busHandler := &commandBusHandler{logger: watermill.NopLogger{}, dispatch: config.DispatchFanOut, commandHandlers: []handlers.CommandHandler{
+		&transformingCommandHandler{name: "first", suffix: "-1", matches: true},
+		&transformingCommandHandler{name: "failing", handleErr: errors.New("failed"), matches: true},
+		&transformingCommandHandler{name: "not_matching", suffix: "-3", matches: false},
+		&transformingCommandHandler{name: "skipping", handleErr: handlers.Skip("not mine"), matches: true},
+		&transformingCommandHandler{name: "second", suffix: "-5", matches: true},
+	}}
+
+	outgoingMessages, err := busHandler.HandleMessage(message.NewMessage(watermill.NewUUID(), message.Payload("cmd")))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"cmd-1", "cmd-5"}, payloads(outgoingMessages))
+
+	busHandler.commandHandlers = busHandler.commandHandlers[1:4]
+	_, err = busHandler.HandleMessage(message.NewMessage(watermill.NewUUID(), message.Payload("cmd")))
+	assert.Equal(t, handlers.ResultFailed, handlers.ResultOf(err))
+
+	busHandler.commandHandlers = busHandler.commandHandlers[1:]
+	_, err = busHandler.HandleMessage(message.NewMessage(watermill.NewUUID(), message.Payload("cmd")))
+	assert.Equal(t, handlers.ResultSkipped, handlers.ResultOf(err))
+}
+
+func TestChainDispatch(t *testing.T) {
+	busHandler := &commandBusHandler{logger: watermill.NopLogger{}, dispatch: config.DispatchChain, commandHandlers: []handlers.CommandHandler{
+		&transformingCommandHandler{name: "first", suffix: "-1", matches: true},
+		&transformingCommandHandler{name: "not_matching", suffix: "-2", matches: false},
+		&transformingCommandHandler{name: "skipping", handleErr: handlers.Skip("not mine"), matches: true},
+		&transformingCommandHandler{name: "last", suffix: "-4", matches: true},
+	}}
+
+	outgoingMessages, err := busHandler.HandleMessage(message.NewMessage(watermill.NewUUID(), message.Payload("cmd")))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"cmd-1-4"}, payloads(outgoingMessages))
+
+	busHandler.commandHandlers = append(busHandler.commandHandlers,
+		&transformingCommandHandler{name: "failing", handleErr: errors.New("failed"), matches: true})
+	_, err = busHandler.HandleMessage(message.NewMessage(watermill.NewUUID(), message.Payload("cmd")))
+	assert.Equal(t, handlers.ResultFailed, handlers.ResultOf(err))
+
+	busHandler.commandHandlers = busHandler.commandHandlers[1:3]
+	_, err = busHandler.HandleMessage(message.NewMessage(watermill.NewUUID(), message.Payload("cmd")))
+	assert.Equal(t, handlers.ResultSkipped, handlers.ResultOf(err))
+}
+
+func TestCommandBusWithOptions(t *testing.T) {
+	router, connInfo := setupTestRouter("dummy-device")
+
+	CommandBusWithOptions(router, conn.NullPublisher(), test.NewDummySubscriber(), connInfo, nil, &CommandBusOptions{Dispatch: config.DispatchFanOut})
+	refRouter := reflect.Indirect(reflect.ValueOf(router))
+	refHandlers := refRouter.FieldByName(fieldHandlers)
+	assert.Equal(t, 1, refHandlers.Len())
+}
+
+type contextCommandHandler struct {
+	transformingCommandHandler
+	ctx *handlers.HandlerContext
+}
+
+func (h *contextCommandHandler) InitWithContext(ctx *handlers.HandlerContext) error {
+	h.ctx = ctx
+	return nil
+}
+
+func TestCommandBusHandlerContext(t *testing.T) {
+	router, connInfo := setupTestRouter("dummy-device")
+
+	aware := &contextCommandHandler{transformingCommandHandler: transformingCommandHandler{name: "aware"}}
+	failing := test.NewDummyCommandHandler(testCommandHandlerName, errors.New("cannot init"), nil)
+	handlerCtx := &handlers.HandlerContext{Version: handlers.ContextVersion, StatusPublisher: conn.NullPublisher()}
+
+	initialized := CommandBusWithOptions(router, conn.NullPublisher(), test.NewDummySubscriber(), connInfo,
+		[]handlers.CommandHandler{failing, aware}, &CommandBusOptions{Context: handlerCtx},
+	)
+	assert.Equal(t, []handlers.CommandHandler{aware}, initialized)
+	require.NotNil(t, aware.ctx)
+	assert.Equal(t, connInfo, aware.ctx.ConnInfo)
+	assert.NotNil(t, aware.ctx.Logger)
+	assert.NotNil(t, aware.ctx.StatusPublisher)
+	assert.Nil(t, handlerCtx.ConnInfo)
+}
@@ -0,0 +1,101 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package bus
+
+import (
+	"sync"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+
+	"github.com/eclipse-kanto/suite-connector/connector"
+
+	"github.com/eclipse-kanto/azure-connector/routing"
+)
+
+// maxDeliveredMessages is the number of the most recently delivered C2D message IDs kept for the duplicates detection.
+const maxDeliveredMessages = 1024
+
+// DeliveredMessages keeps the IDs of the most recently delivered C2D messages,
+// so that the messages redelivered by the Azure IoT Hub after a reconnect are not forwarded again.
+// The same instance is passed to the command bus on each router start to keep the IDs across the router restarts.
+type DeliveredMessages struct {
+	lock  sync.Mutex
+	ids   map[string]struct{}
+	order []string
+	next  int
+}
+
+// NewDeliveredMessages creates the store of the recently delivered C2D message IDs.
+func NewDeliveredMessages() *DeliveredMessages {
+	return newDeliveredMessages(maxDeliveredMessages)
+}
+
+func newDeliveredMessages(capacity int) *DeliveredMessages {
+	return &DeliveredMessages{
+		ids:   make(map[string]struct{}, capacity),
+		order: make([]string, 0, capacity),
+	}
+}
+
+// delivered returns true if a message with the given ID is already delivered.
+func (d *DeliveredMessages) delivered(id string) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	_, ok := d.ids[id]
+	return ok
+}
+
+// add records the message ID as delivered, evicting the oldest one if the capacity is reached.
+func (d *DeliveredMessages) add(id string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if _, ok := d.ids[id]; ok {
+		return
+	}
+	if len(d.order) < cap(d.order) {
+		d.order = append(d.order, id)
+	} else {
+		delete(d.ids, d.order[d.next])
+		d.order[d.next] = id
+		d.next = (d.next + 1) % len(d.order)
+	}
+	d.ids[id] = struct{}{}
+}
+
+// track records the message as delivered once it is acknowledged, i.e. the produced messages are accepted by the local broker.
+func (d *DeliveredMessages) track(id string, msg *message.Message) {
+	go func() {
+		select {
+		case <-msg.Acked():
+			d.add(id)
+		case <-msg.Nacked():
+		case <-msg.Context().Done():
+			select {
+			case <-msg.Acked():
+				d.add(id)
+			default:
+			}
+		}
+	}()
+}
+
+// cloudMessageProperty returns the value of a property of a C2D message.
+func cloudMessageProperty(msg *message.Message, key string) string {
+	topic, _ := connector.TopicFromCtx(msg.Context())
+	if _, properties, ok := routing.ParseCloudTopic(topic); ok {
+		return properties.Get(key)
+	}
+	return ""
+}
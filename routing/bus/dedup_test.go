@@ -0,0 +1,136 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package bus
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+
+	"github.com/eclipse-kanto/azure-connector/routing/message/handlers"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeliveredMessagesEviction(t *testing.T) {
+	delivered := newDeliveredMessages(2)
+	delivered.add("1")
+	delivered.add("2")
+	delivered.add("2")
+	assert.True(t, delivered.delivered("1"))
+	assert.True(t, delivered.delivered("2"))
+
+	delivered.add("3")
+	assert.False(t, delivered.delivered("1"))
+	assert.True(t, delivered.delivered("2"))
+	assert.True(t, delivered.delivered("3"))
+
+	delivered.add("4")
+	assert.False(t, delivered.delivered("2"))
+	assert.True(t, delivered.delivered("4"))
+}
+
+func TestCommandBusRedelivery(t *testing.T) {
+	busHandler := &commandBusHandler{
+		logger:    watermill.NopLogger{},
+		delivered: newDeliveredMessages(maxDeliveredMessages),
+		commandHandlers: []handlers.CommandHandler{
+			&transformingCommandHandler{name: "handler", suffix: "-handled", matches: true},
+		},
+	}
+	topic := "devices/dev/messages/devicebound/%24.mid=c2d-1&subject=cmd"
+
+	nacked := topicMessage(topic, "payload")
+	produced, err := busHandler.HandleMessage(nacked)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"payload-handled"}, payloads(produced))
+	nacked.Nack()
+
+	acked := topicMessage(topic, "payload")
+	produced, err = busHandler.HandleMessage(acked)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"payload-handled"}, payloads(produced))
+	acked.Ack()
+	require.Eventually(t, func() bool {
+		return busHandler.delivered.delivered("c2d-1")
+	}, time.Second, 10*time.Millisecond)
+
+	produced, err = busHandler.HandleMessage(topicMessage(topic, "payload"))
+	require.NoError(t, err)
+	assert.Empty(t, produced)
+
+	produced, err = busHandler.HandleMessage(topicMessage("devices/dev/messages/devicebound/%24.mid=c2d-2", "payload"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"payload-handled"}, payloads(produced))
+
+	timedOut := topicMessage("devices/dev/messages/devicebound/%24.mid=c2d-3", "payload")
+	ctx, cancel := context.WithCancel(timedOut.Context())
+	timedOut.SetContext(ctx)
+	_, err = busHandler.HandleMessage(timedOut)
+	require.NoError(t, err)
+	cancel()
+	assert.Never(t, func() bool {
+		return busHandler.delivered.delivered("c2d-3")
+	}, 100*time.Millisecond, 10*time.Millisecond)
+}
+
+// chanSubscriber delivers the messages sent to its channel.
+type chanSubscriber struct {
+	messages  chan *message.Message
+	closeOnce sync.Once
+}
+
+func (s *chanSubscriber) Subscribe(ctx context.Context, topic string) (<-chan *message.Message, error) {
+	return s.messages, nil
+}
+
+func (s *chanSubscriber) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.messages)
+	})
+	return nil
+}
+
+func TestCommandBusRedeliveryAcrossRestarts(t *testing.T) {
+	delivered := NewDeliveredMessages()
+	// the redelivered message is not forwarded by the restarted router
+	for _, forwarded := range []int{1, 0} {
+		pub := &batchPublisher{}
+		sub := &chanSubscriber{messages: make(chan *message.Message)}
+		router, connInfo := setupTestRouter("dev")
+		CommandBusWithOptions(router, pub, sub, connInfo, []handlers.CommandHandler{
+			&transformingCommandHandler{name: "handler", suffix: "-handled", matches: true},
+		}, &CommandBusOptions{Delivered: delivered})
+		go router.Run(context.Background())
+		<-router.Running()
+
+		msg := topicMessage("devices/dev/messages/devicebound/%24.mid=c2d-1", "payload")
+		sub.messages <- msg
+		select {
+		case <-msg.Acked():
+		case <-time.After(time.Second):
+			require.Fail(t, "command message not acknowledged")
+		}
+		require.Eventually(t, func() bool {
+			return delivered.delivered("c2d-1")
+		}, time.Second, 10*time.Millisecond)
+		require.NoError(t, router.Close())
+
+		assert.Len(t, pub.messages(), forwarded)
+	}
+}
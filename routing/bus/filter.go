@@ -0,0 +1,383 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package bus
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+
+	"github.com/eclipse-kanto/suite-connector/connector"
+
+	"github.com/eclipse-kanto/azure-connector/config"
+	"github.com/eclipse-kanto/azure-connector/metrics"
+	"github.com/eclipse-kanto/azure-connector/routing"
+	"github.com/eclipse-kanto/azure-connector/routing/message/handlers"
+)
+
+// telemetryFilter is the state of a single telemetry filter of a handler.
+type telemetryFilter struct {
+	settings  *config.TelemetryFilter
+	sample    time.Duration
+	lastValue time.Duration
+	burst     float64
+
+	tokens  float64
+	refill  time.Time
+	topics  map[string]*filteredTopic
+	pending map[string]*heldMessage
+}
+
+// filteredTopic is the state of a local topic matching a filter.
+type filteredTopic struct {
+	values    []float64
+	forwarded time.Time
+}
+
+// heldMessage is the last message received on a local topic within the last value interval.
+type heldMessage struct {
+	msg   *message.Message
+	timer *time.Timer
+}
+
+// heldMessageKey marks the context of a held last value message.
+type heldMessageKey struct{}
+
+// telemetryFilters drops the telemetry messages exceeding the rate limits, not changed beyond the deadband or not sampled,
+// before they are processed by a handler. The messages in last value mode are held and passed back to the router handler
+// at the end of the interval, so that they are processed and published with the router middleware like the other messages.
+// The messages still held when the handler is closed are dropped.
+type telemetryFilters struct {
+	handlerName string
+	metrics     *metrics.ConnectorMetrics
+	logger      watermill.LoggerAdapter
+	now         func() time.Time
+
+	tree     *routing.TopicTree
+	lock     sync.Mutex
+	filters  []*telemetryFilter
+	released chan *message.Message
+
+	closing   chan struct{}
+	closeOnce sync.Once
+}
+
+func newTelemetryFilters(
+	settings []config.TelemetryFilter,
+	handlerName string,
+	connMetrics *metrics.ConnectorMetrics,
+	logger watermill.LoggerAdapter,
+) *telemetryFilters {
+	if len(settings) == 0 {
+		return nil
+	}
+
+	f := &telemetryFilters{
+		handlerName: handlerName,
+		metrics:     connMetrics,
+		logger:      logger,
+		now:         time.Now,
+		tree:        routing.NewTopicTree(),
+		released:    make(chan *message.Message),
+		closing:     make(chan struct{}),
+	}
+	for i := range settings {
+		// the settings are validated on load
+		sample, _ := settings[i].SampleInterval()
+		lastValue, _ := settings[i].LastValueInterval()
+		burst := float64(settings[i].RateBurst())
+		f.filters = append(f.filters, &telemetryFilter{
+			settings:  &settings[i],
+			sample:    sample,
+			lastValue: lastValue,
+			burst:     burst,
+			tokens:    burst,
+			topics:    map[string]*filteredTopic{},
+			pending:   map[string]*heldMessage{},
+		})
+		f.tree.Add(settings[i].Topic, i)
+	}
+	return f
+}
+
+// decorate applies the first filter matching the local topic of the message before the handler processes it.
+// The released last value messages are processed right away.
+func (f *telemetryFilters) decorate(handlerFunc message.HandlerFunc) message.HandlerFunc {
+	return func(msg *message.Message) ([]*message.Message, error) {
+		if held, _ := msg.Context().Value(heldMessageKey{}).(bool); held {
+			return handlerFunc(msg)
+		}
+
+		topic, _ := connector.TopicFromCtx(msg.Context())
+		matches := f.tree.Match(topic)
+		if len(matches) == 0 {
+			return handlerFunc(msg)
+		}
+
+		if f.admit(f.filters[matches[0]], topic, msg) {
+			return handlerFunc(msg)
+		}
+		return nil, nil
+	}
+}
+
+// admit returns true if the message is to be processed right away, otherwise it is either dropped or held.
+func (f *telemetryFilters) admit(filter *telemetryFilter, topic string, msg *message.Message) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	now := f.now()
+	state, ok := filter.topics[topic]
+	if !ok {
+		state = &filteredTopic{}
+		filter.topics[topic] = state
+	}
+
+	var values []float64
+	if filter.settings.Deadband != nil {
+		values = numericValues(filter.settings.Deadband.Paths, msg.Payload)
+		if !deadbandExceeded(state.values, values, filter.settings.Deadband.Threshold) {
+			f.drop(metrics.FilterDeadband)
+			return false
+		}
+	}
+	if current, ok := filter.pending[topic]; ok {
+		// the rate limit is already applied to the held message
+		current.msg = heldCopy(msg)
+		state.values = values
+		f.drop(metrics.FilterSuperseded)
+		return false
+	}
+	if filter.sample > 0 && !state.forwarded.IsZero() && now.Sub(state.forwarded) < filter.sample {
+		f.drop(metrics.FilterSampled)
+		return false
+	}
+	if filter.settings.Rate > 0 && !filter.take(now) {
+		f.drop(metrics.FilterRateLimited)
+		return false
+	}
+
+	if filter.settings.Deadband != nil {
+		state.values = values
+	}
+	state.forwarded = now
+
+	if filter.lastValue > 0 {
+		current := &heldMessage{msg: heldCopy(msg)}
+		current.timer = time.AfterFunc(filter.lastValue, func() {
+			f.release(filter, topic, current)
+		})
+		filter.pending[topic] = current
+		return false
+	}
+	return true
+}
+
+// take takes a token from the rate limit bucket, returning false if there is none.
+func (filter *telemetryFilter) take(now time.Time) bool {
+	if !filter.refill.IsZero() {
+		filter.tokens = math.Min(filter.burst, filter.tokens+now.Sub(filter.refill).Seconds()*filter.settings.Rate)
+	}
+	filter.refill = now
+	if filter.tokens < 1 {
+		return false
+	}
+	filter.tokens--
+	return true
+}
+
+// heldCopy returns a copy of the message that is processed after the original one is acknowledged.
+func heldCopy(msg *message.Message) *message.Message {
+	held := message.NewMessage(msg.UUID, msg.Payload)
+	for key, value := range msg.Metadata {
+		held.Metadata.Set(key, value)
+	}
+	held.SetContext(context.WithValue(detachedContext{msg.Context()}, heldMessageKey{}, true))
+	return held
+}
+
+// release passes the held message to the router handler, it is dropped if the handler is closed meanwhile.
+func (f *telemetryFilters) release(filter *telemetryFilter, topic string, current *heldMessage) {
+	f.lock.Lock()
+	if filter.pending[topic] != current {
+		f.lock.Unlock()
+		return
+	}
+	delete(filter.pending, topic)
+	f.lock.Unlock()
+
+	select {
+	case f.released <- current.msg:
+	case <-f.closing:
+		f.logger.Debug("Dropping last value message of closed handler", watermill.LogFields{"message_uuid": current.msg.UUID})
+		f.drop(metrics.FilterClosed)
+	}
+}
+
+// close drops all held messages and the ones being released.
+func (f *telemetryFilters) close() {
+	f.closeOnce.Do(func() {
+		close(f.closing)
+	})
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for _, filter := range f.filters {
+		for topic, current := range filter.pending {
+			current.timer.Stop()
+			delete(filter.pending, topic)
+			f.drop(metrics.FilterClosed)
+		}
+	}
+}
+
+// subscriber returns a subscriber passing the released last value messages along with the messages of the given subscriber.
+func (f *telemetryFilters) subscriber(sub message.Subscriber) message.Subscriber {
+	return &filteringSubscriber{Subscriber: sub, filters: f}
+}
+
+func (f *telemetryFilters) drop(reason string) {
+	if f.metrics != nil {
+		f.metrics.Filtered.Inc(f.handlerName, reason)
+	}
+}
+
+// numericValues returns the numeric values on the paths in the JSON payload, NaN for the missing or not numeric values.
+func numericValues(paths []string, payload []byte) []float64 {
+	var root interface{}
+	if err := json.Unmarshal(payload, &root); err != nil {
+		root = nil
+	}
+	if len(paths) == 0 {
+		return []float64{numericValue(root)}
+	}
+
+	values := make([]float64, len(paths))
+	for i, path := range paths {
+		value := root
+		for _, key := range strings.Split(path, ".") {
+			object, ok := value.(map[string]interface{})
+			if !ok {
+				value = nil
+				break
+			}
+			value = object[key]
+		}
+		values[i] = numericValue(value)
+	}
+	return values
+}
+
+func numericValue(value interface{}) float64 {
+	if number, ok := value.(float64); ok {
+		return number
+	}
+	return math.NaN()
+}
+
+// deadbandExceeded returns true if any value changed by more than the threshold since the last forwarded values.
+// The values that are not numeric are always considered changed.
+func deadbandExceeded(last, values []float64, threshold float64) bool {
+	if len(last) != len(values) {
+		return true
+	}
+	for i, value := range values {
+		if math.IsNaN(value) || math.IsNaN(last[i]) || math.Abs(value-last[i]) > threshold {
+			return true
+		}
+	}
+	return false
+}
+
+// detachedContext keeps the values of a message context after the message is acknowledged and its context is cancelled.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
+
+// filteringSubscriber merges the released last value messages into the subscribed messages of a router handler.
+type filteringSubscriber struct {
+	message.Subscriber
+
+	filters *telemetryFilters
+}
+
+// Subscribe subscribes the wrapped subscriber, the returned channel is closed once the channel of the wrapped one is closed.
+func (s *filteringSubscriber) Subscribe(ctx context.Context, topic string) (<-chan *message.Message, error) {
+	subscribed, err := s.Subscriber.Subscribe(ctx, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan *message.Message)
+	go func() {
+		defer close(out)
+
+		for {
+			var msg *message.Message
+			select {
+			case received, ok := <-subscribed:
+				if !ok {
+					return
+				}
+				msg = received
+			case msg = <-s.filters.released:
+			}
+
+			select {
+			case out <- msg:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+// filteringTelemetryHandler drops the held last value messages on close.
+type filteringTelemetryHandler struct {
+	handlers.TelemetryHandler
+
+	filters *telemetryFilters
+}
+
+// Connected notifies the wrapped handler, if it listens for the Azure IoT Hub connection changes.
+func (h *filteringTelemetryHandler) Connected(connected bool, err error) {
+	if listener, ok := h.TelemetryHandler.(connector.ConnectionListener); ok {
+		listener.Connected(connected, err)
+	}
+}
+
+// Close drops the held messages and closes the handler.
+func (h *filteringTelemetryHandler) Close() error {
+	h.filters.close()
+	return handlers.CloseHandler(h.TelemetryHandler)
+}
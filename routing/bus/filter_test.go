@@ -0,0 +1,249 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package bus
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+
+	"github.com/eclipse-kanto/azure-connector/config"
+	"github.com/eclipse-kanto/azure-connector/metrics"
+	"github.com/eclipse-kanto/azure-connector/routing/message/handlers"
+
+	test "github.com/eclipse-kanto/azure-connector/routing/bus/internal/testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const filterHandlerName = "filtered"
+
+type filterClock struct {
+	now time.Time
+}
+
+func (c *filterClock) time() time.Time {
+	return c.now
+}
+
+// channelSubscriber passes the messages sent on its channel to the subscribed router handler.
+type channelSubscriber struct {
+	messages chan *message.Message
+}
+
+func (s *channelSubscriber) Subscribe(ctx context.Context, topic string) (<-chan *message.Message, error) {
+	return s.messages, nil
+}
+
+func (s *channelSubscriber) Close() error {
+	close(s.messages)
+	return nil
+}
+
+func newTestFilters(filters ...config.TelemetryFilter) (*telemetryFilters, *metrics.ConnectorMetrics, *filterClock) {
+	connMetrics := metrics.NewConnectorMetrics(metrics.NewRegistry())
+	f := newTelemetryFilters(filters, filterHandlerName, connMetrics, watermill.NopLogger{})
+	clock := &filterClock{now: time.Now()}
+	f.now = clock.time
+	return f, connMetrics, clock
+}
+
+func filtered(t *testing.T, handlerFunc message.HandlerFunc, topic string, values ...string) []string {
+	var forwarded []string
+	for _, payload := range values {
+		produced, err := handlerFunc(topicMessage(topic, payload))
+		require.NoError(t, err)
+		forwarded = append(forwarded, payloads(produced)...)
+	}
+	return forwarded
+}
+
+func TestTelemetryFiltersRateLimit(t *testing.T) {
+	f, connMetrics, clock := newTestFilters(config.TelemetryFilter{Topic: "sensors/#", Rate: 2})
+	handlerFunc := f.decorate(telemetryPassthrough)
+
+	assert.Equal(t, []string{"1", "2"}, filtered(t, handlerFunc, "sensors/a", "1", "2", "3"))
+	assert.Empty(t, filtered(t, handlerFunc, "sensors/b", "4"))
+	assert.Equal(t, []string{"5"}, filtered(t, handlerFunc, "events", "5"))
+
+	clock.now = clock.now.Add(500 * time.Millisecond)
+	assert.Equal(t, []string{"6"}, filtered(t, handlerFunc, "sensors/b", "6", "7"))
+	clock.now = clock.now.Add(time.Minute)
+	assert.Equal(t, []string{"8", "9"}, filtered(t, handlerFunc, "sensors/b", "8", "9", "10"))
+
+	assert.Equal(t, 4.0, connMetrics.Filtered.Value(filterHandlerName, metrics.FilterRateLimited))
+}
+
+func TestTelemetryFiltersDeadband(t *testing.T) {
+	f, connMetrics, _ := newTestFilters(
+		config.TelemetryFilter{Topic: "sensors/+", Deadband: &config.DeadbandSettings{Paths: []string{"temp", "meter.value"}, Threshold: 0.5}},
+		config.TelemetryFilter{Topic: "level", Deadband: &config.DeadbandSettings{Threshold: 1}},
+	)
+	handlerFunc := f.decorate(telemetryPassthrough)
+
+	assert.Equal(t, []string{
+		`{"temp":20,"meter":{"value":1}}`,
+		`{"temp":20.6,"meter":{"value":1}}`,
+		`{"temp":20.6,"meter":{"value":0.4}}`,
+		`{"temp":20.6}`,
+	}, filtered(t, handlerFunc, "sensors/a",
+		`{"temp":20,"meter":{"value":1}}`,
+		`{"temp":20.5,"meter":{"value":1}}`,
+		`{"temp":20.6,"meter":{"value":1}}`,
+		`{"temp":20.6,"meter":{"value":0.6}}`,
+		`{"temp":20.6,"meter":{"value":0.4}}`,
+		`{"temp":20.6}`,
+	))
+	assert.Equal(t, []string{`{"temp":20.5}`}, filtered(t, handlerFunc, "sensors/b", `{"temp":20.5}`))
+	assert.Equal(t, []string{"1", "2.5", "text"}, filtered(t, handlerFunc, "level", "1", "2", "2.5", "3", "text"))
+
+	assert.Equal(t, 4.0, connMetrics.Filtered.Value(filterHandlerName, metrics.FilterDeadband))
+}
+
+func TestTelemetryFiltersSample(t *testing.T) {
+	f, connMetrics, clock := newTestFilters(config.TelemetryFilter{Topic: "sensors/#", Sample: "1s"})
+	handlerFunc := f.decorate(telemetryPassthrough)
+
+	assert.Equal(t, []string{"1"}, filtered(t, handlerFunc, "sensors/a", "1", "2"))
+	assert.Equal(t, []string{"3"}, filtered(t, handlerFunc, "sensors/b", "3"))
+	clock.now = clock.now.Add(999 * time.Millisecond)
+	assert.Empty(t, filtered(t, handlerFunc, "sensors/a", "4"))
+	clock.now = clock.now.Add(time.Millisecond)
+	assert.Equal(t, []string{"5"}, filtered(t, handlerFunc, "sensors/a", "5", "6"))
+
+	assert.Equal(t, 3.0, connMetrics.Filtered.Value(filterHandlerName, metrics.FilterSampled))
+}
+
+func TestTelemetryFiltersLastValue(t *testing.T) {
+	f, connMetrics, _ := newTestFilters(config.TelemetryFilter{Topic: "sensors/#", LastValue: "50ms"})
+	handlerFunc := f.decorate(telemetryPassthrough)
+	sub := &channelSubscriber{messages: make(chan *message.Message)}
+	released, err := f.subscriber(sub).Subscribe(context.Background(), "sensors/#")
+	require.NoError(t, err)
+
+	assert.Empty(t, filtered(t, handlerFunc, "sensors/a", "1", "2", "3"))
+	assert.Empty(t, filtered(t, handlerFunc, "sensors/b", "4"))
+	var forwarded []string
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-released:
+			// the released messages are not held again
+			produced, err := handlerFunc(msg)
+			require.NoError(t, err)
+			forwarded = append(forwarded, payloads(produced)...)
+		case <-time.After(time.Second):
+			require.Fail(t, "last value message not released")
+		}
+	}
+	assert.ElementsMatch(t, []string{"3", "4"}, forwarded)
+	assert.Equal(t, 2.0, connMetrics.Filtered.Value(filterHandlerName, metrics.FilterSuperseded))
+
+	// the subscribed messages are passed as well
+	go func() {
+		sub.messages <- topicMessage("sensors/a", "5")
+	}()
+	assert.Equal(t, "5", string((<-released).Payload))
+	require.NoError(t, sub.Close())
+	_, ok := <-released
+	assert.False(t, ok)
+}
+
+func TestTelemetryFiltersLastValueClose(t *testing.T) {
+	f, connMetrics, _ := newTestFilters(config.TelemetryFilter{Topic: "sensors/#", LastValue: "1h"})
+	handler := &filteringTelemetryHandler{TelemetryHandler: &batchingDummyHandler{}, filters: f}
+	handlerFunc := f.decorate(telemetryPassthrough)
+
+	assert.Empty(t, filtered(t, handlerFunc, "sensors/a", "1", "2"))
+	assert.Empty(t, filtered(t, handlerFunc, "sensors/b", "3"))
+	require.NoError(t, handler.Close())
+	assert.Equal(t, 2.0, connMetrics.Filtered.Value(filterHandlerName, metrics.FilterClosed))
+
+	// a message being released on close is dropped as well
+	f, connMetrics, _ = newTestFilters(config.TelemetryFilter{Topic: "sensors/#", LastValue: "10ms"})
+	handlerFunc = f.decorate(telemetryPassthrough)
+	assert.Empty(t, filtered(t, handlerFunc, "sensors/a", "1"))
+	time.Sleep(50 * time.Millisecond)
+	f.close()
+	require.Eventually(t, func() bool {
+		return connMetrics.Filtered.Value(filterHandlerName, metrics.FilterClosed) == 1
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestTelemetryBusLastValueMiddleware(t *testing.T) {
+	router, connInfo := setupTestRouter(routesDeviceID)
+	var lock sync.Mutex
+	handled := map[string]int{}
+	router.AddMiddleware(func(h message.HandlerFunc) message.HandlerFunc {
+		return func(msg *message.Message) ([]*message.Message, error) {
+			lock.Lock()
+			handled[message.HandlerNameFromCtx(msg.Context())+":"+string(msg.Payload)]++
+			lock.Unlock()
+			return h(msg)
+		}
+	})
+
+	pub := &batchPublisher{}
+	sub := &channelSubscriber{messages: make(chan *message.Message)}
+	initialized := TelemetryBusWithOptions(router, pub, sub, connInfo,
+		[]handlers.TelemetryHandler{test.NewDummyTelemetryHandler(filterHandlerName, "sensors/#", nil)},
+		&TelemetryBusOptions{Filters: []config.TelemetryFilter{{Topic: "sensors/#", LastValue: "50ms"}}},
+	)
+	require.Len(t, initialized, 1)
+	go router.Run(context.Background())
+	<-router.Running()
+	defer func() {
+		require.NoError(t, router.Close())
+		for _, handler := range initialized {
+			assert.NoError(t, handlers.CloseHandler(handler))
+		}
+	}()
+
+	for _, payload := range []string{"1", "2"} {
+		sub.messages <- topicMessage("sensors/a", payload)
+	}
+	require.Eventually(t, func() bool {
+		return len(pub.messages()) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// the released message passes the middleware of the handler again, the messages are handled concurrently
+	released := string(pub.messages()[0].Payload)
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Equal(t, 2, handled[filterHandlerName+":"+released])
+	assert.Equal(t, 3, handled[filterHandlerName+":1"]+handled[filterHandlerName+":2"])
+}
+
+func TestTelemetryFiltersCombined(t *testing.T) {
+	f, connMetrics, clock := newTestFilters(config.TelemetryFilter{
+		Topic:    "sensors/#",
+		Rate:     1,
+		Deadband: &config.DeadbandSettings{Threshold: 1},
+		Sample:   "10s",
+	})
+	handlerFunc := f.decorate(telemetryPassthrough)
+
+	assert.Equal(t, []string{"1"}, filtered(t, handlerFunc, "sensors/a", "1", "1.5", "5"))
+	clock.now = clock.now.Add(10 * time.Second)
+	assert.Equal(t, []string{"5"}, filtered(t, handlerFunc, "sensors/a", "5"))
+	assert.Empty(t, filtered(t, handlerFunc, "sensors/b", "1"))
+
+	assert.Equal(t, 1.0, connMetrics.Filtered.Value(filterHandlerName, metrics.FilterDeadband))
+	assert.Equal(t, 1.0, connMetrics.Filtered.Value(filterHandlerName, metrics.FilterSampled))
+	assert.Equal(t, 1.0, connMetrics.Filtered.Value(filterHandlerName, metrics.FilterRateLimited))
+	assert.Nil(t, newTelemetryFilters(nil, filterHandlerName, nil, watermill.NopLogger{}))
+}
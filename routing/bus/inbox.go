@@ -0,0 +1,318 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package bus
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/pkg/errors"
+
+	"github.com/eclipse-kanto/suite-connector/connector"
+
+	"github.com/eclipse-kanto/azure-connector/config"
+	"github.com/eclipse-kanto/azure-connector/health"
+	"github.com/eclipse-kanto/azure-connector/metrics"
+)
+
+const (
+	// MetadataExpiry is the metadata key of the expiry time of the messages produced from a C2D message, in RFC 3339 format.
+	MetadataExpiry = "expiry"
+
+	inboxFileExt = ".json"
+	inboxTmpExt  = ".tmp"
+)
+
+// InboxOptions contains the settings of the local C2D inbox.
+type InboxOptions struct {
+	// Dir is the directory of the stored messages, the messages are kept in memory and lost on restart if not set.
+	Dir string
+	// MaxMessages is the max number of stored messages, config.DefaultInboxMaxMessages if not set.
+	MaxMessages int
+	// Metrics tracks the inbox size and events, if set.
+	Metrics *metrics.ConnectorMetrics
+	// Status reports the inbox size, if set.
+	Status *health.Status
+}
+
+// inboxEntry is a message stored in the inbox.
+type inboxEntry struct {
+	UUID    string         `json:"uuid"`
+	Topic   string         `json:"topic"`
+	Qos     *connector.Qos `json:"qos,omitempty"`
+	Payload []byte         `json:"payload"`
+	Expiry  *time.Time     `json:"expiry,omitempty"`
+}
+
+func (e *inboxEntry) expired(now time.Time) bool {
+	return e.Expiry != nil && !now.Before(*e.Expiry)
+}
+
+func (e *inboxEntry) message() *message.Message {
+	msg := message.NewMessage(e.UUID, e.Payload)
+	msg.SetContext(connector.SetTopicToCtx(msg.Context(), e.Topic))
+	if e.Qos != nil {
+		msg.SetContext(connector.SetQosToCtx(msg.Context(), *e.Qos))
+	}
+	return msg
+}
+
+// Inbox is a publisher of the messages produced from the C2D messages to the local broker,
+// which stores the messages that cannot be published and replays them in order when the local connection is restored.
+// The messages stored on the disk survive restarts. The stored messages are discarded once their expiry time elapses.
+type Inbox struct {
+	pub         message.Publisher
+	dir         string
+	maxMessages int
+	metrics     *metrics.ConnectorMetrics
+	status      *health.Status
+	logger      watermill.LoggerAdapter
+
+	disconnected int32
+
+	lock    sync.Mutex
+	pending []string
+	entries map[string]*inboxEntry
+	next    uint64
+}
+
+// NewInbox creates an inbox publishing the messages using the given publisher and loads the messages stored in the inbox directory, if set.
+func NewInbox(pub message.Publisher, options *InboxOptions, logger watermill.LoggerAdapter) (*Inbox, error) {
+	inbox := &Inbox{
+		pub:         pub,
+		dir:         options.Dir,
+		maxMessages: options.MaxMessages,
+		metrics:     options.Metrics,
+		status:      options.Status,
+		logger:      logger,
+	}
+	if inbox.maxMessages <= 0 {
+		inbox.maxMessages = config.DefaultInboxMaxMessages
+	}
+	if len(inbox.dir) == 0 {
+		inbox.entries = make(map[string]*inboxEntry)
+		inbox.report()
+		return inbox, nil
+	}
+
+	if err := os.MkdirAll(inbox.dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "cannot create inbox directory")
+	}
+	files, err := ioutil.ReadDir(inbox.dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read inbox directory")
+	}
+	for _, file := range files {
+		name := file.Name()
+		if strings.HasSuffix(name, inboxTmpExt) {
+			os.Remove(filepath.Join(inbox.dir, name))
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, inboxFileExt), 10, 64)
+		if err != nil || !strings.HasSuffix(name, inboxFileExt) {
+			continue
+		}
+		inbox.pending = append(inbox.pending, name)
+		if seq >= inbox.next {
+			inbox.next = seq + 1
+		}
+	}
+	sort.Strings(inbox.pending)
+	inbox.report()
+	return inbox, nil
+}
+
+// Publish publishes the messages, storing them in the inbox if the publishing fails.
+// While the inbox holds messages, new messages are published only after the stored ones to keep the delivery order.
+// While the local connection is lost, the messages are stored without publishing.
+func (i *Inbox) Publish(topic string, messages ...*message.Message) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	connected := atomic.LoadInt32(&i.disconnected) == 0
+	if connected && len(i.pending) > 0 {
+		i.replay()
+	}
+	for _, msg := range messages {
+		if connected && len(i.pending) == 0 {
+			err := i.pub.Publish(topic, msg)
+			if err == nil {
+				continue
+			}
+			i.logger.Debug("Storing message in the inbox", watermill.LogFields{"message_uuid": msg.UUID, "error": err.Error()})
+		}
+		if err := i.store(topic, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the underlying publisher, the stored messages are kept.
+func (i *Inbox) Close() error {
+	return i.pub.Close()
+}
+
+// Connected replays the stored messages when the local connection is restored.
+func (i *Inbox) Connected(connected bool, err error) {
+	if connected {
+		atomic.StoreInt32(&i.disconnected, 0)
+		go i.Replay()
+	} else {
+		atomic.StoreInt32(&i.disconnected, 1)
+	}
+}
+
+// Replay publishes the stored messages in order, until a publishing fails.
+func (i *Inbox) Replay() {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	i.replay()
+}
+
+// Len returns the number of stored messages.
+func (i *Inbox) Len() int {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	return len(i.pending)
+}
+
+func (i *Inbox) replay() {
+	defer i.report()
+
+	for len(i.pending) > 0 {
+		name := i.pending[0]
+		entry, err := i.load(name)
+		if err != nil {
+			i.logger.Error("Dropping unreadable inbox message", err, watermill.LogFields{"file": name})
+			i.remove(metrics.InboxDropped)
+			continue
+		}
+		if entry.expired(time.Now()) {
+			i.logger.Info("Discarding expired inbox message", watermill.LogFields{"message_uuid": entry.UUID})
+			i.remove(metrics.InboxExpired)
+			continue
+		}
+		if err := i.pub.Publish(entry.Topic, entry.message()); err != nil {
+			i.logger.Debug("Cannot replay inbox messages", watermill.LogFields{"pending": len(i.pending), "error": err.Error()})
+			return
+		}
+		i.remove(metrics.InboxReplayed)
+	}
+}
+
+func (i *Inbox) store(topic string, msg *message.Message) error {
+	entry := &inboxEntry{UUID: msg.UUID, Topic: topic, Payload: msg.Payload}
+	if msgTopic, ok := connector.TopicFromCtx(msg.Context()); ok && len(msgTopic) > 0 {
+		entry.Topic = msgTopic
+	}
+	if qos, ok := connector.QosFromCtx(msg.Context()); ok {
+		entry.Qos = &qos
+	}
+	if expiry, err := time.Parse(time.RFC3339Nano, msg.Metadata.Get(MetadataExpiry)); err == nil {
+		entry.Expiry = &expiry
+	}
+
+	if entry.expired(time.Now()) {
+		i.logger.Info("Discarding expired message", watermill.LogFields{"message_uuid": msg.UUID})
+		i.event(metrics.InboxExpired)
+		return nil
+	}
+	if len(i.pending) >= i.maxMessages {
+		i.event(metrics.InboxDropped)
+		return errors.Errorf("inbox is full with %d messages", len(i.pending))
+	}
+
+	name := fmt.Sprintf("%020d%s", i.next, inboxFileExt)
+	if i.entries != nil {
+		i.entries[name] = entry
+	} else if err := i.write(name, entry); err != nil {
+		return err
+	}
+
+	i.next++
+	i.pending = append(i.pending, name)
+	i.event(metrics.InboxStored)
+	i.report()
+	return nil
+}
+
+func (i *Inbox) write(name string, entry *inboxEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return errors.Wrap(err, "cannot encode inbox message")
+	}
+	tmpPath := filepath.Join(i.dir, name+inboxTmpExt)
+	if err := ioutil.WriteFile(tmpPath, data, 0600); err != nil {
+		return errors.Wrap(err, "cannot store inbox message")
+	}
+	if err := os.Rename(tmpPath, filepath.Join(i.dir, name)); err != nil {
+		os.Remove(tmpPath)
+		return errors.Wrap(err, "cannot store inbox message")
+	}
+	return nil
+}
+
+func (i *Inbox) load(name string) (*inboxEntry, error) {
+	if i.entries != nil {
+		return i.entries[name], nil
+	}
+	data, err := ioutil.ReadFile(filepath.Join(i.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	entry := &inboxEntry{}
+	if err := json.Unmarshal(data, entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// remove deletes the oldest stored message.
+func (i *Inbox) remove(event string) {
+	if i.entries != nil {
+		delete(i.entries, i.pending[0])
+	} else if err := os.Remove(filepath.Join(i.dir, i.pending[0])); err != nil && !os.IsNotExist(err) {
+		i.logger.Error("Cannot remove inbox message", err, watermill.LogFields{"file": i.pending[0]})
+	}
+	i.pending = i.pending[1:]
+	i.event(event)
+}
+
+func (i *Inbox) event(event string) {
+	if i.metrics != nil {
+		i.metrics.InboxEvents.Inc(event)
+	}
+}
+
+func (i *Inbox) report() {
+	if i.metrics != nil {
+		i.metrics.InboxMessages.Set(float64(len(i.pending)))
+	}
+	if i.status != nil {
+		i.status.SetInboxMessages(len(i.pending))
+	}
+}
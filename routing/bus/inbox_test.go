@@ -0,0 +1,210 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package bus
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/pkg/errors"
+
+	"github.com/eclipse-kanto/suite-connector/connector"
+
+	"github.com/eclipse-kanto/azure-connector/health"
+	"github.com/eclipse-kanto/azure-connector/metrics"
+	"github.com/eclipse-kanto/azure-connector/routing/message/handlers"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func commandMessage(topic, payload string) *message.Message {
+	msg := message.NewMessage(watermill.NewUUID(), []byte(payload))
+	msg.SetContext(connector.SetTopicToCtx(msg.Context(), topic))
+	return msg
+}
+
+func publishedTopics(pub *batchPublisher) []string {
+	var topics []string
+	for _, msg := range pub.messages() {
+		topic, _ := connector.TopicFromCtx(msg.Context())
+		topics = append(topics, topic)
+	}
+	return topics
+}
+
+func newTestInbox(t *testing.T, pub message.Publisher, options *InboxOptions) *Inbox {
+	inbox, err := NewInbox(pub, options, watermill.NopLogger{})
+	require.NoError(t, err)
+	return inbox
+}
+
+func TestInboxStoreAndReplay(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "inbox")
+	connMetrics := metrics.NewConnectorMetrics(metrics.NewRegistry())
+	status := health.NewStatus()
+	pub := &batchPublisher{}
+	inbox := newTestInbox(t, pub, &InboxOptions{Dir: dir, Metrics: connMetrics, Status: status})
+
+	require.NoError(t, inbox.Publish("", commandMessage("command/1", "1")))
+	assert.Equal(t, []string{"command/1"}, publishedTopics(pub))
+
+	pub.err = errors.New("not connected")
+	qos1 := commandMessage("command/2", "2")
+	qos1.SetContext(connector.SetQosToCtx(qos1.Context(), connector.QosAtLeastOnce))
+	require.NoError(t, inbox.Publish("", qos1, commandMessage("command/3", "3")))
+	assert.Equal(t, 2, inbox.Len())
+	assert.Equal(t, float64(2), connMetrics.InboxMessages.Value())
+	assert.Equal(t, float64(2), connMetrics.InboxEvents.Value(metrics.InboxStored))
+	assert.Equal(t, 2, status.Report().InboxMessages)
+
+	pub.err = nil
+	inbox.Connected(true, nil)
+	require.Eventually(t, func() bool {
+		return inbox.Len() == 0
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"command/1", "command/2", "command/3"}, publishedTopics(pub))
+
+	replayed := pub.messages()[1]
+	assert.Equal(t, qos1.UUID, replayed.UUID)
+	assert.Equal(t, "2", string(replayed.Payload))
+	qos, ok := connector.QosFromCtx(replayed.Context())
+	assert.True(t, ok)
+	assert.Equal(t, connector.QosAtLeastOnce, qos)
+
+	assert.Equal(t, float64(2), connMetrics.InboxEvents.Value(metrics.InboxReplayed))
+	assert.Equal(t, float64(0), connMetrics.InboxMessages.Value())
+	assert.Equal(t, 0, status.Report().InboxMessages)
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestInboxKeepsOrder(t *testing.T) {
+	pub := &batchPublisher{err: errors.New("not connected")}
+	inbox := newTestInbox(t, pub, &InboxOptions{Dir: t.TempDir()})
+
+	require.NoError(t, inbox.Publish("", commandMessage("command/1", "1")))
+	pub.err = nil
+	require.NoError(t, inbox.Publish("", commandMessage("command/2", "2")))
+	assert.Equal(t, []string{"command/1", "command/2"}, publishedTopics(pub))
+	assert.Equal(t, 0, inbox.Len())
+}
+
+func TestInboxPersistence(t *testing.T) {
+	dir := t.TempDir()
+	pub := &batchPublisher{err: errors.New("not connected")}
+	inbox := newTestInbox(t, pub, &InboxOptions{Dir: dir})
+	for _, topic := range []string{"command/1", "command/2"} {
+		require.NoError(t, inbox.Publish("", commandMessage(topic, "payload")))
+	}
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "unknown.txt"), []byte("x"), 0600))
+
+	restarted := newTestInbox(t, pub, &InboxOptions{Dir: dir})
+	assert.Equal(t, 2, restarted.Len())
+	require.NoError(t, restarted.Publish("", commandMessage("command/3", "payload")))
+	assert.Equal(t, 3, restarted.Len())
+
+	pub.err = nil
+	restarted.Replay()
+	assert.Equal(t, []string{"command/1", "command/2", "command/3"}, publishedTopics(pub))
+}
+
+func TestInboxInMemory(t *testing.T) {
+	pub := &batchPublisher{err: errors.New("not connected")}
+	inbox := newTestInbox(t, pub, &InboxOptions{MaxMessages: 2})
+
+	require.NoError(t, inbox.Publish("", commandMessage("command/1", "1"), commandMessage("command/2", "2")))
+	assert.Error(t, inbox.Publish("", commandMessage("command/3", "3")))
+	assert.Equal(t, 2, inbox.Len())
+
+	pub.err = nil
+	inbox.Replay()
+	assert.Equal(t, []string{"command/1", "command/2"}, publishedTopics(pub))
+	assert.Equal(t, []string{"1", "2"}, payloads(pub.messages()))
+	assert.Equal(t, 0, inbox.Len())
+}
+
+func TestInboxDisconnected(t *testing.T) {
+	pub := &flakyPublisher{}
+	inbox := newTestInbox(t, pub, &InboxOptions{})
+
+	inbox.Connected(false, errors.New("connection lost"))
+	require.NoError(t, inbox.Publish("", commandMessage("command/1", "1")))
+	assert.Equal(t, 0, pub.attempts)
+	assert.Equal(t, 1, inbox.Len())
+
+	inbox.Connected(true, nil)
+	require.Eventually(t, func() bool {
+		return inbox.Len() == 0
+	}, time.Second, 10*time.Millisecond)
+	require.NoError(t, inbox.Publish("", commandMessage("command/2", "2")))
+	assert.Equal(t, []string{"1", "2"}, pub.payloads())
+}
+
+func TestInboxExpiry(t *testing.T) {
+	connMetrics := metrics.NewConnectorMetrics(metrics.NewRegistry())
+	pub := &batchPublisher{err: errors.New("not connected")}
+	inbox := newTestInbox(t, pub, &InboxOptions{Dir: t.TempDir(), Metrics: connMetrics})
+
+	expired := commandMessage("command/expired", "payload")
+	expired.Metadata.Set(MetadataExpiry, time.Now().Add(-time.Second).UTC().Format(time.RFC3339Nano))
+	expiring := commandMessage("command/expiring", "payload")
+	expiring.Metadata.Set(MetadataExpiry, time.Now().Add(100*time.Millisecond).UTC().Format(time.RFC3339Nano))
+	valid := commandMessage("command/valid", "payload")
+	valid.Metadata.Set(MetadataExpiry, time.Now().Add(time.Hour).UTC().Format(time.RFC3339Nano))
+
+	require.NoError(t, inbox.Publish("", expired, expiring, valid))
+	assert.Equal(t, 2, inbox.Len())
+
+	time.Sleep(150 * time.Millisecond)
+	pub.err = nil
+	inbox.Replay()
+	assert.Equal(t, []string{"command/valid"}, publishedTopics(pub))
+	assert.Equal(t, float64(2), connMetrics.InboxEvents.Value(metrics.InboxExpired))
+}
+
+func TestInboxFull(t *testing.T) {
+	connMetrics := metrics.NewConnectorMetrics(metrics.NewRegistry())
+	pub := &batchPublisher{err: errors.New("not connected")}
+	inbox := newTestInbox(t, pub, &InboxOptions{Dir: t.TempDir(), MaxMessages: 1, Metrics: connMetrics})
+
+	require.NoError(t, inbox.Publish("", commandMessage("command/1", "payload")))
+	assert.Error(t, inbox.Publish("", commandMessage("command/2", "payload")))
+	assert.Equal(t, 1, inbox.Len())
+	assert.Equal(t, float64(1), connMetrics.InboxEvents.Value(metrics.InboxDropped))
+}
+
+func TestCommandBusExpiryMetadata(t *testing.T) {
+	busHandler := &commandBusHandler{
+		logger: watermill.NopLogger{},
+		commandHandlers: []handlers.CommandHandler{
+			&transformingCommandHandler{name: "handler", suffix: "-handled", matches: true},
+		},
+	}
+
+	expiry := "2022-06-01T10:00:00.000Z"
+	produced, err := busHandler.HandleMessage(topicMessage("devices/dev/messages/devicebound/%24.exp="+expiry, "payload"))
+	require.NoError(t, err)
+	require.Len(t, produced, 1)
+	assert.Equal(t, expiry, produced[0].Metadata.Get(MetadataExpiry))
+
+	produced, err = busHandler.HandleMessage(topicMessage("devices/dev/messages/devicebound/", "payload"))
+	require.NoError(t, err)
+	require.Len(t, produced, 1)
+	assert.Empty(t, produced[0].Metadata.Get(MetadataExpiry))
+}
@@ -0,0 +1,231 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package bus
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/pkg/errors"
+
+	"github.com/eclipse-kanto/suite-connector/connector"
+
+	"github.com/eclipse-kanto/azure-connector/config"
+	"github.com/eclipse-kanto/azure-connector/fileupload"
+	"github.com/eclipse-kanto/azure-connector/routing"
+)
+
+const (
+	// PropertySplitID is the device-to-cloud message property with the ID of the split message, shared by all parts.
+	PropertySplitID = "splitId"
+	// PropertySplitIndex is the device-to-cloud message property with the zero-based index of the part.
+	PropertySplitIndex = "splitIndex"
+	// PropertySplitCount is the device-to-cloud message property with the number of parts.
+	PropertySplitCount = "splitCount"
+	// PropertyOffload is the device-to-cloud message property marking a reference to an offloaded payload.
+	PropertyOffload = "offload"
+	// OffloadBlob marks a reference to a payload uploaded as a blob.
+	OffloadBlob = "blob"
+
+	// splitOverhead reserves space for the split properties of the parts.
+	splitOverhead = 128
+
+	offloadBlobPrefix = "telemetry/"
+	offloadTimeout    = time.Minute
+)
+
+// SizeLimitOptions contains the settings of the device-to-cloud message size check.
+type SizeLimitOptions struct {
+	// MaxSize is the max size of a device-to-cloud message including its properties, config.MaxMessageSize if not set.
+	MaxSize int
+	// Policy is the handling of the oversized messages, reject by default.
+	Policy string
+	// Uploader uploads the offloaded payloads, required by the offload policy.
+	Uploader fileupload.Uploader
+	// ErrorPublisher publishes the local error events about the rejected messages.
+	ErrorPublisher message.Publisher
+}
+
+// offloadReference is the payload of the message sent instead of an offloaded one.
+type offloadReference struct {
+	fileupload.Result
+
+	URL             string `json:"url"`
+	ContentType     string `json:"contentType,omitempty"`
+	ContentEncoding string `json:"contentEncoding,omitempty"`
+}
+
+// sizeLimit checks the size of the device-to-cloud messages produced by the telemetry handlers.
+type sizeLimit struct {
+	maxSize  int
+	policy   string
+	uploader fileupload.Uploader
+	errorPub message.Publisher
+	logger   watermill.LoggerAdapter
+}
+
+func newSizeLimit(options *SizeLimitOptions, logger watermill.LoggerAdapter) *sizeLimit {
+	limit := &sizeLimit{logger: logger}
+	if options != nil {
+		limit.maxSize = options.MaxSize
+		limit.policy = options.Policy
+		limit.uploader = options.Uploader
+		limit.errorPub = options.ErrorPublisher
+	}
+	if limit.maxSize <= 0 {
+		limit.maxSize = config.MaxMessageSize
+	}
+	return limit
+}
+
+// decorate applies the size policy to the oversized device-to-cloud messages produced by the handler.
+func (l *sizeLimit) decorate(handlerFunc message.HandlerFunc) message.HandlerFunc {
+	return func(msg *message.Message) ([]*message.Message, error) {
+		produced, err := handlerFunc(msg)
+		if err != nil || len(produced) == 0 {
+			return produced, err
+		}
+
+		localTopic, _ := connector.TopicFromCtx(msg.Context())
+		result := make([]*message.Message, 0, len(produced))
+		for _, m := range produced {
+			result = append(result, l.apply(localTopic, m)...)
+		}
+		return result, nil
+	}
+}
+
+func (l *sizeLimit) apply(localTopic string, msg *message.Message) []*message.Message {
+	topic, _ := connector.TopicFromCtx(msg.Context())
+	deviceID, properties, ok := routing.ParseTelemetryTopic(topic)
+	if !ok {
+		return []*message.Message{msg}
+	}
+
+	size := len(msg.Payload) + len(properties.Encode())
+	if size <= l.maxSize {
+		return []*message.Message{msg}
+	}
+
+	switch l.policy {
+	case config.MessageSizeSplit:
+		if parts := l.split(deviceID, properties, msg); parts != nil {
+			return parts
+		}
+		l.reject(localTopic, msg, size, errors.New("properties too large to split the message"))
+	case config.MessageSizeOffload:
+		reference, err := l.offload(deviceID, properties, msg)
+		if err == nil {
+			return []*message.Message{reference}
+		}
+		l.reject(localTopic, msg, size, err)
+	default:
+		l.reject(localTopic, msg, size, nil)
+	}
+	return nil
+}
+
+// split returns the message payload split in parts fitting the max size, nil if the properties leave no space for the payload.
+func (l *sizeLimit) split(deviceID string, properties url.Values, msg *message.Message) []*message.Message {
+	properties.Del(keyMessageID)
+	chunkSize := l.maxSize - len(properties.Encode()) - splitOverhead
+	if chunkSize <= 0 {
+		return nil
+	}
+
+	count := (len(msg.Payload) + chunkSize - 1) / chunkSize
+	properties.Set(PropertySplitID, msg.UUID)
+	properties.Set(PropertySplitCount, strconv.Itoa(count))
+
+	parts := make([]*message.Message, 0, count)
+	for i := 0; i < count; i++ {
+		end := (i + 1) * chunkSize
+		if end > len(msg.Payload) {
+			end = len(msg.Payload)
+		}
+		properties.Set(PropertySplitIndex, strconv.Itoa(i))
+		id := derivedMessageID(msg.UUID, PropertySplitIndex+"="+strconv.Itoa(i))
+		parts = append(parts, l.derived(deviceID, id, properties, msg, msg.Payload[i*chunkSize:end]))
+	}
+	return parts
+}
+
+// offload uploads the message payload and returns a message referencing the uploaded blob.
+func (l *sizeLimit) offload(deviceID string, properties url.Values, msg *message.Message) (*message.Message, error) {
+	if l.uploader == nil {
+		return nil, errors.New("file upload is not available")
+	}
+
+	ctx, cancel := context.WithTimeout(msg.Context(), offloadTimeout)
+	defer cancel()
+
+	contentType := properties.Get(routing.KeyContentType)
+	result, err := l.uploader.Upload(ctx, offloadBlobPrefix+msg.UUID, msg.Payload, contentType)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot offload message payload")
+	}
+
+	payload, err := json.Marshal(&offloadReference{
+		Result:          *result,
+		URL:             result.URL(),
+		ContentType:     contentType,
+		ContentEncoding: properties.Get(routing.KeyContentEncoding),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot encode offloaded message reference")
+	}
+
+	properties.Del(keyMessageID)
+	properties.Del(routing.KeyContentType)
+	properties.Del(routing.KeyContentEncoding)
+	properties.Set(PropertyOffload, OffloadBlob)
+	return l.derived(deviceID, derivedMessageID(msg.UUID, PropertyOffload), properties, msg, payload), nil
+}
+
+// derived creates a device-to-cloud message with the given ID, properties and payload, keeping the QoS and metadata of the original message.
+// The ID is derived from the original message ID, so that re-publishing the original message produces the same messages.
+func (l *sizeLimit) derived(deviceID, id string, properties url.Values, msg *message.Message, payload []byte) *message.Message {
+	derived := message.NewMessage(id, payload)
+	for key, value := range msg.Metadata {
+		derived.Metadata.Set(key, value)
+	}
+	topic := routing.CreateTelemetryTopicWithProperties(deviceID, derived.UUID, properties)
+	derived.SetContext(connector.SetTopicToCtx(derived.Context(), topic))
+	if qos, ok := connector.QosFromCtx(msg.Context()); ok {
+		derived.SetContext(connector.SetQosToCtx(derived.Context(), qos))
+	}
+	return derived
+}
+
+func (l *sizeLimit) reject(localTopic string, msg *message.Message, size int, cause error) {
+	msgErr := &routing.MessageError{
+		Cause:     routing.ErrorMessageTooLarge,
+		Topic:     localTopic,
+		MessageID: msg.UUID,
+		Size:      size,
+	}
+	if cause != nil {
+		msgErr.Error = cause.Error()
+	}
+	logFields := watermill.LogFields{"message_uuid": msg.UUID, "size": size, "max_size": l.maxSize}
+	l.logger.Error("rejecting message exceeding the max message size", cause, logFields)
+
+	if l.errorPub != nil {
+		routing.SendMessageError(msgErr, l.errorPub, l.logger)
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package bus
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+
+	"github.com/eclipse-kanto/suite-connector/connector"
+
+	"github.com/eclipse-kanto/azure-connector/config"
+	"github.com/eclipse-kanto/azure-connector/fileupload"
+	"github.com/eclipse-kanto/azure-connector/routing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func limitedTelemetry(t *testing.T, options *SizeLimitOptions, produced ...*message.Message) []*message.Message {
+	handlerFunc := newSizeLimit(options, watermill.NopLogger{}).decorate(producing(produced...))
+	result, err := handlerFunc(topicMessage("telemetry/large", ""))
+	require.NoError(t, err)
+	return result
+}
+
+func messageErrors(t *testing.T, pub *batchPublisher) []routing.MessageError {
+	var result []routing.MessageError
+	for _, msg := range pub.messages() {
+		msgErr := routing.MessageError{}
+		require.NoError(t, json.Unmarshal(msg.Payload, &msgErr))
+		result = append(result, msgErr)
+	}
+	return result
+}
+
+func TestSizeLimitPassthrough(t *testing.T) {
+	errorPub := &batchPublisher{}
+	small := telemetryMessage(nil, "small")
+	twin := topicMessage(routing.CreateTwinReportedTopic("1"), strings.Repeat("x", 2048))
+
+	result := limitedTelemetry(t, &SizeLimitOptions{MaxSize: 1024, ErrorPublisher: errorPub}, small, twin)
+	assert.Equal(t, []*message.Message{small, twin}, result)
+	assert.Empty(t, errorPub.messages())
+
+	assert.Equal(t, config.MaxMessageSize, newSizeLimit(nil, watermill.NopLogger{}).maxSize)
+}
+
+func TestSizeLimitReject(t *testing.T) {
+	errorPub := &batchPublisher{}
+	large := telemetryMessage(nil, strings.Repeat("x", 2048))
+
+	result := limitedTelemetry(t, &SizeLimitOptions{MaxSize: 1024, ErrorPublisher: errorPub}, large, telemetryMessage(nil, "small"))
+	require.Len(t, result, 1)
+	assert.Equal(t, "small", string(result[0].Payload))
+
+	msgErrors := messageErrors(t, errorPub)
+	require.Len(t, msgErrors, 1)
+	assert.Equal(t, routing.ErrorMessageTooLarge, msgErrors[0].Cause)
+	assert.Equal(t, "telemetry/large", msgErrors[0].Topic)
+	assert.Equal(t, large.UUID, msgErrors[0].MessageID)
+	assert.Greater(t, msgErrors[0].Size, 2048)
+	assert.Empty(t, msgErrors[0].Error)
+}
+
+func TestSizeLimitSplit(t *testing.T) {
+	payload := strings.Repeat("0123456789", 250)
+	large := telemetryMessage(map[string]string{"room": "1"}, payload)
+	large.SetContext(connector.SetQosToCtx(large.Context(), connector.QosAtMostOnce))
+
+	parts := limitedTelemetry(t, &SizeLimitOptions{MaxSize: 1024, Policy: config.MessageSizeSplit}, large)
+	require.True(t, len(parts) > 2)
+
+	var joined strings.Builder
+	for i, part := range parts {
+		topic, _ := connector.TopicFromCtx(part.Context())
+		_, properties, ok := routing.ParseTelemetryTopic(topic)
+		require.True(t, ok)
+		assert.LessOrEqual(t, len(part.Payload)+len(properties.Encode()), 1024)
+		assert.Equal(t, large.UUID, properties.Get(PropertySplitID))
+		assert.Equal(t, strconv.Itoa(i), properties.Get(PropertySplitIndex))
+		assert.Equal(t, strconv.Itoa(len(parts)), properties.Get(PropertySplitCount))
+		assert.Equal(t, "1", properties.Get("room"))
+		assert.Equal(t, part.UUID, properties.Get(keyMessageID))
+		qos, _ := connector.QosFromCtx(part.Context())
+		assert.Equal(t, connector.QosAtMostOnce, qos)
+		joined.Write(part.Payload)
+	}
+	assert.Equal(t, payload, joined.String())
+
+	errorPub := &batchPublisher{}
+	properties := map[string]string{"large": strings.Repeat("x", 1024)}
+	result := limitedTelemetry(t, &SizeLimitOptions{MaxSize: 1024, Policy: config.MessageSizeSplit, ErrorPublisher: errorPub},
+		telemetryMessage(properties, "payload"),
+	)
+	assert.Empty(t, result)
+	assert.Len(t, messageErrors(t, errorPub), 1)
+}
+
+func TestSizeLimitOffload(t *testing.T) {
+	var uploaded []byte
+	var notified map[string]interface{}
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/devices/"+routesDeviceID+"/files":
+			request := map[string]string{}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+			json.NewEncoder(w).Encode(map[string]string{
+				"correlationId": "correlation",
+				"hostName":      r.Host,
+				"containerName": "container",
+				"blobName":      routesDeviceID + "/" + request["blobName"],
+				"sasToken":      "?sig=test",
+			})
+		case r.URL.Path == "/devices/"+routesDeviceID+"/files/notifications":
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&notified))
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == http.MethodPut:
+			uploaded, _ = ioutil.ReadAll(r.Body)
+			w.WriteHeader(http.StatusCreated)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	uploader := &fileupload.Client{
+		HubURL:     server.URL,
+		DeviceID:   routesDeviceID,
+		HubClient:  server.Client(),
+		BlobClient: server.Client(),
+	}
+	payload := `{"data":"` + strings.Repeat("x", 2048) + `"}`
+	large := telemetryMessage(map[string]string{"room": "1"}, payload)
+
+	result := limitedTelemetry(t, &SizeLimitOptions{MaxSize: 1024, Policy: config.MessageSizeOffload, Uploader: uploader}, large)
+	require.Len(t, result, 1)
+	assert.Equal(t, payload, string(uploaded))
+	assert.Equal(t, true, notified["isSuccess"])
+
+	topic, _ := connector.TopicFromCtx(result[0].Context())
+	_, properties, ok := routing.ParseTelemetryTopic(topic)
+	require.True(t, ok)
+	assert.Equal(t, OffloadBlob, properties.Get(PropertyOffload))
+	assert.Equal(t, "1", properties.Get("room"))
+	assert.Equal(t, "application/json", properties.Get(routing.KeyContentType))
+
+	reference := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(result[0].Payload, &reference))
+	blobName := routesDeviceID + "/telemetry/" + large.UUID
+	assert.Equal(t, blobName, reference["blobName"])
+	assert.Equal(t, "container", reference["containerName"])
+	assert.Equal(t, float64(len(payload)), reference["size"])
+	assert.Equal(t, "https://"+server.Listener.Addr().String()+"/container/"+blobName, reference["url"])
+	assert.Equal(t, "application/json", reference["contentType"])
+	assert.Equal(t, "utf-8", reference["contentEncoding"])
+}
+
+func TestSizeLimitOffloadError(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	errorPub := &batchPublisher{}
+	uploader := &fileupload.Client{HubURL: server.URL, DeviceID: routesDeviceID, HubClient: server.Client()}
+	large := telemetryMessage(nil, strings.Repeat("x", 2048))
+	for _, options := range []*SizeLimitOptions{
+		{MaxSize: 1024, Policy: config.MessageSizeOffload, Uploader: uploader, ErrorPublisher: errorPub},
+		{MaxSize: 1024, Policy: config.MessageSizeOffload, ErrorPublisher: errorPub},
+	} {
+		assert.Empty(t, limitedTelemetry(t, options, large))
+	}
+
+	msgErrors := messageErrors(t, errorPub)
+	require.Len(t, msgErrors, 2)
+	for _, msgErr := range msgErrors {
+		assert.Equal(t, large.UUID, msgErr.MessageID)
+		assert.NotEmpty(t, msgErr.Error)
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package bus
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/google/uuid"
+
+	"github.com/eclipse/ditto-clients-golang/protocol"
+
+	"github.com/eclipse-kanto/suite-connector/connector"
+
+	"github.com/eclipse-kanto/azure-connector/config"
+	"github.com/eclipse-kanto/azure-connector/routing"
+)
+
+// messageIDNamespace is the namespace of the name-based UUIDs used as deterministic message IDs.
+var messageIDNamespace = uuid.MustParse("9437717e-b91d-49fa-a476-cfdde50ca167")
+
+// MessageIDOptions contains the settings of the device-to-cloud message IDs.
+type MessageIDOptions struct {
+	// Source is the source of the message IDs, config.MessageIDRandom if not set.
+	Source string
+	// DedupWindow is the number of the recently forwarded message IDs, whose duplicates are dropped. No duplicates are detected if not positive.
+	DedupWindow int
+	// Epoch identifies the connection of the local broker the messages are received on. It is required for the duplicates
+	// detection with the config.MessageIDPacket source, as the packet identifiers are reused on each connection.
+	Epoch *ConnectionEpoch
+}
+
+// ConnectionEpoch is a connection listener counting the connection state changes of the local MQTT client.
+// The MQTT packet identifiers are unique only within a connection, so the epoch is part of the message IDs derived from them.
+type ConnectionEpoch struct {
+	value uint64
+}
+
+// Connected starts a new epoch on each connection state change, so that the messages of the lost connection still
+// being handled and the messages of the new connection do not share an epoch.
+func (e *ConnectionEpoch) Connected(connected bool, err error) {
+	atomic.AddUint64(&e.value, 1)
+}
+
+func (e *ConnectionEpoch) current() uint64 {
+	if e == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&e.value)
+}
+
+// messageIDs assigns deterministic IDs to the device-to-cloud messages, so that re-publishing the same local message
+// produces the same $.mid, and drops the messages with IDs that are already forwarded.
+type messageIDs struct {
+	source    string
+	epoch     *ConnectionEpoch
+	forwarded *DeliveredMessages
+	logger    watermill.LoggerAdapter
+}
+
+func newMessageIDs(options *MessageIDOptions, logger watermill.LoggerAdapter) *messageIDs {
+	if options == nil || len(options.Source) == 0 || options.Source == config.MessageIDRandom {
+		return nil
+	}
+
+	ids := &messageIDs{source: options.Source, epoch: options.Epoch, logger: logger}
+	if options.DedupWindow > 0 {
+		if options.Source == config.MessageIDPacket && options.Epoch == nil {
+			logger.Info("Duplicates detection is disabled, the packet identifiers are not bound to a connection", nil)
+			return ids
+		}
+		ids.forwarded = newDeliveredMessages(options.DedupWindow)
+	}
+	return ids
+}
+
+// decorate replaces the IDs of the device-to-cloud messages produced by the handler with IDs derived from the handled message.
+func (d *messageIDs) decorate(handlerFunc message.HandlerFunc) message.HandlerFunc {
+	return func(msg *message.Message) ([]*message.Message, error) {
+		produced, err := handlerFunc(msg)
+		if err != nil || len(produced) == 0 {
+			return produced, err
+		}
+
+		key, stable := d.key(msg)
+		result := make([]*message.Message, 0, len(produced))
+		for i, m := range produced {
+			topic, _ := connector.TopicFromCtx(m.Context())
+			deviceID, properties, ok := routing.ParseTelemetryTopic(topic)
+			if !ok {
+				result = append(result, m)
+				continue
+			}
+
+			id := uuid.NewSHA1(messageIDNamespace, append(key, []byte(strconv.Itoa(i))...)).String()
+			if d.forwarded != nil && stable {
+				if d.forwarded.delivered(id) {
+					d.logger.Debug("Dropping already forwarded message", watermill.LogFields{"message_id": id})
+					continue
+				}
+				d.forwarded.track(id, msg)
+			}
+			m.UUID = id
+			m.SetContext(connector.SetTopicToCtx(m.Context(), routing.CreateTelemetryTopicWithProperties(deviceID, id, properties)))
+			result = append(result, m)
+		}
+		return result, nil
+	}
+}
+
+// key returns the stable identity of the handled message, which the message IDs are derived from.
+// The messages without an identity in the configured source, i.e. the QoS 0 messages without a packet identifier
+// and the messages without a correlation ID, get a random key and false is returned, so that they are not dropped
+// as duplicates of other messages with the same content.
+func (d *messageIDs) key(msg *message.Message) ([]byte, bool) {
+	topic, _ := connector.TopicFromCtx(msg.Context())
+	switch d.source {
+	case config.MessageIDPacket:
+		// the QoS 0 messages have no packet identifier
+		if len(msg.UUID) == 0 || msg.UUID == "0" {
+			return []byte(watermill.NewUUID()), false
+		}
+		epoch := strconv.FormatUint(d.epoch.current(), 10)
+		return []byte(d.source + "\x00" + epoch + "\x00" + topic + "\x00" + msg.UUID + "\x00"), true
+	case config.MessageIDCorrelation:
+		correlationID := dittoCorrelationID(msg.Payload)
+		if len(correlationID) == 0 {
+			return []byte(watermill.NewUUID()), false
+		}
+		return []byte(d.source + "\x00" + correlationID + "\x00"), true
+	}
+
+	hash := sha256.New()
+	hash.Write([]byte(config.MessageIDContent + "\x00" + topic + "\x00"))
+	hash.Write(msg.Payload)
+	return hash.Sum(nil), true
+}
+
+// dittoCorrelationID returns the correlation ID of a Ditto protocol message, empty if the payload is not a Ditto protocol message.
+func dittoCorrelationID(payload []byte) string {
+	env := struct {
+		Headers map[string]interface{} `json:"headers"`
+	}{}
+	if err := json.Unmarshal(payload, &env); err != nil {
+		return ""
+	}
+	correlationID, _ := env.Headers[protocol.HeaderCorrelationID].(string)
+	return correlationID
+}
+
+// derivedMessageID returns the ID of a message derived from the message with the given ID, e.g. a split message part.
+func derivedMessageID(id, suffix string) string {
+	return uuid.NewSHA1(messageIDNamespace, []byte(id+"\x00"+suffix)).String()
+}
@@ -0,0 +1,188 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package bus
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+
+	"github.com/eclipse-kanto/suite-connector/connector"
+
+	"github.com/eclipse-kanto/azure-connector/config"
+	"github.com/eclipse-kanto/azure-connector/routing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const dittoPayload = `{"topic":"org.eclipse.kanto/test/things/twin/commands/modify","headers":{"correlation-id":"%s"},"path":"/features/meter","value":%d}`
+
+func identifiedMessage(t *testing.T, ids *messageIDs, msg *message.Message) string {
+	produced, err := ids.decorate(telemetryPassthrough)(msg)
+	require.NoError(t, err)
+	require.Len(t, produced, 1)
+
+	topic, _ := connector.TopicFromCtx(produced[0].Context())
+	_, properties, ok := routing.ParseTelemetryTopic(topic)
+	require.True(t, ok)
+	assert.Equal(t, produced[0].UUID, properties.Get(keyMessageID))
+	return produced[0].UUID
+}
+
+func packetMessage(topic, packetID, payload string) *message.Message {
+	msg := topicMessage(topic, payload)
+	msg.UUID = packetID
+	return msg
+}
+
+func TestMessageIDRandom(t *testing.T) {
+	assert.Nil(t, newMessageIDs(nil, watermill.NopLogger{}))
+	assert.Nil(t, newMessageIDs(&MessageIDOptions{}, watermill.NopLogger{}))
+	assert.Nil(t, newMessageIDs(&MessageIDOptions{Source: config.MessageIDRandom, DedupWindow: 10}, watermill.NopLogger{}))
+}
+
+func TestMessageIDPacket(t *testing.T) {
+	ids := newMessageIDs(&MessageIDOptions{Source: config.MessageIDPacket}, watermill.NopLogger{})
+
+	id := identifiedMessage(t, ids, packetMessage("device/telemetry", "7", "a"))
+	assert.Equal(t, id, identifiedMessage(t, ids, packetMessage("device/telemetry", "7", "b")))
+	assert.NotEqual(t, id, identifiedMessage(t, ids, packetMessage("device/telemetry", "8", "a")))
+	assert.NotEqual(t, id, identifiedMessage(t, ids, packetMessage("device/event", "7", "a")))
+
+	// no packet identifier for QoS 0, a random ID is used instead
+	id = identifiedMessage(t, ids, packetMessage("device/telemetry", "0", "a"))
+	assert.NotEqual(t, id, identifiedMessage(t, ids, packetMessage("device/telemetry", "0", "a")))
+}
+
+func TestMessageIDPacketEpoch(t *testing.T) {
+	epoch := &ConnectionEpoch{}
+	ids := newMessageIDs(&MessageIDOptions{Source: config.MessageIDPacket, DedupWindow: 10, Epoch: epoch}, watermill.NopLogger{})
+	require.NotNil(t, ids.forwarded)
+
+	id := identifiedMessage(t, ids, packetMessage("device/telemetry", "7", "a"))
+	assert.Equal(t, id, identifiedMessage(t, ids, packetMessage("device/telemetry", "7", "a")))
+
+	// the packet identifiers are reused after a reconnect
+	epoch.Connected(false, nil)
+	epoch.Connected(true, nil)
+	assert.NotEqual(t, id, identifiedMessage(t, ids, packetMessage("device/telemetry", "7", "a")))
+
+	// the repeated QoS 0 readings are not dropped as duplicates
+	for i := 0; i < 3; i++ {
+		identifiedMessage(t, ids, packetMessage("device/telemetry", "0", "a"))
+	}
+
+	// no duplicates detection without an epoch
+	ids = newMessageIDs(&MessageIDOptions{Source: config.MessageIDPacket, DedupWindow: 10}, watermill.NopLogger{})
+	assert.Nil(t, ids.forwarded)
+}
+
+func TestMessageIDCorrelation(t *testing.T) {
+	ids := newMessageIDs(&MessageIDOptions{Source: config.MessageIDCorrelation}, watermill.NopLogger{})
+
+	id := identifiedMessage(t, ids, topicMessage("e", fmt.Sprintf(dittoPayload, "corr-1", 1)))
+	assert.Equal(t, id, identifiedMessage(t, ids, topicMessage("event", fmt.Sprintf(dittoPayload, "corr-1", 2))))
+	assert.NotEqual(t, id, identifiedMessage(t, ids, topicMessage("e", fmt.Sprintf(dittoPayload, "corr-2", 1))))
+
+	// no correlation ID, a random ID is used instead
+	id = identifiedMessage(t, ids, topicMessage("e", "not ditto"))
+	assert.NotEqual(t, id, identifiedMessage(t, ids, topicMessage("e", "not ditto")))
+}
+
+func TestMessageIDCorrelationDedup(t *testing.T) {
+	ids := newMessageIDs(&MessageIDOptions{Source: config.MessageIDCorrelation, DedupWindow: 10}, watermill.NopLogger{})
+	handlerFunc := ids.decorate(telemetryPassthrough)
+
+	forward := func(payload string) []*message.Message {
+		msg := topicMessage("e", payload)
+		produced, err := handlerFunc(msg)
+		require.NoError(t, err)
+		msg.Ack()
+		return produced
+	}
+
+	assert.Len(t, forward(fmt.Sprintf(dittoPayload, "corr-1", 1)), 1)
+	require.Eventually(t, func() bool {
+		return len(forward(fmt.Sprintf(dittoPayload, "corr-1", 1))) == 0
+	}, time.Second, 10*time.Millisecond)
+
+	// the repeated readings without a correlation ID are forwarded
+	for i := 0; i < 3; i++ {
+		assert.Len(t, forward(`{"value":21}`), 1)
+	}
+}
+
+func TestMessageIDContent(t *testing.T) {
+	ids := newMessageIDs(&MessageIDOptions{Source: config.MessageIDContent}, watermill.NopLogger{})
+
+	id := identifiedMessage(t, ids, topicMessage("e", "payload"))
+	assert.Equal(t, id, identifiedMessage(t, ids, topicMessage("e", "payload")))
+	assert.NotEqual(t, id, identifiedMessage(t, ids, topicMessage("t", "payload")))
+	assert.NotEqual(t, id, identifiedMessage(t, ids, topicMessage("e", "other")))
+
+	produced, err := ids.decorate(producing(
+		telemetryMessage(nil, "1"), telemetryMessage(nil, "2"), topicMessage("local/topic", "3"),
+	))(topicMessage("e", "payload"))
+	require.NoError(t, err)
+	require.Len(t, produced, 3)
+	assert.NotEqual(t, produced[0].UUID, produced[1].UUID)
+	topic, _ := connector.TopicFromCtx(produced[2].Context())
+	assert.Equal(t, "local/topic", topic)
+}
+
+func TestMessageIDDedupWindow(t *testing.T) {
+	ids := newMessageIDs(&MessageIDOptions{Source: config.MessageIDContent, DedupWindow: 2}, watermill.NopLogger{})
+	handlerFunc := ids.decorate(telemetryPassthrough)
+
+	forward := func(payload string, ack bool) []*message.Message {
+		msg := topicMessage("e", payload)
+		produced, err := handlerFunc(msg)
+		require.NoError(t, err)
+		if ack {
+			msg.Ack()
+		} else {
+			msg.Nack()
+		}
+		return produced
+	}
+	forwarded := func(payload string) bool {
+		return ids.forwarded.delivered(identifiedMessage(t, newMessageIDs(&MessageIDOptions{Source: config.MessageIDContent}, watermill.NopLogger{}), topicMessage("e", payload)))
+	}
+
+	assert.Len(t, forward("a", false), 1)
+	assert.Len(t, forward("a", true), 1)
+	require.Eventually(t, func() bool { return forwarded("a") }, time.Second, 10*time.Millisecond)
+	assert.Empty(t, forward("a", true))
+
+	assert.Len(t, forward("b", true), 1)
+	assert.Len(t, forward("c", true), 1)
+	require.Eventually(t, func() bool { return forwarded("c") && !forwarded("a") }, time.Second, 10*time.Millisecond)
+	assert.Len(t, forward("a", true), 1)
+}
+
+func TestSizeLimitSplitDeterministic(t *testing.T) {
+	msg := telemetryMessage(nil, strings.Repeat("x", 3000))
+	first := limitedTelemetry(t, &SizeLimitOptions{MaxSize: 1024, Policy: config.MessageSizeSplit}, msg)
+	second := limitedTelemetry(t, &SizeLimitOptions{MaxSize: 1024, Policy: config.MessageSizeSplit}, msg)
+	require.Len(t, first, len(second))
+	require.True(t, len(first) > 1)
+	for i := range first {
+		assert.Equal(t, first[i].UUID, second[i].UUID)
+	}
+	assert.NotEqual(t, first[0].UUID, first[1].UUID)
+}
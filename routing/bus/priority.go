@@ -0,0 +1,296 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package bus
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/pkg/errors"
+
+	"github.com/eclipse-kanto/suite-connector/connector"
+
+	"github.com/eclipse-kanto/azure-connector/config"
+	"github.com/eclipse-kanto/azure-connector/metrics"
+	"github.com/eclipse-kanto/azure-connector/routing"
+)
+
+const (
+	// MetadataPriority is the metadata key of the priority class assigned to a device-to-cloud message.
+	MetadataPriority = "priority"
+
+	priorityRetryDelay = 5 * time.Second
+)
+
+// priorityLane is the queue of a priority class.
+type priorityLane struct {
+	name      string
+	weight    int
+	maxQueued int
+	overflow  string
+
+	queue   []*message.Message
+	credits int
+}
+
+// PriorityLanes is a publisher queuing the device-to-cloud messages per priority class.
+// A weighted scheduler publishes the queued messages, preferring the higher classes: in each round up to weight messages
+// are published from every class in the priority order. A failed publishing is retried on reconnect starting a new round,
+// so that the highest priority messages go first.
+type PriorityLanes struct {
+	pub     message.Publisher
+	classes []config.PriorityClass
+	metrics *metrics.ConnectorMetrics
+	logger  watermill.LoggerAdapter
+
+	lock      sync.Mutex
+	cond      *sync.Cond
+	lanes     []*priorityLane
+	names     map[string]*priorityLane
+	closed    bool
+	reconnect chan struct{}
+	done      chan struct{}
+}
+
+// NewPriorityLanes creates the priority queues of the given classes, followed by the lowest default class,
+// and starts publishing the queued messages using the given publisher. The publisher has to fail while the Azure IoT Hub
+// is not connected, e.g. an online publisher, otherwise the queues are drained into the MQTT client buffer.
+func NewPriorityLanes(
+	pub message.Publisher,
+	classes []config.PriorityClass,
+	connMetrics *metrics.ConnectorMetrics,
+	logger watermill.LoggerAdapter,
+) *PriorityLanes {
+	l := &PriorityLanes{
+		pub:       pub,
+		classes:   classes,
+		metrics:   connMetrics,
+		logger:    logger,
+		names:     map[string]*priorityLane{},
+		reconnect: make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+	l.cond = sync.NewCond(&l.lock)
+
+	for i := range classes {
+		l.addLane(classes[i].Name, classes[i].ClassWeight(), classes[i].QueueSize(), classes[i].OverflowPolicy())
+	}
+	l.addLane(config.DefaultPriorityClass, 1, config.DefaultPriorityQueueSize, config.OverflowDropOldest)
+
+	go l.run()
+	return l
+}
+
+func (l *PriorityLanes) addLane(name string, weight, maxQueued int, overflow string) {
+	lane := &priorityLane{name: name, weight: weight, maxQueued: maxQueued, overflow: overflow, credits: weight}
+	l.lanes = append(l.lanes, lane)
+	l.names[name] = lane
+}
+
+// decorate assigns the priority class to the messages produced by the handler.
+func (l *PriorityLanes) decorate(handlerFunc message.HandlerFunc) message.HandlerFunc {
+	return func(msg *message.Message) ([]*message.Message, error) {
+		produced, err := handlerFunc(msg)
+		if err != nil || len(produced) == 0 {
+			return produced, err
+		}
+
+		localTopic, _ := connector.TopicFromCtx(msg.Context())
+		for _, m := range produced {
+			m.Metadata.Set(MetadataPriority, l.classify(localTopic, m))
+		}
+		return produced, nil
+	}
+}
+
+// classify returns the name of the first class matching the local topic and the message properties.
+func (l *PriorityLanes) classify(localTopic string, msg *message.Message) string {
+	topic, _ := connector.TopicFromCtx(msg.Context())
+	_, properties, _ := routing.ParseTelemetryTopic(topic)
+	for _, class := range l.classes {
+		if len(class.Topic) > 0 && !routing.MatchTopic(class.Topic, localTopic) {
+			continue
+		}
+		if !routing.MatchProperties(class.Properties, properties) {
+			continue
+		}
+		return class.Name
+	}
+	return config.DefaultPriorityClass
+}
+
+// Publish queues the messages in the queues of their priority classes, the messages without a class are queued in the default one.
+// It waits for space in the full queues with the block overflow policy.
+func (l *PriorityLanes) Publish(topic string, messages ...*message.Message) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for _, msg := range messages {
+		lane, ok := l.names[msg.Metadata.Get(MetadataPriority)]
+		if !ok {
+			lane = l.names[config.DefaultPriorityClass]
+		}
+
+		for len(lane.queue) >= lane.maxQueued && lane.overflow == config.OverflowBlock && !l.closed {
+			l.cond.Wait()
+		}
+		if l.closed {
+			return errors.New("priority queues are closed")
+		}
+
+		if len(lane.queue) >= lane.maxQueued {
+			l.dropped(lane)
+			if lane.overflow == config.OverflowDropNewest {
+				continue
+			}
+			lane.queue[0] = nil
+			lane.queue = lane.queue[1:]
+		}
+		if msgTopic, ok := connector.TopicFromCtx(msg.Context()); !ok || len(msgTopic) == 0 {
+			msg.SetContext(connector.SetTopicToCtx(msg.Context(), topic))
+		}
+		lane.queue = append(lane.queue, msg)
+		l.report(lane)
+	}
+	l.cond.Broadcast()
+	return nil
+}
+
+// Connected resumes the publishing of the queued messages when the Azure IoT Hub connection is established.
+func (l *PriorityLanes) Connected(connected bool, err error) {
+	if connected {
+		select {
+		case l.reconnect <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Close stops the scheduler after publishing the queued messages, until a publishing fails.
+// The blocked publishers are released with an error.
+func (l *PriorityLanes) Close() error {
+	l.lock.Lock()
+	l.closed = true
+	l.cond.Broadcast()
+	l.lock.Unlock()
+
+	l.Connected(true, nil)
+	<-l.done
+	return nil
+}
+
+// Len returns the number of queued messages of the class with the given name.
+func (l *PriorityLanes) Len(name string) int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if lane, ok := l.names[name]; ok {
+		return len(lane.queue)
+	}
+	return 0
+}
+
+func (l *PriorityLanes) run() {
+	defer close(l.done)
+
+	for {
+		l.lock.Lock()
+		lane := l.next()
+		for lane == nil && !l.closed {
+			l.cond.Wait()
+			lane = l.next()
+		}
+		if lane == nil {
+			l.lock.Unlock()
+			return
+		}
+		msg := lane.queue[0]
+		lane.queue[0] = nil
+		lane.queue = lane.queue[1:]
+		l.report(lane)
+		l.cond.Broadcast()
+		l.lock.Unlock()
+
+		topic, _ := connector.TopicFromCtx(msg.Context())
+		if err := l.pub.Publish(topic, msg); err != nil {
+			if !l.retry(lane, msg, err) {
+				return
+			}
+		}
+	}
+}
+
+// next returns the lane of the next published message, starting a new round when the non-empty lanes have no credits left.
+// The lock must be held.
+func (l *PriorityLanes) next() *priorityLane {
+	for round := 0; round < 2; round++ {
+		for _, lane := range l.lanes {
+			if len(lane.queue) > 0 && lane.credits > 0 {
+				lane.credits--
+				return lane
+			}
+		}
+		l.resetCredits()
+	}
+	return nil
+}
+
+func (l *PriorityLanes) resetCredits() {
+	for _, lane := range l.lanes {
+		lane.credits = lane.weight
+	}
+}
+
+// retry puts back the message that cannot be published and waits for a reconnect, returning false if the lanes are closed.
+func (l *PriorityLanes) retry(lane *priorityLane, msg *message.Message, err error) bool {
+	l.logger.Debug("Cannot publish prioritized message, waiting for reconnect", watermill.LogFields{
+		"class":        lane.name,
+		"message_uuid": msg.UUID,
+		"error":        err.Error(),
+	})
+
+	l.lock.Lock()
+	lane.queue = append([]*message.Message{msg}, lane.queue...)
+	l.report(lane)
+	closed := l.closed
+	l.lock.Unlock()
+
+	if closed {
+		l.logger.Error("Dropping queued messages on close", err, watermill.LogFields{"class": lane.name})
+		return false
+	}
+
+	select {
+	case <-l.reconnect:
+	case <-time.After(priorityRetryDelay):
+	}
+
+	l.lock.Lock()
+	l.resetCredits()
+	l.lock.Unlock()
+	return true
+}
+
+func (l *PriorityLanes) dropped(lane *priorityLane) {
+	if l.metrics != nil {
+		l.metrics.PriorityDropped.Inc(lane.name)
+	}
+}
+
+func (l *PriorityLanes) report(lane *priorityLane) {
+	if l.metrics != nil {
+		l.metrics.PriorityQueued.Set(float64(len(lane.queue)), lane.name)
+	}
+}
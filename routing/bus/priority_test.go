@@ -0,0 +1,218 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package bus
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/pkg/errors"
+
+	"github.com/eclipse-kanto/suite-connector/connector"
+
+	"github.com/eclipse-kanto/azure-connector/config"
+	"github.com/eclipse-kanto/azure-connector/metrics"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type lanesPublisher struct {
+	lock      sync.Mutex
+	err       error
+	gate      chan struct{}
+	attempts  int
+	published []*message.Message
+}
+
+func (p *lanesPublisher) Publish(topic string, messages ...*message.Message) error {
+	p.lock.Lock()
+	p.attempts++
+	gate := p.gate
+	p.lock.Unlock()
+
+	if gate != nil {
+		<-gate
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.err != nil {
+		return p.err
+	}
+	p.published = append(p.published, messages...)
+	return nil
+}
+
+func (p *lanesPublisher) Close() error {
+	return nil
+}
+
+func (p *lanesPublisher) setErr(err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.err = err
+}
+
+func (p *lanesPublisher) attempted() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.attempts
+}
+
+func (p *lanesPublisher) payloads() []string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return payloads(p.published)
+}
+
+func prioritized(class, payload string) *message.Message {
+	msg := telemetryMessage(nil, payload)
+	if len(class) > 0 {
+		msg.Metadata.Set(MetadataPriority, class)
+	}
+	return msg
+}
+
+func TestPriorityLanesClassify(t *testing.T) {
+	lanes := NewPriorityLanes(&lanesPublisher{}, []config.PriorityClass{
+		{Name: "alarm", Topic: "alarm/#"},
+		{Name: "critical", Properties: map[string]string{"severity": "critical"}},
+		{Name: "events", Topic: "event/+", Properties: map[string]string{"type": "*"}},
+	}, nil, watermill.NopLogger{})
+	defer lanes.Close()
+
+	handlerFunc := lanes.decorate(producing(
+		telemetryMessage(nil, "1"),
+		telemetryMessage(map[string]string{"severity": "critical"}, "2"),
+		telemetryMessage(map[string]string{"type": "start"}, "3"),
+	))
+	classes := func(topic string) []string {
+		produced, err := handlerFunc(topicMessage(topic, "payload"))
+		require.NoError(t, err)
+		var result []string
+		for _, msg := range produced {
+			result = append(result, msg.Metadata.Get(MetadataPriority))
+		}
+		return result
+	}
+
+	assert.Equal(t, []string{"alarm", "alarm", "alarm"}, classes("alarm/fire"))
+	assert.Equal(t, []string{"default", "critical", "events"}, classes("event/engine"))
+	assert.Equal(t, []string{"default", "critical", "default"}, classes("telemetry"))
+}
+
+func TestPriorityLanesWeightedAfterReconnect(t *testing.T) {
+	pub := &lanesPublisher{err: errors.New("disconnected")}
+	lanes := NewPriorityLanes(pub, []config.PriorityClass{{Name: "alarm", Topic: "alarm/#", Weight: 2}}, nil, watermill.NopLogger{})
+	defer lanes.Close()
+
+	for _, payload := range []string{"b1", "b2", "b3", "b4"} {
+		require.NoError(t, lanes.Publish("", prioritized("", payload)))
+	}
+	require.Eventually(t, func() bool {
+		return pub.attempted() > 0
+	}, time.Second, 10*time.Millisecond)
+	for _, payload := range []string{"a1", "a2", "a3"} {
+		require.NoError(t, lanes.Publish("", prioritized("alarm", payload)))
+	}
+	assert.Equal(t, 3, lanes.Len("alarm"))
+	assert.Equal(t, 4, lanes.Len(config.DefaultPriorityClass))
+
+	pub.setErr(nil)
+	lanes.Connected(true, nil)
+	require.Eventually(t, func() bool {
+		return len(pub.payloads()) == 7
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"a1", "a2", "b1", "a3", "b2", "b3", "b4"}, pub.payloads())
+	assert.Equal(t, 0, lanes.Len("alarm"))
+}
+
+func TestPriorityLanesOverflow(t *testing.T) {
+	pub := &lanesPublisher{gate: make(chan struct{})}
+	connMetrics := metrics.NewConnectorMetrics(metrics.NewRegistry())
+	lanes := NewPriorityLanes(pub, []config.PriorityClass{
+		{Name: "newest", Topic: "newest", MaxQueued: 1, Overflow: config.OverflowDropNewest},
+		{Name: "oldest", Topic: "oldest", MaxQueued: 1, Overflow: config.OverflowDropOldest},
+		{Name: "alarm", Topic: "alarm", MaxQueued: 1},
+	}, connMetrics, watermill.NopLogger{})
+
+	// the scheduler waits for the publishing of the first message
+	require.NoError(t, lanes.Publish("", prioritized("", "first")))
+	require.Eventually(t, func() bool {
+		return pub.attempted() == 1
+	}, time.Second, 10*time.Millisecond)
+
+	require.NoError(t, lanes.Publish("", prioritized("newest", "n1"), prioritized("newest", "n2")))
+	require.NoError(t, lanes.Publish("", prioritized("oldest", "o1"), prioritized("oldest", "o2")))
+	require.NoError(t, lanes.Publish("", prioritized("alarm", "a1")))
+	assert.Equal(t, 1.0, connMetrics.PriorityDropped.Value("newest"))
+	assert.Equal(t, 1.0, connMetrics.PriorityDropped.Value("oldest"))
+	assert.Equal(t, 1.0, connMetrics.PriorityQueued.Value("alarm"))
+
+	blocked := make(chan error, 1)
+	go func() {
+		blocked <- lanes.Publish("", prioritized("alarm", "a2"))
+	}()
+	select {
+	case <-blocked:
+		require.Fail(t, "publishing to a full queue not blocked")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(pub.gate)
+	require.NoError(t, <-blocked)
+	require.NoError(t, lanes.Close())
+	assert.Equal(t, []string{"first", "n1", "o2", "a1", "a2"}, pub.payloads())
+	assert.Equal(t, 0.0, connMetrics.PriorityDropped.Value("alarm"))
+
+	assert.Error(t, lanes.Publish("", prioritized("alarm", "closed")))
+}
+
+// disconnectedHub returns a MQTT connection that is never connected.
+func disconnectedHub(t *testing.T) *connector.MQTTConnection {
+	cfg, err := connector.NewMQTTClientConfig("tcp://localhost:1")
+	require.NoError(t, err)
+	conn, err := connector.NewMQTTConnection(cfg, watermill.NewShortUUID(), watermill.NopLogger{})
+	require.NoError(t, err)
+	return conn
+}
+
+func TestPriorityLanesDisconnectedHub(t *testing.T) {
+	conn := disconnectedHub(t)
+	pub := connector.NewOnlinePublisher(conn, connector.QosAtLeastOnce, time.Second, watermill.NopLogger{}, nil)
+	lanes := NewPriorityLanes(pub, []config.PriorityClass{{Name: "alarm", Topic: "alarm/#"}}, nil, watermill.NopLogger{})
+	defer lanes.Close()
+
+	require.NoError(t, lanes.Publish("", prioritized("alarm", "a1"), prioritized("", "b1"), prioritized("", "b2")))
+	// the messages are kept queued until the hub is connected
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 1, lanes.Len("alarm"))
+	assert.Equal(t, 2, lanes.Len(config.DefaultPriorityClass))
+}
+
+func TestPriorityLanesDisconnectedHubAsyncPublisher(t *testing.T) {
+	conn := disconnectedHub(t)
+	// the asynchronous publisher does not fail while offline, the messages are drained from the queues
+	pub := connector.NewPublisher(conn, connector.QosAtLeastOnce, watermill.NopLogger{}, nil)
+	lanes := NewPriorityLanes(pub, nil, nil, watermill.NopLogger{})
+	defer lanes.Close()
+
+	require.NoError(t, lanes.Publish("", prioritized("", "b1"), prioritized("", "b2")))
+	require.Eventually(t, func() bool {
+		return lanes.Len(config.DefaultPriorityClass) == 0
+	}, time.Second, 10*time.Millisecond)
+}
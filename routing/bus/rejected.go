@@ -0,0 +1,216 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package bus
+
+import (
+	"encoding/json"
+	"net/url"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/ThreeDotsLabs/watermill/message/router/middleware"
+	"github.com/pkg/errors"
+
+	"github.com/eclipse-kanto/suite-connector/connector"
+
+	"github.com/eclipse-kanto/azure-connector/config"
+	"github.com/eclipse-kanto/azure-connector/metrics"
+	"github.com/eclipse-kanto/azure-connector/routing"
+	"github.com/eclipse-kanto/azure-connector/routing/message/handlers"
+)
+
+const (
+	// PropertyEvent is the device-to-cloud message property with the type of an event reported by the connector.
+	PropertyEvent = "event"
+	// EventCommandRejected marks an event reporting a C2D message that cannot be processed.
+	EventCommandRejected = "command-rejected"
+
+	commandRetryMaxInterval = 10 * time.Second
+)
+
+// CommandDeadLetter is the payload of the C2D messages published to the local dead-letter topic.
+// The C2D message payload is included as it is, if it is valid JSON, and base64 encoded otherwise.
+type CommandDeadLetter struct {
+	// Properties are the C2D message properties.
+	Properties map[string]string `json:"properties"`
+	// Error is the reason of the rejection.
+	Error string `json:"error"`
+	// Payload is the JSON payload of the C2D message.
+	Payload json.RawMessage `json:"payload,omitempty"`
+	// PayloadBase64 is the payload of the C2D message, if it is not valid JSON, e.g. a binary or compressed one.
+	PayloadBase64 []byte `json:"payloadBase64,omitempty"`
+}
+
+// CommandRejected is the payload of the command rejected device-to-cloud events and of the timed out command responses.
+type CommandRejected struct {
+	// MessageID is the ID of the rejected C2D message.
+	MessageID string `json:"messageId,omitempty"`
+	// CorrelationID is the correlation ID of the rejected C2D message.
+	CorrelationID string `json:"correlationId,omitempty"`
+	// Error is the reason of the rejection.
+	Error string `json:"error"`
+}
+
+// commandDeadLetters retries the C2D messages that cannot be processed, then publishes them to the local dead-letter topic
+// and reports them to the Azure IoT Hub. The messages are acknowledged afterwards, the dead letters not accepted by the local broker
+// are kept by the local publisher, e.g. the inbox.
+type commandDeadLetters struct {
+	settings *config.CommandDeadLetterSettings
+	retry    *middleware.Retry
+	localPub message.Publisher
+	hubPub   message.Publisher
+	deviceID string
+	metrics  *metrics.ConnectorMetrics
+	logger   watermill.LoggerAdapter
+}
+
+func newCommandDeadLetters(
+	settings *config.CommandDeadLetterSettings,
+	localPub message.Publisher,
+	handlerCtx *handlers.HandlerContext,
+	connMetrics *metrics.ConnectorMetrics,
+	logger watermill.LoggerAdapter,
+) *commandDeadLetters {
+	if settings == nil || (!settings.Enabled() && settings.Retries == 0) {
+		return nil
+	}
+
+	d := &commandDeadLetters{
+		settings: settings,
+		deviceID: handlerCtx.ConnInfo.DeviceID,
+		metrics:  connMetrics,
+		logger:   logger,
+	}
+	if settings.Retries > 0 {
+		// the settings are validated on load
+		interval, _ := settings.InitialRetryInterval()
+		d.retry = &middleware.Retry{
+			MaxRetries:      settings.Retries,
+			InitialInterval: interval,
+			MaxInterval:     commandRetryMaxInterval,
+			Multiplier:      2,
+			Logger:          logger,
+		}
+	}
+	if len(settings.Topic) > 0 {
+		if localPub != nil {
+			d.localPub = localPub
+		} else if handlerCtx.LocalPublisher != nil {
+			d.localPub = handlerCtx.LocalPublisher(connector.QosAtLeastOnce)
+		}
+	}
+	if settings.Report && handlerCtx.HubPublisher != nil {
+		d.hubPub = handlerCtx.HubPublisher(connector.QosAtLeastOnce)
+	}
+	return d
+}
+
+// decorate retries the failed C2D messages and passes the ones still failing to the dead-letter handling.
+// The messages, which no command handler accepts, are not retried.
+func (d *commandDeadLetters) decorate(handlerFunc message.HandlerFunc) message.HandlerFunc {
+	return func(msg *message.Message) ([]*message.Message, error) {
+		var skipped error
+		handle := func(msg *message.Message) ([]*message.Message, error) {
+			produced, err := handlerFunc(msg)
+			if err != nil && handlers.ResultOf(err) == handlers.ResultSkipped {
+				skipped = err
+				return nil, nil
+			}
+			skipped = nil
+			return produced, err
+		}
+		if d.retry != nil {
+			handle = d.retry.Middleware(handle)
+		}
+
+		produced, err := handle(msg)
+		reason := metrics.DeadLetterFailed
+		if skipped != nil {
+			err, reason = skipped, metrics.DeadLetterUnhandled
+		}
+		if err == nil {
+			return produced, nil
+		}
+		if !d.settings.Enabled() {
+			return nil, err
+		}
+
+		if d.metrics != nil {
+			d.metrics.CommandRejected.Inc(reason)
+		}
+		if err := d.reject(msg, err); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	}
+}
+
+// reject publishes the C2D message to the local dead-letter topic and reports it to the Azure IoT Hub.
+// Only the local publishing error is returned, e.g. if the inbox is full, in which case the C2D message is lost.
+func (d *commandDeadLetters) reject(msg *message.Message, cause error) error {
+	topic, _ := connector.TopicFromCtx(msg.Context())
+	_, properties, _ := routing.ParseCloudTopic(topic)
+	logFields := watermill.LogFields{"message_uuid": msg.UUID, "message_id": properties.Get(keyMessageID)}
+
+	if len(d.settings.Topic) > 0 {
+		if d.localPub == nil {
+			return errors.New("no local publisher for the command dead-letter topic")
+		}
+		deadLetter := &CommandDeadLetter{
+			Properties: map[string]string{},
+			Error:      cause.Error(),
+		}
+		if json.Valid(msg.Payload) {
+			deadLetter.Payload = json.RawMessage(msg.Payload)
+		} else {
+			deadLetter.PayloadBase64 = msg.Payload
+		}
+		for key := range properties {
+			deadLetter.Properties[key] = properties.Get(key)
+		}
+		if err := d.publish(d.localPub, d.settings.Topic, deadLetter); err != nil {
+			return errors.Wrap(err, "cannot publish command dead letter")
+		}
+		d.logger.Debug("Command message published to the dead-letter topic", logFields)
+	}
+
+	if d.hubPub != nil {
+		rejected := &CommandRejected{
+			MessageID:     properties.Get(keyMessageID),
+			CorrelationID: properties.Get(routing.KeyCorrelationID),
+			Error:         cause.Error(),
+		}
+		eventProperties := url.Values{PropertyEvent: []string{EventCommandRejected}}
+		if len(rejected.CorrelationID) > 0 {
+			eventProperties.Set(routing.KeyCorrelationID, rejected.CorrelationID)
+		} else if len(rejected.MessageID) > 0 {
+			eventProperties.Set(routing.KeyCorrelationID, rejected.MessageID)
+		}
+		eventTopic := routing.CreateTelemetryTopicWithProperties(d.deviceID, watermill.NewUUID(), eventProperties)
+		if err := d.publish(d.hubPub, eventTopic, rejected); err != nil {
+			d.logger.Error("cannot report rejected command message", err, logFields)
+		}
+	}
+	return nil
+}
+
+func (d *commandDeadLetters) publish(pub message.Publisher, topic string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	msg := message.NewMessage(watermill.NewUUID(), data)
+	msg.SetContext(connector.SetTopicToCtx(msg.Context(), topic))
+	return pub.Publish(topic, msg)
+}
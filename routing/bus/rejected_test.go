@@ -0,0 +1,202 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package bus
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/pkg/errors"
+
+	"github.com/eclipse-kanto/suite-connector/connector"
+
+	"github.com/eclipse-kanto/azure-connector/config"
+	"github.com/eclipse-kanto/azure-connector/metrics"
+	"github.com/eclipse-kanto/azure-connector/routing"
+	"github.com/eclipse-kanto/azure-connector/routing/message/handlers"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const rejectedTopic = "devices/dev/messages/devicebound/%24.mid=c2d-1&%24.cid=req-1&subject=cmd"
+
+func newTestDeadLetters(
+	settings *config.CommandDeadLetterSettings,
+	localPub, hubPub message.Publisher,
+) (*commandDeadLetters, *metrics.ConnectorMetrics) {
+	handlerCtx := handlers.NewHandlerContext(&config.RemoteConnectionInfo{DeviceID: "dev"}, watermill.NopLogger{})
+	handlerCtx.LocalPublisher = func(qos connector.Qos) message.Publisher {
+		return localPub
+	}
+	handlerCtx.HubPublisher = func(qos connector.Qos) message.Publisher {
+		return hubPub
+	}
+	connMetrics := metrics.NewConnectorMetrics(metrics.NewRegistry())
+	return newCommandDeadLetters(settings, nil, handlerCtx, connMetrics, watermill.NopLogger{}), connMetrics
+}
+
+// flakyHandler fails the given number of times before producing the message payload.
+func flakyHandler(failures int, attempts *int) message.HandlerFunc {
+	return func(msg *message.Message) ([]*message.Message, error) {
+		*attempts++
+		if *attempts <= failures {
+			return nil, errors.New("temporary failure")
+		}
+		return []*message.Message{message.NewMessage(watermill.NewUUID(), msg.Payload)}, nil
+	}
+}
+
+func TestCommandDeadLettersDisabled(t *testing.T) {
+	d, _ := newTestDeadLetters(nil, nil, nil)
+	assert.Nil(t, d)
+	d, _ = newTestDeadLetters(&config.CommandDeadLetterSettings{}, nil, nil)
+	assert.Nil(t, d)
+}
+
+func TestCommandDeadLettersRetry(t *testing.T) {
+	d, connMetrics := newTestDeadLetters(&config.CommandDeadLetterSettings{Retries: 2, RetryInterval: "1ms"}, nil, nil)
+
+	attempts := 0
+	produced, err := d.decorate(flakyHandler(2, &attempts))(topicMessage(rejectedTopic, "cmd"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"cmd"}, payloads(produced))
+	assert.Equal(t, 3, attempts)
+
+	// the dead-letter handling is disabled
+	attempts = 0
+	_, err = d.decorate(flakyHandler(3, &attempts))(topicMessage(rejectedTopic, "cmd"))
+	assert.Error(t, err)
+	assert.Equal(t, 3, attempts)
+	assert.Zero(t, connMetrics.CommandRejected.Value(metrics.DeadLetterFailed))
+}
+
+func TestCommandDeadLettersPublish(t *testing.T) {
+	localPub := &batchPublisher{}
+	hubPub := &batchPublisher{}
+	d, connMetrics := newTestDeadLetters(&config.CommandDeadLetterSettings{
+		Topic:         "command/deadletter",
+		Report:        true,
+		Retries:       1,
+		RetryInterval: "1ms",
+	}, localPub, hubPub)
+
+	attempts := 0
+	produced, err := d.decorate(flakyHandler(2, &attempts))(topicMessage(rejectedTopic, "cmd"))
+	require.NoError(t, err)
+	assert.Empty(t, produced)
+	assert.Equal(t, 2, attempts)
+
+	assert.Equal(t, []string{"command/deadletter"}, publishedTopics(localPub))
+	var deadLetter CommandDeadLetter
+	require.NoError(t, json.Unmarshal(localPub.messages()[0].Payload, &deadLetter))
+	assert.Equal(t, CommandDeadLetter{
+		Properties:    map[string]string{"$.mid": "c2d-1", "$.cid": "req-1", "subject": "cmd"},
+		Error:         "temporary failure",
+		PayloadBase64: []byte("cmd"),
+	}, deadLetter)
+
+	require.Len(t, hubPub.messages(), 1)
+	topic, _ := connector.TopicFromCtx(hubPub.messages()[0].Context())
+	deviceID, properties, ok := routing.ParseTelemetryTopic(topic)
+	require.True(t, ok)
+	assert.Equal(t, "dev", deviceID)
+	assert.Equal(t, EventCommandRejected, properties.Get(PropertyEvent))
+	assert.Equal(t, "req-1", properties.Get(routing.KeyCorrelationID))
+	var rejected CommandRejected
+	require.NoError(t, json.Unmarshal(hubPub.messages()[0].Payload, &rejected))
+	assert.Equal(t, CommandRejected{MessageID: "c2d-1", CorrelationID: "req-1", Error: "temporary failure"}, rejected)
+
+	assert.Equal(t, 1.0, connMetrics.CommandRejected.Value(metrics.DeadLetterFailed))
+}
+
+func TestCommandDeadLettersPayload(t *testing.T) {
+	localPub := &batchPublisher{}
+	d, _ := newTestDeadLetters(&config.CommandDeadLetterSettings{Topic: "command/deadletter"}, localPub, nil)
+
+	payloads := []string{`{"start":true}`, "\x1f\x8b\x08\x00\xff"}
+	for _, payload := range payloads {
+		attempts := 0
+		_, err := d.decorate(flakyHandler(1, &attempts))(topicMessage(rejectedTopic, payload))
+		require.NoError(t, err)
+	}
+
+	require.Len(t, localPub.messages(), 2)
+	var deadLetter CommandDeadLetter
+	require.NoError(t, json.Unmarshal(localPub.messages()[0].Payload, &deadLetter))
+	assert.JSONEq(t, payloads[0], string(deadLetter.Payload))
+	assert.Empty(t, deadLetter.PayloadBase64)
+
+	deadLetter = CommandDeadLetter{}
+	require.NoError(t, json.Unmarshal(localPub.messages()[1].Payload, &deadLetter))
+	assert.Empty(t, deadLetter.Payload)
+	assert.Equal(t, []byte(payloads[1]), deadLetter.PayloadBase64)
+}
+
+func TestCommandDeadLettersDisconnectedBroker(t *testing.T) {
+	localPub := connector.NewSyncPublisher(disconnectedHub(t), connector.QosAtLeastOnce, time.Second, watermill.NopLogger{}, nil)
+	inbox := newTestInbox(t, localPub, &InboxOptions{MaxMessages: 1})
+	handlerCtx := handlers.NewHandlerContext(&config.RemoteConnectionInfo{DeviceID: "dev"}, watermill.NopLogger{})
+	d := newCommandDeadLetters(&config.CommandDeadLetterSettings{Topic: "command/deadletter"}, inbox, handlerCtx, nil, watermill.NopLogger{})
+
+	// the C2D message is acknowledged and its dead letter is kept until the local connection is restored
+	attempts := 0
+	_, err := d.decorate(flakyHandler(1, &attempts))(topicMessage(rejectedTopic, "cmd"))
+	require.NoError(t, err)
+	assert.Equal(t, 1, inbox.Len())
+
+	// the dead letter is lost only if the inbox is full
+	attempts = 0
+	_, err = d.decorate(flakyHandler(1, &attempts))(topicMessage(rejectedTopic, "cmd"))
+	assert.Error(t, err)
+}
+
+func TestCommandDeadLettersUnhandled(t *testing.T) {
+	hubPub := &batchPublisher{}
+	d, connMetrics := newTestDeadLetters(&config.CommandDeadLetterSettings{Report: true, Retries: 3}, nil, hubPub)
+	busHandler := &commandBusHandler{
+		logger: watermill.NopLogger{},
+		commandHandlers: []handlers.CommandHandler{
+			&transformingCommandHandler{name: "handler", matches: false},
+		},
+	}
+
+	produced, err := d.decorate(busHandler.HandleMessage)(topicMessage("devices/dev/messages/devicebound/%24.mid=c2d-2", "cmd"))
+	require.NoError(t, err)
+	assert.Empty(t, produced)
+
+	require.Len(t, hubPub.messages(), 1)
+	topic, _ := connector.TopicFromCtx(hubPub.messages()[0].Context())
+	_, properties, _ := routing.ParseTelemetryTopic(topic)
+	assert.Equal(t, "c2d-2", properties.Get(routing.KeyCorrelationID))
+	assert.Equal(t, 1.0, connMetrics.CommandRejected.Value(metrics.DeadLetterUnhandled))
+}
+
+func TestCommandDeadLettersPublishError(t *testing.T) {
+	localPub := &batchPublisher{err: errors.New("not connected")}
+	hubPub := &batchPublisher{err: errors.New("not connected")}
+	d, _ := newTestDeadLetters(&config.CommandDeadLetterSettings{Topic: "command/deadletter"}, localPub, hubPub)
+
+	attempts := 0
+	_, err := d.decorate(flakyHandler(1, &attempts))(topicMessage(rejectedTopic, "cmd"))
+	assert.Error(t, err)
+
+	// the report errors are logged only
+	d, _ = newTestDeadLetters(&config.CommandDeadLetterSettings{Report: true}, localPub, hubPub)
+	attempts = 0
+	_, err = d.decorate(flakyHandler(1, &attempts))(topicMessage(rejectedTopic, "cmd"))
+	assert.NoError(t, err)
+}
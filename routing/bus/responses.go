@@ -0,0 +1,328 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package bus
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+
+	"github.com/eclipse/ditto-clients-golang/protocol"
+
+	"github.com/eclipse-kanto/suite-connector/connector"
+
+	"github.com/eclipse-kanto/azure-connector/routing"
+)
+
+const (
+	// PropertyStatus is the device-to-cloud message property with the status of a command response.
+	PropertyStatus = "status"
+	// EventCommandResponse marks a response to a C2D message, correlated by the C2D message ID or correlation ID.
+	EventCommandResponse = "command-response"
+
+	// StatusTimeout is the status of the failure responses sent for the commands without a response in time.
+	StatusTimeout = "408"
+
+	maxPendingCommands = 1000
+
+	headerTimeout          = "timeout"
+	headerResponseRequired = "response-required"
+)
+
+type pendingCommand struct {
+	messageID     string
+	correlationID string
+	timeout       time.Duration
+	timer         *time.Timer
+}
+
+// correlation returns the correlation ID of the command responses, the C2D message ID if no correlation ID is set.
+func (c *pendingCommand) correlation() string {
+	if len(c.correlationID) > 0 {
+		return c.correlationID
+	}
+	return c.messageID
+}
+
+// CommandResponses correlates the responses to the commands forwarded from the Azure IoT Hub with the originating C2D messages.
+// The C2D message ID and correlation ID of each forwarded command are stored by its Ditto correlation ID, which is the request ID
+// of the local command topic. The device-to-cloud messages produced for the matching command response are sent with the
+// correlation ID of the C2D message, the response status and the command response event property. A failure response is sent
+// instead, if no response is received in time.
+type CommandResponses struct {
+	pub      message.Publisher
+	deviceID string
+	timeout  time.Duration
+	logger   watermill.LoggerAdapter
+
+	lock    sync.Mutex
+	pending map[string]*pendingCommand
+	closed  bool
+}
+
+// NewCommandResponses creates the command responses correlation, publishing the failure responses of the timed out commands
+// to the Azure IoT Hub using the given publisher. The timeout is overridden by the Ditto timeout header of a command, if set.
+func NewCommandResponses(
+	pub message.Publisher,
+	deviceID string,
+	timeout time.Duration,
+	logger watermill.LoggerAdapter,
+) *CommandResponses {
+	return &CommandResponses{
+		pub:      pub,
+		deviceID: deviceID,
+		timeout:  timeout,
+		logger:   logger,
+		pending:  make(map[string]*pendingCommand),
+	}
+}
+
+// Len returns the number of the commands waiting for a response.
+func (r *CommandResponses) Len() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return len(r.pending)
+}
+
+// Close stops waiting for the responses of the pending commands, no failure responses are sent for them.
+func (r *CommandResponses) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.closed = true
+	for requestID, command := range r.pending {
+		command.timer.Stop()
+		delete(r.pending, requestID)
+	}
+	return nil
+}
+
+// decorateCommands stores the forwarded commands produced from the successfully handled C2D messages.
+func (r *CommandResponses) decorateCommands(handlerFunc message.HandlerFunc) message.HandlerFunc {
+	return func(msg *message.Message) ([]*message.Message, error) {
+		produced, err := handlerFunc(msg)
+		if err != nil || len(produced) == 0 {
+			return produced, err
+		}
+
+		messageID := cloudMessageProperty(msg, keyMessageID)
+		correlationID := cloudMessageProperty(msg, routing.KeyCorrelationID)
+		if len(messageID) == 0 && len(correlationID) == 0 {
+			return produced, nil
+		}
+		for _, m := range produced {
+			requestID, timeout, ok := r.commandRequest(m)
+			if ok {
+				r.track(requestID, &pendingCommand{messageID: messageID, correlationID: correlationID, timeout: timeout})
+			}
+		}
+		return produced, nil
+	}
+}
+
+// decorateResponses applies the correlation of the command stored for the handled command response to the produced messages.
+func (r *CommandResponses) decorateResponses(handlerFunc message.HandlerFunc) message.HandlerFunc {
+	return func(msg *message.Message) ([]*message.Message, error) {
+		produced, err := handlerFunc(msg)
+		if err != nil || len(produced) == 0 {
+			return produced, err
+		}
+
+		localTopic, _ := connector.TopicFromCtx(msg.Context())
+		requestID, status, ok := parseCommandResponseTopic(localTopic)
+		if !ok {
+			return produced, nil
+		}
+		command := r.resolve(requestID)
+		if command == nil {
+			return produced, nil
+		}
+
+		for _, m := range produced {
+			topic, _ := connector.TopicFromCtx(m.Context())
+			deviceID, properties, ok := routing.ParseTelemetryTopic(topic)
+			if !ok {
+				continue
+			}
+			properties.Set(routing.KeyCorrelationID, command.correlation())
+			properties.Set(PropertyStatus, status)
+			properties.Set(PropertyEvent, EventCommandResponse)
+			m.SetContext(connector.SetTopicToCtx(m.Context(), routing.CreateTelemetryTopicWithProperties(deviceID, "", properties)))
+		}
+		return produced, nil
+	}
+}
+
+// commandRequest returns the Ditto correlation ID and the response timeout of a command forwarded to the local command topic.
+// The last result is false if the message is not a command or no response is required.
+func (r *CommandResponses) commandRequest(msg *message.Message) (string, time.Duration, bool) {
+	topic, _ := connector.TopicFromCtx(msg.Context())
+	requestID, ok := parseCommandRequestTopic(topic)
+	if !ok {
+		return "", 0, false
+	}
+
+	env := struct {
+		Headers map[string]interface{} `json:"headers"`
+	}{}
+	if err := json.Unmarshal(msg.Payload, &env); err != nil {
+		return "", 0, false
+	}
+	if correlationID, _ := env.Headers[protocol.HeaderCorrelationID].(string); correlationID != requestID {
+		return "", 0, false
+	}
+	if required, ok := env.Headers[headerResponseRequired].(bool); ok && !required {
+		return "", 0, false
+	}
+
+	timeout := r.timeout
+	if value, ok := env.Headers[headerTimeout]; ok {
+		timeout, ok = parseDittoTimeout(value)
+		if !ok {
+			timeout = r.timeout
+		} else if timeout == 0 {
+			// no response is expected
+			return "", 0, false
+		}
+	}
+	return requestID, timeout, true
+}
+
+// track stores the forwarded command and starts waiting for its response. The commands exceeding the max number
+// of the pending commands are not correlated.
+func (r *CommandResponses) track(requestID string, command *pendingCommand) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.closed {
+		return
+	}
+	logFields := watermill.LogFields{"request_id": requestID, "message_id": command.messageID}
+	if previous, ok := r.pending[requestID]; ok {
+		previous.timer.Stop()
+	} else if len(r.pending) >= maxPendingCommands {
+		r.logger.Error("too many commands waiting for a response, the command response will not be correlated", nil, logFields)
+		return
+	}
+	command.timer = time.AfterFunc(command.timeout, func() {
+		r.expire(requestID, command)
+	})
+	r.pending[requestID] = command
+	r.logger.Debug("Waiting for command response", logFields)
+}
+
+// resolve returns the pending command with the given request ID and stops waiting for its response, nil if there is none.
+func (r *CommandResponses) resolve(requestID string) *pendingCommand {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	command, ok := r.pending[requestID]
+	if !ok {
+		return nil
+	}
+	command.timer.Stop()
+	delete(r.pending, requestID)
+	return command
+}
+
+// expire sends the failure response of a command without a response in time.
+func (r *CommandResponses) expire(requestID string, command *pendingCommand) {
+	r.lock.Lock()
+	if r.pending[requestID] != command {
+		// already responded or replaced
+		r.lock.Unlock()
+		return
+	}
+	delete(r.pending, requestID)
+	r.lock.Unlock()
+
+	logFields := watermill.LogFields{"request_id": requestID, "message_id": command.messageID}
+	r.logger.Debug("Command response timed out", logFields)
+
+	payload, err := json.Marshal(&CommandRejected{
+		MessageID:     command.messageID,
+		CorrelationID: command.correlationID,
+		Error:         fmt.Sprintf("no command response within %v", command.timeout),
+	})
+	if err != nil {
+		r.logger.Error("cannot create command timeout response", err, logFields)
+		return
+	}
+	properties := url.Values{
+		routing.KeyCorrelationID: []string{command.correlation()},
+		PropertyStatus:           []string{StatusTimeout},
+		PropertyEvent:            []string{EventCommandResponse},
+	}
+	topic := routing.CreateTelemetryTopicWithProperties(r.deviceID, watermill.NewUUID(), properties)
+	msg := message.NewMessage(watermill.NewUUID(), payload)
+	msg.SetContext(connector.SetTopicToCtx(msg.Context(), topic))
+	if err := r.pub.Publish(topic, msg); err != nil {
+		r.logger.Error("cannot send command timeout response", err, logFields)
+	}
+}
+
+// parseCommandRequestTopic returns the request ID of a local command topic,
+// i.e. 'command//<name>/req/<request-id>/<action>' or 'c//<name>/q/<request-id>/<action>'.
+func parseCommandRequestTopic(topic string) (string, bool) {
+	levels := strings.Split(topic, "/")
+	if len(levels) < 5 || len(levels[4]) == 0 {
+		return "", false
+	}
+	if (levels[0] == "command" && levels[3] == "req") || (levels[0] == "c" && levels[3] == "q") {
+		return levels[4], true
+	}
+	return "", false
+}
+
+// parseCommandResponseTopic returns the request ID and the status of a local command response topic,
+// i.e. 'command//<name>/res/<request-id>/<status>' or 'c//<name>/s/<request-id>/<status>'.
+func parseCommandResponseTopic(topic string) (string, string, bool) {
+	levels := strings.Split(topic, "/")
+	if len(levels) != 6 || len(levels[4]) == 0 || len(levels[5]) == 0 {
+		return "", "", false
+	}
+	if (levels[0] == "command" && levels[3] == "res") || (levels[0] == "c" && levels[3] == "s") {
+		return levels[4], levels[5], true
+	}
+	return "", "", false
+}
+
+// parseDittoTimeout parses the value of a Ditto timeout header, e.g. '30s', '500ms', '1m' or a number of seconds.
+func parseDittoTimeout(value interface{}) (time.Duration, bool) {
+	switch v := value.(type) {
+	case float64:
+		if v < 0 {
+			return 0, false
+		}
+		return time.Duration(v * float64(time.Second)), true
+	case string:
+		if seconds, err := strconv.ParseUint(v, 10, 32); err == nil {
+			return time.Duration(seconds) * time.Second, true
+		}
+		timeout, err := time.ParseDuration(v)
+		if err != nil || timeout < 0 {
+			return 0, false
+		}
+		return timeout, true
+	default:
+		return 0, false
+	}
+}
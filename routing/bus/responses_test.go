@@ -0,0 +1,196 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package bus
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/pkg/errors"
+
+	"github.com/eclipse-kanto/suite-connector/connector"
+
+	"github.com/eclipse-kanto/azure-connector/routing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	responsesCloudTopic = "devices/" + routesDeviceID + "/messages/devicebound/%24.mid=c2d-1&%24.cid=corr-1"
+	responsesCommand    = `{"topic":"org.acme/pump/things/live/messages/start","headers":{"correlation-id":"req-1"%s},"path":"/inbox/messages/start"}`
+)
+
+// forwardingCommand forwards the C2D message payload to the given local topic.
+func forwardingCommand(topic string) message.HandlerFunc {
+	return func(msg *message.Message) ([]*message.Message, error) {
+		return []*message.Message{topicMessage(topic, string(msg.Payload))}, nil
+	}
+}
+
+func dittoCommand(headers string) string {
+	return fmt.Sprintf(responsesCommand, headers)
+}
+
+func responseProperties(t *testing.T, msg *message.Message) (string, map[string]string) {
+	topic, _ := connector.TopicFromCtx(msg.Context())
+	deviceID, properties, ok := routing.ParseTelemetryTopic(topic)
+	require.True(t, ok)
+	return deviceID, map[string]string{
+		routing.KeyCorrelationID: properties.Get(routing.KeyCorrelationID),
+		PropertyStatus:           properties.Get(PropertyStatus),
+		PropertyEvent:            properties.Get(PropertyEvent),
+	}
+}
+
+func TestCommandResponsesCorrelation(t *testing.T) {
+	r := NewCommandResponses(&batchPublisher{}, routesDeviceID, time.Minute, watermill.NopLogger{})
+	defer r.Close()
+
+	commands := r.decorateCommands(forwardingCommand("command//org.acme:pump/req/req-1/start"))
+	_, err := commands(topicMessage(responsesCloudTopic, dittoCommand("")))
+	require.NoError(t, err)
+	assert.Equal(t, 1, r.Len())
+
+	responses := r.decorateResponses(telemetryPassthrough)
+	produced, err := responses(topicMessage("command//org.acme:pump/res/req-1/200", `{"status":200}`))
+	require.NoError(t, err)
+	require.Len(t, produced, 1)
+	deviceID, properties := responseProperties(t, produced[0])
+	assert.Equal(t, routesDeviceID, deviceID)
+	assert.Equal(t, map[string]string{"$.cid": "corr-1", "status": "200", "event": "command-response"}, properties)
+	assert.Equal(t, 0, r.Len())
+
+	// the response is correlated once
+	produced, err = responses(topicMessage("command//org.acme:pump/res/req-1/200", `{"status":200}`))
+	require.NoError(t, err)
+	_, properties = responseProperties(t, produced[0])
+	assert.Empty(t, properties[PropertyEvent])
+}
+
+func TestCommandResponsesShortTopics(t *testing.T) {
+	r := NewCommandResponses(&batchPublisher{}, routesDeviceID, time.Minute, watermill.NopLogger{})
+	defer r.Close()
+
+	commands := r.decorateCommands(forwardingCommand("c//org.acme:pump/q/req-1/start"))
+	_, err := commands(topicMessage("devices/"+routesDeviceID+"/messages/devicebound/%24.mid=c2d-2", dittoCommand("")))
+	require.NoError(t, err)
+
+	produced, err := r.decorateResponses(telemetryPassthrough)(topicMessage("c//org.acme:pump/s/req-1/500", `{}`))
+	require.NoError(t, err)
+	_, properties := responseProperties(t, produced[0])
+	// the message ID is used without a correlation ID
+	assert.Equal(t, map[string]string{"$.cid": "c2d-2", "status": "500", "event": "command-response"}, properties)
+}
+
+func TestCommandResponsesNotTracked(t *testing.T) {
+	r := NewCommandResponses(&batchPublisher{}, routesDeviceID, time.Minute, watermill.NopLogger{})
+	defer r.Close()
+
+	tests := []struct {
+		name    string
+		cloud   string
+		topic   string
+		payload string
+	}{
+		{name: "not a command topic", cloud: responsesCloudTopic, topic: "event/pump", payload: dittoCommand("")},
+		{name: "not a Ditto message", cloud: responsesCloudTopic, topic: "command//org.acme:pump/req/req-1/start", payload: "start"},
+		{name: "other correlation ID", cloud: responsesCloudTopic, topic: "command//org.acme:pump/req/req-2/start", payload: dittoCommand("")},
+		{name: "no response required", cloud: responsesCloudTopic, topic: "command//org.acme:pump/req/req-1/start", payload: dittoCommand(`,"response-required":false`)},
+		{name: "zero timeout", cloud: responsesCloudTopic, topic: "command//org.acme:pump/req/req-1/start", payload: dittoCommand(`,"timeout":"0"`)},
+		{name: "no C2D message IDs", cloud: "devices/" + routesDeviceID + "/messages/devicebound/subject=cmd", topic: "command//org.acme:pump/req/req-1/start", payload: dittoCommand("")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := r.decorateCommands(forwardingCommand(test.topic))(topicMessage(test.cloud, test.payload))
+			require.NoError(t, err)
+			assert.Equal(t, 0, r.Len())
+		})
+	}
+
+	failing := func(msg *message.Message) ([]*message.Message, error) {
+		return nil, errors.New("not delivered")
+	}
+	_, err := r.decorateCommands(failing)(topicMessage(responsesCloudTopic, dittoCommand("")))
+	assert.Error(t, err)
+	assert.Equal(t, 0, r.Len())
+}
+
+func TestCommandResponsesTimeout(t *testing.T) {
+	pub := &batchPublisher{}
+	r := NewCommandResponses(pub, routesDeviceID, time.Minute, watermill.NopLogger{})
+	defer r.Close()
+
+	commands := r.decorateCommands(forwardingCommand("command//org.acme:pump/req/req-1/start"))
+	_, err := commands(topicMessage(responsesCloudTopic, dittoCommand(`,"timeout":"10ms"`)))
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return len(pub.messages()) == 1
+	}, time.Second, 5*time.Millisecond)
+	assert.Equal(t, 0, r.Len())
+
+	_, properties := responseProperties(t, pub.messages()[0])
+	assert.Equal(t, map[string]string{"$.cid": "corr-1", "status": StatusTimeout, "event": "command-response"}, properties)
+	var failure CommandRejected
+	require.NoError(t, json.Unmarshal(pub.messages()[0].Payload, &failure))
+	assert.Equal(t, CommandRejected{MessageID: "c2d-1", CorrelationID: "corr-1", Error: "no command response within 10ms"}, failure)
+
+	// the late response is not correlated
+	produced, err := r.decorateResponses(telemetryPassthrough)(topicMessage("command//org.acme:pump/res/req-1/200", `{}`))
+	require.NoError(t, err)
+	_, properties = responseProperties(t, produced[0])
+	assert.Empty(t, properties[PropertyEvent])
+}
+
+func TestCommandResponsesClose(t *testing.T) {
+	pub := &batchPublisher{}
+	r := NewCommandResponses(pub, routesDeviceID, 10*time.Millisecond, watermill.NopLogger{})
+
+	commands := r.decorateCommands(forwardingCommand("command//org.acme:pump/req/req-1/start"))
+	_, err := commands(topicMessage(responsesCloudTopic, dittoCommand("")))
+	require.NoError(t, err)
+	assert.Equal(t, 1, r.Len())
+
+	require.NoError(t, r.Close())
+	assert.Equal(t, 0, r.Len())
+	time.Sleep(30 * time.Millisecond)
+	assert.Empty(t, pub.messages())
+
+	_, err = commands(topicMessage(responsesCloudTopic, dittoCommand("")))
+	require.NoError(t, err)
+	assert.Equal(t, 0, r.Len())
+}
+
+func TestParseDittoTimeout(t *testing.T) {
+	valid := map[interface{}]time.Duration{
+		"30":    30 * time.Second,
+		"500ms": 500 * time.Millisecond,
+		"1m":    time.Minute,
+		2.5:     2500 * time.Millisecond,
+	}
+	for value, expected := range valid {
+		timeout, ok := parseDittoTimeout(value)
+		assert.True(t, ok, value)
+		assert.Equal(t, expected, timeout, value)
+	}
+
+	for _, value := range []interface{}{"soon", "-1s", -1.0, true} {
+		_, ok := parseDittoTimeout(value)
+		assert.False(t, ok, value)
+	}
+}
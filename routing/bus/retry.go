@@ -0,0 +1,102 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package bus
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/pkg/errors"
+)
+
+const (
+	retryPublishInitialInterval = 100 * time.Millisecond
+	retryPublishMaxInterval     = 5 * time.Second
+)
+
+// RetryPublisher is a publisher of the messages produced from the C2D messages to the local broker,
+// which retries each message until the local broker accepts it or the retry timeout elapses. While the messages are retried,
+// the C2D message is not acknowledged, so that its PUBACK to the Azure IoT Hub is deferred. The timeout has to be shorter than
+// the acknowledgement timeout of the C2D subscriber, as the C2D message is acknowledged on that timeout anyway.
+// The messages still not published are returned as an error, so that the inbox wrapping the publisher stores them.
+type RetryPublisher struct {
+	pub     message.Publisher
+	timeout time.Duration
+	logger  watermill.LoggerAdapter
+
+	initialInterval time.Duration
+	maxInterval     time.Duration
+
+	closing   chan struct{}
+	closeOnce sync.Once
+}
+
+// NewRetryPublisher creates a publisher retrying the messages that cannot be published using the given publisher for up to the given timeout.
+func NewRetryPublisher(pub message.Publisher, timeout time.Duration, logger watermill.LoggerAdapter) *RetryPublisher {
+	return &RetryPublisher{
+		pub:             pub,
+		timeout:         timeout,
+		logger:          logger,
+		initialInterval: retryPublishInitialInterval,
+		maxInterval:     retryPublishMaxInterval,
+		closing:         make(chan struct{}),
+	}
+}
+
+// Publish publishes the messages in order, retrying each message with a growing interval until it is published.
+// The messages already published are not published again. An error is returned if the messages are not published
+// within the timeout or if the publisher is closed.
+func (p *RetryPublisher) Publish(topic string, messages ...*message.Message) error {
+	deadline := time.Now().Add(p.timeout)
+	for _, msg := range messages {
+		interval := p.initialInterval
+		for {
+			err := p.pub.Publish(topic, msg)
+			if err == nil {
+				break
+			}
+			remaining := time.Until(deadline)
+			if remaining <= 0 {
+				return errors.Wrapf(err, "command message not published within %v", p.timeout)
+			}
+			if interval > remaining {
+				interval = remaining
+			}
+			p.logger.Debug("Cannot publish command message, retrying", watermill.LogFields{
+				"message_uuid": msg.UUID,
+				"error":        err.Error(),
+				"interval":     interval,
+			})
+
+			select {
+			case <-p.closing:
+				return errors.Wrap(err, "publisher closed before the command message is published")
+			case <-time.After(interval):
+			}
+			if interval *= 2; interval > p.maxInterval {
+				interval = p.maxInterval
+			}
+		}
+	}
+	return nil
+}
+
+// Close stops the retrying and closes the underlying publisher.
+func (p *RetryPublisher) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.closing)
+	})
+	return p.pub.Close()
+}
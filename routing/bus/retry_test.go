@@ -0,0 +1,130 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package bus
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/pkg/errors"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyPublisher fails publishing the given number of times.
+type flakyPublisher struct {
+	lock      sync.Mutex
+	failures  int
+	attempts  int
+	published []*message.Message
+}
+
+func (p *flakyPublisher) Publish(topic string, messages ...*message.Message) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.attempts++
+	if p.failures != 0 {
+		p.failures--
+		return errors.New("not connected")
+	}
+	p.published = append(p.published, messages...)
+	return nil
+}
+
+func (p *flakyPublisher) Close() error {
+	return nil
+}
+
+func (p *flakyPublisher) payloads() []string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return payloads(p.published)
+}
+
+func newTestRetryPublisher(pub message.Publisher) *RetryPublisher {
+	retry := NewRetryPublisher(pub, time.Minute, watermill.NopLogger{})
+	retry.initialInterval = time.Millisecond
+	retry.maxInterval = 4 * time.Millisecond
+	return retry
+}
+
+func TestRetryPublisher(t *testing.T) {
+	pub := &flakyPublisher{failures: 2}
+	retry := newTestRetryPublisher(pub)
+	defer retry.Close()
+
+	require.NoError(t, retry.Publish("", topicMessage("command//ns:thing/req/1/start", "1"), topicMessage("c//ns:thing/q/1/start", "2")))
+	assert.Equal(t, []string{"1", "2"}, pub.payloads())
+	assert.Equal(t, 4, pub.attempts)
+
+	// the first message is not published again if the second one fails
+	pub.failures = 3
+	require.NoError(t, retry.Publish("", topicMessage("a", "3"), topicMessage("b", "4")))
+	pub.failures = 0
+	assert.Equal(t, []string{"1", "2", "3", "4"}, pub.payloads())
+}
+
+func TestRetryPublisherTimeout(t *testing.T) {
+	pub := &flakyPublisher{failures: -1}
+	retry := NewRetryPublisher(pub, 20*time.Millisecond, watermill.NopLogger{})
+	retry.initialInterval = time.Millisecond
+	retry.maxInterval = 4 * time.Millisecond
+	defer retry.Close()
+
+	start := time.Now()
+	assert.Error(t, retry.Publish("", topicMessage("a", "1")))
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Greater(t, pub.attempts, 1)
+	assert.Empty(t, pub.payloads())
+
+	// the messages not published within the timeout are stored by the inbox
+	inbox := newTestInbox(t, retry, &InboxOptions{})
+	require.NoError(t, inbox.Publish("", topicMessage("b", "2")))
+	assert.Equal(t, 1, inbox.Len())
+
+	pub.lock.Lock()
+	pub.failures = 0
+	pub.lock.Unlock()
+	inbox.Replay()
+	assert.Equal(t, []string{"2"}, pub.payloads())
+}
+
+func TestRetryPublisherClose(t *testing.T) {
+	pub := &flakyPublisher{failures: -1}
+	retry := newTestRetryPublisher(pub)
+
+	published := make(chan error, 1)
+	go func() {
+		published <- retry.Publish("", topicMessage("a", "1"))
+	}()
+	time.Sleep(20 * time.Millisecond)
+	select {
+	case <-published:
+		require.Fail(t, "message published before the local broker accepts it")
+	default:
+	}
+
+	require.NoError(t, retry.Close())
+	select {
+	case err := <-published:
+		assert.Error(t, err)
+	case <-time.After(time.Second):
+		require.Fail(t, "retrying not stopped on close")
+	}
+	assert.Empty(t, pub.payloads())
+}
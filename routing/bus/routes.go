@@ -0,0 +1,375 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package bus
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/pkg/errors"
+
+	"github.com/eclipse-kanto/suite-connector/connector"
+
+	"github.com/eclipse-kanto/azure-connector/config"
+	"github.com/eclipse-kanto/azure-connector/metrics"
+	"github.com/eclipse-kanto/azure-connector/routing"
+	"github.com/eclipse-kanto/azure-connector/routing/schema"
+)
+
+const templateDeviceID = "deviceId"
+
+// DeadLetter is the payload of the messages diverted to a dead-letter topic as they cannot be routed.
+type DeadLetter struct {
+	// Topic is the local topic of the handled message.
+	Topic string `json:"topic"`
+	// Schema is the JSON Schema file of the route, empty if the message is not rejected by a schema.
+	Schema string `json:"schema,omitempty"`
+	// Errors are the validation errors or the error applying the route.
+	Errors []string `json:"errors"`
+	// Payload is the invalid device-to-cloud message payload.
+	Payload string `json:"payload"`
+}
+
+// telemetryRoutes rewrites the destination of the messages produced by the telemetry handlers according to the routing table.
+// The messages failing the schema validation of a route, or the route itself, are published to the local dead-letter topic instead.
+type telemetryRoutes struct {
+	routes     []config.TelemetryRoute
+	schemas    []*schema.Schema
+	schemaErrs []error
+	tree       *routing.TopicTree
+	requestID  uint64
+
+	deadLetterPub message.Publisher
+	metrics       *metrics.ConnectorMetrics
+	logger        watermill.LoggerAdapter
+}
+
+// ValidateRoutes compiles the JSON Schemas of the telemetry routes, returning an error for the first invalid one.
+// A schema that can no longer be compiled on a later telemetry bus setup diverts all messages of its route to the dead-letter topic.
+func ValidateRoutes(routes []config.TelemetryRoute) error {
+	for _, route := range routes {
+		if route.Schema == nil {
+			continue
+		}
+		if _, err := schema.Load(route.Schema.File); err != nil {
+			return errors.Wrapf(err, "invalid telemetry route '%s'", route.Topic)
+		}
+	}
+	return nil
+}
+
+func newTelemetryRoutes(
+	routes []config.TelemetryRoute,
+	deadLetterPub message.Publisher,
+	connMetrics *metrics.ConnectorMetrics,
+	logger watermill.LoggerAdapter,
+) *telemetryRoutes {
+	if len(routes) == 0 {
+		return nil
+	}
+
+	r := &telemetryRoutes{
+		routes:        routes,
+		schemas:       make([]*schema.Schema, len(routes)),
+		schemaErrs:    make([]error, len(routes)),
+		tree:          routing.NewTopicTree(),
+		deadLetterPub: deadLetterPub,
+		metrics:       connMetrics,
+		logger:        logger,
+	}
+	for i, route := range routes {
+		r.tree.Add(route.Topic, i)
+		if route.Schema == nil {
+			continue
+		}
+		// the schemas are validated on startup using ValidateRoutes, the file may still change before a router restart
+		s, err := schema.Load(route.Schema.File)
+		if err != nil {
+			logger.Error("diverting all messages of telemetry route with invalid schema", err, watermill.LogFields{"topic": route.Topic})
+			r.schemaErrs[i] = err
+			continue
+		}
+		r.schemas[i] = s
+	}
+	return r
+}
+
+// decorate applies the first route matching the local topic of the handled message to the produced messages.
+// A produced message the route cannot be applied to is diverted to the dead-letter topic, its siblings are still forwarded.
+func (r *telemetryRoutes) decorate(deviceID string, handlerFunc message.HandlerFunc) message.HandlerFunc {
+	return func(msg *message.Message) ([]*message.Message, error) {
+		produced, err := handlerFunc(msg)
+		if err != nil || len(produced) == 0 {
+			return produced, err
+		}
+
+		topic, _ := connector.TopicFromCtx(msg.Context())
+		matches := r.tree.Match(topic)
+		if len(matches) == 0 {
+			return produced, nil
+		}
+
+		route := &r.routes[matches[0]]
+		routeSchema := r.schemas[matches[0]]
+		schemaErr := r.schemaErrs[matches[0]]
+		captures := routing.CaptureTopic(route.Topic, topic)
+		vars := func(name string) (string, bool) {
+			if name == templateDeviceID {
+				return deviceID, true
+			}
+			index, err := strconv.Atoi(name)
+			if err != nil || index < 1 || index > len(captures) {
+				return "", false
+			}
+			return captures[index-1], true
+		}
+
+		forwarded := make([]*message.Message, 0, len(produced))
+		for _, m := range produced {
+			if schemaErr != nil {
+				if err := r.divert(route, topic, schemaErr, m); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if routeSchema != nil {
+				valid, err := r.validate(route, routeSchema, topic, m)
+				if err != nil {
+					return nil, errors.Wrapf(err, "cannot apply telemetry route '%s'", route.Topic)
+				}
+				if !valid {
+					continue
+				}
+			}
+			if err := r.apply(route, vars, m); err != nil {
+				if err := r.divert(route, topic, err, m); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			forwarded = append(forwarded, m)
+		}
+		return forwarded, nil
+	}
+}
+
+// validate validates the payload of a device-to-cloud message against the route schema.
+// An invalid message is published to the dead-letter topic and false is returned.
+func (r *telemetryRoutes) validate(route *config.TelemetryRoute, routeSchema *schema.Schema, localTopic string, msg *message.Message) (bool, error) {
+	outTopic, _ := connector.TopicFromCtx(msg.Context())
+	if _, _, ok := routing.ParseTelemetryTopic(outTopic); !ok {
+		return true, nil
+	}
+
+	validationErrors := routeSchema.Validate(msg.Payload)
+	if len(validationErrors) == 0 {
+		return true, nil
+	}
+
+	if r.metrics != nil {
+		r.metrics.SchemaRejected.Inc(route.Schema.File)
+	}
+	logFields := watermill.LogFields{"topic": localTopic, "schema": route.Schema.File, "message_uuid": msg.UUID}
+	if r.deadLetterPub == nil {
+		r.logger.Error("dropping invalid telemetry message without a dead-letter publisher", nil, logFields)
+		return false, nil
+	}
+	r.logger.Debug("Diverting invalid telemetry message to the dead-letter topic", logFields)
+
+	return false, r.publishDeadLetter(route, &DeadLetter{
+		Topic:   localTopic,
+		Schema:  route.Schema.File,
+		Errors:  validationErrors,
+		Payload: string(msg.Payload),
+	})
+}
+
+// divert publishes a produced message the route cannot be applied to on the dead-letter topic.
+// The message is dropped if there is no dead-letter publisher.
+func (r *telemetryRoutes) divert(route *config.TelemetryRoute, localTopic string, routeErr error, msg *message.Message) error {
+	routeErr = errors.Wrapf(routeErr, "cannot apply telemetry route '%s'", route.Topic)
+	logFields := watermill.LogFields{"topic": localTopic, "message_uuid": msg.UUID}
+	if r.deadLetterPub == nil {
+		r.logger.Error("dropping telemetry message without a dead-letter publisher", routeErr, logFields)
+		return nil
+	}
+	r.logger.Error("diverting telemetry message to the dead-letter topic", routeErr, logFields)
+
+	return r.publishDeadLetter(route, &DeadLetter{
+		Topic:   localTopic,
+		Errors:  []string{routeErr.Error()},
+		Payload: string(msg.Payload),
+	})
+}
+
+func (r *telemetryRoutes) publishDeadLetter(route *config.TelemetryRoute, letter *DeadLetter) error {
+	payload, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+	deadLetterTopic := config.DefaultDeadLetterTopic
+	if route.Schema != nil {
+		deadLetterTopic = route.Schema.DeadLetterTopic()
+	}
+	deadLetter := message.NewMessage(watermill.NewUUID(), payload)
+	deadLetter.SetContext(connector.SetTopicToCtx(deadLetter.Context(), deadLetterTopic))
+	if err := r.deadLetterPub.Publish(deadLetterTopic, deadLetter); err != nil {
+		return errors.Wrap(err, "cannot publish dead letter")
+	}
+	return nil
+}
+
+func (r *telemetryRoutes) apply(route *config.TelemetryRoute, vars func(string) (string, bool), msg *message.Message) error {
+	outTopic, _ := connector.TopicFromCtx(msg.Context())
+	deviceID, properties, ok := routing.ParseTelemetryTopic(outTopic)
+	if !ok {
+		// not a device-to-cloud message
+		return nil
+	}
+
+	if len(route.Reported) > 0 {
+		path, err := expandTemplate(route.Reported, vars)
+		if err != nil {
+			return err
+		}
+		payload, err := reportedPayload(path, msg.Payload)
+		if err != nil {
+			return err
+		}
+		msg.Payload = payload
+		requestID := strconv.FormatUint(atomic.AddUint64(&r.requestID, 1), 10)
+		msg.SetContext(connector.SetTopicToCtx(msg.Context(), routing.CreateTwinReportedTopic(requestID)))
+		return nil
+	}
+
+	for key, template := range route.Properties {
+		value, err := expandTemplate(template, vars)
+		if err != nil {
+			return err
+		}
+		properties.Set(key, value)
+	}
+	if len(route.Output) > 0 {
+		output, err := expandTemplate(route.Output, vars)
+		if err != nil {
+			return err
+		}
+		properties.Set(routing.KeyOutputName, output)
+	}
+	if route.Compression != nil && len(msg.Payload) >= route.Compression.MinSize() {
+		payload, err := routing.CompressMessage(route.Compression.ContentEncoding(), msg.Payload, properties)
+		if err != nil {
+			return err
+		}
+		msg.Payload = payload
+	}
+	msg.SetContext(connector.SetTopicToCtx(msg.Context(), routing.CreateTelemetryTopicWithProperties(deviceID, "", properties)))
+	return nil
+}
+
+// reportedPayload nests the JSON payload in objects following the dot separated path.
+func reportedPayload(path string, payload []byte) ([]byte, error) {
+	var value interface{}
+	if err := json.Unmarshal(payload, &value); err != nil {
+		return nil, errors.Wrap(err, "reported property requires a JSON payload")
+	}
+
+	keys := strings.Split(path, ".")
+	for i := len(keys) - 1; i >= 0; i-- {
+		if len(keys[i]) == 0 {
+			return nil, errors.Errorf("invalid reported property path '%s'", path)
+		}
+		value = map[string]interface{}{keys[i]: value}
+	}
+	return json.Marshal(value)
+}
+
+// commandRoutes sends the C2D messages matching a route directly to the local topic of the route.
+type commandRoutes struct {
+	routes []config.CommandRoute
+}
+
+func newCommandRoutes(routes []config.CommandRoute) *commandRoutes {
+	if len(routes) == 0 {
+		return nil
+	}
+	return &commandRoutes{routes: routes}
+}
+
+// route returns the message for the first route matching the C2D message properties.
+// The second result is false if no route matches.
+func (r *commandRoutes) route(msg *message.Message) ([]*message.Message, bool, error) {
+	topic, _ := connector.TopicFromCtx(msg.Context())
+	deviceID, properties, ok := routing.ParseCloudTopic(topic)
+	if !ok {
+		return nil, false, nil
+	}
+
+	for _, route := range r.routes {
+		if !routing.MatchProperties(route.Properties, properties) {
+			continue
+		}
+
+		localTopic, err := expandTemplate(route.Topic, func(name string) (string, bool) {
+			if name == templateDeviceID {
+				return deviceID, true
+			}
+			values, ok := properties[name]
+			if !ok || len(values) == 0 {
+				return "", false
+			}
+			return values[0], true
+		})
+		if err != nil {
+			return nil, true, errors.Wrapf(err, "cannot apply command route '%s'", route.Topic)
+		}
+
+		outgoing := message.NewMessage(watermill.NewUUID(), msg.Payload)
+		outgoing.SetContext(connector.SetTopicToCtx(outgoing.Context(), localTopic))
+		return []*message.Message{outgoing}, true, nil
+	}
+	return nil, false, nil
+}
+
+// expandTemplate replaces the {name} placeholders in the template with the values of the variables.
+func expandTemplate(template string, vars func(name string) (string, bool)) (string, error) {
+	if !strings.Contains(template, "{") {
+		return template, nil
+	}
+
+	var result strings.Builder
+	for {
+		start := strings.Index(template, "{")
+		if start < 0 {
+			result.WriteString(template)
+			return result.String(), nil
+		}
+		end := strings.Index(template[start:], "}")
+		if end < 0 {
+			return "", errors.Errorf("unterminated placeholder in '%s'", template)
+		}
+
+		name := template[start+1 : start+end]
+		value, ok := vars(name)
+		if !ok {
+			return "", errors.Errorf("unresolved placeholder '{%s}'", name)
+		}
+		result.WriteString(template[:start])
+		result.WriteString(value)
+		template = template[start+end+1:]
+	}
+}
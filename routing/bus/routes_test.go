@@ -0,0 +1,356 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package bus
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/pkg/errors"
+
+	"github.com/eclipse-kanto/suite-connector/connector"
+
+	"github.com/eclipse-kanto/azure-connector/config"
+	"github.com/eclipse-kanto/azure-connector/metrics"
+	"github.com/eclipse-kanto/azure-connector/routing"
+	"github.com/eclipse-kanto/azure-connector/routing/message/handlers"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const routesDeviceID = "routes-device"
+
+func topicMessage(topic, payload string) *message.Message {
+	msg := message.NewMessage(watermill.NewUUID(), []byte(payload))
+	msg.SetContext(connector.SetTopicToCtx(msg.Context(), topic))
+	return msg
+}
+
+func telemetryPassthrough(msg *message.Message) ([]*message.Message, error) {
+	outgoing := message.NewMessage(watermill.NewUUID(), msg.Payload)
+	outgoing.SetContext(connector.SetTopicToCtx(outgoing.Context(), routing.CreateTelemetryTopic(routesDeviceID, outgoing.UUID)))
+	return []*message.Message{outgoing}, nil
+}
+
+func routedTopic(t *testing.T, routes []config.TelemetryRoute, topic, payload string) (*message.Message, string) {
+	handlerFunc := newTelemetryRoutes(routes, nil, nil, watermill.NopLogger{}).decorate(routesDeviceID, telemetryPassthrough)
+	produced, err := handlerFunc(topicMessage(topic, payload))
+	require.NoError(t, err)
+	require.Len(t, produced, 1)
+	outTopic, _ := connector.TopicFromCtx(produced[0].Context())
+	return produced[0], outTopic
+}
+
+func TestTelemetryRoutesProperties(t *testing.T) {
+	routes := []config.TelemetryRoute{
+		{Topic: "event/+/alarm/#", Properties: map[string]string{"room": "{1}", "alarm": "{2}", "device": "{deviceId}"}, Output: "alarms"},
+		{Topic: "event/#", Properties: map[string]string{"kind": "event"}},
+	}
+
+	msg, topic := routedTopic(t, routes, "event/room1/alarm/fire/high", "{}")
+	deviceID, properties, ok := routing.ParseTelemetryTopic(topic)
+	require.True(t, ok)
+	assert.Equal(t, routesDeviceID, deviceID)
+	assert.Equal(t, "room1", properties.Get("room"))
+	assert.Equal(t, "fire/high", properties.Get("alarm"))
+	assert.Equal(t, routesDeviceID, properties.Get("device"))
+	assert.Equal(t, "alarms", properties.Get(routing.KeyOutputName))
+	assert.Empty(t, properties.Get("kind"))
+	assert.NotEmpty(t, properties.Get("$.mid"))
+	assert.Equal(t, "{}", string(msg.Payload))
+
+	_, topic = routedTopic(t, routes, "event/room1", "{}")
+	_, properties, _ = routing.ParseTelemetryTopic(topic)
+	assert.Equal(t, "event", properties.Get("kind"))
+
+	_, topic = routedTopic(t, routes, "telemetry/room1", "{}")
+	_, properties, _ = routing.ParseTelemetryTopic(topic)
+	assert.Empty(t, properties.Get("kind"))
+}
+
+func TestTelemetryRoutesReported(t *testing.T) {
+	routes := []config.TelemetryRoute{{Topic: "state/+", Reported: "sensors.{1}"}}
+
+	msg, topic := routedTopic(t, routes, "state/temp", `{"value":21}`)
+	assert.Equal(t, "$iothub/twin/PATCH/properties/reported/?$rid=1", topic)
+	assert.JSONEq(t, `{"sensors":{"temp":{"value":21}}}`, string(msg.Payload))
+
+	handlerFunc := newTelemetryRoutes(routes, nil, nil, watermill.NopLogger{}).decorate(routesDeviceID, telemetryPassthrough)
+	for _, rid := range []string{"1", "2"} {
+		produced, err := handlerFunc(topicMessage("state/humidity", `40`))
+		require.NoError(t, err)
+		topic, _ = connector.TopicFromCtx(produced[0].Context())
+		assert.Equal(t, "$iothub/twin/PATCH/properties/reported/?$rid="+rid, topic)
+	}
+
+	produced, err := handlerFunc(topicMessage("state/temp", "not json"))
+	require.NoError(t, err)
+	assert.Empty(t, produced)
+}
+
+func TestTelemetryRoutesDivertFailed(t *testing.T) {
+	routes := []config.TelemetryRoute{{Topic: "state/+", Reported: "sensors.{1}"}}
+	deadLetterPub := &batchPublisher{}
+	handlerFunc := newTelemetryRoutes(routes, deadLetterPub, nil, watermill.NopLogger{}).decorate(routesDeviceID,
+		func(msg *message.Message) ([]*message.Message, error) {
+			first, _ := telemetryPassthrough(message.NewMessage(watermill.NewUUID(), []byte(`{"value":1}`)))
+			second, _ := telemetryPassthrough(msg)
+			third, _ := telemetryPassthrough(message.NewMessage(watermill.NewUUID(), []byte(`{"value":3}`)))
+			return append(append(first, second...), third...), nil
+		})
+
+	produced, err := handlerFunc(topicMessage("state/temp", "not json"))
+	require.NoError(t, err)
+	require.Len(t, produced, 2)
+	assert.JSONEq(t, `{"sensors":{"temp":{"value":1}}}`, string(produced[0].Payload))
+	assert.JSONEq(t, `{"sensors":{"temp":{"value":3}}}`, string(produced[1].Payload))
+
+	assert.Equal(t, []string{config.DefaultDeadLetterTopic}, publishedTopics(deadLetterPub))
+	var deadLetter DeadLetter
+	require.NoError(t, json.Unmarshal(deadLetterPub.messages()[0].Payload, &deadLetter))
+	assert.Equal(t, "state/temp", deadLetter.Topic)
+	assert.Empty(t, deadLetter.Schema)
+	assert.Equal(t, "not json", deadLetter.Payload)
+	require.Len(t, deadLetter.Errors, 1)
+	assert.Contains(t, deadLetter.Errors[0], "cannot apply telemetry route 'state/+'")
+
+	deadLetterPub.err = errors.New("not connected")
+	_, err = handlerFunc(topicMessage("state/temp", "not json"))
+	assert.Error(t, err)
+}
+
+func TestTelemetryRoutesInvalidSchema(t *testing.T) {
+	schemaFile := filepath.Join(t.TempDir(), "invalid.json")
+	require.NoError(t, os.WriteFile(schemaFile, []byte(`{"type":"string","pattern":"("}`), 0600))
+	routes := []config.TelemetryRoute{{Topic: "sensors/#", Schema: &config.SchemaSettings{File: schemaFile, DeadLetter: "dead/sensors"}}}
+	deadLetterPub := &batchPublisher{}
+	handlerFunc := newTelemetryRoutes(routes, deadLetterPub, nil, watermill.NopLogger{}).decorate(routesDeviceID, telemetryPassthrough)
+
+	produced, err := handlerFunc(topicMessage("sensors/a", `"valid"`))
+	require.NoError(t, err)
+	assert.Empty(t, produced)
+	assert.Equal(t, []string{"dead/sensors"}, publishedTopics(deadLetterPub))
+}
+
+func TestTelemetryRoutesInvalidTemplate(t *testing.T) {
+	routes := []config.TelemetryRoute{{Topic: "event/+", Properties: map[string]string{"a": "{2}"}}}
+	handlerFunc := newTelemetryRoutes(routes, nil, nil, watermill.NopLogger{}).decorate(routesDeviceID, telemetryPassthrough)
+	produced, err := handlerFunc(topicMessage("event/x", "{}"))
+	require.NoError(t, err)
+	assert.Empty(t, produced)
+
+	assert.Nil(t, newTelemetryRoutes(nil, nil, nil, watermill.NopLogger{}))
+}
+
+func TestTelemetryRoutesCompression(t *testing.T) {
+	threshold := 16
+	routes := []config.TelemetryRoute{
+		{Topic: "logs/#", Compression: &config.CompressionSettings{Threshold: &threshold}},
+		{Topic: "event/#", Properties: map[string]string{"kind": "event"}, Compression: &config.CompressionSettings{Encoding: "deflate"}},
+	}
+
+	payload := strings.Repeat("log line ", 10)
+	msg, topic := routedTopic(t, routes, "logs/app", payload)
+	_, properties, ok := routing.ParseTelemetryTopic(topic)
+	require.True(t, ok)
+	assert.Equal(t, "gzip", properties.Get(routing.KeyContentEncoding))
+	assert.Equal(t, routing.ContentTypeBinary, properties.Get(routing.KeyContentType))
+	decompressed, err := routing.Decompress("gzip", msg.Payload)
+	require.NoError(t, err)
+	assert.Equal(t, payload, string(decompressed))
+
+	msg, topic = routedTopic(t, routes, "logs/app", "short")
+	_, properties, _ = routing.ParseTelemetryTopic(topic)
+	assert.Equal(t, "utf-8", properties.Get(routing.KeyContentEncoding))
+	assert.Equal(t, "short", string(msg.Payload))
+
+	payload = `{"data":"` + strings.Repeat("x", config.DefaultCompressionThreshold) + `"}`
+	msg, topic = routedTopic(t, routes, "event/x", payload)
+	_, properties, _ = routing.ParseTelemetryTopic(topic)
+	assert.Equal(t, "deflate", properties.Get(routing.KeyContentEncoding))
+	assert.Equal(t, "application/json", properties.Get(routing.KeyContentType))
+	assert.Equal(t, "event", properties.Get("kind"))
+	assert.Less(t, len(msg.Payload), len(payload))
+}
+
+func TestCommandRoutes(t *testing.T) {
+	routes := newCommandRoutes([]config.CommandRoute{
+		{Properties: map[string]string{"subject": "*", "kind": "config"}, Topic: "config/{deviceId}/{subject}"},
+		{Properties: map[string]string{"subject": "{"}, Topic: "invalid/{subject"},
+	})
+
+	produced, ok, err := routes.route(topicMessage("devices/dev/messages/devicebound/subject=update&kind=config", "payload"))
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Len(t, produced, 1)
+	topic, _ := connector.TopicFromCtx(produced[0].Context())
+	assert.Equal(t, "config/dev/update", topic)
+	assert.Equal(t, "payload", string(produced[0].Payload))
+
+	_, ok, _ = routes.route(topicMessage("devices/dev/messages/devicebound/subject=update", "payload"))
+	assert.False(t, ok)
+
+	_, ok, err = routes.route(topicMessage("devices/dev/messages/devicebound/subject=%7B", "payload"))
+	assert.True(t, ok)
+	assert.Error(t, err)
+
+	assert.Nil(t, newCommandRoutes(nil))
+}
+
+func TestCommandBusRoutesBypassHandlers(t *testing.T) {
+	busHandler := &commandBusHandler{
+		logger: watermill.NopLogger{},
+		routes: newCommandRoutes([]config.CommandRoute{{Properties: map[string]string{"subject": "*"}, Topic: "local/{subject}"}}),
+		commandHandlers: []handlers.CommandHandler{
+			&transformingCommandHandler{name: "handler", suffix: "-handled", matches: true},
+		},
+	}
+
+	produced, err := busHandler.HandleMessage(topicMessage("devices/dev/messages/devicebound/subject=cmd", "payload"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"payload"}, payloads(produced))
+
+	produced, err = busHandler.HandleMessage(topicMessage("devices/dev/messages/devicebound/", "payload"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"payload-handled"}, payloads(produced))
+}
+
+func TestCommandBusDecompression(t *testing.T) {
+	busHandler := &commandBusHandler{
+		logger: watermill.NopLogger{},
+		routes: newCommandRoutes([]config.CommandRoute{{Properties: map[string]string{"subject": "*"}, Topic: "local/{subject}"}}),
+		commandHandlers: []handlers.CommandHandler{
+			&transformingCommandHandler{name: "handler", suffix: "-handled", matches: true},
+		},
+	}
+
+	compressed, err := routing.Compress("gzip", []byte("payload"))
+	require.NoError(t, err)
+	produced, err := busHandler.HandleMessage(topicMessage("devices/dev/messages/devicebound/%24.ce=gzip&subject=cmd", string(compressed)))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"payload"}, payloads(produced))
+
+	compressed, err = routing.Compress("deflate", []byte("payload"))
+	require.NoError(t, err)
+	msg := topicMessage("devices/dev/messages/devicebound/%24.ce=deflate&app=1", string(compressed))
+	produced, err = busHandler.HandleMessage(msg)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"payload-handled"}, payloads(produced))
+	topic, _ := connector.TopicFromCtx(msg.Context())
+	_, properties, ok := routing.ParseCloudTopic(topic)
+	require.True(t, ok)
+	assert.Empty(t, properties.Get(routing.KeyContentEncoding))
+	assert.Equal(t, "1", properties.Get("app"))
+
+	_, err = busHandler.HandleMessage(topicMessage("devices/dev/messages/devicebound/%24.ce=gzip", "not compressed"))
+	assert.Error(t, err)
+
+	produced, err = busHandler.HandleMessage(topicMessage("devices/dev/messages/devicebound/%24.ce=utf-8", "payload"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"payload-handled"}, payloads(produced))
+}
+
+func TestExpandTemplate(t *testing.T) {
+	vars := func(name string) (string, bool) {
+		return "<" + name + ">", name != "missing"
+	}
+	for template, expected := range map[string]string{
+		"plain":         "plain",
+		"{a}":           "<a>",
+		"x/{a}/{b}/y{c": "",
+		"{a}-{b}":       "<a>-<b>",
+		"{missing}":     "",
+	} {
+		result, err := expandTemplate(template, vars)
+		if len(expected) == 0 {
+			assert.Error(t, err, template)
+		} else {
+			assert.Equal(t, expected, result, template)
+		}
+	}
+}
+
+func TestTelemetryRoutesSchema(t *testing.T) {
+	schemaFile := filepath.Join(t.TempDir(), "reading.json")
+	require.NoError(t, os.WriteFile(schemaFile, []byte(`{"type":"object","required":["value"],"properties":{"value":{"type":"number"}}}`), 0600))
+	routes := []config.TelemetryRoute{
+		{Topic: "sensors/#", Properties: map[string]string{"kind": "reading"}, Schema: &config.SchemaSettings{File: schemaFile}},
+		{Topic: "state/+", Reported: "sensors.{1}", Schema: &config.SchemaSettings{File: schemaFile, DeadLetter: "dead/state"}},
+	}
+	deadLetterPub := &batchPublisher{}
+	connMetrics := metrics.NewConnectorMetrics(metrics.NewRegistry())
+	handlerFunc := newTelemetryRoutes(routes, deadLetterPub, connMetrics, watermill.NopLogger{}).decorate(routesDeviceID, telemetryPassthrough)
+
+	produced, err := handlerFunc(topicMessage("sensors/a", `{"value":1}`))
+	require.NoError(t, err)
+	require.Len(t, produced, 1)
+	topic, _ := connector.TopicFromCtx(produced[0].Context())
+	_, properties, _ := routing.ParseTelemetryTopic(topic)
+	assert.Equal(t, "reading", properties.Get("kind"))
+
+	produced, err = handlerFunc(topicMessage("sensors/a", `{"value":"high"}`))
+	require.NoError(t, err)
+	assert.Empty(t, produced)
+	produced, err = handlerFunc(topicMessage("state/temp", `not json`))
+	require.NoError(t, err)
+	assert.Empty(t, produced)
+
+	assert.Equal(t, []string{config.DefaultDeadLetterTopic, "dead/state"}, publishedTopics(deadLetterPub))
+	var deadLetter DeadLetter
+	require.NoError(t, json.Unmarshal(deadLetterPub.messages()[0].Payload, &deadLetter))
+	assert.Equal(t, DeadLetter{
+		Topic:   "sensors/a",
+		Schema:  schemaFile,
+		Errors:  []string{"/value: expected number, got string"},
+		Payload: `{"value":"high"}`,
+	}, deadLetter)
+	assert.Equal(t, 2.0, connMetrics.SchemaRejected.Value(schemaFile))
+
+	deadLetterPub.err = errors.New("not connected")
+	_, err = handlerFunc(topicMessage("sensors/a", `{}`))
+	assert.Error(t, err)
+}
+
+func TestValidateRoutes(t *testing.T) {
+	schemaFile := filepath.Join(t.TempDir(), "reading.json")
+	require.NoError(t, os.WriteFile(schemaFile, []byte(`{"type":"object"}`), 0600))
+	invalidFile := filepath.Join(t.TempDir(), "invalid.json")
+	require.NoError(t, os.WriteFile(invalidFile, []byte(`{"type":"string","pattern":"("}`), 0600))
+
+	assert.NoError(t, ValidateRoutes(nil))
+	assert.NoError(t, ValidateRoutes([]config.TelemetryRoute{
+		{Topic: "event/#", Output: "events"},
+		{Topic: "sensors/#", Schema: &config.SchemaSettings{File: schemaFile}},
+	}))
+	assert.Error(t, ValidateRoutes([]config.TelemetryRoute{
+		{Topic: "sensors/#", Schema: &config.SchemaSettings{File: schemaFile}},
+		{Topic: "state/+", Schema: &config.SchemaSettings{File: invalidFile}},
+	}))
+}
+
+func TestCompressionSettingsEncodings(t *testing.T) {
+	// the configured encodings are validated in the config package without depending on the routing package
+	assert.Equal(t, routing.EncodingGzip, (&config.CompressionSettings{}).ContentEncoding())
+	for _, encoding := range []string{routing.EncodingGzip, routing.EncodingDeflate} {
+		routes := config.RoutesSettings{Telemetry: []config.TelemetryRoute{
+			{Topic: "event/#", Compression: &config.CompressionSettings{Encoding: encoding}},
+		}}
+		assert.NoError(t, routes.Validate(), encoding)
+	}
+}
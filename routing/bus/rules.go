@@ -0,0 +1,299 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package bus
+
+import (
+	"encoding/json"
+	"math"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/pkg/errors"
+
+	"github.com/eclipse-kanto/suite-connector/connector"
+
+	"github.com/eclipse-kanto/azure-connector/config"
+	"github.com/eclipse-kanto/azure-connector/metrics"
+	"github.com/eclipse-kanto/azure-connector/routing"
+)
+
+const (
+	templateRule  = "rule"
+	templateTopic = "topic"
+	templateValue = "value"
+)
+
+// RuleEvent is the payload of the messages produced by the rule actions.
+type RuleEvent struct {
+	// Rule is the rule name.
+	Rule string `json:"rule"`
+	// Topic is the local topic of the telemetry message.
+	Topic string `json:"topic"`
+	// Active is true when the condition is met and false when it is no longer met.
+	Active bool `json:"active"`
+	// Value is the evaluated value, the rate of change per second for the rate conditions.
+	Value float64 `json:"value"`
+	// Timestamp is the time of the evaluation in milliseconds since the epoch.
+	Timestamp int64 `json:"timestamp"`
+}
+
+// telemetryRule is the state of a single rule of a handler.
+type telemetryRule struct {
+	settings *config.Rule
+	duration time.Duration
+	topics   map[string]*ruleState
+}
+
+// ruleState is the state of a local topic matching a rule.
+type ruleState struct {
+	last     float64
+	lastTime time.Time
+	since    time.Time
+	active   bool
+}
+
+// telemetryRules evaluates the rules over the telemetry messages processed by a handler
+// and adds the messages produced by the triggered actions to the handler results.
+type telemetryRules struct {
+	deviceID string
+	localPub message.Publisher
+	metrics  *metrics.ConnectorMetrics
+	logger   watermill.LoggerAdapter
+	now      func() time.Time
+
+	tree      *routing.TopicTree
+	lock      sync.Mutex
+	rules     []*telemetryRule
+	requestID uint64
+}
+
+func newTelemetryRules(
+	settings []config.Rule,
+	deviceID string,
+	localPub message.Publisher,
+	connMetrics *metrics.ConnectorMetrics,
+	logger watermill.LoggerAdapter,
+) *telemetryRules {
+	if len(settings) == 0 {
+		return nil
+	}
+
+	r := &telemetryRules{
+		deviceID: deviceID,
+		localPub: localPub,
+		metrics:  connMetrics,
+		logger:   logger,
+		now:      time.Now,
+		tree:     routing.NewTopicTree(),
+	}
+	for i := range settings {
+		// the settings are validated on load
+		duration, _ := settings[i].Condition.Duration()
+		r.rules = append(r.rules, &telemetryRule{
+			settings: &settings[i],
+			duration: duration,
+			topics:   map[string]*ruleState{},
+		})
+		r.tree.Add(settings[i].Topic, i)
+	}
+	return r
+}
+
+// decorate evaluates all rules matching the local topic of the message after the handler processed it successfully.
+func (r *telemetryRules) decorate(handlerFunc message.HandlerFunc) message.HandlerFunc {
+	return func(msg *message.Message) ([]*message.Message, error) {
+		produced, err := handlerFunc(msg)
+		if err != nil {
+			return produced, err
+		}
+
+		topic, _ := connector.TopicFromCtx(msg.Context())
+		for _, index := range r.tree.Match(topic) {
+			rule := r.rules[index]
+			event, ok := r.evaluate(rule, topic, msg.Payload)
+			if !ok {
+				continue
+			}
+			produced = append(produced, r.perform(rule, event)...)
+		}
+		return produced, nil
+	}
+}
+
+// evaluate updates the rule state of the local topic, returning the event if the condition is met or no longer met.
+func (r *telemetryRules) evaluate(rule *telemetryRule, topic string, payload []byte) (*RuleEvent, bool) {
+	var paths []string
+	if len(rule.settings.Condition.Path) > 0 {
+		paths = []string{rule.settings.Condition.Path}
+	}
+	value := numericValues(paths, payload)[0]
+	if math.IsNaN(value) {
+		return nil, false
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := r.now()
+	state, ok := rule.topics[topic]
+	if !ok {
+		state = &ruleState{}
+		rule.topics[topic] = state
+	}
+
+	evaluated := value
+	if rule.settings.Condition.Rate {
+		last, lastTime := state.last, state.lastTime
+		state.last, state.lastTime = value, now
+		elapsed := now.Sub(lastTime).Seconds()
+		if lastTime.IsZero() || elapsed <= 0 {
+			return nil, false
+		}
+		evaluated = (value - last) / elapsed
+	}
+
+	if !compare(evaluated, rule.settings.Condition.Operator, rule.settings.Condition.Value) {
+		state.since = time.Time{}
+		if !state.active {
+			return nil, false
+		}
+		state.active = false
+	} else {
+		if state.since.IsZero() {
+			state.since = now
+		}
+		if state.active || now.Sub(state.since) < rule.duration {
+			return nil, false
+		}
+		state.active = true
+	}
+
+	return &RuleEvent{
+		Rule:      rule.settings.Name,
+		Topic:     topic,
+		Active:    state.active,
+		Value:     evaluated,
+		Timestamp: now.UnixNano() / int64(time.Millisecond),
+	}, true
+}
+
+func compare(value float64, operator string, constant float64) bool {
+	switch operator {
+	case ">":
+		return value > constant
+	case ">=":
+		return value >= constant
+	case "<":
+		return value < constant
+	case "<=":
+		return value <= constant
+	case "==":
+		return value == constant
+	case "!=":
+		return value != constant
+	}
+	return false
+}
+
+// perform performs the rule actions for the event, returning the device-to-cloud messages.
+// The messages on the local topics are published right away, the failed actions are logged and skipped.
+func (r *telemetryRules) perform(rule *telemetryRule, event *RuleEvent) []*message.Message {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return nil
+	}
+	vars := func(name string) (string, bool) {
+		switch name {
+		case templateDeviceID:
+			return r.deviceID, true
+		case templateRule:
+			return event.Rule, true
+		case templateTopic:
+			return event.Topic, true
+		case templateValue:
+			return strconv.FormatFloat(event.Value, 'f', -1, 64), true
+		}
+		return "", false
+	}
+
+	var produced []*message.Message
+	for i := range rule.settings.Actions {
+		action := &rule.settings.Actions[i]
+		if !event.Active && !action.Clear {
+			continue
+		}
+
+		msg, err := r.action(action, vars, payload)
+		if err != nil {
+			r.logger.Error("cannot perform rule action", err, watermill.LogFields{"rule": event.Rule, "action": action.Type})
+			continue
+		}
+		if r.metrics != nil {
+			r.metrics.RuleActions.Inc(event.Rule, action.Type)
+		}
+		if msg != nil {
+			produced = append(produced, msg)
+		}
+	}
+	return produced
+}
+
+// action performs a single action, returning the device-to-cloud message if any.
+func (r *telemetryRules) action(action *config.RuleAction, vars func(string) (string, bool), payload []byte) (*message.Message, error) {
+	switch action.Type {
+	case config.RuleActionAlert:
+		properties := url.Values{}
+		for key, template := range action.Properties {
+			value, err := expandTemplate(template, vars)
+			if err != nil {
+				return nil, err
+			}
+			properties.Set(key, value)
+		}
+		msg := message.NewMessage(watermill.NewUUID(), payload)
+		msg.SetContext(connector.SetTopicToCtx(msg.Context(), routing.CreateTelemetryTopicWithProperties(r.deviceID, "", properties)))
+		return msg, nil
+
+	case config.RuleActionReported:
+		path, err := expandTemplate(action.Path, vars)
+		if err != nil {
+			return nil, err
+		}
+		reported, err := reportedPayload(path, payload)
+		if err != nil {
+			return nil, err
+		}
+		msg := message.NewMessage(watermill.NewUUID(), reported)
+		requestID := strconv.FormatUint(atomic.AddUint64(&r.requestID, 1), 10)
+		msg.SetContext(connector.SetTopicToCtx(msg.Context(), routing.CreateTwinReportedTopic(requestID)))
+		return msg, nil
+
+	case config.RuleActionLocal:
+		if r.localPub == nil {
+			return nil, errors.New("no local publisher")
+		}
+		topic, err := expandTemplate(action.Topic, vars)
+		if err != nil {
+			return nil, err
+		}
+		msg := message.NewMessage(watermill.NewUUID(), payload)
+		msg.SetContext(connector.SetTopicToCtx(msg.Context(), topic))
+		return nil, r.localPub.Publish(topic, msg)
+	}
+	return nil, errors.Errorf("unsupported action '%s'", action.Type)
+}
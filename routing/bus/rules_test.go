@@ -0,0 +1,183 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package bus
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/pkg/errors"
+
+	"github.com/eclipse-kanto/suite-connector/connector"
+
+	"github.com/eclipse-kanto/azure-connector/config"
+	"github.com/eclipse-kanto/azure-connector/metrics"
+	"github.com/eclipse-kanto/azure-connector/routing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const rulesDeviceID = "dev"
+
+func newTestRules(localPub message.Publisher, rules ...config.Rule) (*telemetryRules, *metrics.ConnectorMetrics, *filterClock) {
+	connMetrics := metrics.NewConnectorMetrics(metrics.NewRegistry())
+	r := newTelemetryRules(rules, rulesDeviceID, localPub, connMetrics, watermill.NopLogger{})
+	clock := &filterClock{now: time.Now()}
+	r.now = clock.time
+	return r, connMetrics, clock
+}
+
+func evaluated(t *testing.T, handlerFunc message.HandlerFunc, topic string, values ...string) []*message.Message {
+	var produced []*message.Message
+	for _, payload := range values {
+		messages, err := handlerFunc(topicMessage(topic, payload))
+		require.NoError(t, err)
+		produced = append(produced, messages...)
+	}
+	return produced
+}
+
+func ruleEvents(t *testing.T, messages []*message.Message) []RuleEvent {
+	events := make([]RuleEvent, len(messages))
+	for i, msg := range messages {
+		require.NoError(t, json.Unmarshal(msg.Payload, &events[i]))
+	}
+	return events
+}
+
+func TestTelemetryRulesThreshold(t *testing.T) {
+	r, connMetrics, clock := newTestRules(nil, config.Rule{
+		Name:      "overheating",
+		Topic:     "sensors/+",
+		Condition: config.RuleCondition{Path: "temp", Operator: ">", Value: 80, For: "10s"},
+		Actions: []config.RuleAction{
+			{Type: config.RuleActionAlert, Properties: map[string]string{"alert": "{rule}", "source": "{topic}", "value": "{value}"}},
+		},
+	})
+	handlerFunc := r.decorate(producing())
+
+	assert.Empty(t, evaluated(t, handlerFunc, "sensors/a", `{"temp":81}`, `{"humidity":90}`, "text"))
+	clock.now = clock.now.Add(9 * time.Second)
+	assert.Empty(t, evaluated(t, handlerFunc, "sensors/a", `{"temp":82}`))
+	assert.Empty(t, evaluated(t, handlerFunc, "sensors/b", `{"temp":90}`))
+	clock.now = clock.now.Add(time.Second)
+
+	alerts := evaluated(t, handlerFunc, "sensors/a", `{"temp":83}`, `{"temp":84}`)
+	require.Len(t, alerts, 1)
+	topic, _ := connector.TopicFromCtx(alerts[0].Context())
+	deviceID, properties, ok := routing.ParseTelemetryTopic(topic)
+	require.True(t, ok)
+	assert.Equal(t, rulesDeviceID, deviceID)
+	assert.Equal(t, "overheating", properties.Get("alert"))
+	assert.Equal(t, "sensors/a", properties.Get("source"))
+	assert.Equal(t, "83", properties.Get("value"))
+	assert.Equal(t, []RuleEvent{{
+		Rule:      "overheating",
+		Topic:     "sensors/a",
+		Active:    true,
+		Value:     83,
+		Timestamp: clock.now.UnixNano() / int64(time.Millisecond),
+	}}, ruleEvents(t, alerts))
+
+	// the condition has to hold for the whole duration again after it is no longer met
+	assert.Empty(t, evaluated(t, handlerFunc, "sensors/a", `{"temp":80}`, `{"temp":85}`))
+	clock.now = clock.now.Add(10 * time.Second)
+	assert.Len(t, evaluated(t, handlerFunc, "sensors/a", `{"temp":85}`), 1)
+	assert.Len(t, evaluated(t, handlerFunc, "sensors/b", `{"temp":85}`), 1)
+
+	assert.Equal(t, 3.0, connMetrics.RuleActions.Value("overheating", config.RuleActionAlert))
+}
+
+func TestTelemetryRulesRate(t *testing.T) {
+	r, _, clock := newTestRules(nil, config.Rule{
+		Name:      "pressure-drop",
+		Topic:     "pressure",
+		Condition: config.RuleCondition{Operator: "<", Value: -5, Rate: true},
+		Actions:   []config.RuleAction{{Type: config.RuleActionAlert, Clear: true}},
+	})
+	handlerFunc := r.decorate(producing())
+
+	assert.Empty(t, evaluated(t, handlerFunc, "pressure", "100"))
+	clock.now = clock.now.Add(2 * time.Second)
+	assert.Empty(t, evaluated(t, handlerFunc, "pressure", "92"))
+	clock.now = clock.now.Add(2 * time.Second)
+
+	events := ruleEvents(t, evaluated(t, handlerFunc, "pressure", "80"))
+	require.Len(t, events, 1)
+	assert.True(t, events[0].Active)
+	assert.Equal(t, -6.0, events[0].Value)
+
+	clock.now = clock.now.Add(2 * time.Second)
+	events = ruleEvents(t, evaluated(t, handlerFunc, "pressure", "79"))
+	require.Len(t, events, 1)
+	assert.False(t, events[0].Active)
+	assert.Equal(t, -0.5, events[0].Value)
+}
+
+func TestTelemetryRulesActions(t *testing.T) {
+	localPub := &batchPublisher{}
+	r, connMetrics, _ := newTestRules(localPub, config.Rule{
+		Name:      "level",
+		Topic:     "tank/#",
+		Condition: config.RuleCondition{Operator: ">=", Value: 90},
+		Actions: []config.RuleAction{
+			{Type: config.RuleActionLocal, Topic: "event/{deviceId}"},
+			{Type: config.RuleActionReported, Path: "alerts.{rule}", Clear: true},
+			{Type: config.RuleActionLocal, Topic: "command/{missing}"},
+		},
+	})
+	handlerFunc := r.decorate(producing(topicMessage("devices/dev/messages/events/", "handled")))
+
+	produced := evaluated(t, handlerFunc, "tank/1", "95")
+	require.Len(t, produced, 2)
+	assert.Equal(t, "handled", string(produced[0].Payload))
+
+	topic, _ := connector.TopicFromCtx(produced[1].Context())
+	assert.Equal(t, routing.CreateTwinReportedTopic("1"), topic)
+	var reported map[string]map[string]RuleEvent
+	require.NoError(t, json.Unmarshal(produced[1].Payload, &reported))
+	assert.True(t, reported["alerts"]["level"].Active)
+
+	assert.Equal(t, []string{"event/" + rulesDeviceID}, publishedTopics(localPub))
+	assert.Equal(t, 1.0, connMetrics.RuleActions.Value("level", config.RuleActionLocal))
+
+	produced = evaluated(t, handlerFunc, "tank/1", "50")
+	require.Len(t, produced, 2)
+	topic, _ = connector.TopicFromCtx(produced[1].Context())
+	assert.Equal(t, routing.CreateTwinReportedTopic("2"), topic)
+	require.NoError(t, json.Unmarshal(produced[1].Payload, &reported))
+	assert.False(t, reported["alerts"]["level"].Active)
+	assert.Len(t, localPub.messages(), 1)
+	assert.Equal(t, 2.0, connMetrics.RuleActions.Value("level", config.RuleActionReported))
+}
+
+func TestTelemetryRulesHandlerError(t *testing.T) {
+	r, _, _ := newTestRules(nil, config.Rule{
+		Name:      "any",
+		Topic:     "#",
+		Condition: config.RuleCondition{Operator: "!=", Value: 0},
+		Actions:   []config.RuleAction{{Type: config.RuleActionAlert}},
+	})
+	handlerFunc := r.decorate(func(msg *message.Message) ([]*message.Message, error) {
+		return nil, errors.New("failed")
+	})
+
+	produced, err := handlerFunc(topicMessage("sensors", "1"))
+	assert.Error(t, err)
+	assert.Empty(t, produced)
+	assert.Len(t, evaluated(t, r.decorate(producing()), "sensors", "1"), 1)
+}
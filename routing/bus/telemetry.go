@@ -18,9 +18,36 @@ import (
 	"github.com/eclipse-kanto/suite-connector/connector"
 
 	"github.com/eclipse-kanto/azure-connector/config"
+	"github.com/eclipse-kanto/azure-connector/metrics"
 	"github.com/eclipse-kanto/azure-connector/routing/message/handlers"
 )
 
+// TelemetryBusOptions contains the optional settings of the telemetry message bus.
+type TelemetryBusOptions struct {
+	// Context is the handler context passed on the telemetry handlers initialization.
+	Context *handlers.HandlerContext
+	// Routes is the routing table applied to the messages produced by the telemetry handlers.
+	// The messages failing the schema validation are published to the dead-letter topics using the local publisher of the context.
+	Routes []config.TelemetryRoute
+	// SizeLimit is the handling of the oversized device-to-cloud messages, rejecting them by default.
+	SizeLimit *SizeLimitOptions
+	// MessageIDs is the assignment of the device-to-cloud message IDs, random by default.
+	MessageIDs *MessageIDOptions
+	// Filters are the rate limits, deadbands and sampling applied to the telemetry messages before they are handled.
+	Filters []config.TelemetryFilter
+	// Metrics counts the messages dropped by the filters, the messages failing the schema validation and the rule actions, if set.
+	Metrics *metrics.ConnectorMetrics
+	// Rules are the rules evaluated over the telemetry messages after they are handled, separately for each handler.
+	Rules []config.Rule
+	// Lanes queues the device-to-cloud messages per priority class, if set. The messages are published directly otherwise.
+	Lanes *PriorityLanes
+	// BatchPublisher publishes the batches of the batching handlers to the Azure IoT Hub, if set and no lanes are set.
+	// It has to fail while the Azure IoT Hub is disconnected, so that the batches are kept for retry on reconnect.
+	BatchPublisher message.Publisher
+	// Responses correlates the command responses with the C2D messages of the commands, if set.
+	Responses *CommandResponses
+}
+
 // TelemetryBus creates the telemetry message bus for processing & forwarding the telemetry messages from the local MQTT broker to the Azure IoT Hub.
 func TelemetryBus(
 	router *message.Router,
@@ -29,9 +56,60 @@ func TelemetryBus(
 	connInfo *config.RemoteConnectionInfo,
 	telemetryHandlers []handlers.TelemetryHandler,
 ) {
+	TelemetryBusWithOptions(router, azurePub, mosquittoSub, connInfo, telemetryHandlers, nil)
+}
+
+// TelemetryBusWithOptions creates the telemetry message bus using the given options and returns the initialized telemetry handlers.
+// The handlers batching the produced messages are returned wrapped, so that closing them flushes the pending batches.
+func TelemetryBusWithOptions(
+	router *message.Router,
+	azurePub message.Publisher,
+	mosquittoSub message.Subscriber,
+	connInfo *config.RemoteConnectionInfo,
+	telemetryHandlers []handlers.TelemetryHandler,
+	options *TelemetryBusOptions,
+) []handlers.TelemetryHandler {
 	//Gateway -> Mosquitto Broker -> Message bus -> Azure IoT Hub
+	var handlerCtx *handlers.HandlerContext
+	var routeSettings []config.TelemetryRoute
+	var sizeLimitOptions *SizeLimitOptions
+	var messageIDOptions *MessageIDOptions
+	var filters []config.TelemetryFilter
+	var rules []config.Rule
+	var connMetrics *metrics.ConnectorMetrics
+	var lanes *PriorityLanes
+	var batchPub message.Publisher
+	var responses *CommandResponses
+	if options != nil {
+		handlerCtx = options.Context
+		routeSettings = options.Routes
+		sizeLimitOptions = options.SizeLimit
+		messageIDOptions = options.MessageIDs
+		filters = options.Filters
+		rules = options.Rules
+		connMetrics = options.Metrics
+		lanes = options.Lanes
+		batchPub = options.BatchPublisher
+		responses = options.Responses
+	}
+	if lanes != nil {
+		azurePub = lanes
+	}
+	if lanes != nil || batchPub == nil {
+		batchPub = azurePub
+	}
+	handlerCtx = busHandlerContext(handlerCtx, connInfo, router.Logger())
+	sizeLimit := newSizeLimit(sizeLimitOptions, router.Logger())
+	messageIDs := newMessageIDs(messageIDOptions, router.Logger())
+	var localPub message.Publisher
+	if handlerCtx.LocalPublisher != nil {
+		localPub = handlerCtx.LocalPublisher(connector.QosAtLeastOnce)
+	}
+	routes := newTelemetryRoutes(routeSettings, localPub, connMetrics, router.Logger())
+
+	initTelemetryHandlers := []handlers.TelemetryHandler{}
 	for _, telemetryHandler := range telemetryHandlers {
-		if err := telemetryHandler.Init(connInfo); err != nil {
+		if err := handlers.InitHandler(telemetryHandler, handlerCtx); err != nil {
 			logFields := watermill.LogFields{"handler_name": telemetryHandler.Name()}
 			router.Logger().Error("skipping telemetry handler that cannot be initialized", err, logFields)
 			continue
@@ -39,16 +117,67 @@ func TelemetryBus(
 		handlerName := telemetryHandler.Name()
 		handlerTopics := telemetryHandler.Topics()
 		if len(handlerTopics) == 0 {
+			initTelemetryHandlers = append(initTelemetryHandlers, telemetryHandler)
 			logFields := watermill.LogFields{"handler_name": telemetryHandler.Name()}
 			router.Logger().Error("skipping telemetry handler without any topics", nil, logFields)
 			continue
 		}
+		handlerFunc := telemetryHandler.HandleMessage
+		if routes != nil {
+			handlerFunc = routes.decorate(connInfo.DeviceID, handlerFunc)
+		}
+		if responses != nil {
+			handlerFunc = responses.decorateResponses(handlerFunc)
+		}
+		if rule := newTelemetryRules(rules, connInfo.DeviceID, localPub, connMetrics, router.Logger()); rule != nil {
+			handlerFunc = rule.decorate(handlerFunc)
+		}
+		if messageIDs != nil {
+			handlerFunc = messageIDs.decorate(handlerFunc)
+		}
+		if lanes != nil {
+			handlerFunc = lanes.decorate(handlerFunc)
+		}
+		if batching, ok := telemetryHandler.(handlers.BatchingHandler); ok && batching.BatchSettings() != nil {
+			logFields := watermill.LogFields{"handler_name": handlerName}
+			batcher, err := newBatcher(batchPub, sizeLimit, batching.BatchSettings(), router.Logger().With(logFields))
+			if err != nil {
+				initTelemetryHandlers = append(initTelemetryHandlers, telemetryHandler)
+				router.Logger().Error("skipping telemetry handler with invalid batch settings", err, logFields)
+				continue
+			}
+			handlerFunc = batcher.decorate(handlerFunc)
+			telemetryHandler = &batchingTelemetryHandler{TelemetryHandler: telemetryHandler, batcher: batcher}
+		}
+		handlerFunc = sizeLimit.decorate(handlerFunc)
+		var handlerSub message.Subscriber = mosquittoSub
+		if filter := newTelemetryFilters(filters, handlerName, connMetrics, router.Logger()); filter != nil {
+			handlerFunc = filter.decorate(handlerFunc)
+			handlerSub = filter.subscriber(mosquittoSub)
+			telemetryHandler = &filteringTelemetryHandler{TelemetryHandler: telemetryHandler, filters: filter}
+		}
+		initTelemetryHandlers = append(initTelemetryHandlers, telemetryHandler)
 		router.AddHandler(handlerName,
 			handlerTopics,
-			mosquittoSub,
+			handlerSub,
 			connector.TopicEmpty,
 			azurePub,
-			telemetryHandler.HandleMessage,
+			handlerFunc,
 		)
 	}
+	return initTelemetryHandlers
+}
+
+// busHandlerContext returns a copy of the given handler context with the bus connection information,
+// or a new context with the router logger if none is given.
+func busHandlerContext(handlerCtx *handlers.HandlerContext, connInfo *config.RemoteConnectionInfo, logger watermill.LoggerAdapter) *handlers.HandlerContext {
+	if handlerCtx == nil {
+		return handlers.NewHandlerContext(connInfo, logger)
+	}
+	busCtx := *handlerCtx
+	busCtx.ConnInfo = connInfo
+	if busCtx.Logger == nil {
+		busCtx.Logger = logger
+	}
+	return &busCtx
 }
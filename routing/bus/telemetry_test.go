@@ -98,6 +98,21 @@ func TestTelemetryMessageHandlerInitializationError(t *testing.T) {
 	test.AssertNoRouterHandlers(t, router)
 }
 
+func TestTelemetryBusWithOptions(t *testing.T) {
+	router, connInfo := setupTestRouter("dummy-device")
+
+	valid := test.NewDummyTelemetryHandler(testTelemetryHandlerName+"_valid", "telemetry/#", nil)
+	failing := test.NewDummyTelemetryHandler(testTelemetryHandlerName+"_failing", "telemetry/#", errors.New("init error"))
+	handlerCtx := handlers.NewHandlerContext(nil, watermill.NopLogger{})
+
+	initialized := TelemetryBusWithOptions(router, conn.NullPublisher(), test.NewDummySubscriber(), connInfo,
+		[]handlers.TelemetryHandler{valid, failing}, &TelemetryBusOptions{Context: handlerCtx},
+	)
+	assert.Equal(t, []handlers.TelemetryHandler{valid}, initialized)
+	refHandlers := reflect.Indirect(reflect.ValueOf(router)).FieldByName(fieldHandlers)
+	assert.Equal(t, 1, refHandlers.Len())
+}
+
 func setupTestRouter(deviceID string) (*message.Router, *config.RemoteConnectionInfo) {
 	connInfo := &config.RemoteConnectionInfo{
 		DeviceID: deviceID,
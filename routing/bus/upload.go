@@ -0,0 +1,280 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package bus
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/pkg/errors"
+
+	"github.com/eclipse-kanto/azure-connector/config"
+	"github.com/eclipse-kanto/azure-connector/fileupload"
+)
+
+const (
+	// FileUploadHandlerName is the name of the message router handler that processes the local file upload requests.
+	FileUploadHandlerName = "file_upload_handler"
+
+	// TopicFileUploadRequest is the local topic of the file upload requests.
+	TopicFileUploadRequest = "edge/connection/remote/upload"
+	// TopicFileUploadStatus is the local topic prefix of the file upload status events, followed by the request ID.
+	TopicFileUploadStatus = "edge/connection/remote/upload/status"
+
+	// UploadStarted is the status of an accepted file upload request.
+	UploadStarted = "started"
+	// UploadProgress is the status reported after each uploaded block.
+	UploadProgress = "progress"
+	// UploadCompleted is the status of a successful file upload.
+	UploadCompleted = "completed"
+	// UploadFailed is the status of a rejected or failed file upload.
+	UploadFailed = "failed"
+
+	maxConcurrentUploads = 4
+	uploadTimeout        = time.Hour
+)
+
+// FileUploadRequest is the payload of a local file upload request.
+// Either the path of a file in the allowed directories or inline data is uploaded.
+type FileUploadRequest struct {
+	// RequestID is the ID of the request, used in the status topic. A random one is generated if not set.
+	RequestID string `json:"requestId"`
+	// BlobName is the name of the uploaded blob, which is prefixed with the device ID by the Azure IoT Hub.
+	// The file name is used for file uploads if not set.
+	BlobName string `json:"blobName"`
+	// Path is the absolute path of the uploaded file.
+	Path string `json:"path"`
+	// Data is the uploaded data, base64 encoded in JSON.
+	Data []byte `json:"data"`
+	// ContentType is the content type of the blob.
+	ContentType string `json:"contentType"`
+}
+
+// FileUploadStatus is the payload of a file upload status event.
+type FileUploadStatus struct {
+	RequestID string `json:"requestId"`
+	Status    string `json:"status"`
+	BlobName  string `json:"blobName,omitempty"`
+	URL       string `json:"url,omitempty"`
+	Uploaded  int64  `json:"uploaded"`
+	Size      int64  `json:"size,omitempty"`
+	Error     string `json:"error,omitempty"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// FileUploadHandler processes the local file upload requests, performing the uploads in the background
+// and publishing their status to the local broker.
+type FileUploadHandler struct {
+	uploader fileupload.Uploader
+	pub      message.Publisher
+	dirs     []string
+	logger   watermill.LoggerAdapter
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	slots  chan struct{}
+	wg     sync.WaitGroup
+}
+
+// NewFileUploadHandler creates a file upload handler, allowing the files in the given directories to be uploaded.
+func NewFileUploadHandler(uploader fileupload.Uploader, pub message.Publisher, dirs []string, logger watermill.LoggerAdapter) *FileUploadHandler {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &FileUploadHandler{
+		uploader: uploader,
+		pub:      pub,
+		dirs:     dirs,
+		logger:   logger,
+		ctx:      ctx,
+		cancel:   cancel,
+		slots:    make(chan struct{}, maxConcurrentUploads),
+	}
+}
+
+// FileUploadBus creates the message bus for processing the file upload requests from the local MQTT broker
+// and returns the handler, which has to be closed after the router stops.
+func FileUploadBus(
+	router *message.Router,
+	mosquittoPub message.Publisher,
+	mosquittoSub message.Subscriber,
+	uploader fileupload.Uploader,
+	settings *config.FileUploadSettings,
+) *FileUploadHandler {
+	//Application -> Mosquitto Broker -> Message bus -> Azure IoT Hub & Storage
+	handler := NewFileUploadHandler(uploader, mosquittoPub, settings.Dirs, router.Logger())
+	router.AddNoPublisherHandler(FileUploadHandlerName,
+		TopicFileUploadRequest,
+		mosquittoSub,
+		handler.HandleMessage,
+	)
+	return handler
+}
+
+// HandleMessage starts the requested upload. Invalid requests are reported with a failed status and not retried.
+func (h *FileUploadHandler) HandleMessage(msg *message.Message) error {
+	request := FileUploadRequest{}
+	if err := json.Unmarshal(msg.Payload, &request); err != nil {
+		h.logger.Error("invalid file upload request", err, watermill.LogFields{"message_uuid": msg.UUID})
+		return nil
+	}
+	if len(request.RequestID) == 0 {
+		request.RequestID = watermill.NewUUID()
+	} else if strings.ContainsAny(request.RequestID, "/+#") {
+		h.logger.Error("invalid file upload request ID", nil, watermill.LogFields{"request_id": request.RequestID})
+		return nil
+	}
+
+	reader, size, err := h.open(&request)
+	if err != nil {
+		h.publish(&FileUploadStatus{RequestID: request.RequestID, Status: UploadFailed, BlobName: request.BlobName, Error: err.Error()})
+		return nil
+	}
+
+	select {
+	case h.slots <- struct{}{}:
+	default:
+		reader.Close()
+		h.publish(&FileUploadStatus{
+			RequestID: request.RequestID,
+			Status:    UploadFailed,
+			BlobName:  request.BlobName,
+			Error:     "too many concurrent file uploads",
+		})
+		return nil
+	}
+
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		defer func() {
+			<-h.slots
+		}()
+		defer reader.Close()
+
+		h.upload(&request, reader, size)
+	}()
+	return nil
+}
+
+// Close cancels the running uploads and waits for them to finish.
+func (h *FileUploadHandler) Close() error {
+	h.cancel()
+	h.wg.Wait()
+	return nil
+}
+
+func (h *FileUploadHandler) upload(request *FileUploadRequest, reader io.Reader, size int64) {
+	status := &FileUploadStatus{RequestID: request.RequestID, BlobName: request.BlobName, Size: size}
+	status.Status = UploadStarted
+	h.publish(status)
+
+	ctx, cancel := context.WithTimeout(h.ctx, uploadTimeout)
+	defer cancel()
+
+	result, err := h.uploader.UploadReader(ctx, request.BlobName, reader, request.ContentType, func(uploaded int64) {
+		status.Status = UploadProgress
+		status.Uploaded = uploaded
+		h.publish(status)
+	})
+	if err != nil {
+		status.Status = UploadFailed
+		status.Error = err.Error()
+		h.logger.Error("file upload failed", err, watermill.LogFields{"request_id": request.RequestID})
+	} else {
+		status.Status = UploadCompleted
+		status.BlobName = result.BlobName
+		status.URL = result.URL()
+		status.Uploaded = result.Size
+		status.Size = result.Size
+	}
+	h.publish(status)
+}
+
+// open validates the request and returns the reader of the uploaded data and its size.
+func (h *FileUploadHandler) open(request *FileUploadRequest) (io.ReadCloser, int64, error) {
+	if (len(request.Path) > 0) == (request.Data != nil) {
+		return nil, 0, errors.New("either a file path or inline data must be uploaded")
+	}
+
+	if len(request.Path) == 0 {
+		if len(request.BlobName) == 0 {
+			return nil, 0, errors.New("missing blob name")
+		}
+		return ioutil.NopCloser(bytes.NewReader(request.Data)), int64(len(request.Data)), nil
+	}
+
+	path, err := h.resolvePath(request.Path)
+	if err != nil {
+		return nil, 0, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "cannot open file")
+	}
+	info, err := file.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		file.Close()
+		return nil, 0, errors.Errorf("'%s' is not a regular file", request.Path)
+	}
+	if len(request.BlobName) == 0 {
+		request.BlobName = filepath.Base(path)
+	}
+	return file, info.Size(), nil
+}
+
+// resolvePath returns the path with the symbolic links resolved, if it is located in one of the allowed directories.
+func (h *FileUploadHandler) resolvePath(path string) (string, error) {
+	if len(h.dirs) == 0 {
+		return "", errors.New("file uploads are not allowed from any directory")
+	}
+	if !filepath.IsAbs(path) {
+		return "", errors.Errorf("'%s' is not an absolute path", path)
+	}
+
+	resolved, err := filepath.EvalSymlinks(filepath.Clean(path))
+	if err != nil {
+		return "", errors.Wrap(err, "cannot resolve file path")
+	}
+	for _, dir := range h.dirs {
+		resolvedDir, err := filepath.EvalSymlinks(dir)
+		if err != nil {
+			continue
+		}
+		rel, err := filepath.Rel(resolvedDir, resolved)
+		if err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return resolved, nil
+		}
+	}
+	return "", errors.Errorf("'%s' is not located in an allowed directory", path)
+}
+
+func (h *FileUploadHandler) publish(status *FileUploadStatus) {
+	status.Timestamp = time.Now().Unix()
+	payload, err := json.Marshal(status)
+	if err != nil {
+		return
+	}
+	topic := TopicFileUploadStatus + "/" + status.RequestID
+	if err := h.pub.Publish(topic, message.NewMessage(watermill.NewUUID(), payload)); err != nil {
+		h.logger.Error("Failed to publish file upload status", err, watermill.LogFields{"request_id": status.RequestID})
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package bus
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/pkg/errors"
+
+	"github.com/eclipse-kanto/azure-connector/config"
+	"github.com/eclipse-kanto/azure-connector/fileupload"
+
+	test "github.com/eclipse-kanto/azure-connector/routing/bus/internal/testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testUploader struct {
+	lock  sync.Mutex
+	err   error
+	blobs map[string][]byte
+}
+
+func (u *testUploader) Upload(ctx context.Context, blobName string, data []byte, contentType string) (*fileupload.Result, error) {
+	return nil, errors.New("not expected")
+}
+
+func (u *testUploader) UploadReader(ctx context.Context, blobName string, reader io.Reader, contentType string,
+	progress fileupload.Progress,
+) (*fileupload.Result, error) {
+	if u.err != nil {
+		return nil, u.err
+	}
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	progress(int64(len(data)))
+
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	u.blobs[blobName] = data
+	return &fileupload.Result{HostName: "storage", ContainerName: "uploads", BlobName: "device/" + blobName, Size: int64(len(data))}, nil
+}
+
+type statusPublisher struct {
+	lock     sync.Mutex
+	topics   []string
+	statuses []FileUploadStatus
+}
+
+func (p *statusPublisher) Publish(topic string, messages ...*message.Message) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for _, msg := range messages {
+		status := FileUploadStatus{}
+		if err := json.Unmarshal(msg.Payload, &status); err != nil {
+			return err
+		}
+		p.topics = append(p.topics, topic)
+		p.statuses = append(p.statuses, status)
+	}
+	return nil
+}
+
+func (p *statusPublisher) Close() error {
+	return nil
+}
+
+func uploadRequest(t *testing.T, handler *FileUploadHandler, request *FileUploadRequest) {
+	payload, err := json.Marshal(request)
+	require.NoError(t, err)
+	require.NoError(t, handler.HandleMessage(message.NewMessage(watermill.NewUUID(), payload)))
+	require.NoError(t, handler.Close())
+}
+
+func TestFileUploadData(t *testing.T) {
+	uploader := &testUploader{blobs: map[string][]byte{}}
+	pub := &statusPublisher{}
+	handler := NewFileUploadHandler(uploader, pub, nil, watermill.NopLogger{})
+
+	uploadRequest(t, handler, &FileUploadRequest{RequestID: "snapshot", BlobName: "snapshot.bin", Data: []byte{1, 2, 3}})
+	assert.Equal(t, []byte{1, 2, 3}, uploader.blobs["snapshot.bin"])
+
+	for _, topic := range pub.topics {
+		assert.Equal(t, "edge/connection/remote/upload/status/snapshot", topic)
+	}
+	require.Len(t, pub.statuses, 3)
+	assert.Equal(t, UploadStarted, pub.statuses[0].Status)
+	assert.Equal(t, int64(3), pub.statuses[0].Size)
+	assert.Equal(t, UploadProgress, pub.statuses[1].Status)
+	assert.Equal(t, int64(3), pub.statuses[1].Uploaded)
+
+	completed := pub.statuses[2]
+	assert.Equal(t, UploadCompleted, completed.Status)
+	assert.Equal(t, "snapshot", completed.RequestID)
+	assert.Equal(t, "device/snapshot.bin", completed.BlobName)
+	assert.Equal(t, "https://storage/uploads/device/snapshot.bin", completed.URL)
+	assert.Equal(t, int64(3), completed.Uploaded)
+	assert.Empty(t, completed.Error)
+}
+
+func TestFileUploadPath(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.log")
+	require.NoError(t, ioutil.WriteFile(path, []byte("log data"), 0600))
+
+	uploader := &testUploader{blobs: map[string][]byte{}}
+	pub := &statusPublisher{}
+	uploadRequest(t, NewFileUploadHandler(uploader, pub, []string{dir}, watermill.NopLogger{}), &FileUploadRequest{Path: path})
+	assert.Equal(t, "log data", string(uploader.blobs["app.log"]))
+	require.NotEmpty(t, pub.statuses)
+	assert.Equal(t, UploadCompleted, pub.statuses[len(pub.statuses)-1].Status)
+	assert.NotEmpty(t, pub.statuses[0].RequestID)
+}
+
+func TestFileUploadInvalidRequests(t *testing.T) {
+	dir := t.TempDir()
+	outside := t.TempDir()
+	outsidePath := filepath.Join(outside, "secret")
+	require.NoError(t, ioutil.WriteFile(outsidePath, []byte("secret"), 0600))
+	link := filepath.Join(dir, "link")
+	require.NoError(t, os.Symlink(outsidePath, link))
+
+	invalid := []*FileUploadRequest{
+		{RequestID: "missing"},
+		{RequestID: "both", BlobName: "data", Path: outsidePath, Data: []byte{1}},
+		{RequestID: "noBlobName", Data: []byte{1}},
+		{RequestID: "relative", Path: "secret"},
+		{RequestID: "outside", Path: outsidePath},
+		{RequestID: "traversal", Path: filepath.Join(dir, "..", filepath.Base(outside), "secret")},
+		{RequestID: "symlink", Path: link},
+		{RequestID: "dir", Path: dir},
+	}
+	for _, request := range invalid {
+		uploader := &testUploader{blobs: map[string][]byte{}}
+		pub := &statusPublisher{}
+		uploadRequest(t, NewFileUploadHandler(uploader, pub, []string{dir}, watermill.NopLogger{}), request)
+
+		assert.Empty(t, uploader.blobs, request.RequestID)
+		require.Len(t, pub.statuses, 1, request.RequestID)
+		assert.Equal(t, UploadFailed, pub.statuses[0].Status)
+		assert.Equal(t, request.RequestID, pub.statuses[0].RequestID)
+		assert.NotEmpty(t, pub.statuses[0].Error)
+	}
+
+	uploader := &testUploader{blobs: map[string][]byte{}}
+	pub := &statusPublisher{}
+	uploadRequest(t, NewFileUploadHandler(uploader, pub, nil, watermill.NopLogger{}), &FileUploadRequest{Path: outsidePath})
+	require.Len(t, pub.statuses, 1)
+	assert.Equal(t, UploadFailed, pub.statuses[0].Status)
+
+	pub = &statusPublisher{}
+	handler := NewFileUploadHandler(uploader, pub, nil, watermill.NopLogger{})
+	assert.NoError(t, handler.HandleMessage(message.NewMessage(watermill.NewUUID(), []byte("invalid"))))
+	uploadRequest(t, handler, &FileUploadRequest{RequestID: "a/b", BlobName: "data", Data: []byte{1}})
+	assert.Empty(t, pub.statuses)
+}
+
+func TestFileUploadError(t *testing.T) {
+	uploader := &testUploader{err: errors.New("upload error")}
+	pub := &statusPublisher{}
+	uploadRequest(t, NewFileUploadHandler(uploader, pub, nil, watermill.NopLogger{}),
+		&FileUploadRequest{RequestID: "failing", BlobName: "data", Data: []byte{1}},
+	)
+
+	require.Len(t, pub.statuses, 2)
+	assert.Equal(t, UploadStarted, pub.statuses[0].Status)
+	assert.Equal(t, UploadFailed, pub.statuses[1].Status)
+	assert.Equal(t, "upload error", pub.statuses[1].Error)
+}
+
+func TestFileUploadBus(t *testing.T) {
+	router, _ := setupTestRouter("dummy-device")
+
+	handler := FileUploadBus(router, &statusPublisher{}, test.NewDummySubscriber(), &testUploader{}, &config.FileUploadSettings{Enabled: true})
+	assert.NotNil(t, handler)
+
+	refHandlers := reflect.Indirect(reflect.ValueOf(router)).FieldByName(fieldHandlers)
+	require.Equal(t, 1, refHandlers.Len())
+	refHandler := refHandlers.MapIndex(refHandlers.MapKeys()[0])
+	test.AssertRouterHandler(t, FileUploadHandlerName, TopicFileUploadRequest, "", reflect.Indirect(refHandler))
+}
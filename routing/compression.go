@@ -0,0 +1,117 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package routing
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// EncodingGzip is the content encoding of gzip compressed payloads.
+	EncodingGzip = "gzip"
+	// EncodingDeflate is the content encoding of deflate compressed payloads.
+	EncodingDeflate = "deflate"
+
+	// ContentTypeBinary is the content type of compressed payloads that are neither JSON nor have an explicit content type.
+	ContentTypeBinary = "application/octet-stream"
+
+	// MaxDecompressedSize limits the size of a decompressed payload.
+	MaxDecompressedSize = 16 * 1024 * 1024
+)
+
+// IsCompressed returns true if the content encoding is one of the supported compression encodings.
+func IsCompressed(encoding string) bool {
+	switch strings.ToLower(encoding) {
+	case EncodingGzip, EncodingDeflate:
+		return true
+	default:
+		return false
+	}
+}
+
+// Compress compresses the payload using the given content encoding.
+func Compress(encoding string, payload []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+	var writer io.WriteCloser
+	switch strings.ToLower(encoding) {
+	case EncodingGzip:
+		writer = gzip.NewWriter(&buffer)
+	case EncodingDeflate:
+		writer, _ = flate.NewWriter(&buffer, flate.DefaultCompression)
+	default:
+		return nil, errors.Errorf("unsupported content encoding '%s'", encoding)
+	}
+
+	if _, err := writer.Write(payload); err != nil {
+		return nil, errors.Wrapf(err, "cannot compress payload using %s", encoding)
+	}
+	if err := writer.Close(); err != nil {
+		return nil, errors.Wrapf(err, "cannot compress payload using %s", encoding)
+	}
+	return buffer.Bytes(), nil
+}
+
+// Decompress decompresses the payload using the given content encoding.
+// Payloads decompressing to more than MaxDecompressedSize bytes are rejected.
+func Decompress(encoding string, payload []byte) ([]byte, error) {
+	var reader io.ReadCloser
+	switch strings.ToLower(encoding) {
+	case EncodingGzip:
+		gzipReader, err := gzip.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid gzip payload")
+		}
+		reader = gzipReader
+	case EncodingDeflate:
+		reader = flate.NewReader(bytes.NewReader(payload))
+	default:
+		return nil, errors.Errorf("unsupported content encoding '%s'", encoding)
+	}
+	defer reader.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(reader, MaxDecompressedSize+1))
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot decompress %s payload", encoding)
+	}
+	if len(data) > MaxDecompressedSize {
+		return nil, errors.Errorf("decompressed payload exceeds %d bytes", MaxDecompressedSize)
+	}
+	return data, nil
+}
+
+// CompressMessage compresses the payload of a message with the given properties and sets the content encoding property.
+// An explicit content type is kept, while a missing or default JSON one is set to JSON or binary depending on the original payload.
+func CompressMessage(encoding string, payload []byte, properties url.Values) ([]byte, error) {
+	compressed, err := Compress(encoding, payload)
+	if err != nil {
+		return nil, err
+	}
+	if ct := properties.Get(KeyContentType); len(ct) == 0 || ct == contentType {
+		if json.Valid(payload) {
+			properties.Set(KeyContentType, contentType)
+		} else {
+			properties.Set(KeyContentType, ContentTypeBinary)
+		}
+	}
+	properties.Set(KeyContentEncoding, strings.ToLower(encoding))
+	return compressed, nil
+}
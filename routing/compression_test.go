@@ -0,0 +1,73 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package routing_test
+
+import (
+	"bytes"
+	"net/url"
+	"testing"
+
+	azurerouting "github.com/eclipse-kanto/azure-connector/routing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressDecompress(t *testing.T) {
+	payload := bytes.Repeat([]byte(`{"temperature":21.5}`), 100)
+	for _, encoding := range []string{azurerouting.EncodingGzip, azurerouting.EncodingDeflate, "GZIP"} {
+		assert.True(t, azurerouting.IsCompressed(encoding))
+
+		compressed, err := azurerouting.Compress(encoding, payload)
+		require.NoError(t, err)
+		assert.Less(t, len(compressed), len(payload))
+
+		decompressed, err := azurerouting.Decompress(encoding, compressed)
+		require.NoError(t, err)
+		assert.Equal(t, payload, decompressed)
+	}
+
+	assert.False(t, azurerouting.IsCompressed("utf-8"))
+	_, err := azurerouting.Compress("utf-8", payload)
+	assert.Error(t, err)
+	_, err = azurerouting.Decompress("utf-8", payload)
+	assert.Error(t, err)
+	_, err = azurerouting.Decompress(azurerouting.EncodingGzip, payload)
+	assert.Error(t, err)
+}
+
+func TestDecompressLimit(t *testing.T) {
+	compressed, err := azurerouting.Compress(azurerouting.EncodingGzip, make([]byte, azurerouting.MaxDecompressedSize+1))
+	require.NoError(t, err)
+	_, err = azurerouting.Decompress(azurerouting.EncodingGzip, compressed)
+	assert.Error(t, err)
+}
+
+func TestCompressMessage(t *testing.T) {
+	properties := url.Values{}
+	_, err := azurerouting.CompressMessage(azurerouting.EncodingGzip, []byte("binary"), properties)
+	require.NoError(t, err)
+	assert.Equal(t, azurerouting.EncodingGzip, properties.Get(azurerouting.KeyContentEncoding))
+	assert.Equal(t, azurerouting.ContentTypeBinary, properties.Get(azurerouting.KeyContentType))
+
+	properties = url.Values{azurerouting.KeyContentType: {"application/json"}}
+	_, err = azurerouting.CompressMessage(azurerouting.EncodingDeflate, []byte(`{}`), properties)
+	require.NoError(t, err)
+	assert.Equal(t, azurerouting.EncodingDeflate, properties.Get(azurerouting.KeyContentEncoding))
+	assert.Equal(t, "application/json", properties.Get(azurerouting.KeyContentType))
+
+	properties = url.Values{azurerouting.KeyContentType: {"text/csv"}}
+	_, err = azurerouting.CompressMessage(azurerouting.EncodingGzip, []byte("a,b"), properties)
+	require.NoError(t, err)
+	assert.Equal(t, "text/csv", properties.Get(azurerouting.KeyContentType))
+}
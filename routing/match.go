@@ -0,0 +1,64 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package routing
+
+import (
+	"net/url"
+	"strings"
+)
+
+// MatchTopic reports whether the topic matches the MQTT topic filter, supporting the '+' and '#' wildcards.
+func MatchTopic(filter, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+
+	if len(topicLevels) > 0 && strings.HasPrefix(topicLevels[0], "$") &&
+		(filterLevels[0] == "+" || filterLevels[0] == "#") {
+		return false
+	}
+
+	for i, level := range filterLevels {
+		if level == "#" {
+			return i == len(filterLevels)-1
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+// MatchTopics reports whether the topic matches any of the comma separated MQTT topic filters.
+func MatchTopics(filters, topic string) bool {
+	for _, filter := range strings.Split(filters, ",") {
+		if filter = strings.TrimSpace(filter); len(filter) > 0 && MatchTopic(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchProperties reports whether the message properties contain all expected properties.
+// An expected value of '*' matches any present value.
+func MatchProperties(expected map[string]string, properties url.Values) bool {
+	for key, value := range expected {
+		actual, present := properties[key]
+		if !present || (value != "*" && (len(actual) == 0 || actual[0] != value)) {
+			return false
+		}
+	}
+	return true
+}
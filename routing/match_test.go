@@ -0,0 +1,65 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package routing_test
+
+import (
+	"net/url"
+	"testing"
+
+	azurerouting "github.com/eclipse-kanto/azure-connector/routing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchTopic(t *testing.T) {
+	matching := map[string]string{
+		"event/#":                          "event/ns/thing",
+		"sport/#":                          "sport",
+		"event/+/thing":                    "event/ns/thing",
+		"+/+":                              "/finance",
+		"#":                                "event/ns/thing",
+		"command//+/res/#":                 "command//ns:thing/res/cid/200",
+		"devices/+/messages/devicebound/#": "devices/dummy/messages/devicebound/%24.mid=1",
+	}
+	for filter, topic := range matching {
+		assert.True(t, azurerouting.MatchTopic(filter, topic), "%s - %s", filter, topic)
+	}
+
+	notMatching := map[string]string{
+		"event/#":       "telemetry/ns/thing",
+		"event/+":       "event/ns/thing",
+		"event/+/thing": "event/ns/other",
+		"event":         "event/ns",
+		"+/#":           "$SYS/broker",
+		"event/#/thing": "event/ns/thing",
+	}
+	for filter, topic := range notMatching {
+		assert.False(t, azurerouting.MatchTopic(filter, topic), "%s - %s", filter, topic)
+	}
+}
+
+func TestMatchTopics(t *testing.T) {
+	assert.True(t, azurerouting.MatchTopics("event/#, telemetry/#", "telemetry/ns/thing"))
+	assert.False(t, azurerouting.MatchTopics("event/#,,telemetry/#", "command//ns:thing/req/cid/toggle"))
+	assert.False(t, azurerouting.MatchTopics("", "event"))
+}
+
+func TestMatchProperties(t *testing.T) {
+	properties := url.Values{"subject": {"restart"}, "kind": {""}}
+
+	assert.True(t, azurerouting.MatchProperties(nil, properties))
+	assert.True(t, azurerouting.MatchProperties(map[string]string{"subject": "restart"}, properties))
+	assert.True(t, azurerouting.MatchProperties(map[string]string{"subject": "*", "kind": "*"}, properties))
+	assert.False(t, azurerouting.MatchProperties(map[string]string{"subject": "reboot"}, properties))
+	assert.False(t, azurerouting.MatchProperties(map[string]string{"missing": "*"}, properties))
+}
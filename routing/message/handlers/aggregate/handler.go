@@ -0,0 +1,452 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package aggregate
+
+import (
+	"encoding/json"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/pkg/errors"
+
+	"github.com/eclipse-kanto/suite-connector/connector"
+
+	"github.com/eclipse-kanto/azure-connector/config"
+	"github.com/eclipse-kanto/azure-connector/routing"
+	"github.com/eclipse-kanto/azure-connector/routing/message/handlers"
+)
+
+// HandlerType is the type of the configured telemetry handlers aggregating the numeric values of the messages into windowed statistics.
+const HandlerType = "aggregate"
+
+const (
+	// PropertyAggregate is the device-to-cloud message property marking the messages with the statistics of a window.
+	PropertyAggregate = "aggregate"
+	// AggregateWindow is the value of PropertyAggregate.
+	AggregateWindow = "window"
+
+	telemetryHandlerName = "aggregate_telemetry_handler"
+
+	defaultWindow     = "1m"
+	defaultMaxSamples = 10000
+	payloadValue      = "value"
+)
+
+func init() {
+	handlers.RegisterTelemetryHandler(HandlerType, func(settings *config.HandlerSettings) (handlers.TelemetryHandler, error) {
+		if len(settings.Topics) == 0 {
+			return nil, errors.New("aggregate telemetry handler requires topics")
+		}
+		aggregateSettings, err := parseSettings(settings)
+		if err != nil {
+			return nil, err
+		}
+		return &handler{settings: aggregateSettings, topics: settings.Topics, now: time.Now}, nil
+	})
+}
+
+// options contains the aggregate handler configuration options.
+type options struct {
+	// Window is the length of the aggregation window.
+	Window string `json:"window"`
+	// Slide is the interval of emitting the statistics of sliding windows. The windows are tumbling if not set.
+	Slide string `json:"slide"`
+	// Paths are the dot separated paths of the numeric values in the JSON payloads, the payload itself is the value if not set.
+	// The paths of the Ditto protocol messages are relative to their value.
+	Paths []string `json:"paths"`
+	// Percentiles are the percentiles of the values included in the statistics, e.g. 50, 90 and 99.
+	Percentiles []float64 `json:"percentiles"`
+	// MaxSamples is the max number of values per group and path kept in a window, the oldest values are dropped above it.
+	MaxSamples int `json:"maxSamples"`
+	// Forward forwards the raw messages with values out of the given range in addition to the statistics.
+	Forward *forwardRange `json:"forward"`
+}
+
+// forwardRange is the range of the values, which are aggregated only.
+type forwardRange struct {
+	Min *float64 `json:"min"`
+	Max *float64 `json:"max"`
+}
+
+func (r *forwardRange) exceeded(value float64) bool {
+	return (r.Min != nil && value < *r.Min) || (r.Max != nil && value > *r.Max)
+}
+
+type aggregateSettings struct {
+	window      time.Duration
+	slide       time.Duration
+	paths       []string
+	percentiles []float64
+	maxSamples  int
+	forward     *forwardRange
+}
+
+func parseSettings(settings *config.HandlerSettings) (*aggregateSettings, error) {
+	opts := &options{Window: defaultWindow, MaxSamples: defaultMaxSamples}
+	if err := settings.DecodeOptions(opts); err != nil {
+		return nil, err
+	}
+
+	window, err := time.ParseDuration(opts.Window)
+	if err != nil || window <= 0 {
+		return nil, errors.Errorf("invalid aggregation window '%s'", opts.Window)
+	}
+	slide := window
+	if len(opts.Slide) > 0 {
+		slide, err = time.ParseDuration(opts.Slide)
+		if err != nil || slide <= 0 || slide > window {
+			return nil, errors.Errorf("invalid aggregation slide '%s'", opts.Slide)
+		}
+	}
+	for _, path := range opts.Paths {
+		if len(path) == 0 {
+			return nil, errors.New("empty aggregation path")
+		}
+	}
+	for _, percentile := range opts.Percentiles {
+		if percentile < 0 || percentile > 100 {
+			return nil, errors.Errorf("invalid percentile %v", percentile)
+		}
+	}
+	if opts.MaxSamples <= 0 {
+		return nil, errors.New("max samples must be positive")
+	}
+
+	return &aggregateSettings{
+		window:      window,
+		slide:       slide,
+		paths:       opts.Paths,
+		percentiles: opts.Percentiles,
+		maxSamples:  opts.MaxSamples,
+		forward:     opts.Forward,
+	}, nil
+}
+
+// groupKey identifies the aggregated messages by their local topic and, for the Ditto protocol messages, the thing and the path.
+type groupKey struct {
+	Topic   string `json:"topic"`
+	ThingID string `json:"thingId,omitempty"`
+	Path    string `json:"path,omitempty"`
+}
+
+type sample struct {
+	time  time.Time
+	value float64
+}
+
+// group contains the values of a group per path.
+type group struct {
+	key     groupKey
+	samples map[string][]sample
+}
+
+// Statistics contains the statistics of the values on a path within a window.
+type Statistics struct {
+	Count       int                `json:"count"`
+	Min         float64            `json:"min"`
+	Max         float64            `json:"max"`
+	Mean        float64            `json:"mean"`
+	Last        float64            `json:"last"`
+	Percentiles map[string]float64 `json:"percentiles,omitempty"`
+}
+
+// Window is the payload of the device-to-cloud message with the statistics of a group within a window.
+type Window struct {
+	Key        groupKey               `json:"key"`
+	Start      time.Time              `json:"start"`
+	End        time.Time              `json:"end"`
+	Statistics map[string]*Statistics `json:"statistics"`
+}
+
+// handler groups the numeric values of the JSON messages and sends their statistics once per window and group.
+// The windows are tumbling, or sliding if the slide interval is shorter than the window.
+type handler struct {
+	settings *aggregateSettings
+	topics   string
+	now      func() time.Time
+
+	lock     sync.Mutex
+	deviceID string
+	pub      message.Publisher
+	logger   watermill.LoggerAdapter
+	groups   map[groupKey]*group
+	start    time.Time
+	stop     chan struct{}
+	stopped  chan struct{}
+}
+
+// InitWithContext initializes the handler with the Azure IoT Hub publisher of the statistics and starts the windows.
+func (h *handler) InitWithContext(ctx *handlers.HandlerContext) error {
+	if ctx.HubPublisher == nil {
+		return errors.New("aggregate telemetry handler requires a hub publisher")
+	}
+	h.Close()
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.deviceID = ctx.ConnInfo.DeviceID
+	h.pub = ctx.HubPublisher(connector.QosAtLeastOnce)
+	h.logger = ctx.Logger
+	h.groups = map[groupKey]*group{}
+	h.start = h.now()
+	h.stop = make(chan struct{})
+	h.stopped = make(chan struct{})
+	go h.run(h.stop, h.stopped)
+	return nil
+}
+
+// Init is not used as the handler requires the handler context.
+func (h *handler) Init(connInfo *config.RemoteConnectionInfo) error {
+	return errors.New("aggregate telemetry handler requires the handler context")
+}
+
+// Close stops the windows, sending the statistics of the current ones.
+func (h *handler) Close() error {
+	h.lock.Lock()
+	stop, stopped := h.stop, h.stopped
+	h.stop = nil
+	h.lock.Unlock()
+
+	if stop == nil {
+		return nil
+	}
+	close(stop)
+	<-stopped
+	h.emit(h.now())
+	return nil
+}
+
+func (h *handler) run(stop, stopped chan struct{}) {
+	defer close(stopped)
+
+	ticker := time.NewTicker(h.settings.slide)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			h.emit(h.now())
+		}
+	}
+}
+
+// HandleMessage adds the numeric values of the message to its group, returning the message for forwarding if a value is out of the forward range.
+func (h *handler) HandleMessage(msg *message.Message) ([]*message.Message, error) {
+	topic, _ := connector.TopicFromCtx(msg.Context())
+	key, root := groupOf(topic, msg.Payload)
+
+	now := h.now()
+	forward := false
+
+	h.lock.Lock()
+	current, ok := h.groups[key]
+	if !ok {
+		current = &group{key: key, samples: map[string][]sample{}}
+		h.groups[key] = current
+	}
+	added := 0
+	for name, value := range h.values(root) {
+		samples := append(current.samples[name], sample{time: now, value: value})
+		if len(samples) > h.settings.maxSamples {
+			samples = samples[len(samples)-h.settings.maxSamples:]
+		}
+		current.samples[name] = samples
+		added++
+		if h.settings.forward != nil && h.settings.forward.exceeded(value) {
+			forward = true
+		}
+	}
+	if len(current.samples) == 0 {
+		delete(h.groups, key)
+	}
+	deviceID := h.deviceID
+	h.lock.Unlock()
+
+	if added == 0 {
+		h.logger.Debug("Dropping message without numeric values", watermill.LogFields{"message_uuid": msg.UUID})
+		return nil, nil
+	}
+	if !forward {
+		return nil, nil
+	}
+	outgoing := message.NewMessage(watermill.NewUUID(), msg.Payload)
+	outgoing.SetContext(connector.SetTopicToCtx(outgoing.Context(), routing.CreateTelemetryTopic(deviceID, outgoing.UUID)))
+	return []*message.Message{outgoing}, nil
+}
+
+// values returns the numeric values on the configured paths.
+func (h *handler) values(root interface{}) map[string]float64 {
+	values := map[string]float64{}
+	if len(h.settings.paths) == 0 {
+		if number, ok := root.(float64); ok {
+			values[payloadValue] = number
+		}
+		return values
+	}
+
+	for _, path := range h.settings.paths {
+		value := root
+		for _, name := range strings.Split(path, ".") {
+			object, ok := value.(map[string]interface{})
+			if !ok {
+				value = nil
+				break
+			}
+			value = object[name]
+		}
+		if number, ok := value.(float64); ok {
+			values[path] = number
+		}
+	}
+	return values
+}
+
+// emit sends the statistics of the windows ending at the given time and drops the values leaving the windows.
+// A tumbling window starts at the end of the previous one.
+func (h *handler) emit(end time.Time) {
+	h.lock.Lock()
+	tumbling := h.settings.slide == h.settings.window
+	start := end.Add(-h.settings.window)
+	if tumbling {
+		start, h.start = h.start, end
+	}
+
+	var windows []*Window
+	for key, current := range h.groups {
+		window := &Window{Key: key, Start: start, End: end, Statistics: map[string]*Statistics{}}
+		for name, samples := range current.samples {
+			if !tumbling {
+				first := sort.Search(len(samples), func(i int) bool {
+					return !samples[i].time.Before(start)
+				})
+				samples = samples[first:]
+			}
+			if len(samples) > 0 {
+				window.Statistics[name] = statistics(samples, h.settings.percentiles)
+			}
+			if tumbling || len(samples) == 0 {
+				delete(current.samples, name)
+			} else {
+				current.samples[name] = samples
+			}
+		}
+		if len(current.samples) == 0 {
+			delete(h.groups, key)
+		}
+		if len(window.Statistics) > 0 {
+			windows = append(windows, window)
+		}
+	}
+	pub, deviceID, logger := h.pub, h.deviceID, h.logger
+	h.lock.Unlock()
+
+	sort.Slice(windows, func(i, j int) bool {
+		return windows[i].Key.Topic+windows[i].Key.ThingID+windows[i].Key.Path < windows[j].Key.Topic+windows[j].Key.ThingID+windows[j].Key.Path
+	})
+	for _, window := range windows {
+		payload, err := json.Marshal(window)
+		if err != nil {
+			continue
+		}
+		msg := message.NewMessage(watermill.NewUUID(), payload)
+		topic := routing.CreateTelemetryTopicWithProperties(deviceID, msg.UUID, url.Values{PropertyAggregate: []string{AggregateWindow}})
+		msg.SetContext(connector.SetTopicToCtx(msg.Context(), topic))
+		if err := pub.Publish(topic, msg); err != nil {
+			logger.Error("cannot send window statistics", err, watermill.LogFields{"topic": window.Key.Topic})
+		}
+	}
+}
+
+// groupOf returns the group key and the JSON value of a message, the value of the Ditto protocol messages is unwrapped.
+func groupOf(topic string, payload []byte) (groupKey, interface{}) {
+	key := groupKey{Topic: topic}
+
+	var root interface{}
+	if err := json.Unmarshal(payload, &root); err != nil {
+		return key, nil
+	}
+
+	env, ok := root.(map[string]interface{})
+	if !ok {
+		return key, root
+	}
+	dittoTopic, _ := env["topic"].(string)
+	path, _ := env["path"].(string)
+	if len(dittoTopic) == 0 || len(path) == 0 {
+		return key, root
+	}
+	if segments := strings.SplitN(dittoTopic, "/", 3); len(segments) == 3 {
+		key.ThingID = segments[0] + ":" + segments[1]
+	}
+	key.Path = path
+	return key, env["value"]
+}
+
+// statistics calculates the statistics of the values in time order.
+func statistics(samples []sample, percentiles []float64) *Statistics {
+	values := make([]float64, len(samples))
+	stats := &Statistics{Count: len(samples), Min: samples[0].value, Max: samples[0].value, Last: samples[len(samples)-1].value}
+	sum := 0.0
+	for i, s := range samples {
+		values[i] = s.value
+		sum += s.value
+		if s.value < stats.Min {
+			stats.Min = s.value
+		}
+		if s.value > stats.Max {
+			stats.Max = s.value
+		}
+	}
+	stats.Mean = sum / float64(len(values))
+
+	if len(percentiles) > 0 {
+		sort.Float64s(values)
+		stats.Percentiles = make(map[string]float64, len(percentiles))
+		for _, percentile := range percentiles {
+			stats.Percentiles["p"+formatPercentile(percentile)] = percentileOf(values, percentile)
+		}
+	}
+	return stats
+}
+
+// percentileOf returns the percentile of the sorted values, interpolating linearly between the closest ranks.
+func percentileOf(sorted []float64, percentile float64) float64 {
+	rank := percentile / 100 * float64(len(sorted)-1)
+	lower := int(rank)
+	if lower >= len(sorted)-1 {
+		return sorted[len(sorted)-1]
+	}
+	return sorted[lower] + (rank-float64(lower))*(sorted[lower+1]-sorted[lower])
+}
+
+func formatPercentile(percentile float64) string {
+	data, _ := json.Marshal(percentile)
+	return string(data)
+}
+
+// Name returns the message handler name.
+func (h *handler) Name() string {
+	return telemetryHandlerName
+}
+
+// Topics returns the configurable list of topics that are used for subscription on the local message broker.
+func (h *handler) Topics() string {
+	return h.topics
+}
@@ -0,0 +1,246 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package aggregate_test
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+
+	"github.com/eclipse-kanto/suite-connector/connector"
+
+	"github.com/eclipse-kanto/azure-connector/config"
+	"github.com/eclipse-kanto/azure-connector/routing"
+	"github.com/eclipse-kanto/azure-connector/routing/message/handlers"
+	"github.com/eclipse-kanto/azure-connector/routing/message/handlers/aggregate"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testDeviceID = "device"
+
+type hubPublisher struct {
+	lock     sync.Mutex
+	messages []*message.Message
+}
+
+func (p *hubPublisher) Publish(topic string, messages ...*message.Message) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.messages = append(p.messages, messages...)
+	return nil
+}
+
+func (p *hubPublisher) Close() error {
+	return nil
+}
+
+func (p *hubPublisher) windows(t *testing.T) []aggregate.Window {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	windows := make([]aggregate.Window, len(p.messages))
+	for i, msg := range p.messages {
+		topic, _ := connector.TopicFromCtx(msg.Context())
+		deviceID, properties, ok := routing.ParseTelemetryTopic(topic)
+		require.True(t, ok)
+		assert.Equal(t, testDeviceID, deviceID)
+		assert.Equal(t, aggregate.AggregateWindow, properties.Get(aggregate.PropertyAggregate))
+		require.NoError(t, json.Unmarshal(msg.Payload, &windows[i]))
+	}
+	return windows
+}
+
+func newAggregateHandler(t *testing.T, options map[string]interface{}) (handlers.TelemetryHandler, *hubPublisher) {
+	data, err := json.Marshal(options)
+	require.NoError(t, err)
+	telemetryHandlers, err := handlers.CreateTelemetryHandlers([]config.HandlerSettings{
+		{Type: aggregate.HandlerType, Topics: "sensors/#", Options: data},
+	})
+	require.NoError(t, err)
+
+	pub := &hubPublisher{}
+	ctx := handlers.NewHandlerContext(&config.RemoteConnectionInfo{DeviceID: testDeviceID}, watermill.NopLogger{})
+	ctx.HubPublisher = func(qos connector.Qos) message.Publisher {
+		assert.Equal(t, connector.QosAtLeastOnce, qos)
+		return pub
+	}
+	require.NoError(t, handlers.InitHandler(telemetryHandlers[0], ctx))
+	t.Cleanup(func() {
+		handlers.CloseHandler(telemetryHandlers[0])
+	})
+	return telemetryHandlers[0], pub
+}
+
+func handle(t *testing.T, handler handlers.TelemetryHandler, topic string, payloads ...string) []*message.Message {
+	var forwarded []*message.Message
+	for _, payload := range payloads {
+		msg := message.NewMessage(watermill.NewUUID(), []byte(payload))
+		msg.SetContext(connector.SetTopicToCtx(msg.Context(), topic))
+		produced, err := handler.HandleMessage(msg)
+		require.NoError(t, err)
+		forwarded = append(forwarded, produced...)
+	}
+	return forwarded
+}
+
+func TestAggregateStatistics(t *testing.T) {
+	handler, pub := newAggregateHandler(t, map[string]interface{}{
+		"window":      "1h",
+		"paths":       []string{"temp", "meter.value"},
+		"percentiles": []float64{50, 90},
+	})
+	assert.Equal(t, "sensors/#", handler.Topics())
+
+	assert.Empty(t, handle(t, handler, "sensors/a",
+		`{"temp":4,"meter":{"value":10}}`,
+		`{"temp":1}`,
+		`{"temp":3,"meter":{"value":"n/a"}}`,
+		`{"temp":2}`,
+		`{"humidity":50}`,
+		`not json`,
+	))
+	assert.Empty(t, handle(t, handler, "sensors/b", `{"temp":7}`))
+	require.NoError(t, handlers.CloseHandler(handler))
+
+	windows := pub.windows(t)
+	require.Len(t, windows, 2)
+	assert.Equal(t, "sensors/a", windows[0].Key.Topic)
+	// the window is closed early
+	assert.True(t, windows[0].Start.Before(windows[0].End))
+	assert.Less(t, int64(windows[0].End.Sub(windows[0].Start)), int64(time.Hour))
+	assert.Equal(t, &aggregate.Statistics{
+		Count:       4,
+		Min:         1,
+		Max:         4,
+		Mean:        2.5,
+		Last:        2,
+		Percentiles: map[string]float64{"p50": 2.5, "p90": 3.7},
+	}, roundPercentiles(windows[0].Statistics["temp"]))
+	assert.Equal(t, 1, windows[0].Statistics["meter.value"].Count)
+	assert.Equal(t, 10.0, windows[0].Statistics["meter.value"].Last)
+
+	assert.Equal(t, "sensors/b", windows[1].Key.Topic)
+	assert.Equal(t, 7.0, windows[1].Statistics["temp"].Mean)
+}
+
+func roundPercentiles(stats *aggregate.Statistics) *aggregate.Statistics {
+	for key, value := range stats.Percentiles {
+		stats.Percentiles[key] = float64(int(value*1000+0.5)) / 1000
+	}
+	return stats
+}
+
+func TestAggregateDittoGroups(t *testing.T) {
+	handler, pub := newAggregateHandler(t, map[string]interface{}{"window": "1h"})
+
+	handle(t, handler, "sensors/ditto",
+		`{"topic":"org.eclipse/meter/things/twin/commands/modify","path":"/features/power/properties/value","value":10}`,
+		`{"topic":"org.eclipse/meter/things/twin/commands/modify","path":"/features/power/properties/value","value":20}`,
+		`{"topic":"org.eclipse/meter/things/twin/commands/modify","path":"/features/energy/properties/value","value":5}`,
+		`{"topic":"org.eclipse/pump/things/twin/commands/modify","path":"/features/power/properties/value","value":3}`,
+	)
+	require.NoError(t, handlers.CloseHandler(handler))
+
+	windows := pub.windows(t)
+	require.Len(t, windows, 3)
+	assert.Equal(t, "org.eclipse:meter", windows[0].Key.ThingID)
+	assert.Equal(t, "/features/energy/properties/value", windows[0].Key.Path)
+	assert.Equal(t, 5.0, windows[0].Statistics["value"].Last)
+	assert.Equal(t, "/features/power/properties/value", windows[1].Key.Path)
+	assert.Equal(t, 15.0, windows[1].Statistics["value"].Mean)
+	assert.Equal(t, "org.eclipse:pump", windows[2].Key.ThingID)
+	assert.Equal(t, "sensors/ditto", windows[2].Key.Topic)
+}
+
+func TestAggregateForward(t *testing.T) {
+	handler, pub := newAggregateHandler(t, map[string]interface{}{
+		"window":  "1h",
+		"forward": map[string]interface{}{"min": 0, "max": 100},
+	})
+
+	forwarded := handle(t, handler, "sensors/level", "50", "120", "-1", "0", "100")
+	require.Len(t, forwarded, 2)
+	assert.Equal(t, "120", string(forwarded[0].Payload))
+	assert.Equal(t, "-1", string(forwarded[1].Payload))
+	topic, _ := connector.TopicFromCtx(forwarded[0].Context())
+	_, properties, ok := routing.ParseTelemetryTopic(topic)
+	require.True(t, ok)
+	assert.Empty(t, properties.Get(aggregate.PropertyAggregate))
+
+	require.NoError(t, handlers.CloseHandler(handler))
+	windows := pub.windows(t)
+	require.Len(t, windows, 1)
+	assert.Equal(t, 5, windows[0].Statistics["value"].Count)
+}
+
+func TestAggregateTumblingWindows(t *testing.T) {
+	handler, pub := newAggregateHandler(t, map[string]interface{}{"window": "20ms"})
+
+	handle(t, handler, "sensors/a", "1", "2")
+	require.Eventually(t, func() bool {
+		return len(pub.windows(t)) == 1
+	}, time.Second, 5*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+
+	handle(t, handler, "sensors/a", "3")
+	require.NoError(t, handlers.CloseHandler(handler))
+	windows := pub.windows(t)
+	require.Len(t, windows, 2)
+	assert.Equal(t, 2, windows[0].Statistics["value"].Count)
+	assert.Equal(t, 1, windows[1].Statistics["value"].Count)
+	assert.Equal(t, 3.0, windows[1].Statistics["value"].Last)
+}
+
+func TestAggregateSlidingWindows(t *testing.T) {
+	handler, pub := newAggregateHandler(t, map[string]interface{}{"window": "1h", "slide": "10ms"})
+
+	handle(t, handler, "sensors/a", "1", "2")
+	require.Eventually(t, func() bool {
+		return len(pub.windows(t)) >= 2
+	}, time.Second, 5*time.Millisecond)
+	for _, window := range pub.windows(t) {
+		assert.Equal(t, 2, window.Statistics["value"].Count)
+	}
+}
+
+func TestAggregateInvalidSettings(t *testing.T) {
+	invalid := []map[string]interface{}{
+		{"window": "0s"},
+		{"window": "1m", "slide": "2m"},
+		{"slide": "soon"},
+		{"paths": []string{""}},
+		{"percentiles": []float64{101}},
+		{"maxSamples": -1},
+		{"unknown": true},
+	}
+	for _, options := range invalid {
+		data, err := json.Marshal(options)
+		require.NoError(t, err)
+		_, err = handlers.CreateTelemetryHandlers([]config.HandlerSettings{{Type: aggregate.HandlerType, Topics: "sensors/#", Options: data}})
+		assert.Error(t, err, options)
+	}
+
+	_, err := handlers.CreateTelemetryHandlers([]config.HandlerSettings{{Type: aggregate.HandlerType}})
+	assert.Error(t, err)
+
+	telemetryHandlers, err := handlers.CreateTelemetryHandlers([]config.HandlerSettings{{Type: aggregate.HandlerType, Topics: "sensors/#"}})
+	require.NoError(t, err)
+	ctx := handlers.NewHandlerContext(&config.RemoteConnectionInfo{DeviceID: testDeviceID}, watermill.NopLogger{})
+	assert.Error(t, handlers.InitHandler(telemetryHandlers[0], ctx))
+}
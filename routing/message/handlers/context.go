@@ -0,0 +1,110 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package handlers
+
+import (
+	"encoding/json"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+
+	"github.com/eclipse-kanto/suite-connector/connector"
+	"github.com/eclipse-kanto/suite-connector/routing"
+
+	"github.com/eclipse-kanto/azure-connector/config"
+)
+
+// ContextVersion is the version of the HandlerContext structure.
+// It is incremented when the meaning of an existing field changes, new fields are added without changing it.
+const ContextVersion = 1
+
+// PublisherFactory creates a publisher that sends messages with the given QoS.
+type PublisherFactory func(qos connector.Qos) message.Publisher
+
+// HandlerContext provides the runtime environment of a message handler on initialization.
+type HandlerContext struct {
+	// Version is the version of the context structure, see ContextVersion.
+	Version int
+	// ConnInfo contains the Azure IoT Hub connection information.
+	ConnInfo *config.RemoteConnectionInfo
+	// Logger is the messages router logger, including the handler name in the log fields.
+	Logger watermill.LoggerAdapter
+	// Config contains the raw options of the handler configuration, if any.
+	Config json.RawMessage
+	// LocalPublisher creates publishers to the local message broker.
+	LocalPublisher PublisherFactory
+	// HubPublisher creates publishers to the Azure IoT Hub.
+	HubPublisher PublisherFactory
+	// StatusPublisher publishes the connection status messages to the local message broker.
+	StatusPublisher message.Publisher
+	// GwParams contains the gateway parameters sent to the local message broker.
+	GwParams *routing.GwParams
+}
+
+// ContextInitializer is an optional interface of the message handlers to be initialized with the handler context.
+// If implemented, it is invoked instead of Init.
+type ContextInitializer interface {
+	InitWithContext(ctx *HandlerContext) error
+}
+
+// Closer is an optional interface of the message handlers to release their resources when the messages router stops.
+type Closer interface {
+	Close() error
+}
+
+// NewHandlerContext creates a handler context with the given connection information and logger.
+func NewHandlerContext(connInfo *config.RemoteConnectionInfo, logger watermill.LoggerAdapter) *HandlerContext {
+	return &HandlerContext{
+		Version:  ContextVersion,
+		ConnInfo: connInfo,
+		Logger:   logger,
+	}
+}
+
+// InitHandler initializes the handler with a copy of the given context dedicated to it,
+// using Init with the connection information if the handler does not implement ContextInitializer.
+func InitHandler(handler messageHandler, ctx *HandlerContext) error {
+	initializer, ok := handler.(ContextInitializer)
+	if !ok {
+		return handler.Init(ctx.ConnInfo)
+	}
+
+	handlerCtx := *ctx
+	if handlerCtx.Logger == nil {
+		handlerCtx.Logger = watermill.NopLogger{}
+	}
+	handlerCtx.Logger = handlerCtx.Logger.With(watermill.LogFields{"handler_name": handler.Name()})
+	return initializer.InitWithContext(&handlerCtx)
+}
+
+// CloseHandler releases the handler resources if the handler implements Closer.
+func CloseHandler(handler interface{}) error {
+	if closer, ok := handler.(Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// initConfigured initializes a handler wrapped by a configured handler, passing the raw handler configuration in the context.
+func initConfigured(handler messageHandler, ctx *HandlerContext, options json.RawMessage) error {
+	initializer, ok := handler.(ContextInitializer)
+	if !ok {
+		return handler.Init(ctx.ConnInfo)
+	}
+	if len(options) == 0 {
+		return initializer.InitWithContext(ctx)
+	}
+	configured := *ctx
+	configured.Config = options
+	return initializer.InitWithContext(&configured)
+}
@@ -0,0 +1,113 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package handlers_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/pkg/errors"
+
+	"github.com/eclipse-kanto/azure-connector/config"
+	"github.com/eclipse-kanto/azure-connector/routing/message/handlers"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testContextType = "context_test_telemetry"
+
+type contextHandler struct {
+	testHandler
+	ctx      *handlers.HandlerContext
+	initErr  error
+	closed   bool
+	closeErr error
+}
+
+func (h *contextHandler) InitWithContext(ctx *handlers.HandlerContext) error {
+	h.ctx = ctx
+	return h.initErr
+}
+
+func (h *contextHandler) Close() error {
+	h.closed = true
+	return h.closeErr
+}
+
+var lastContextHandler *contextHandler
+
+func init() {
+	handlers.RegisterTelemetryHandler(testContextType, func(settings *config.HandlerSettings) (handlers.TelemetryHandler, error) {
+		lastContextHandler = &contextHandler{testHandler: testHandler{name: testContextType, topics: "context/#"}}
+		return lastContextHandler, nil
+	})
+}
+
+func TestInitHandler(t *testing.T) {
+	connInfo := &config.RemoteConnectionInfo{DeviceID: "device"}
+	ctx := handlers.NewHandlerContext(connInfo, watermill.NopLogger{})
+	assert.Equal(t, handlers.ContextVersion, ctx.Version)
+
+	require.NoError(t, handlers.InitHandler(&testHandler{name: "plain"}, ctx))
+
+	handler := &contextHandler{testHandler: testHandler{name: "aware"}}
+	require.NoError(t, handlers.InitHandler(handler, ctx))
+	require.NotNil(t, handler.ctx)
+	assert.NotSame(t, ctx, handler.ctx)
+	assert.Equal(t, connInfo, handler.ctx.ConnInfo)
+	assert.NotNil(t, handler.ctx.Logger)
+	assert.Nil(t, handler.ctx.Config)
+
+	handler.initErr = errors.New("cannot init")
+	assert.Error(t, handlers.InitHandler(handler, ctx))
+
+	handler.ctx = nil
+	handler.initErr = nil
+	require.NoError(t, handlers.InitHandler(handler, handlers.NewHandlerContext(connInfo, nil)))
+	assert.NotNil(t, handler.ctx.Logger)
+}
+
+func TestCloseHandler(t *testing.T) {
+	assert.NoError(t, handlers.CloseHandler(&testHandler{}))
+
+	handler := &contextHandler{closeErr: errors.New("cannot close")}
+	assert.Error(t, handlers.CloseHandler(handler))
+	assert.True(t, handler.closed)
+}
+
+func TestConfiguredHandlerContext(t *testing.T) {
+	telemetryHandlers, err := handlers.CreateTelemetryHandlers([]config.HandlerSettings{
+		{Type: testContextType, Name: "configured", Options: json.RawMessage(`{"key":"value"}`)},
+	})
+	require.NoError(t, err)
+	require.Len(t, telemetryHandlers, 1)
+	inner := lastContextHandler
+
+	ctx := handlers.NewHandlerContext(&config.RemoteConnectionInfo{DeviceID: "device"}, watermill.NopLogger{})
+	require.NoError(t, handlers.InitHandler(telemetryHandlers[0], ctx))
+	require.NotNil(t, inner.ctx)
+	assert.JSONEq(t, `{"key":"value"}`, string(inner.ctx.Config))
+	assert.Nil(t, ctx.Config)
+
+	require.NoError(t, handlers.CloseHandler(telemetryHandlers[0]))
+	assert.True(t, inner.closed)
+
+	commandHandlers, err := handlers.CreateCommandHandlers([]config.HandlerSettings{
+		{Type: testCommandType, Options: json.RawMessage(`{}`)},
+	})
+	require.NoError(t, err)
+	assert.NoError(t, handlers.InitHandler(commandHandlers[0], ctx))
+	assert.NoError(t, handlers.CloseHandler(commandHandlers[0]))
+}
@@ -34,3 +34,8 @@ type TelemetryHandler interface {
 	messageHandler
 	Topics() string
 }
+
+// BatchingHandler is an optional interface of the telemetry handlers to batch the produced device-to-cloud messages.
+type BatchingHandler interface {
+	BatchSettings() *config.BatchSettings
+}
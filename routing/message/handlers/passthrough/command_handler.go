@@ -34,6 +34,15 @@ const (
 	msgInvalidCloudCommand = "invalid cloud command"
 )
 
+func init() {
+	handlers.RegisterCommandHandler(HandlerType, func(settings *config.HandlerSettings) (handlers.CommandHandler, error) {
+		if err := settings.DecodeOptions(&struct{}{}); err != nil {
+			return nil, err
+		}
+		return CreateDefaultCommandHandler(), nil
+	})
+}
+
 type commandHandler struct{}
 
 // CreateDefaultCommandHandler instantiates a new command handler that forwards cloud-to-device messages to the local message broker as Hono commands.
@@ -51,7 +60,7 @@ func (h *commandHandler) HandleMessage(msg *message.Message) ([]*message.Message
 	command := protocol.Envelope{Headers: protocol.NewHeaders()}
 
 	if err := json.Unmarshal(msg.Payload, &command); err != nil {
-		return nil, errors.Wrap(err, msgInvalidCloudCommand)
+		return nil, handlers.Skip(errors.Wrap(err, msgInvalidCloudCommand).Error())
 	}
 
 	l := message.NewMessage(watermill.NewUUID(), msg.Payload)
@@ -20,6 +20,9 @@ import (
 
 	"github.com/eclipse-kanto/suite-connector/connector"
 
+	"github.com/eclipse-kanto/azure-connector/config"
+	"github.com/eclipse-kanto/azure-connector/routing/message/handlers"
+
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -30,6 +33,16 @@ func TestCreateDefaultCommandHandler(t *testing.T) {
 	assert.Equal(t, commandHandlerName, messageHandler.Name())
 }
 
+func TestCreateConfiguredCommandHandlers(t *testing.T) {
+	commandHandlers, err := handlers.CreateCommandHandlers([]config.HandlerSettings{{Type: HandlerType}})
+	require.NoError(t, err)
+	require.Len(t, commandHandlers, 1)
+	assert.Equal(t, commandHandlerName, commandHandlers[0].Name())
+
+	_, err = handlers.CreateCommandHandlers([]config.HandlerSettings{{Type: HandlerType, Options: []byte(`{"unknown":1}`)}})
+	assert.Error(t, err)
+}
+
 func TestHandleOneWayCommand(t *testing.T) {
 	messageHandler := CreateDefaultCommandHandler()
 	require.NoError(t, messageHandler.Init(nil))
@@ -92,3 +105,13 @@ func TestHandleCommand(t *testing.T) {
 	assert.True(t, strings.HasPrefix(azureMsgTopic, "c//"))
 	assert.Equal(t, payload, string(azureMsg.Payload))
 }
+
+func TestHandleInvalidCommandSkipped(t *testing.T) {
+	messageHandler := CreateDefaultCommandHandler()
+	require.NoError(t, messageHandler.Init(nil))
+
+	_, err := messageHandler.HandleMessage(&message.Message{Payload: []byte("invalid")})
+	require.Error(t, err)
+	assert.Equal(t, handlers.ResultSkipped, handlers.ResultOf(err))
+	assert.Contains(t, err.Error(), msgInvalidCloudCommand)
+}
@@ -24,11 +24,26 @@ import (
 )
 
 const (
+	// HandlerType is the type name of the passthrough telemetry and command handlers in the handlers configuration.
+	HandlerType = "passthrough"
+
 	telemetryHandlerName = "passthrough_telemetry_handler"
 
 	topicsEvent = "event/#,e/#,telemetry/#,t/#,command//+/res/#,c//+/s/#"
 )
 
+func init() {
+	handlers.RegisterTelemetryHandler(HandlerType, func(settings *config.HandlerSettings) (handlers.TelemetryHandler, error) {
+		if err := settings.DecodeOptions(&struct{}{}); err != nil {
+			return nil, err
+		}
+		if len(settings.Topics) == 0 {
+			return CreateDefaultTelemetryHandler(), nil
+		}
+		return CreateTelemetryHandler(settings.Topics), nil
+	})
+}
+
 type telemetryHandler struct {
 	deviceID string
 	topics   string
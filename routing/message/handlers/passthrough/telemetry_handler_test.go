@@ -19,6 +19,7 @@ import (
 	"github.com/ThreeDotsLabs/watermill/message"
 
 	"github.com/eclipse-kanto/azure-connector/config"
+	"github.com/eclipse-kanto/azure-connector/routing/message/handlers"
 
 	"github.com/eclipse-kanto/suite-connector/connector"
 
@@ -40,6 +41,23 @@ func TestCreateTelemetryHandler(t *testing.T) {
 	assert.Equal(t, topic, messageHandler.Topics())
 }
 
+func TestCreateConfiguredTelemetryHandlers(t *testing.T) {
+	telemetryHandlers, err := handlers.CreateTelemetryHandlers([]config.HandlerSettings{
+		{Type: HandlerType},
+		{Type: HandlerType, Name: "alarms", Topics: "event/alarm/#"},
+	})
+	require.NoError(t, err)
+	require.Len(t, telemetryHandlers, 2)
+
+	assert.Equal(t, telemetryHandlerName, telemetryHandlers[0].Name())
+	assert.Equal(t, topicsEvent, telemetryHandlers[0].Topics())
+	assert.Equal(t, "alarms", telemetryHandlers[1].Name())
+	assert.Equal(t, "event/alarm/#", telemetryHandlers[1].Topics())
+
+	_, err = handlers.CreateTelemetryHandlers([]config.HandlerSettings{{Type: HandlerType, Options: []byte(`{"topics":"x"}`)}})
+	assert.Error(t, err)
+}
+
 func TestHandleTelemetryMessage(t *testing.T) {
 	handler := CreateTelemetryHandler("telemetry_topic")
 	require.NoError(t, handler.Init(&config.RemoteConnectionInfo{DeviceID: "dummy_device"}))
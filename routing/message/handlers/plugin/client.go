@@ -0,0 +1,76 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package plugin
+
+import (
+	"io"
+	"net"
+	"os"
+
+	"github.com/pkg/errors"
+
+	"github.com/eclipse-kanto/azure-connector/routing/message/handlers"
+)
+
+// HandleFunc handles a message in a plugin process. Returning an error created with handlers.Skip marks the message as skipped.
+type HandleFunc func(init *Frame, msg *Message) ([]*Message, error)
+
+// Serve implements the plugin side of the protocol for plugins written in Go.
+// It connects to the socket from the PLUGIN_SOCKET environment variable, registers the given topics
+// and handles the messages until the connector closes the connection.
+func Serve(topics string, handle HandleFunc) error {
+	socket := os.Getenv(EnvSocket)
+	if len(socket) == 0 {
+		return errors.Errorf("missing %s environment variable", EnvSocket)
+	}
+
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return errors.Wrapf(err, "cannot connect to %s", socket)
+	}
+	defer conn.Close()
+
+	if err := WriteFrame(conn, &Frame{Type: FrameRegister, Topics: topics}); err != nil {
+		return err
+	}
+
+	init, err := ReadFrame(conn)
+	if err != nil {
+		return errors.Wrap(err, "cannot read init frame")
+	}
+
+	for {
+		frame, err := ReadFrame(conn)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		if frame.Type != FrameHandle || frame.Message == nil {
+			continue
+		}
+
+		result := &Frame{Type: FrameResult, ID: frame.ID}
+		messages, err := handle(init, frame.Message)
+		if err != nil {
+			result.Error = err.Error()
+			result.Skip = handlers.ResultOf(err) == handlers.ResultSkipped
+		} else {
+			result.Messages = messages
+		}
+		if err := WriteFrame(conn, result); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,221 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package plugin
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/pkg/errors"
+
+	"github.com/eclipse-kanto/suite-connector/connector"
+
+	"github.com/eclipse-kanto/azure-connector/config"
+	"github.com/eclipse-kanto/azure-connector/routing"
+	"github.com/eclipse-kanto/azure-connector/routing/message/handlers"
+)
+
+// HandlerType is the type of the configured handlers delegating to an external plugin process.
+const HandlerType = "plugin"
+
+const (
+	defaultTimeout      = "5s"
+	defaultStartTimeout = "10s"
+)
+
+func init() {
+	handlers.RegisterTelemetryHandler(HandlerType, func(settings *config.HandlerSettings) (handlers.TelemetryHandler, error) {
+		pluginSettings, err := parseSettings(settings)
+		if err != nil {
+			return nil, err
+		}
+		return &handler{name: handlerName(pluginSettings, "telemetry"), settings: pluginSettings, telemetry: true}, nil
+	})
+	handlers.RegisterCommandHandler(HandlerType, func(settings *config.HandlerSettings) (handlers.CommandHandler, error) {
+		pluginSettings, err := parseSettings(settings)
+		if err != nil {
+			return nil, err
+		}
+		return &handler{name: handlerName(pluginSettings, "command"), settings: pluginSettings}, nil
+	})
+}
+
+// options contains the plugin handler configuration options.
+type options struct {
+	// Command is the plugin executable followed by its arguments.
+	Command []string `json:"command"`
+	// Socket is the unix socket path, a temporary one is used if not set.
+	Socket string `json:"socket"`
+	// Timeout is the maximum time for handling a single message.
+	Timeout string `json:"timeout"`
+	// StartTimeout is the maximum time for the plugin process to register itself.
+	StartTimeout string `json:"startTimeout"`
+}
+
+type pluginSettings struct {
+	command      []string
+	socket       string
+	timeout      time.Duration
+	startTimeout time.Duration
+}
+
+func parseSettings(settings *config.HandlerSettings) (*pluginSettings, error) {
+	opts := &options{
+		Timeout:      defaultTimeout,
+		StartTimeout: defaultStartTimeout,
+	}
+	if err := settings.DecodeOptions(opts); err != nil {
+		return nil, err
+	}
+
+	if len(opts.Command) == 0 || len(opts.Command[0]) == 0 {
+		return nil, errors.New("plugin command is missing")
+	}
+
+	timeout, err := time.ParseDuration(opts.Timeout)
+	if err != nil || timeout <= 0 {
+		return nil, errors.Errorf("invalid plugin timeout '%s'", opts.Timeout)
+	}
+
+	startTimeout, err := time.ParseDuration(opts.StartTimeout)
+	if err != nil || startTimeout <= 0 {
+		return nil, errors.Errorf("invalid plugin start timeout '%s'", opts.StartTimeout)
+	}
+
+	return &pluginSettings{
+		command:      opts.Command,
+		socket:       opts.Socket,
+		timeout:      timeout,
+		startTimeout: startTimeout,
+	}, nil
+}
+
+func handlerName(settings *pluginSettings, direction string) string {
+	return fmt.Sprintf("plugin_%s_%s_handler", filepath.Base(settings.command[0]), direction)
+}
+
+// handler delegates the messages handling to a supervised plugin process.
+type handler struct {
+	name      string
+	settings  *pluginSettings
+	telemetry bool
+
+	connInfo *config.RemoteConnectionInfo
+	process  *process
+}
+
+// Init starts the plugin process.
+func (h *handler) Init(connInfo *config.RemoteConnectionInfo) error {
+	return h.InitWithContext(handlers.NewHandlerContext(connInfo, watermill.NopLogger{}))
+}
+
+// InitWithContext starts the plugin process, restarting it if already started, and waits for its registration.
+func (h *handler) InitWithContext(ctx *handlers.HandlerContext) error {
+	h.Close()
+
+	settings := *h.settings
+	if len(settings.socket) == 0 {
+		settings.socket = filepath.Join(os.TempDir(), fmt.Sprintf("%s_%s.sock", h.name, watermill.NewShortUUID()))
+	}
+
+	logger := ctx.Logger
+	if logger == nil {
+		logger = watermill.NopLogger{}
+	}
+
+	init := &Frame{Type: FrameInit}
+	if ctx.ConnInfo != nil {
+		init.DeviceID = ctx.ConnInfo.DeviceID
+		init.HubName = ctx.ConnInfo.HubName
+	}
+
+	h.connInfo = ctx.ConnInfo
+	h.process = newProcess(&settings, init, logger)
+	if err := h.process.start(); err != nil {
+		h.process = nil
+		return err
+	}
+	return nil
+}
+
+// Close stops the plugin process.
+func (h *handler) Close() error {
+	if h.process != nil {
+		h.process.close()
+		h.process = nil
+	}
+	return nil
+}
+
+// HandleMessage passes the message to the plugin process and returns the messages produced by it.
+func (h *handler) HandleMessage(msg *message.Message) ([]*message.Message, error) {
+	if h.process == nil {
+		return nil, errors.New("plugin process not started")
+	}
+
+	topic, _ := connector.TopicFromCtx(msg.Context())
+	result, err := h.process.request(&Message{
+		Topic:    topic,
+		Payload:  msg.Payload,
+		Metadata: msg.Metadata,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if result.Skip {
+		if len(result.Error) == 0 {
+			return nil, handlers.Skip("skipped by plugin")
+		}
+		return nil, handlers.Skip(result.Error)
+	}
+	if len(result.Error) > 0 {
+		return nil, errors.New(result.Error)
+	}
+
+	produced := make([]*message.Message, 0, len(result.Messages))
+	for _, m := range result.Messages {
+		outgoing := message.NewMessage(watermill.NewUUID(), m.Payload)
+		for key, value := range m.Metadata {
+			outgoing.Metadata.Set(key, value)
+		}
+
+		outTopic := m.Topic
+		if len(outTopic) == 0 {
+			if !h.telemetry || h.connInfo == nil {
+				return nil, errors.New("plugin message without topic")
+			}
+			outTopic = routing.CreateTelemetryTopic(h.connInfo.DeviceID, outgoing.UUID)
+		}
+		outgoing.SetContext(connector.SetTopicToCtx(outgoing.Context(), outTopic))
+		produced = append(produced, outgoing)
+	}
+	return produced, nil
+}
+
+// Name returns the message handler name.
+func (h *handler) Name() string {
+	return h.name
+}
+
+// Topics returns the local topics registered by the plugin process.
+func (h *handler) Topics() string {
+	if h.process == nil {
+		return ""
+	}
+	return h.process.topics()
+}
@@ -0,0 +1,178 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package plugin_test
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/pkg/errors"
+
+	"github.com/eclipse-kanto/suite-connector/connector"
+
+	"github.com/eclipse-kanto/azure-connector/config"
+	"github.com/eclipse-kanto/azure-connector/routing/message/handlers"
+	"github.com/eclipse-kanto/azure-connector/routing/message/handlers/plugin"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const envHelperPlugin = "AZURE_CONNECTOR_HELPER_PLUGIN"
+
+// TestHelperPlugin is not a real test, it is the plugin process started by the other tests.
+func TestHelperPlugin(t *testing.T) {
+	if os.Getenv(envHelperPlugin) != "1" {
+		return
+	}
+
+	err := plugin.Serve("plugin/#", func(init *plugin.Frame, msg *plugin.Message) ([]*plugin.Message, error) {
+		switch string(msg.Payload) {
+		case "crash":
+			os.Exit(1)
+		case "slow":
+			time.Sleep(time.Minute)
+		case "skip":
+			return nil, handlers.Skip("not mine")
+		case "fail":
+			return nil, errors.New("cannot handle")
+		case "default":
+			return []*plugin.Message{{Payload: msg.Payload}}, nil
+		}
+		return []*plugin.Message{{
+			Topic:    init.DeviceID + "/" + msg.Topic,
+			Payload:  []byte(strings.ToUpper(string(msg.Payload))),
+			Metadata: msg.Metadata,
+		}}, nil
+	})
+	if err != nil {
+		os.Exit(2)
+	}
+	os.Exit(0)
+}
+
+func pluginSettings(t *testing.T, timeout string) *config.HandlerSettings {
+	t.Setenv(envHelperPlugin, "1")
+
+	options, err := json.Marshal(map[string]interface{}{
+		"command": []string{os.Args[0], "-test.run=TestHelperPlugin"},
+		"timeout": timeout,
+	})
+	require.NoError(t, err)
+	return &config.HandlerSettings{Type: plugin.HandlerType, Options: options}
+}
+
+func newMessage(topic, payload string) *message.Message {
+	msg := message.NewMessage(watermill.NewUUID(), []byte(payload))
+	msg.SetContext(connector.SetTopicToCtx(msg.Context(), topic))
+	return msg
+}
+
+func TestPluginTelemetryHandler(t *testing.T) {
+	telemetryHandlers, err := handlers.CreateTelemetryHandlers([]config.HandlerSettings{*pluginSettings(t, "1s")})
+	require.NoError(t, err)
+	require.Len(t, telemetryHandlers, 1)
+
+	handler := telemetryHandlers[0]
+	assert.True(t, strings.HasPrefix(handler.Name(), "plugin_"))
+	assert.Empty(t, handler.Topics())
+
+	require.NoError(t, handler.Init(&config.RemoteConnectionInfo{DeviceID: "device", HubName: "hub"}))
+	defer handlers.CloseHandler(handler)
+	assert.Equal(t, "plugin/#", handler.Topics())
+
+	msg := newMessage("plugin/test", "payload")
+	msg.Metadata.Set("key", "value")
+	produced, err := handler.HandleMessage(msg)
+	require.NoError(t, err)
+	require.Len(t, produced, 1)
+	assert.Equal(t, "PAYLOAD", string(produced[0].Payload))
+	assert.Equal(t, "value", produced[0].Metadata.Get("key"))
+	topic, _ := connector.TopicFromCtx(produced[0].Context())
+	assert.Equal(t, "device/plugin/test", topic)
+
+	produced, err = handler.HandleMessage(newMessage("plugin/test", "default"))
+	require.NoError(t, err)
+	topic, _ = connector.TopicFromCtx(produced[0].Context())
+	assert.True(t, strings.HasPrefix(topic, "devices/device/messages/events/"))
+
+	_, err = handler.HandleMessage(newMessage("plugin/test", "skip"))
+	assert.Equal(t, handlers.ResultSkipped, handlers.ResultOf(err))
+
+	_, err = handler.HandleMessage(newMessage("plugin/test", "fail"))
+	assert.Equal(t, handlers.ResultFailed, handlers.ResultOf(err))
+}
+
+func TestPluginCommandHandlerRestart(t *testing.T) {
+	commandHandlers, err := handlers.CreateCommandHandlers([]config.HandlerSettings{*pluginSettings(t, "200ms")})
+	require.NoError(t, err)
+
+	handler := commandHandlers[0]
+	require.NoError(t, handler.Init(&config.RemoteConnectionInfo{DeviceID: "device"}))
+	defer handlers.CloseHandler(handler)
+
+	_, err = handler.HandleMessage(newMessage("c2d", "default"))
+	assert.Error(t, err, "command messages require a topic")
+
+	_, err = handler.HandleMessage(newMessage("c2d", "slow"))
+	assert.Error(t, err)
+
+	// the plugin is killed on timeout and restarted after the backoff interval
+	assert.Eventually(t, func() bool {
+		produced, err := handler.HandleMessage(newMessage("c2d", "cmd"))
+		return err == nil && len(produced) == 1
+	}, 5*time.Second, 50*time.Millisecond)
+
+	_, err = handler.HandleMessage(newMessage("c2d", "crash"))
+	assert.Error(t, err)
+
+	assert.Eventually(t, func() bool {
+		_, err := handler.HandleMessage(newMessage("c2d", "cmd"))
+		return err == nil
+	}, 5*time.Second, 50*time.Millisecond)
+
+	require.NoError(t, handlers.CloseHandler(handler))
+	_, err = handler.HandleMessage(newMessage("c2d", "cmd"))
+	assert.Error(t, err)
+}
+
+func TestPluginStartFailure(t *testing.T) {
+	settings := &config.HandlerSettings{
+		Type:    plugin.HandlerType,
+		Options: json.RawMessage(`{"command":["/nonexistent/plugin"],"startTimeout":"100ms"}`),
+	}
+	telemetryHandlers, err := handlers.CreateTelemetryHandlers([]config.HandlerSettings{*settings})
+	require.NoError(t, err)
+	assert.Error(t, telemetryHandlers[0].Init(&config.RemoteConnectionInfo{}))
+}
+
+func TestPluginInvalidOptions(t *testing.T) {
+	invalid := []string{
+		`{}`,
+		`{"command":[""]}`,
+		`{"command":["plugin"],"timeout":"never"}`,
+		`{"command":["plugin"],"startTimeout":"0s"}`,
+		`{"command":["plugin"],"unknown":true}`,
+	}
+	for _, options := range invalid {
+		_, err := handlers.CreateTelemetryHandlers([]config.HandlerSettings{{Type: plugin.HandlerType, Options: json.RawMessage(options)}})
+		assert.Error(t, err, options)
+		_, err = handlers.CreateCommandHandlers([]config.HandlerSettings{{Type: plugin.HandlerType, Options: json.RawMessage(options)}})
+		assert.Error(t, err, options)
+	}
+}
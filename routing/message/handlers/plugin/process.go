@@ -0,0 +1,264 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package plugin
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff/v3"
+	"github.com/pkg/errors"
+
+	"github.com/ThreeDotsLabs/watermill"
+)
+
+const (
+	restartInitialInterval = time.Second
+	restartMaxInterval     = time.Minute
+)
+
+// process supervises a plugin process, restarting it when it exits or does not answer in time.
+type process struct {
+	settings *pluginSettings
+	init     *Frame
+	logger   watermill.LoggerAdapter
+
+	listener *net.UnixListener
+	backoff  backoff.BackOff
+
+	lock         sync.Mutex
+	cmd          *exec.Cmd
+	conn         net.Conn
+	registration *Frame
+	registered   chan struct{}
+
+	requestLock sync.Mutex
+	nextID      uint64
+
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+func newProcess(settings *pluginSettings, init *Frame, logger watermill.LoggerAdapter) *process {
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = restartInitialInterval
+	b.MaxInterval = restartMaxInterval
+	b.MaxElapsedTime = 0
+	b.Reset()
+
+	return &process{
+		settings:   settings,
+		init:       init,
+		logger:     logger,
+		backoff:    b,
+		registered: make(chan struct{}),
+		stop:       make(chan struct{}),
+		stopped:    make(chan struct{}),
+	}
+}
+
+// start starts the plugin process supervision and waits until the plugin registers itself.
+func (p *process) start() error {
+	os.Remove(p.settings.socket)
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: p.settings.socket, Net: "unix"})
+	if err != nil {
+		return errors.Wrapf(err, "cannot listen on plugin socket %s", p.settings.socket)
+	}
+	p.listener = listener
+
+	go p.supervise()
+
+	select {
+	case <-p.registered:
+		return nil
+	case <-time.After(p.settings.startTimeout):
+		p.close()
+		return errors.Errorf("plugin '%s' not registered in %v", p.settings.command[0], p.settings.startTimeout)
+	}
+}
+
+// close stops the plugin process and its supervision.
+func (p *process) close() {
+	select {
+	case <-p.stop:
+		return
+	default:
+		close(p.stop)
+	}
+
+	p.kill()
+	p.listener.Close()
+	<-p.stopped
+	os.Remove(p.settings.socket)
+}
+
+func (p *process) supervise() {
+	defer close(p.stopped)
+
+	for {
+		started := time.Now()
+		err := p.run()
+
+		select {
+		case <-p.stop:
+			return
+		default:
+		}
+
+		if time.Since(started) >= restartMaxInterval {
+			p.backoff.Reset()
+		}
+		waitTime := p.backoff.NextBackOff()
+		p.logger.Error("plugin process stopped, restarting", err, watermill.LogFields{"retry_after": waitTime.String()})
+
+		select {
+		case <-p.stop:
+			return
+		case <-time.After(waitTime):
+		}
+	}
+}
+
+// run starts the plugin process, accepts its connection and waits until the process exits.
+func (p *process) run() error {
+	cmd := exec.Command(p.settings.command[0], p.settings.command[1:]...)
+	cmd.Env = append(os.Environ(), EnvSocket+"="+p.settings.socket)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return errors.Wrap(err, "cannot start plugin process")
+	}
+
+	p.lock.Lock()
+	p.cmd = cmd
+	p.lock.Unlock()
+
+	conn, err := p.accept()
+	if err != nil {
+		p.kill()
+		cmd.Wait()
+		return err
+	}
+	defer conn.Close()
+
+	p.lock.Lock()
+	p.conn = conn
+	p.lock.Unlock()
+	p.logger.Info("plugin process registered", watermill.LogFields{"pid": cmd.Process.Pid})
+
+	err = cmd.Wait()
+
+	p.lock.Lock()
+	p.conn = nil
+	p.cmd = nil
+	p.lock.Unlock()
+
+	if err != nil {
+		return errors.Wrap(err, "plugin process exited")
+	}
+	return errors.New("plugin process exited")
+}
+
+// accept waits for the plugin connection and exchanges the register and init frames.
+func (p *process) accept() (net.Conn, error) {
+	deadline := time.Now().Add(p.settings.startTimeout)
+	p.listener.SetDeadline(deadline)
+	conn, err := p.listener.Accept()
+	if err != nil {
+		return nil, errors.Wrap(err, "plugin process not connected")
+	}
+
+	conn.SetDeadline(deadline)
+	frame, err := ReadFrame(conn)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "cannot read plugin registration")
+	}
+	if frame.Type != FrameRegister {
+		conn.Close()
+		return nil, errors.Errorf("unexpected plugin frame '%s', expected '%s'", frame.Type, FrameRegister)
+	}
+	if err := WriteFrame(conn, p.init); err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "cannot initialize plugin")
+	}
+	conn.SetDeadline(time.Time{})
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.registration == nil {
+		close(p.registered)
+	}
+	p.registration = frame
+	return conn, nil
+}
+
+// kill terminates the plugin process, if running.
+func (p *process) kill() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.cmd != nil && p.cmd.Process != nil {
+		p.cmd.Process.Kill()
+	}
+}
+
+// topics returns the local topics registered by the plugin.
+func (p *process) topics() string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.registration == nil {
+		return ""
+	}
+	return p.registration.Topics
+}
+
+// request sends the message to the plugin and waits for its result, killing the plugin if it does not answer in time.
+func (p *process) request(msg *Message) (*Frame, error) {
+	p.requestLock.Lock()
+	defer p.requestLock.Unlock()
+
+	p.lock.Lock()
+	conn := p.conn
+	p.lock.Unlock()
+	if conn == nil {
+		return nil, errors.New("plugin process not connected")
+	}
+
+	p.nextID++
+	id := p.nextID
+
+	conn.SetDeadline(time.Now().Add(p.settings.timeout))
+	defer conn.SetDeadline(time.Time{})
+
+	if err := WriteFrame(conn, &Frame{Type: FrameHandle, ID: id, Message: msg}); err != nil {
+		p.kill()
+		return nil, errors.Wrap(err, "cannot send message to plugin")
+	}
+
+	result, err := ReadFrame(conn)
+	if err != nil {
+		p.kill()
+		return nil, errors.Wrap(err, "no result from plugin")
+	}
+	if result.Type != FrameResult || result.ID != id {
+		p.kill()
+		return nil, errors.Errorf("unexpected plugin frame '%s' with id %d, expected result with id %d", result.Type, result.ID, id)
+	}
+	return result, nil
+}
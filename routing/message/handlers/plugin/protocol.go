@@ -0,0 +1,113 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package plugin
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// The plugin protocol exchanges frames over a unix socket, each frame being a JSON document
+// prefixed by its length as a 4 bytes unsigned big-endian integer.
+//
+// The plugin process connects to the socket given in the PLUGIN_SOCKET environment variable and sends a register frame.
+// The connector answers with an init frame and then sends handle frames, one at a time, each answered by a result frame.
+const (
+	// FrameRegister is sent by the plugin to announce its name and the local topics it handles.
+	FrameRegister = "register"
+	// FrameInit is sent by the connector with the Azure IoT Hub connection information.
+	FrameInit = "init"
+	// FrameHandle is sent by the connector for each message to be handled.
+	FrameHandle = "handle"
+	// FrameResult is sent by the plugin with the outcome of a handle frame.
+	FrameResult = "result"
+
+	// EnvSocket is the environment variable with the unix socket path to connect to.
+	EnvSocket = "PLUGIN_SOCKET"
+
+	// MaxFrameSize is the maximum size of a frame.
+	MaxFrameSize = 16 * 1024 * 1024
+)
+
+// Frame is a single protocol data unit, only the fields relevant for its type are set.
+type Frame struct {
+	Type string `json:"type"`
+	ID   uint64 `json:"id,omitempty"`
+
+	// register
+	Name   string `json:"name,omitempty"`
+	Topics string `json:"topics,omitempty"`
+
+	// init
+	DeviceID string `json:"deviceId,omitempty"`
+	HubName  string `json:"hubName,omitempty"`
+
+	// handle
+	Message *Message `json:"message,omitempty"`
+
+	// result
+	Messages []*Message `json:"messages,omitempty"`
+	Error    string     `json:"error,omitempty"`
+	Skip     bool       `json:"skip,omitempty"`
+}
+
+// Message is a message passed to or returned by the plugin.
+type Message struct {
+	Topic    string            `json:"topic"`
+	Payload  []byte            `json:"payload"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// WriteFrame writes a length-prefixed JSON frame.
+func WriteFrame(w io.Writer, frame *Frame) error {
+	data, err := json.Marshal(frame)
+	if err != nil {
+		return errors.Wrap(err, "cannot encode frame")
+	}
+	if len(data) > MaxFrameSize {
+		return errors.Errorf("frame size %d exceeds the maximum of %d bytes", len(data), MaxFrameSize)
+	}
+
+	buf := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)))
+	copy(buf[4:], data)
+	_, err = w.Write(buf)
+	return err
+}
+
+// ReadFrame reads a length-prefixed JSON frame.
+func ReadFrame(r io.Reader) (*Frame, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header[:])
+	if size > MaxFrameSize {
+		return nil, errors.Errorf("frame size %d exceeds the maximum of %d bytes", size, MaxFrameSize)
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+
+	frame := &Frame{}
+	if err := json.Unmarshal(data, frame); err != nil {
+		return nil, errors.Wrap(err, "cannot decode frame")
+	}
+	return frame, nil
+}
@@ -0,0 +1,57 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package plugin_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/eclipse-kanto/azure-connector/routing/message/handlers/plugin"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	buf := &bytes.Buffer{}
+	frame := &plugin.Frame{
+		Type: plugin.FrameHandle,
+		ID:   7,
+		Message: &plugin.Message{
+			Topic:    "event/test",
+			Payload:  []byte{0, 1, 2},
+			Metadata: map[string]string{"key": "value"},
+		},
+	}
+	require.NoError(t, plugin.WriteFrame(buf, frame))
+	assert.Equal(t, uint32(buf.Len()-4), binary.BigEndian.Uint32(buf.Bytes()))
+
+	read, err := plugin.ReadFrame(buf)
+	require.NoError(t, err)
+	assert.Equal(t, frame, read)
+}
+
+func TestReadFrameInvalid(t *testing.T) {
+	_, err := plugin.ReadFrame(bytes.NewReader([]byte{0, 0}))
+	assert.Error(t, err)
+
+	_, err = plugin.ReadFrame(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff}))
+	assert.Error(t, err)
+
+	_, err = plugin.ReadFrame(bytes.NewReader([]byte{0, 0, 0, 2, '{', '{'}))
+	assert.Error(t, err)
+
+	_, err = plugin.ReadFrame(bytes.NewReader([]byte{0, 0, 0, 10, '{', '}'}))
+	assert.Error(t, err)
+}
@@ -0,0 +1,313 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package handlers
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/pkg/errors"
+
+	"github.com/eclipse-kanto/suite-connector/connector"
+
+	"github.com/eclipse-kanto/azure-connector/config"
+	"github.com/eclipse-kanto/azure-connector/routing"
+)
+
+// TelemetryHandlerFactory creates a telemetry handler from its configuration.
+type TelemetryHandlerFactory func(settings *config.HandlerSettings) (TelemetryHandler, error)
+
+// CommandHandlerFactory creates a command handler from its configuration.
+type CommandHandlerFactory func(settings *config.HandlerSettings) (CommandHandler, error)
+
+var (
+	registryLock      sync.RWMutex
+	telemetryRegistry = map[string]TelemetryHandlerFactory{}
+	commandRegistry   = map[string]CommandHandlerFactory{}
+)
+
+// RegisterTelemetryHandler makes a telemetry handler type available by the provided type name.
+// It panics if the factory is nil or the type is already registered.
+func RegisterTelemetryHandler(typeName string, factory TelemetryHandlerFactory) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	if factory == nil {
+		panic("nil factory of telemetry handler type " + typeName)
+	}
+	if _, ok := telemetryRegistry[typeName]; ok {
+		panic("duplicate registration of telemetry handler type " + typeName)
+	}
+	telemetryRegistry[typeName] = factory
+}
+
+// RegisterCommandHandler makes a command handler type available by the provided type name.
+// It panics if the factory is nil or the type is already registered.
+func RegisterCommandHandler(typeName string, factory CommandHandlerFactory) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	if factory == nil {
+		panic("nil factory of command handler type " + typeName)
+	}
+	if _, ok := commandRegistry[typeName]; ok {
+		panic("duplicate registration of command handler type " + typeName)
+	}
+	commandRegistry[typeName] = factory
+}
+
+// TelemetryHandlerTypes returns the sorted names of the registered telemetry handler types.
+func TelemetryHandlerTypes() []string {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+
+	types := make([]string, 0, len(telemetryRegistry))
+	for typeName := range telemetryRegistry {
+		types = append(types, typeName)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// CommandHandlerTypes returns the sorted names of the registered command handler types.
+func CommandHandlerTypes() []string {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+
+	types := make([]string, 0, len(commandRegistry))
+	for typeName := range commandRegistry {
+		types = append(types, typeName)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// CreateTelemetryHandlers instantiates the configured telemetry handlers sorted by their order.
+func CreateTelemetryHandlers(settings []config.HandlerSettings) ([]TelemetryHandler, error) {
+	telemetryHandlers := make([]TelemetryHandler, 0, len(settings))
+	names := map[string]bool{}
+	for _, handlerSettings := range sortByOrder(settings) {
+		registryLock.RLock()
+		factory, ok := telemetryRegistry[handlerSettings.Type]
+		registryLock.RUnlock()
+		if !ok {
+			return nil, errors.Errorf("unknown telemetry handler type '%s', supported types are %v", handlerSettings.Type, TelemetryHandlerTypes())
+		}
+
+		handler, err := factory(handlerSettings)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot create telemetry handler of type '%s'", handlerSettings.Type)
+		}
+		handler = configureTelemetryHandler(handler, handlerSettings)
+
+		if names[handler.Name()] {
+			return nil, errors.Errorf("duplicate telemetry handler name '%s'", handler.Name())
+		}
+		names[handler.Name()] = true
+
+		telemetryHandlers = append(telemetryHandlers, handler)
+	}
+	return telemetryHandlers, nil
+}
+
+// CreateCommandHandlers instantiates the configured command handlers sorted by their order.
+func CreateCommandHandlers(settings []config.HandlerSettings) ([]CommandHandler, error) {
+	commandHandlers := make([]CommandHandler, 0, len(settings))
+	for _, handlerSettings := range sortByOrder(settings) {
+		registryLock.RLock()
+		factory, ok := commandRegistry[handlerSettings.Type]
+		registryLock.RUnlock()
+		if !ok {
+			return nil, errors.Errorf("unknown command handler type '%s', supported types are %v", handlerSettings.Type, CommandHandlerTypes())
+		}
+
+		handler, err := factory(handlerSettings)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot create command handler of type '%s'", handlerSettings.Type)
+		}
+		commandHandlers = append(commandHandlers, configureCommandHandler(handler, handlerSettings))
+	}
+	return commandHandlers, nil
+}
+
+func sortByOrder(settings []config.HandlerSettings) []*config.HandlerSettings {
+	sorted := make([]*config.HandlerSettings, len(settings))
+	for i := range settings {
+		sorted[i] = &settings[i]
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Order < sorted[j].Order
+	})
+	return sorted
+}
+
+// configuredTelemetryHandler overrides the name, topics and QoS of a telemetry handler with the configured ones.
+type configuredTelemetryHandler struct {
+	TelemetryHandler
+
+	name    string
+	topics  string
+	qos     *connector.Qos
+	batch   *config.BatchSettings
+	options json.RawMessage
+}
+
+func configureTelemetryHandler(handler TelemetryHandler, settings *config.HandlerSettings) TelemetryHandler {
+	if len(settings.Name) == 0 && len(settings.Topics) == 0 && settings.QoS == nil && settings.Batch == nil && len(settings.Options) == 0 {
+		return handler
+	}
+	return &configuredTelemetryHandler{
+		TelemetryHandler: handler,
+		name:             settings.Name,
+		topics:           settings.Topics,
+		qos:              toQos(settings.QoS),
+		batch:            settings.Batch,
+		options:          settings.Options,
+	}
+}
+
+// BatchSettings returns the configured batching of the produced messages, nil if not configured.
+func (h *configuredTelemetryHandler) BatchSettings() *config.BatchSettings {
+	return h.batch
+}
+
+// InitWithContext initializes the configured handler, passing the handler options in the context.
+func (h *configuredTelemetryHandler) InitWithContext(ctx *HandlerContext) error {
+	return initConfigured(h.TelemetryHandler, ctx, h.options)
+}
+
+// Close releases the configured handler resources.
+func (h *configuredTelemetryHandler) Close() error {
+	return CloseHandler(h.TelemetryHandler)
+}
+
+// Connected notifies the configured handler, if it listens for the Azure IoT Hub connection changes.
+func (h *configuredTelemetryHandler) Connected(connected bool, err error) {
+	if listener, ok := h.TelemetryHandler.(connector.ConnectionListener); ok {
+		listener.Connected(connected, err)
+	}
+}
+
+// HandleMessage delegates to the configured handler and applies the configured QoS to the produced messages.
+func (h *configuredTelemetryHandler) HandleMessage(msg *message.Message) ([]*message.Message, error) {
+	return withQos(h.qos)(h.TelemetryHandler.HandleMessage(msg))
+}
+
+// Name returns the configured handler name or the handler's own name if not configured.
+func (h *configuredTelemetryHandler) Name() string {
+	if len(h.name) > 0 {
+		return h.name
+	}
+	return h.TelemetryHandler.Name()
+}
+
+// Topics returns the configured topics or the handler's own topics if not configured.
+func (h *configuredTelemetryHandler) Topics() string {
+	if len(h.topics) > 0 {
+		return h.topics
+	}
+	return h.TelemetryHandler.Topics()
+}
+
+// configuredCommandHandler overrides the name, QoS and applicable messages of a command handler with the configured ones.
+type configuredCommandHandler struct {
+	CommandHandler
+
+	name    string
+	qos     *connector.Qos
+	match   *config.MatchSettings
+	options json.RawMessage
+}
+
+func configureCommandHandler(handler CommandHandler, settings *config.HandlerSettings) CommandHandler {
+	if len(settings.Name) == 0 && settings.QoS == nil && settings.Match == nil && len(settings.Options) == 0 {
+		return handler
+	}
+	return &configuredCommandHandler{
+		CommandHandler: handler,
+		name:           settings.Name,
+		qos:            toQos(settings.QoS),
+		match:          settings.Match,
+		options:        settings.Options,
+	}
+}
+
+// InitWithContext initializes the configured handler, passing the handler options in the context.
+func (h *configuredCommandHandler) InitWithContext(ctx *HandlerContext) error {
+	return initConfigured(h.CommandHandler, ctx, h.options)
+}
+
+// Close releases the configured handler resources.
+func (h *configuredCommandHandler) Close() error {
+	return CloseHandler(h.CommandHandler)
+}
+
+// Connected notifies the configured handler, if it listens for the Azure IoT Hub connection changes.
+func (h *configuredCommandHandler) Connected(connected bool, err error) {
+	if listener, ok := h.CommandHandler.(connector.ConnectionListener); ok {
+		listener.Connected(connected, err)
+	}
+}
+
+// Matches returns true if the message matches the configured topics and properties and the wrapped handler's own matcher.
+func (h *configuredCommandHandler) Matches(msg *message.Message) bool {
+	if h.match != nil {
+		topic, _ := connector.TopicFromCtx(msg.Context())
+		if len(h.match.Topics) > 0 && !routing.MatchTopics(h.match.Topics, topic) {
+			return false
+		}
+		if len(h.match.Properties) > 0 && !matchProperties(h.match.Properties, topic) {
+			return false
+		}
+	}
+	return Matches(h.CommandHandler, msg)
+}
+
+func matchProperties(expected map[string]string, topic string) bool {
+	_, properties, ok := routing.ParseCloudTopic(topic)
+	return ok && routing.MatchProperties(expected, properties)
+}
+
+// HandleMessage delegates to the configured handler and applies the configured QoS to the produced messages.
+func (h *configuredCommandHandler) HandleMessage(msg *message.Message) ([]*message.Message, error) {
+	return withQos(h.qos)(h.CommandHandler.HandleMessage(msg))
+}
+
+// Name returns the configured handler name or the handler's own name if not configured.
+func (h *configuredCommandHandler) Name() string {
+	if len(h.name) > 0 {
+		return h.name
+	}
+	return h.CommandHandler.Name()
+}
+
+func toQos(qos *int) *connector.Qos {
+	if qos == nil {
+		return nil
+	}
+	value := connector.Qos(*qos)
+	return &value
+}
+
+func withQos(qos *connector.Qos) func([]*message.Message, error) ([]*message.Message, error) {
+	return func(produced []*message.Message, err error) ([]*message.Message, error) {
+		if err == nil && qos != nil {
+			for _, msg := range produced {
+				msg.SetContext(connector.SetQosToCtx(msg.Context(), *qos))
+			}
+		}
+		return produced, err
+	}
+}
@@ -0,0 +1,215 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package handlers_test
+
+import (
+	"testing"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/pkg/errors"
+
+	"github.com/eclipse-kanto/suite-connector/connector"
+
+	"github.com/eclipse-kanto/azure-connector/config"
+	"github.com/eclipse-kanto/azure-connector/routing/message/handlers"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testTelemetryType = "registry_test_telemetry"
+	testCommandType   = "registry_test_command"
+	testFailingType   = "registry_test_failing"
+	testListeningType = "registry_test_listening"
+)
+
+type testHandler struct {
+	name   string
+	topics string
+}
+
+func (h *testHandler) Init(connInfo *config.RemoteConnectionInfo) error {
+	return nil
+}
+
+func (h *testHandler) HandleMessage(msg *message.Message) ([]*message.Message, error) {
+	return []*message.Message{message.NewMessage(watermill.NewUUID(), msg.Payload)}, nil
+}
+
+func (h *testHandler) Name() string {
+	return h.name
+}
+
+func (h *testHandler) Topics() string {
+	return h.topics
+}
+
+// listeningHandler records the connection changes it is notified about.
+type listeningHandler struct {
+	testHandler
+
+	connected []bool
+}
+
+func (h *listeningHandler) Connected(connected bool, err error) {
+	h.connected = append(h.connected, connected)
+}
+
+var (
+	listeningTelemetry = &listeningHandler{testHandler: testHandler{name: testListeningType, topics: "test/#"}}
+	listeningCommand   = &listeningHandler{testHandler: testHandler{name: testListeningType}}
+)
+
+func init() {
+	handlers.RegisterTelemetryHandler(testTelemetryType, func(settings *config.HandlerSettings) (handlers.TelemetryHandler, error) {
+		options := struct {
+			Name string `json:"name"`
+		}{Name: testTelemetryType}
+		if err := settings.DecodeOptions(&options); err != nil {
+			return nil, err
+		}
+		return &testHandler{name: options.Name, topics: "test/#"}, nil
+	})
+	handlers.RegisterTelemetryHandler(testFailingType, func(settings *config.HandlerSettings) (handlers.TelemetryHandler, error) {
+		return nil, errors.New("cannot create")
+	})
+	handlers.RegisterCommandHandler(testCommandType, func(settings *config.HandlerSettings) (handlers.CommandHandler, error) {
+		return &testHandler{name: testCommandType}, nil
+	})
+	handlers.RegisterCommandHandler(testFailingType, func(settings *config.HandlerSettings) (handlers.CommandHandler, error) {
+		return nil, errors.New("cannot create")
+	})
+	handlers.RegisterTelemetryHandler(testListeningType, func(settings *config.HandlerSettings) (handlers.TelemetryHandler, error) {
+		return listeningTelemetry, nil
+	})
+	handlers.RegisterCommandHandler(testListeningType, func(settings *config.HandlerSettings) (handlers.CommandHandler, error) {
+		return listeningCommand, nil
+	})
+}
+
+func TestRegisterDuplicate(t *testing.T) {
+	assert.Panics(t, func() {
+		handlers.RegisterTelemetryHandler(testTelemetryType, func(settings *config.HandlerSettings) (handlers.TelemetryHandler, error) {
+			return nil, nil
+		})
+	})
+	assert.Panics(t, func() {
+		handlers.RegisterCommandHandler(testCommandType, nil)
+	})
+	assert.Contains(t, handlers.TelemetryHandlerTypes(), testTelemetryType)
+	assert.Contains(t, handlers.CommandHandlerTypes(), testCommandType)
+}
+
+func TestCreateTelemetryHandlers(t *testing.T) {
+	qos := 0
+	telemetryHandlers, err := handlers.CreateTelemetryHandlers([]config.HandlerSettings{
+		{Type: testTelemetryType, Order: 2},
+		{Type: testTelemetryType, Name: "configured", Topics: "configured/#", QoS: &qos, Order: 1},
+		{Type: testTelemetryType, Options: []byte(`{"name":"from_options"}`), Order: 2},
+	})
+	require.NoError(t, err)
+	require.Len(t, telemetryHandlers, 3)
+
+	assert.Equal(t, "configured", telemetryHandlers[0].Name())
+	assert.Equal(t, "configured/#", telemetryHandlers[0].Topics())
+	assert.Equal(t, testTelemetryType, telemetryHandlers[1].Name())
+	assert.Equal(t, "test/#", telemetryHandlers[1].Topics())
+	assert.Equal(t, "from_options", telemetryHandlers[2].Name())
+
+	produced, err := telemetryHandlers[0].HandleMessage(message.NewMessage(watermill.NewUUID(), []byte("{}")))
+	require.NoError(t, err)
+	require.Len(t, produced, 1)
+	msgQos, ok := connector.QosFromCtx(produced[0].Context())
+	require.True(t, ok)
+	assert.Equal(t, connector.QosAtMostOnce, msgQos)
+
+	produced, err = telemetryHandlers[1].HandleMessage(message.NewMessage(watermill.NewUUID(), []byte("{}")))
+	require.NoError(t, err)
+	_, ok = connector.QosFromCtx(produced[0].Context())
+	assert.False(t, ok)
+}
+
+func TestCreateTelemetryHandlersBatch(t *testing.T) {
+	batch := &config.BatchSettings{Window: "1s"}
+	telemetryHandlers, err := handlers.CreateTelemetryHandlers([]config.HandlerSettings{
+		{Type: testTelemetryType, Name: "batching", Batch: batch},
+		{Type: testTelemetryType},
+	})
+	require.NoError(t, err)
+	require.Len(t, telemetryHandlers, 2)
+
+	batching, ok := telemetryHandlers[0].(handlers.BatchingHandler)
+	require.True(t, ok)
+	assert.Equal(t, batch, batching.BatchSettings())
+	_, ok = telemetryHandlers[1].(handlers.BatchingHandler)
+	assert.False(t, ok)
+}
+
+func TestCreateTelemetryHandlersErrors(t *testing.T) {
+	invalid := [][]config.HandlerSettings{
+		{{Type: "unknown"}},
+		{{Type: testFailingType}},
+		{{Type: testTelemetryType, Options: []byte(`{"unknown":true}`)}},
+		{{Type: testTelemetryType}, {Type: testTelemetryType}},
+	}
+	for _, settings := range invalid {
+		_, err := handlers.CreateTelemetryHandlers(settings)
+		assert.Error(t, err)
+	}
+}
+
+func TestCreateCommandHandlers(t *testing.T) {
+	qos := 1
+	commandHandlers, err := handlers.CreateCommandHandlers([]config.HandlerSettings{
+		{Type: testCommandType, Order: 1},
+		{Type: testCommandType, Name: "first", QoS: &qos},
+	})
+	require.NoError(t, err)
+	require.Len(t, commandHandlers, 2)
+	assert.Equal(t, "first", commandHandlers[0].Name())
+	assert.Equal(t, testCommandType, commandHandlers[1].Name())
+
+	produced, err := commandHandlers[0].HandleMessage(message.NewMessage(watermill.NewUUID(), []byte("{}")))
+	require.NoError(t, err)
+	msgQos, ok := connector.QosFromCtx(produced[0].Context())
+	require.True(t, ok)
+	assert.Equal(t, connector.QosAtLeastOnce, msgQos)
+
+	_, err = handlers.CreateCommandHandlers([]config.HandlerSettings{{Type: "unknown"}})
+	assert.Error(t, err)
+	_, err = handlers.CreateCommandHandlers([]config.HandlerSettings{{Type: testFailingType}})
+	assert.Error(t, err)
+}
+
+func TestConfiguredHandlersConnected(t *testing.T) {
+	telemetryHandlers, err := handlers.CreateTelemetryHandlers([]config.HandlerSettings{{Type: testListeningType, Name: "configured"}})
+	require.NoError(t, err)
+	commandHandlers, err := handlers.CreateCommandHandlers([]config.HandlerSettings{{Type: testListeningType, Name: "configured"}})
+	require.NoError(t, err)
+
+	for _, handler := range []interface{}{telemetryHandlers[0], commandHandlers[0]} {
+		listener, ok := handler.(connector.ConnectionListener)
+		require.True(t, ok)
+		listener.Connected(true, nil)
+		listener.Connected(false, errors.New("connection lost"))
+	}
+	assert.Equal(t, []bool{true, false}, listeningTelemetry.connected)
+	assert.Equal(t, []bool{true, false}, listeningCommand.connected)
+
+	// the handlers without connection listening are notified without effect
+	telemetryHandlers, err = handlers.CreateTelemetryHandlers([]config.HandlerSettings{{Type: testTelemetryType, Name: "configured"}})
+	require.NoError(t, err)
+	telemetryHandlers[0].(connector.ConnectionListener).Connected(true, nil)
+}
@@ -0,0 +1,74 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package handlers
+
+import (
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/pkg/errors"
+)
+
+// ErrSkipped is returned by a message handler if the message is not applicable for it.
+var ErrSkipped = errors.New("message not applicable for handler")
+
+// Result represents the outcome of a message handling.
+type Result int
+
+const (
+	// ResultHandled marks a message that is processed by the handler.
+	ResultHandled Result = iota
+	// ResultSkipped marks a message that is not applicable for the handler.
+	ResultSkipped
+	// ResultFailed marks a message that the handler failed to process.
+	ResultFailed
+)
+
+// String returns the result name.
+func (r Result) String() string {
+	switch r {
+	case ResultHandled:
+		return "handled"
+	case ResultSkipped:
+		return "skipped"
+	default:
+		return "failed"
+	}
+}
+
+// Skip returns an error marking the message as not applicable for the handler, with the given reason.
+func Skip(reason string) error {
+	return errors.Wrap(ErrSkipped, reason)
+}
+
+// ResultOf returns the result of a message handling based on the error returned by the handler.
+func ResultOf(err error) Result {
+	if err == nil {
+		return ResultHandled
+	}
+	if errors.Is(err, ErrSkipped) {
+		return ResultSkipped
+	}
+	return ResultFailed
+}
+
+// MessageMatcher is an optional interface of the command handlers to select the applicable messages before handling them.
+type MessageMatcher interface {
+	Matches(msg *message.Message) bool
+}
+
+// Matches returns true if the handler does not implement MessageMatcher or its matcher accepts the message.
+func Matches(handler interface{}, msg *message.Message) bool {
+	if matcher, ok := handler.(MessageMatcher); ok {
+		return matcher.Matches(msg)
+	}
+	return true
+}
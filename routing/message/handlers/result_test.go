@@ -0,0 +1,82 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package handlers_test
+
+import (
+	"testing"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/pkg/errors"
+
+	"github.com/eclipse-kanto/suite-connector/connector"
+
+	"github.com/eclipse-kanto/azure-connector/config"
+	"github.com/eclipse-kanto/azure-connector/routing/message/handlers"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type matchingHandler struct {
+	testHandler
+	matches bool
+}
+
+func (h *matchingHandler) Matches(msg *message.Message) bool {
+	return h.matches
+}
+
+func TestResultOf(t *testing.T) {
+	assert.Equal(t, handlers.ResultHandled, handlers.ResultOf(nil))
+	assert.Equal(t, handlers.ResultSkipped, handlers.ResultOf(handlers.ErrSkipped))
+	assert.Equal(t, handlers.ResultSkipped, handlers.ResultOf(handlers.Skip("not applicable")))
+	assert.Equal(t, handlers.ResultSkipped, handlers.ResultOf(errors.Wrap(handlers.Skip("not applicable"), "wrapped")))
+	assert.Equal(t, handlers.ResultFailed, handlers.ResultOf(errors.New("failed")))
+
+	assert.Equal(t, "handled", handlers.ResultHandled.String())
+	assert.Equal(t, "skipped", handlers.ResultSkipped.String())
+	assert.Equal(t, "failed", handlers.ResultFailed.String())
+	assert.Contains(t, handlers.Skip("not applicable").Error(), "not applicable")
+}
+
+func TestMatches(t *testing.T) {
+	msg := message.NewMessage(watermill.NewUUID(), []byte("{}"))
+	assert.True(t, handlers.Matches(&testHandler{}, msg))
+	assert.True(t, handlers.Matches(&matchingHandler{matches: true}, msg))
+	assert.False(t, handlers.Matches(&matchingHandler{matches: false}, msg))
+}
+
+func TestConfiguredCommandHandlerMatch(t *testing.T) {
+	commandHandlers, err := handlers.CreateCommandHandlers([]config.HandlerSettings{
+		{Type: testCommandType, Match: &config.MatchSettings{
+			Topics:     "devices/+/messages/devicebound/#",
+			Properties: map[string]string{"subject": "*", "kind": "restart"},
+		}},
+	})
+	require.NoError(t, err)
+	require.Len(t, commandHandlers, 1)
+
+	newMessage := func(topic string) *message.Message {
+		msg := message.NewMessage(watermill.NewUUID(), []byte("{}"))
+		msg.SetContext(connector.SetTopicToCtx(msg.Context(), topic))
+		return msg
+	}
+
+	commandHandler := commandHandlers[0]
+	assert.True(t, handlers.Matches(commandHandler, newMessage("devices/dev/messages/devicebound/subject=cmd&kind=restart")))
+	assert.False(t, handlers.Matches(commandHandler, newMessage("devices/dev/messages/devicebound/subject=cmd&kind=reboot")))
+	assert.False(t, handlers.Matches(commandHandler, newMessage("devices/dev/messages/devicebound/kind=restart")))
+	assert.False(t, handlers.Matches(commandHandler, newMessage("$iothub/twin/res/200/?$rid=1")))
+	assert.False(t, handlers.Matches(commandHandler, message.NewMessage(watermill.NewUUID(), []byte("{}"))))
+}
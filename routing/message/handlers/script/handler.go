@@ -0,0 +1,362 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package script
+
+import (
+	"context"
+	"io/ioutil"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/pkg/errors"
+	lua "github.com/yuin/gopher-lua"
+
+	"github.com/eclipse-kanto/suite-connector/connector"
+
+	"github.com/eclipse-kanto/azure-connector/config"
+	"github.com/eclipse-kanto/azure-connector/routing"
+	"github.com/eclipse-kanto/azure-connector/routing/message/handlers"
+)
+
+// HandlerType is the type of the configured handlers transforming the messages with a Lua script.
+const HandlerType = "script"
+
+const (
+	telemetryHandlerName = "script_telemetry_handler"
+	commandHandlerName   = "script_command_handler"
+
+	handleFunction = "handle"
+
+	defaultTimeout      = "100ms"
+	defaultMaxMemory    = 32 * 1024 * 1024
+	defaultMaxStackSize = 64 * 1024
+	defaultMaxCallDepth = 200
+)
+
+func init() {
+	handlers.RegisterTelemetryHandler(HandlerType, func(settings *config.HandlerSettings) (handlers.TelemetryHandler, error) {
+		if len(settings.Topics) == 0 {
+			return nil, errors.New("script telemetry handler requires topics")
+		}
+		scriptSettings, err := parseSettings(settings)
+		if err != nil {
+			return nil, err
+		}
+		return &handler{name: telemetryHandlerName, settings: scriptSettings, topics: settings.Topics, telemetry: true}, nil
+	})
+	handlers.RegisterCommandHandler(HandlerType, func(settings *config.HandlerSettings) (handlers.CommandHandler, error) {
+		scriptSettings, err := parseSettings(settings)
+		if err != nil {
+			return nil, err
+		}
+		return &handler{name: commandHandlerName, settings: scriptSettings}, nil
+	})
+}
+
+// options contains the script handler configuration options.
+type options struct {
+	// Script is the inline Lua script source.
+	Script string `json:"script"`
+	// File is the path to the Lua script file, used if no inline script is set.
+	File string `json:"file"`
+	// Timeout is the maximum execution time of the script for a single message.
+	Timeout string `json:"timeout"`
+	// MaxMemory is the maximum growth in bytes of the process heap during the script execution for a single message.
+	// The heap is checked periodically, so the allocations of the other goroutines during the execution are counted too
+	// and the limit may be overrun by the allocations made between two checks. The strings created by the string, table
+	// and json library functions and the emitted messages are limited precisely before they are created.
+	MaxMemory int64 `json:"maxMemory"`
+	// MaxStackSize is the maximum number of values on the script data stack.
+	MaxStackSize int `json:"maxStackSize"`
+	// MaxCallDepth is the maximum depth of nested function calls.
+	MaxCallDepth int `json:"maxCallDepth"`
+}
+
+type scriptSettings struct {
+	proto        *lua.FunctionProto
+	timeout      time.Duration
+	maxMemory    int64
+	maxStackSize int
+	maxCallDepth int
+}
+
+func parseSettings(settings *config.HandlerSettings) (*scriptSettings, error) {
+	opts := &options{
+		Timeout:      defaultTimeout,
+		MaxMemory:    defaultMaxMemory,
+		MaxStackSize: defaultMaxStackSize,
+		MaxCallDepth: defaultMaxCallDepth,
+	}
+	if err := settings.DecodeOptions(opts); err != nil {
+		return nil, err
+	}
+
+	source, name := opts.Script, "<script>"
+	if len(source) == 0 {
+		if len(opts.File) == 0 {
+			return nil, errors.New("script or script file is required")
+		}
+		data, err := ioutil.ReadFile(opts.File)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot read script file %s", opts.File)
+		}
+		source, name = string(data), opts.File
+	}
+
+	timeout, err := time.ParseDuration(opts.Timeout)
+	if err != nil || timeout <= 0 {
+		return nil, errors.Errorf("invalid script timeout '%s'", opts.Timeout)
+	}
+	if opts.MaxMemory <= 0 || opts.MaxStackSize <= 0 || opts.MaxCallDepth <= 0 {
+		return nil, errors.New("script limits must be positive")
+	}
+
+	proto, err := compile(source, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &scriptSettings{
+		proto:        proto,
+		timeout:      timeout,
+		maxMemory:    opts.MaxMemory,
+		maxStackSize: opts.MaxStackSize,
+		maxCallDepth: opts.MaxCallDepth,
+	}, nil
+}
+
+// handler transforms the messages by calling the script handle function.
+//
+// The function receives a table with the topic, payload, metadata, properties and deviceId of the message.
+// It returns nil to skip the message, a message table or an array of message tables to emit.
+// A message table contains the payload as a string or a table encoded as JSON, and optionally the topic,
+// the properties and the metadata. The telemetry messages without topic are sent to the Azure IoT Hub
+// device-to-cloud topic with the given properties. The command messages require a topic.
+type handler struct {
+	name      string
+	settings  *scriptSettings
+	topics    string
+	telemetry bool
+
+	lock     sync.Mutex
+	state    *lua.LState
+	allocs   *allocations
+	deviceID string
+}
+
+// Init loads the script.
+func (h *handler) Init(connInfo *config.RemoteConnectionInfo) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if connInfo != nil {
+		h.deviceID = connInfo.DeviceID
+	}
+	return h.reset()
+}
+
+// Close releases the script state.
+func (h *handler) Close() error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.state != nil {
+		h.state.Close()
+		h.state = nil
+		h.allocs = nil
+	}
+	return nil
+}
+
+// reset creates a new script state and runs the script main chunk, bounded by the execution limits.
+func (h *handler) reset() error {
+	if h.state != nil {
+		h.state.Close()
+		h.state = nil
+		h.allocs = nil
+	}
+
+	L, allocs := newState(h.settings)
+	L.Push(L.NewFunctionFromProto(h.settings.proto))
+	if err := h.call(L, allocs, 0, 0); err != nil {
+		L.Close()
+		return errors.Wrap(err, "cannot load script")
+	}
+	if _, ok := L.GetGlobal(handleFunction).(*lua.LFunction); !ok {
+		L.Close()
+		return errors.Errorf("script does not define a '%s' function", handleFunction)
+	}
+	h.state = L
+	h.allocs = allocs
+	return nil
+}
+
+// call calls the function on top of the stack, aborting it if the timeout or the memory limit is exceeded.
+// The data stack and the call stack of the state are bounded by the state options.
+func (h *handler) call(L *lua.LState, allocs *allocations, nargs, nret int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), h.settings.timeout)
+	defer cancel()
+
+	allocs.used = 0
+	heap := watchHeap(ctx, cancel, h.settings.maxMemory)
+	L.SetContext(ctx)
+	defer L.RemoveContext()
+
+	err := L.PCall(nargs, nret, nil)
+	cancel()
+	if heap.isExceeded() {
+		return errors.Errorf("script memory limit of %d bytes exceeded", h.settings.maxMemory)
+	}
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return errors.Errorf("script timeout of %v exceeded", h.settings.timeout)
+	}
+	return err
+}
+
+// HandleMessage calls the script handle function with the message and returns the messages emitted by it.
+func (h *handler) HandleMessage(msg *message.Message) ([]*message.Message, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.state == nil {
+		return nil, errors.New("script not loaded")
+	}
+	L := h.state
+
+	topic, _ := connector.TopicFromCtx(msg.Context())
+	arg := L.NewTable()
+	arg.RawSetString("topic", lua.LString(topic))
+	arg.RawSetString("payload", lua.LString(msg.Payload))
+	arg.RawSetString("metadata", toLua(L, map[string]string(msg.Metadata)))
+	arg.RawSetString("deviceId", lua.LString(h.deviceID))
+	properties := L.NewTable()
+	if _, values, ok := routing.ParseCloudTopic(topic); ok {
+		for key := range values {
+			properties.RawSetString(key, lua.LString(values.Get(key)))
+		}
+	}
+	arg.RawSetString("properties", properties)
+
+	L.Push(L.GetGlobal(handleFunction))
+	L.Push(arg)
+	if err := h.call(L, h.allocs, 1, 1); err != nil {
+		// the state may be left inconsistent by an aborted script
+		if resetErr := h.reset(); resetErr != nil {
+			return nil, errors.Wrap(resetErr, err.Error())
+		}
+		return nil, errors.Wrap(err, "script failed")
+	}
+
+	result := L.Get(-1)
+	L.Pop(1)
+	return h.toMessages(result)
+}
+
+func (h *handler) toMessages(result lua.LValue) ([]*message.Message, error) {
+	if result == lua.LNil {
+		return nil, handlers.Skip("skipped by script")
+	}
+
+	table, ok := result.(*lua.LTable)
+	if !ok {
+		return nil, errors.Errorf("script returned %s instead of a message table", result.Type().String())
+	}
+
+	var tables []*lua.LTable
+	if table.RawGetString("payload") != lua.LNil {
+		tables = []*lua.LTable{table}
+	} else {
+		for i := 1; i <= table.MaxN(); i++ {
+			item, ok := table.RawGetInt(i).(*lua.LTable)
+			if !ok {
+				return nil, errors.Errorf("script returned a non-table message at index %d", i)
+			}
+			tables = append(tables, item)
+		}
+	}
+
+	var size int64
+	produced := make([]*message.Message, 0, len(tables))
+	for _, t := range tables {
+		msg, err := h.toMessage(t)
+		if err != nil {
+			return nil, err
+		}
+		size += int64(len(msg.Payload))
+		if size > h.settings.maxMemory {
+			return nil, errors.New("script messages exceed the memory limit")
+		}
+		produced = append(produced, msg)
+	}
+	return produced, nil
+}
+
+func (h *handler) toMessage(t *lua.LTable) (*message.Message, error) {
+	var payload []byte
+	switch p := t.RawGetString("payload").(type) {
+	case lua.LString:
+		payload = []byte(p)
+	case *lua.LTable:
+		data, err := jsonMarshal(p)
+		if err != nil {
+			return nil, err
+		}
+		payload = data
+	default:
+		return nil, errors.New("message payload must be a string or a table")
+	}
+
+	msg := message.NewMessage(watermill.NewUUID(), payload)
+
+	metadata, err := stringMap(t.RawGetString("metadata"), "metadata")
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range metadata {
+		msg.Metadata.Set(key, value)
+	}
+
+	properties, err := stringMap(t.RawGetString("properties"), "properties")
+	if err != nil {
+		return nil, err
+	}
+
+	topic := lua.LVAsString(t.RawGetString("topic"))
+	if len(topic) == 0 {
+		if !h.telemetry {
+			return nil, errors.New("command message requires a topic")
+		}
+		values := url.Values{}
+		for key, value := range properties {
+			values.Set(key, value)
+		}
+		topic = routing.CreateTelemetryTopicWithProperties(h.deviceID, msg.UUID, values)
+	} else if len(properties) > 0 {
+		return nil, errors.New("message properties cannot be combined with a topic")
+	}
+	msg.SetContext(connector.SetTopicToCtx(msg.Context(), topic))
+	return msg, nil
+}
+
+// Name returns the message handler name.
+func (h *handler) Name() string {
+	return h.name
+}
+
+// Topics returns the configured local topics.
+func (h *handler) Topics() string {
+	return h.topics
+}
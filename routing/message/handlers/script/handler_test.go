@@ -0,0 +1,269 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package script_test
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+
+	"github.com/eclipse-kanto/suite-connector/connector"
+
+	"github.com/eclipse-kanto/azure-connector/config"
+	"github.com/eclipse-kanto/azure-connector/routing"
+	"github.com/eclipse-kanto/azure-connector/routing/message/handlers"
+	"github.com/eclipse-kanto/azure-connector/routing/message/handlers/script"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testDeviceID = "device"
+
+func scriptOptions(t *testing.T, options map[string]interface{}) json.RawMessage {
+	data, err := json.Marshal(options)
+	require.NoError(t, err)
+	return data
+}
+
+func newTelemetryHandler(t *testing.T, options map[string]interface{}) handlers.TelemetryHandler {
+	telemetryHandlers, err := handlers.CreateTelemetryHandlers([]config.HandlerSettings{
+		{Type: script.HandlerType, Topics: "event/#", Options: scriptOptions(t, options)},
+	})
+	require.NoError(t, err)
+	require.NoError(t, telemetryHandlers[0].Init(&config.RemoteConnectionInfo{DeviceID: testDeviceID}))
+	t.Cleanup(func() {
+		handlers.CloseHandler(telemetryHandlers[0])
+	})
+	return telemetryHandlers[0]
+}
+
+func newMessage(topic, payload string) *message.Message {
+	msg := message.NewMessage(watermill.NewUUID(), []byte(payload))
+	msg.SetContext(connector.SetTopicToCtx(msg.Context(), topic))
+	return msg
+}
+
+func topicOf(t *testing.T, msg *message.Message) string {
+	topic, ok := connector.TopicFromCtx(msg.Context())
+	require.True(t, ok)
+	return topic
+}
+
+func TestScriptTelemetryFile(t *testing.T) {
+	handler := newTelemetryHandler(t, map[string]interface{}{"file": "testdata/rename.lua"})
+	assert.Equal(t, "event/#", handler.Topics())
+
+	produced, err := handler.HandleMessage(newMessage("event/temp", `{"temp":21.5,"other":1}`))
+	require.NoError(t, err)
+	require.Len(t, produced, 1)
+	assert.JSONEq(t, `{"temperature":21.5}`, string(produced[0].Payload))
+
+	deviceID, properties, ok := routing.ParseTelemetryTopic(topicOf(t, produced[0]))
+	require.True(t, ok)
+	assert.Equal(t, testDeviceID, deviceID)
+	assert.Equal(t, "C", properties.Get("unit"))
+
+	_, err = handler.HandleMessage(newMessage("event/temp", `{"humidity":40}`))
+	assert.Equal(t, handlers.ResultSkipped, handlers.ResultOf(err))
+}
+
+func TestScriptMultipleMessages(t *testing.T) {
+	handler := newTelemetryHandler(t, map[string]interface{}{"script": `
+function handle(msg)
+	local out = {}
+	for _, reading in ipairs(json.decode(msg.payload)) do
+		table.insert(out, { payload = tostring(reading), topic = "local/" .. msg.topic, metadata = { source = msg.metadata.source } })
+	end
+	return out
+end`})
+
+	msg := newMessage("event/batch", `[1, 2, 3]`)
+	msg.Metadata.Set("source", "sensor")
+	produced, err := handler.HandleMessage(msg)
+	require.NoError(t, err)
+	require.Len(t, produced, 3)
+	for i, m := range produced {
+		assert.Equal(t, []string{"1", "2", "3"}[i], string(m.Payload))
+		assert.Equal(t, "local/event/batch", topicOf(t, m))
+		assert.Equal(t, "sensor", m.Metadata.Get("source"))
+	}
+
+	produced, err = handler.HandleMessage(newMessage("event/batch", `[]`))
+	require.NoError(t, err)
+	assert.Empty(t, produced)
+}
+
+func TestScriptCommand(t *testing.T) {
+	commandHandlers, err := handlers.CreateCommandHandlers([]config.HandlerSettings{{
+		Type: script.HandlerType,
+		Options: scriptOptions(t, map[string]interface{}{"script": `
+function handle(msg)
+	if msg.properties.subject == nil then
+		return { payload = msg.payload }
+	end
+	return { payload = msg.payload, topic = "command/" .. msg.deviceId .. "/" .. msg.properties.subject }
+end`}),
+	}})
+	require.NoError(t, err)
+	handler := commandHandlers[0]
+	require.NoError(t, handler.Init(&config.RemoteConnectionInfo{DeviceID: testDeviceID}))
+	defer handlers.CloseHandler(handler)
+
+	produced, err := handler.HandleMessage(newMessage("devices/device/messages/devicebound/subject=restart", "{}"))
+	require.NoError(t, err)
+	require.Len(t, produced, 1)
+	assert.Equal(t, "command/device/restart", topicOf(t, produced[0]))
+
+	_, err = handler.HandleMessage(newMessage("devices/device/messages/devicebound/", "{}"))
+	assert.Equal(t, handlers.ResultFailed, handlers.ResultOf(err))
+}
+
+func TestScriptSandbox(t *testing.T) {
+	handler := newTelemetryHandler(t, map[string]interface{}{"script": `
+function handle(msg)
+	return { payload = tostring(dofile == nil and require == nil and loadstring == nil and io == nil and os == nil) }
+end`})
+
+	produced, err := handler.HandleMessage(newMessage("event/test", "{}"))
+	require.NoError(t, err)
+	assert.Equal(t, "true", string(produced[0].Payload))
+}
+
+func TestScriptLimits(t *testing.T) {
+	handler := newTelemetryHandler(t, map[string]interface{}{"timeout": "50ms", "maxMemory": 1024 * 1024, "script": `
+function handle(msg)
+	if msg.payload == "loop" then
+		while true do end
+	elseif msg.payload == "rep" then
+		return { payload = string.rep("x", 2 * 1024 * 1024) }
+	elseif msg.payload == "alloc" then
+		local t = {}
+		for i = 1, 100000000 do
+			t[i] = { i }
+		end
+	elseif msg.payload == "recurse" then
+		local function f(n) return f(n + 1) + 1 end
+		return f(1)
+	end
+	return { payload = msg.payload }
+end`})
+
+	for _, payload := range []string{"loop", "rep", "alloc", "recurse"} {
+		_, err := handler.HandleMessage(newMessage("event/test", payload))
+		require.Error(t, err, payload)
+		assert.Equal(t, handlers.ResultFailed, handlers.ResultOf(err), payload)
+	}
+
+	_, err := handler.HandleMessage(newMessage("event/test", "loop"))
+	assert.True(t, strings.Contains(err.Error(), "timeout"), err.Error())
+
+	produced, err := handler.HandleMessage(newMessage("event/test", "ok"))
+	require.NoError(t, err, "the handler recovers after exceeding a limit")
+	assert.Equal(t, "ok", string(produced[0].Payload))
+}
+
+func TestScriptMemoryLimit(t *testing.T) {
+	handler := newTelemetryHandler(t, map[string]interface{}{"timeout": "30s", "maxMemory": 4 * 1024 * 1024, "script": `
+function handle(msg)
+	local parts = {}
+	for i = 1, tonumber(msg.payload) do
+		parts[i] = string.upper(string.rep("x", 512 * 1024))
+	end
+	return { payload = tostring(#parts) }
+end`})
+
+	_, err := handler.HandleMessage(newMessage("event/test", "100"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "memory limit")
+
+	// the count is kept per call
+	for i := 0; i < 3; i++ {
+		produced, err := handler.HandleMessage(newMessage("event/test", "3"))
+		require.NoError(t, err)
+		assert.Equal(t, "3", string(produced[0].Payload))
+	}
+}
+
+func TestScriptHeapLimit(t *testing.T) {
+	handler := newTelemetryHandler(t, map[string]interface{}{"timeout": "30s", "maxMemory": 16 * 1024 * 1024, "script": `
+function handle(msg)
+	if msg.payload == "concat" then
+		local s = "x"
+		while true do
+			s = s .. s
+		end
+	elseif msg.payload == "table" then
+		local t = {}
+		for i = 1, 100000000 do
+			t[i] = { i }
+		end
+	elseif msg.payload == "closures" then
+		local fs = {}
+		for i = 1, 100000000 do
+			fs[i] = function() return i end
+		end
+	end
+	return { payload = msg.payload }
+end`})
+
+	for _, payload := range []string{"concat", "table", "closures"} {
+		_, err := handler.HandleMessage(newMessage("event/test", payload))
+		require.Error(t, err, payload)
+		assert.Contains(t, err.Error(), "memory limit", payload)
+	}
+
+	produced, err := handler.HandleMessage(newMessage("event/test", "ok"))
+	require.NoError(t, err)
+	assert.Equal(t, "ok", string(produced[0].Payload))
+}
+
+func TestScriptInvalid(t *testing.T) {
+	invalid := []map[string]interface{}{
+		{},
+		{"file": "testdata/missing.lua"},
+		{"script": "function handle(msg"},
+		{"script": "function handle(msg) end", "timeout": "soon"},
+		{"script": "function handle(msg) end", "maxMemory": 0},
+		{"script": "function handle(msg) end", "unknown": 1},
+	}
+	for _, options := range invalid {
+		_, err := handlers.CreateCommandHandlers([]config.HandlerSettings{{Type: script.HandlerType, Options: scriptOptions(t, options)}})
+		assert.Error(t, err, options)
+	}
+
+	_, err := handlers.CreateTelemetryHandlers([]config.HandlerSettings{{
+		Type: script.HandlerType, Options: scriptOptions(t, map[string]interface{}{"script": "function handle(msg) end"}),
+	}})
+	assert.Error(t, err, "telemetry handler without topics")
+
+	commandHandlers, err := handlers.CreateCommandHandlers([]config.HandlerSettings{{
+		Type: script.HandlerType, Options: scriptOptions(t, map[string]interface{}{"script": "local x = 1"}),
+	}})
+	require.NoError(t, err)
+	assert.Error(t, commandHandlers[0].Init(&config.RemoteConnectionInfo{}), "script without handle function")
+
+	handler := newTelemetryHandler(t, map[string]interface{}{"script": `
+function handle(msg)
+	if msg.payload == "number" then return 1 end
+	if msg.payload == "properties" then return { payload = "x", topic = "t", properties = { a = "b" } } end
+	return { payload = "x", metadata = { nested = {} } }
+end`})
+	for _, payload := range []string{"number", "properties", "metadata"} {
+		_, err := handler.HandleMessage(newMessage("event/test", payload))
+		assert.Equal(t, handlers.ResultFailed, handlers.ResultOf(err), payload)
+	}
+}
@@ -0,0 +1,323 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package script
+
+import (
+	"context"
+	"encoding/json"
+	"runtime/metrics"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// unsafeGlobals are removed from the script environment as they give access to the file system or load arbitrary code.
+var unsafeGlobals = []string{"dofile", "loadfile", "load", "loadstring", "require", "module", "collectgarbage", "_printregs"}
+
+// compile parses the script source and compiles it for loading into multiple states.
+func compile(source, name string) (*lua.FunctionProto, error) {
+	chunk, err := parse.Parse(strings.NewReader(source), name)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot parse script")
+	}
+	proto, err := lua.Compile(chunk, name)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot compile script")
+	}
+	return proto, nil
+}
+
+const (
+	heapObjectsMetric = "/memory/classes/heap/objects:bytes"
+	heapCheckInterval = 2 * time.Millisecond
+)
+
+// allocations counts the bytes of the strings created by the library functions during a single script call,
+// so that the large strings are rejected before they are created. The other values, e.g. the tables, the closures
+// and the concatenated strings, are limited by the heap check of the call.
+type allocations struct {
+	limit int64
+	used  int64
+}
+
+// reserve adds the given number of bytes to the count, raising an error if the limit is exceeded.
+func (a *allocations) reserve(L *lua.LState, size int64) {
+	a.used += size
+	if a.used > a.limit {
+		L.RaiseError("script memory limit of %d bytes exceeded", a.limit)
+	}
+}
+
+// track counts the strings returned by the library function.
+func (a *allocations) track(fn lua.LGFunction) lua.LGFunction {
+	return func(L *lua.LState) int {
+		n := fn(L)
+		for i := L.GetTop() - n + 1; i <= L.GetTop(); i++ {
+			if str, ok := L.Get(i).(lua.LString); ok {
+				a.reserve(L, int64(len(str)))
+			}
+		}
+		return n
+	}
+}
+
+// heapCheck cancels the script call if the heap grows by more than the limit during the call.
+type heapCheck struct {
+	exceeded int32
+	done     chan struct{}
+}
+
+// watchHeap starts checking the heap growth since the start of the call periodically, until the call context is done.
+// The script is aborted by the context cancellation on its next instruction.
+func watchHeap(ctx context.Context, cancel context.CancelFunc, limit int64) *heapCheck {
+	check := &heapCheck{done: make(chan struct{})}
+	baseline := heapObjects()
+	go func() {
+		defer close(check.done)
+
+		ticker := time.NewTicker(heapCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if heapObjects()-baseline > limit {
+					atomic.StoreInt32(&check.exceeded, 1)
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+	return check
+}
+
+// isExceeded waits for the check to stop and returns true if the limit was exceeded, the call context has to be done.
+func (c *heapCheck) isExceeded() bool {
+	<-c.done
+	return atomic.LoadInt32(&c.exceeded) == 1
+}
+
+// heapObjects returns the bytes of the heap occupied by the objects, including the ones not collected yet.
+func heapObjects() int64 {
+	sample := []metrics.Sample{{Name: heapObjectsMetric}}
+	metrics.Read(sample)
+	if sample[0].Value.Kind() != metrics.KindUint64 {
+		return 0
+	}
+	return int64(sample[0].Value.Uint64())
+}
+
+// newState creates a sandboxed state with the base, table, string and math libraries and the json module.
+// The strings created by the library functions are counted by the returned allocations.
+func newState(limits *scriptSettings) (*lua.LState, *allocations) {
+	L := lua.NewState(lua.Options{
+		SkipOpenLibs:        true,
+		CallStackSize:       limits.maxCallDepth,
+		RegistryMaxSize:     limits.maxStackSize,
+		MinimizeStackMemory: true,
+	})
+
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+
+	for _, name := range unsafeGlobals {
+		L.SetGlobal(name, lua.LNil)
+	}
+
+	allocs := &allocations{limit: limits.maxMemory}
+	trackFunctions(L, lua.StringLibName, allocs, "format", "gsub", "upper", "lower", "reverse", "char")
+	trackFunctions(L, lua.TabLibName, allocs, "concat")
+	if str, ok := L.GetGlobal(lua.StringLibName).(*lua.LTable); ok {
+		str.RawSetString("rep", L.NewFunction(boundedRep(allocs)))
+	}
+
+	jsonModule := L.NewTable()
+	jsonModule.RawSetString("decode", L.NewFunction(jsonDecode))
+	jsonModule.RawSetString("encode", L.NewFunction(allocs.track(jsonEncode)))
+	L.SetGlobal("json", jsonModule)
+
+	return L, allocs
+}
+
+// trackFunctions replaces the library functions with ones counting the returned strings.
+func trackFunctions(L *lua.LState, lib string, allocs *allocations, names ...string) {
+	table, ok := L.GetGlobal(lib).(*lua.LTable)
+	if !ok {
+		return
+	}
+	for _, name := range names {
+		if fn, ok := table.RawGetString(name).(*lua.LFunction); ok && fn.IsG {
+			table.RawSetString(name, L.NewFunction(allocs.track(fn.GFunction)))
+		}
+	}
+}
+
+// boundedRep replaces string.rep to count the result before it is created.
+func boundedRep(allocs *allocations) lua.LGFunction {
+	return func(L *lua.LState) int {
+		str := L.CheckString(1)
+		n := L.CheckInt(2)
+		if n <= 0 {
+			L.Push(lua.LString(""))
+			return 1
+		}
+		allocs.reserve(L, int64(len(str))*int64(n))
+		L.Push(lua.LString(strings.Repeat(str, n)))
+		return 1
+	}
+}
+
+func jsonDecode(L *lua.LState) int {
+	var value interface{}
+	if err := json.Unmarshal([]byte(L.CheckString(1)), &value); err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	L.Push(toLua(L, value))
+	return 1
+}
+
+func jsonEncode(L *lua.LState) int {
+	data, err := jsonMarshal(L.CheckAny(1))
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	L.Push(lua.LString(data))
+	return 1
+}
+
+func jsonMarshal(value lua.LValue) ([]byte, error) {
+	data, err := json.Marshal(fromLua(value))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot encode JSON")
+	}
+	return data, nil
+}
+
+// toLua converts a decoded JSON value to a Lua value.
+func toLua(L *lua.LState, value interface{}) lua.LValue {
+	switch v := value.(type) {
+	case nil:
+		return lua.LNil
+	case bool:
+		return lua.LBool(v)
+	case float64:
+		return lua.LNumber(v)
+	case string:
+		return lua.LString(v)
+	case []interface{}:
+		table := L.CreateTable(len(v), 0)
+		for _, item := range v {
+			table.Append(toLua(L, item))
+		}
+		return table
+	case map[string]interface{}:
+		table := L.CreateTable(0, len(v))
+		for key, item := range v {
+			table.RawSetString(key, toLua(L, item))
+		}
+		return table
+	case map[string]string:
+		table := L.CreateTable(0, len(v))
+		for key, item := range v {
+			table.RawSetString(key, lua.LString(item))
+		}
+		return table
+	default:
+		return lua.LNil
+	}
+}
+
+// fromLua converts a Lua value to a value that can be encoded as JSON.
+// Tables with consecutive integer keys starting at 1 are converted to arrays, all others to objects.
+func fromLua(value lua.LValue) interface{} {
+	switch v := value.(type) {
+	case lua.LBool:
+		return bool(v)
+	case lua.LNumber:
+		return float64(v)
+	case lua.LString:
+		return string(v)
+	case *lua.LTable:
+		if n := v.MaxN(); n > 0 && n == tableLen(v) {
+			array := make([]interface{}, 0, n)
+			for i := 1; i <= n; i++ {
+				array = append(array, fromLua(v.RawGetInt(i)))
+			}
+			return array
+		}
+		object := map[string]interface{}{}
+		v.ForEach(func(key, item lua.LValue) {
+			object[key.String()] = fromLua(item)
+		})
+		return object
+	default:
+		return nil
+	}
+}
+
+func tableLen(table *lua.LTable) int {
+	count := 0
+	table.ForEach(func(lua.LValue, lua.LValue) {
+		count++
+	})
+	return count
+}
+
+// stringMap converts a Lua table to a map of strings, the keys are sorted for a deterministic error reporting.
+func stringMap(value lua.LValue, field string) (map[string]string, error) {
+	if value == lua.LNil {
+		return nil, nil
+	}
+	table, ok := value.(*lua.LTable)
+	if !ok {
+		return nil, errors.Errorf("message field '%s' must be a table", field)
+	}
+
+	result := map[string]string{}
+	var invalid []string
+	table.ForEach(func(key, item lua.LValue) {
+		switch item.Type() {
+		case lua.LTString, lua.LTNumber, lua.LTBool:
+			result[key.String()] = item.String()
+		default:
+			invalid = append(invalid, key.String())
+		}
+	})
+	if len(invalid) > 0 {
+		sort.Strings(invalid)
+		return nil, errors.Errorf("message field '%s' has non-scalar values for %v", field, invalid)
+	}
+	return result, nil
+}
@@ -0,0 +1,8 @@
+-- renames the temperature field and drops the readings without it
+function handle(msg)
+	local data = json.decode(msg.payload)
+	if data == nil or data.temp == nil then
+		return nil
+	end
+	return { payload = { temperature = data.temp }, properties = { unit = "C" } }
+end
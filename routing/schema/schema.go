@@ -0,0 +1,502 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+// Package schema validates JSON documents against JSON Schemas.
+//
+// The validation keywords of the JSON Schema draft 7 are supported, except format, if/then/else, dependencies
+// and contentMediaType. The $ref keyword supports the references within the same schema only, e.g. "#/definitions/reading".
+// The annotations and the unknown keywords are ignored.
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// Schema is a compiled JSON Schema.
+type Schema struct {
+	root     interface{}
+	patterns map[string]*regexp.Regexp
+	refs     map[string]bool
+}
+
+// Load reads and compiles the JSON Schema file.
+func Load(file string) (*Schema, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot read JSON schema '%s'", file)
+	}
+	s, err := Compile(data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid JSON schema '%s'", file)
+	}
+	return s, nil
+}
+
+// Compile compiles the JSON Schema, checking the subschemas, the patterns and the references.
+func Compile(data []byte) (*Schema, error) {
+	var root interface{}
+	if err := json.Unmarshal(data, &root); err != nil {
+		return nil, err
+	}
+
+	s := &Schema{root: root, patterns: map[string]*regexp.Regexp{}, refs: map[string]bool{"#": true}}
+	if err := s.compile(root, ""); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Schema) compile(node interface{}, pointer string) error {
+	if _, ok := node.(bool); ok {
+		return nil
+	}
+	schema, ok := node.(map[string]interface{})
+	if !ok {
+		return errors.Errorf("%s: schema is not an object or a boolean", location(pointer))
+	}
+
+	if ref, ok := schema["$ref"]; ok {
+		refPointer, ok := ref.(string)
+		if !ok {
+			return errors.Errorf("%s: reference is not a string", location(pointer))
+		}
+		sub, err := s.resolve(refPointer)
+		if err != nil {
+			return errors.Wrap(err, location(pointer))
+		}
+		// the referenced subschema may be located under a not validated keyword
+		if !s.refs[refPointer] {
+			s.refs[refPointer] = true
+			if err := s.compile(sub, strings.TrimPrefix(refPointer, "#")); err != nil {
+				return err
+			}
+		}
+	}
+	if types, ok := schema["type"]; ok {
+		for _, name := range typeNames(types) {
+			switch name {
+			case "null", "boolean", "object", "array", "number", "integer", "string":
+			default:
+				return errors.Errorf("%s: unsupported type '%s'", location(pointer), name)
+			}
+		}
+	}
+	if pattern, ok := schema["pattern"].(string); ok {
+		if err := s.addPattern(pattern); err != nil {
+			return errors.Wrap(err, location(pointer))
+		}
+	}
+
+	for _, keyword := range []string{"additionalProperties", "items", "additionalItems", "not", "contains", "propertyNames"} {
+		if sub, ok := schema[keyword]; ok {
+			if items, ok := sub.([]interface{}); ok && keyword == "items" {
+				for i, item := range items {
+					if err := s.compile(item, fmt.Sprintf("%s/items/%d", pointer, i)); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			if err := s.compile(sub, pointer+"/"+keyword); err != nil {
+				return err
+			}
+		}
+	}
+	for _, keyword := range []string{"properties", "patternProperties", "definitions", "$defs"} {
+		subs, ok := schema[keyword].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for name, sub := range subs {
+			if keyword == "patternProperties" {
+				if err := s.addPattern(name); err != nil {
+					return errors.Wrap(err, location(pointer))
+				}
+			}
+			if err := s.compile(sub, pointer+"/"+keyword+"/"+escape(name)); err != nil {
+				return err
+			}
+		}
+	}
+	for _, keyword := range []string{"allOf", "anyOf", "oneOf"} {
+		subs, ok := schema[keyword].([]interface{})
+		if !ok {
+			continue
+		}
+		for i, sub := range subs {
+			if err := s.compile(sub, fmt.Sprintf("%s/%s/%d", pointer, keyword, i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Schema) addPattern(pattern string) error {
+	if _, ok := s.patterns[pattern]; ok {
+		return nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return errors.Wrapf(err, "invalid pattern '%s'", pattern)
+	}
+	s.patterns[pattern] = re
+	return nil
+}
+
+// resolve returns the subschema referenced by the JSON pointer fragment.
+func (s *Schema) resolve(ref string) (interface{}, error) {
+	if !strings.HasPrefix(ref, "#") {
+		return nil, errors.Errorf("unsupported reference '%s'", ref)
+	}
+
+	node := s.root
+	pointer := strings.TrimPrefix(ref, "#")
+	if len(pointer) == 0 {
+		return node, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, errors.Errorf("unsupported reference '%s'", ref)
+	}
+	for _, token := range strings.Split(pointer[1:], "/") {
+		token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+		object, ok := node.(map[string]interface{})
+		if !ok {
+			return nil, errors.Errorf("unresolved reference '%s'", ref)
+		}
+		if node, ok = object[token]; !ok {
+			return nil, errors.Errorf("unresolved reference '%s'", ref)
+		}
+	}
+	return node, nil
+}
+
+// Validate validates the JSON document, returning the validation errors prefixed with the JSON pointers of the invalid values.
+func (s *Schema) Validate(data []byte) []string {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return []string{fmt.Sprintf("invalid JSON: %v", err)}
+	}
+
+	v := &validator{schema: s}
+	v.validate(s.root, value, "")
+	return v.errors
+}
+
+type validator struct {
+	schema *Schema
+	errors []string
+}
+
+func (v *validator) fail(pointer, format string, args ...interface{}) {
+	v.errors = append(v.errors, location(pointer)+": "+fmt.Sprintf(format, args...))
+}
+
+// valid returns true if the value is valid against the subschema, without recording the errors.
+func (v *validator) valid(node, value interface{}, pointer string) bool {
+	nested := &validator{schema: v.schema}
+	nested.validate(node, value, pointer)
+	return len(nested.errors) == 0
+}
+
+func (v *validator) validate(node, value interface{}, pointer string) {
+	if allowed, ok := node.(bool); ok {
+		if !allowed {
+			v.fail(pointer, "value is not allowed")
+		}
+		return
+	}
+	schema, ok := node.(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	if ref, ok := schema["$ref"].(string); ok {
+		// the references are resolved on compile
+		sub, _ := v.schema.resolve(ref)
+		v.validate(sub, value, pointer)
+	}
+
+	if types, ok := schema["type"]; ok {
+		names := typeNames(types)
+		matched := false
+		for _, name := range names {
+			if hasType(value, name) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			v.fail(pointer, "expected %s, got %s", strings.Join(names, " or "), typeOf(value))
+			return
+		}
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, allowed := range enum {
+			if reflect.DeepEqual(allowed, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			v.fail(pointer, "value is not one of the enumerated values")
+		}
+	}
+	if constant, ok := schema["const"]; ok && !reflect.DeepEqual(constant, value) {
+		v.fail(pointer, "value does not match the constant")
+	}
+
+	v.validateCombinations(schema, value, pointer)
+
+	switch typed := value.(type) {
+	case float64:
+		v.validateNumber(schema, typed, pointer)
+	case string:
+		v.validateString(schema, typed, pointer)
+	case []interface{}:
+		v.validateArray(schema, typed, pointer)
+	case map[string]interface{}:
+		v.validateObject(schema, typed, pointer)
+	}
+}
+
+func (v *validator) validateCombinations(schema map[string]interface{}, value interface{}, pointer string) {
+	if subs, ok := schema["allOf"].([]interface{}); ok {
+		for _, sub := range subs {
+			v.validate(sub, value, pointer)
+		}
+	}
+	if subs, ok := schema["anyOf"].([]interface{}); ok {
+		matched := false
+		for _, sub := range subs {
+			if v.valid(sub, value, pointer) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			v.fail(pointer, "value does not match any of the schemas")
+		}
+	}
+	if subs, ok := schema["oneOf"].([]interface{}); ok {
+		matched := 0
+		for _, sub := range subs {
+			if v.valid(sub, value, pointer) {
+				matched++
+			}
+		}
+		if matched != 1 {
+			v.fail(pointer, "value matches %d schemas instead of exactly one", matched)
+		}
+	}
+	if sub, ok := schema["not"]; ok && v.valid(sub, value, pointer) {
+		v.fail(pointer, "value matches a not allowed schema")
+	}
+}
+
+func (v *validator) validateNumber(schema map[string]interface{}, value float64, pointer string) {
+	if limit, ok := schema["minimum"].(float64); ok && value < limit {
+		v.fail(pointer, "%v is less than the minimum %v", value, limit)
+	}
+	if limit, ok := schema["maximum"].(float64); ok && value > limit {
+		v.fail(pointer, "%v is greater than the maximum %v", value, limit)
+	}
+	if limit, ok := schema["exclusiveMinimum"].(float64); ok && value <= limit {
+		v.fail(pointer, "%v is not greater than the exclusive minimum %v", value, limit)
+	}
+	if limit, ok := schema["exclusiveMaximum"].(float64); ok && value >= limit {
+		v.fail(pointer, "%v is not less than the exclusive maximum %v", value, limit)
+	}
+	if divisor, ok := schema["multipleOf"].(float64); ok && divisor > 0 {
+		if quotient := value / divisor; math.Abs(quotient-math.Round(quotient)) > 1e-9 {
+			v.fail(pointer, "%v is not a multiple of %v", value, divisor)
+		}
+	}
+}
+
+func (v *validator) validateString(schema map[string]interface{}, value string, pointer string) {
+	length := float64(utf8.RuneCountInString(value))
+	if limit, ok := schema["minLength"].(float64); ok && length < limit {
+		v.fail(pointer, "string is shorter than %v characters", limit)
+	}
+	if limit, ok := schema["maxLength"].(float64); ok && length > limit {
+		v.fail(pointer, "string is longer than %v characters", limit)
+	}
+	if pattern, ok := schema["pattern"].(string); ok && !v.schema.patterns[pattern].MatchString(value) {
+		v.fail(pointer, "string does not match the pattern '%s'", pattern)
+	}
+}
+
+func (v *validator) validateArray(schema map[string]interface{}, value []interface{}, pointer string) {
+	count := float64(len(value))
+	if limit, ok := schema["minItems"].(float64); ok && count < limit {
+		v.fail(pointer, "array has less than %v items", limit)
+	}
+	if limit, ok := schema["maxItems"].(float64); ok && count > limit {
+		v.fail(pointer, "array has more than %v items", limit)
+	}
+	if unique, ok := schema["uniqueItems"].(bool); ok && unique {
+		for i := range value {
+			for j := i + 1; j < len(value); j++ {
+				if reflect.DeepEqual(value[i], value[j]) {
+					v.fail(pointer, "items %d and %d are equal", i, j)
+				}
+			}
+		}
+	}
+
+	if tuple, ok := schema["items"].([]interface{}); ok {
+		for i, item := range value {
+			itemPointer := fmt.Sprintf("%s/%d", pointer, i)
+			if i < len(tuple) {
+				v.validate(tuple[i], item, itemPointer)
+			} else if additional, ok := schema["additionalItems"]; ok {
+				v.validate(additional, item, itemPointer)
+			}
+		}
+	} else if items, ok := schema["items"]; ok {
+		for i, item := range value {
+			v.validate(items, item, fmt.Sprintf("%s/%d", pointer, i))
+		}
+	}
+	if contains, ok := schema["contains"]; ok {
+		found := false
+		for i, item := range value {
+			if v.valid(contains, item, fmt.Sprintf("%s/%d", pointer, i)) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			v.fail(pointer, "array does not contain a matching item")
+		}
+	}
+}
+
+func (v *validator) validateObject(schema map[string]interface{}, value map[string]interface{}, pointer string) {
+	count := float64(len(value))
+	if limit, ok := schema["minProperties"].(float64); ok && count < limit {
+		v.fail(pointer, "object has less than %v properties", limit)
+	}
+	if limit, ok := schema["maxProperties"].(float64); ok && count > limit {
+		v.fail(pointer, "object has more than %v properties", limit)
+	}
+	if required, ok := schema["required"].([]interface{}); ok {
+		for _, name := range required {
+			if key, ok := name.(string); ok {
+				if _, present := value[key]; !present {
+					v.fail(pointer, "missing required property '%s'", key)
+				}
+			}
+		}
+	}
+
+	properties, _ := schema["properties"].(map[string]interface{})
+	patternProperties, _ := schema["patternProperties"].(map[string]interface{})
+	additional, hasAdditional := schema["additionalProperties"]
+	propertyNames, hasPropertyNames := schema["propertyNames"]
+
+	keys := make([]string, 0, len(value))
+	for key := range value {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		propertyPointer := pointer + "/" + escape(key)
+		if hasPropertyNames && !v.valid(propertyNames, key, propertyPointer) {
+			v.fail(propertyPointer, "property name is not allowed")
+		}
+
+		matched := false
+		if sub, ok := properties[key]; ok {
+			matched = true
+			v.validate(sub, value[key], propertyPointer)
+		}
+		for pattern, sub := range patternProperties {
+			if v.schema.patterns[pattern].MatchString(key) {
+				matched = true
+				v.validate(sub, value[key], propertyPointer)
+			}
+		}
+		if !matched && hasAdditional {
+			if allowed, ok := additional.(bool); ok && !allowed {
+				v.fail(propertyPointer, "additional property is not allowed")
+			} else {
+				v.validate(additional, value[key], propertyPointer)
+			}
+		}
+	}
+}
+
+func typeNames(types interface{}) []string {
+	switch typed := types.(type) {
+	case string:
+		return []string{typed}
+	case []interface{}:
+		names := make([]string, 0, len(typed))
+		for _, name := range typed {
+			if text, ok := name.(string); ok {
+				names = append(names, text)
+			}
+		}
+		return names
+	}
+	return nil
+}
+
+func hasType(value interface{}, name string) bool {
+	if name == "integer" {
+		number, ok := value.(float64)
+		return ok && number == math.Trunc(number)
+	}
+	return typeOf(value) == name
+}
+
+func typeOf(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return "unknown"
+}
+
+func escape(token string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(token, "~", "~0"), "/", "~1")
+}
+
+func location(pointer string) string {
+	if len(pointer) == 0 {
+		return "/"
+	}
+	return pointer
+}
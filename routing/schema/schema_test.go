@@ -0,0 +1,140 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package schema_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/eclipse-kanto/azure-connector/routing/schema"
+)
+
+const readingSchema = `{
+	"$schema": "http://json-schema.org/draft-07/schema#",
+	"type": "object",
+	"required": ["deviceId", "readings"],
+	"additionalProperties": false,
+	"properties": {
+		"deviceId": {"type": "string", "pattern": "^[a-z]+-[0-9]+$"},
+		"status": {"enum": ["ok", "degraded"]},
+		"readings": {
+			"type": "array",
+			"minItems": 1,
+			"items": {"$ref": "#/definitions/reading"}
+		},
+		"tags": {"type": "array", "uniqueItems": true, "maxItems": 3}
+	},
+	"patternProperties": {
+		"^x-": {"type": ["string", "null"]}
+	},
+	"definitions": {
+		"reading": {
+			"type": "object",
+			"required": ["value"],
+			"properties": {
+				"value": {"type": "number", "minimum": -40, "exclusiveMaximum": 125},
+				"count": {"type": "integer", "multipleOf": 2},
+				"unit": {"type": "string", "minLength": 1, "maxLength": 3}
+			}
+		}
+	}
+}`
+
+func TestValidateValid(t *testing.T) {
+	s, err := schema.Compile([]byte(readingSchema))
+	require.NoError(t, err)
+
+	assert.Empty(t, s.Validate([]byte(`{"deviceId":"pump-1","readings":[{"value":-40,"count":4,"unit":"°C"}]}`)))
+	assert.Empty(t, s.Validate([]byte(`{"deviceId":"pump-1","status":"ok","readings":[{"value":124.9}],"tags":["a","b"],"x-note":null}`)))
+}
+
+func TestValidateErrors(t *testing.T) {
+	s, err := schema.Compile([]byte(readingSchema))
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"/: expected object, got array"}, s.Validate([]byte(`[]`)))
+	assert.Equal(t, []string{"invalid JSON: unexpected end of JSON input"}, s.Validate([]byte(`{"deviceId"`)))
+	assert.Equal(t, []string{
+		"/: missing required property 'readings'",
+		"/deviceId: string does not match the pattern '^[a-z]+-[0-9]+$'",
+		"/extra: additional property is not allowed",
+		"/status: value is not one of the enumerated values",
+		"/tags: array has more than 3 items",
+		"/tags: items 0 and 2 are equal",
+		"/x-note: expected string or null, got number",
+	}, s.Validate([]byte(`{"deviceId":"Pump","status":"broken","tags":["a","b","a","c"],"x-note":1,"extra":true}`)))
+	assert.Equal(t, []string{
+		"/readings/0: missing required property 'value'",
+		"/readings/0/count: expected integer, got number",
+		"/readings/1/count: 3 is not a multiple of 2",
+		"/readings/1/unit: string is longer than 3 characters",
+		"/readings/1/value: 125 is not less than the exclusive maximum 125",
+		"/readings/2/unit: string is shorter than 1 characters",
+		"/readings/2/value: -41 is less than the minimum -40",
+	}, s.Validate([]byte(`{"deviceId":"pump-1","readings":[{"count":1.5},{"value":125,"count":3,"unit":"kPa/s"},{"value":-41,"unit":""}]}`)))
+}
+
+func TestValidateCombinations(t *testing.T) {
+	s, err := schema.Compile([]byte(`{
+		"anyOf": [{"type": "string"}, {"type": "number", "maximum": 10}],
+		"oneOf": [{"type": ["number", "string"]}, {"const": 5}],
+		"not": {"const": 3}
+	}`))
+	require.NoError(t, err)
+
+	assert.Empty(t, s.Validate([]byte(`"text"`)))
+	assert.Empty(t, s.Validate([]byte(`7`)))
+	assert.Equal(t, []string{"/: value matches 2 schemas instead of exactly one"}, s.Validate([]byte(`5`)))
+	assert.Equal(t, []string{"/: value matches a not allowed schema"}, s.Validate([]byte(`3`)))
+	assert.Equal(t, []string{"/: value does not match any of the schemas"}, s.Validate([]byte(`11`)))
+
+	s, err = schema.Compile([]byte(`false`))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/: value is not allowed"}, s.Validate([]byte(`{}`)))
+}
+
+func TestCompileInvalid(t *testing.T) {
+	invalid := []string{
+		`not json`,
+		`"schema"`,
+		`{"type": "decimal"}`,
+		`{"pattern": "("}`,
+		`{"patternProperties": {"(": {}}}`,
+		`{"properties": {"value": 1}}`,
+		`{"items": [true, "number"]}`,
+		`{"$ref": "#/definitions/missing"}`,
+		`{"$ref": "other.json#/definitions/reading"}`,
+		`{"$ref": 1}`,
+		`{"allOf": [{"$ref": "#/unknown/broken"}], "unknown": {"broken": {"pattern": "["}}}`,
+	}
+	for _, data := range invalid {
+		_, err := schema.Compile([]byte(data))
+		assert.Error(t, err, data)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "schema.json")
+	require.NoError(t, os.WriteFile(file, []byte(`{"type": "number"}`), 0600))
+
+	s, err := schema.Load(file)
+	require.NoError(t, err)
+	assert.Empty(t, s.Validate([]byte(`1`)))
+
+	_, err = schema.Load(filepath.Join(t.TempDir(), "missing.json"))
+	assert.Error(t, err)
+}
@@ -13,7 +13,12 @@
 package routing
 
 import (
+	"encoding/json"
 	"fmt"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
 
 	"github.com/eclipse-kanto/suite-connector/routing"
 )
@@ -25,6 +30,14 @@ const (
 	StatusConnectionTokenExpired = "CONNECTION_TOKEN_EXPIRED"
 )
 
+const (
+	// TopicMessageErrors defines the local topic of the events about the messages that are not sent to the Azure IoT Hub.
+	TopicMessageErrors = "edge/connection/remote/errors"
+
+	// ErrorMessageTooLarge defines a message exceeding the max message size error cause.
+	ErrorMessageTooLarge = "MESSAGE_TOO_LARGE"
+)
+
 const (
 	defaultTenantID = "defaultTenant"
 	dittoNamespace  = "azure.edge"
@@ -42,3 +55,28 @@ func NewAzureGwParams(deviceID, tenantID, hubName string) *routing.GwParams {
 		PolicyID: "",
 	}
 }
+
+// MessageError describes a message that is not sent to the Azure IoT Hub.
+type MessageError struct {
+	Cause     string `json:"cause"`
+	Topic     string `json:"topic"`
+	MessageID string `json:"messageId"`
+	Size      int    `json:"size,omitempty"`
+	Error     string `json:"error,omitempty"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// SendMessageError publishes the message error event to the local broker.
+func SendMessageError(msgErr *MessageError, pub message.Publisher, logger watermill.LoggerAdapter) {
+	if msgErr.Timestamp == 0 {
+		msgErr.Timestamp = time.Now().Unix()
+	}
+
+	payload, err := json.Marshal(msgErr)
+	if err != nil {
+		return
+	}
+	if err := pub.Publish(TopicMessageErrors, message.NewMessage(watermill.NewUUID(), payload)); err != nil {
+		logger.Error("Failed to publish message error", err, watermill.LogFields{"cause": msgErr.Cause})
+	}
+}
@@ -15,20 +15,36 @@ package routing
 import (
 	"fmt"
 	"net/url"
+	"strings"
 
 	"github.com/eclipse/ditto-clients-golang/protocol"
 )
 
 const (
-	keyMessageID       = "$.mid"
-	keyContentType     = "$.ct"
-	keyContentEncoding = "$.ce"
-	contentType        = "application/json"
-	contentEncoding    = "utf-8"
+	keyMessageID    = "$.mid"
+	contentType     = "application/json"
+	contentEncoding = "utf-8"
+
+	// KeyOutputName is the message system property with the module output name.
+	KeyOutputName = "$.on"
+	// KeyContentType is the message system property with the content type of the payload.
+	KeyContentType = "$.ct"
+	// KeyContentEncoding is the message system property with the content encoding of the payload.
+	KeyContentEncoding = "$.ce"
+	// KeyCorrelationID is the message system property with the ID of the correlated message.
+	KeyCorrelationID = "$.cid"
+	// KeyExpiryTime is the message system property with the absolute expiry time of a C2D message.
+	KeyExpiryTime = "$.exp"
 
 	remoteCloudTopicFmt     = "devices/%s/messages/devicebound/#"
+	remoteCloudMessageFmt   = "devices/%s/messages/devicebound/%s"
+	remoteTwinReportedFmt   = "$iothub/twin/PATCH/properties/reported/?$rid=%s"
 	remoteTelemetryTopicFmt = "devices/%s/messages/events/%s"
 
+	remoteTopicPrefix           = "devices/"
+	remoteCloudTopicSegment     = "/messages/devicebound/"
+	remoteTelemetryTopicSegment = "/messages/events/"
+
 	localCmdTopicLongFmt  = "command//%s:%s/req/%s/%s"
 	localCmdTopicShortFmt = "c//%s:%s/q/%s/%s"
 )
@@ -38,17 +54,69 @@ func CreateRemoteCloudTopic(deviceID string) string {
 	return fmt.Sprintf(remoteCloudTopicFmt, deviceID)
 }
 
+// CreateCloudTopicWithProperties constructs the MQTT topic of a C2D message received from an Azure IoT Hub device with the given properties.
+func CreateCloudTopicWithProperties(deviceID string, properties url.Values) string {
+	return fmt.Sprintf(remoteCloudMessageFmt, deviceID, properties.Encode())
+}
+
 // CreateTelemetryTopic constructs the MQTT topic for sending telemetry data to an Azure IoT Hub device.
 func CreateTelemetryTopic(deviceID, msgID string) string {
-	msgProps := make(url.Values, 3)
-	msgProps[keyContentType] = []string{contentType}
-	msgProps[keyContentEncoding] = []string{contentEncoding}
+	return CreateTelemetryTopicWithProperties(deviceID, msgID, nil)
+}
+
+// CreateTelemetryTopicWithProperties constructs the MQTT topic for sending telemetry data to an Azure IoT Hub device
+// with additional system and application properties. The default content type and encoding are used if not provided.
+func CreateTelemetryTopicWithProperties(deviceID, msgID string, properties url.Values) string {
+	msgProps := make(url.Values, len(properties)+3)
+	for key, values := range properties {
+		msgProps[key] = append([]string{}, values...)
+	}
+	if _, ok := msgProps[KeyContentType]; !ok {
+		msgProps[KeyContentType] = []string{contentType}
+	}
+	if _, ok := msgProps[KeyContentEncoding]; !ok {
+		msgProps[KeyContentEncoding] = []string{contentEncoding}
+	}
 	if msgID != "" {
 		msgProps[keyMessageID] = []string{msgID}
 	}
 	return fmt.Sprintf(remoteTelemetryTopicFmt, deviceID, msgProps.Encode())
 }
 
+// CreateTwinReportedTopic constructs the MQTT topic for updating the reported properties of an Azure IoT Hub device twin.
+func CreateTwinReportedTopic(requestID string) string {
+	return fmt.Sprintf(remoteTwinReportedFmt, requestID)
+}
+
+// ParseTelemetryTopic returns the device ID and the message properties of an Azure IoT Hub telemetry topic.
+// The last result is false if the topic is not a telemetry topic.
+func ParseTelemetryTopic(topic string) (string, url.Values, bool) {
+	return parseRemoteTopic(topic, remoteTelemetryTopicSegment)
+}
+
+// ParseCloudTopic returns the device ID and the message properties of an Azure IoT Hub C2D message topic.
+// The last result is false if the topic is not a C2D message topic.
+func ParseCloudTopic(topic string) (string, url.Values, bool) {
+	return parseRemoteTopic(topic, remoteCloudTopicSegment)
+}
+
+func parseRemoteTopic(topic, segment string) (string, url.Values, bool) {
+	if !strings.HasPrefix(topic, remoteTopicPrefix) {
+		return "", nil, false
+	}
+
+	index := strings.Index(topic, segment)
+	if index <= len(remoteTopicPrefix) {
+		return "", nil, false
+	}
+
+	properties, err := url.ParseQuery(topic[index+len(segment):])
+	if err != nil {
+		return "", nil, false
+	}
+	return topic[len(remoteTopicPrefix):index], properties, true
+}
+
 // CreateLocalCmdTopicLong constructs the local MQTT topic for receiving C2D messages from an Azure IoT Hub device.
 func CreateLocalCmdTopicLong(env *protocol.Envelope) string {
 	return createLocalCmdTopic(localCmdTopicLongFmt, env)
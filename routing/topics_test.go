@@ -0,0 +1,75 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package routing_test
+
+import (
+	"net/url"
+	"testing"
+
+	azurerouting "github.com/eclipse-kanto/azure-connector/routing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreateTelemetryTopic(t *testing.T) {
+	assert.Equal(t,
+		"devices/dummy-device/messages/events/%24.ce=utf-8&%24.ct=application%2Fjson&%24.mid=msg-1",
+		azurerouting.CreateTelemetryTopic(testDeviceID, "msg-1"),
+	)
+}
+
+func TestCreateTelemetryTopicWithProperties(t *testing.T) {
+	props := url.Values{}
+	props.Set("$.ct", "application/octet-stream")
+	props.Set("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+
+	topic := azurerouting.CreateTelemetryTopicWithProperties(testDeviceID, "", props)
+	deviceID, parsed, ok := azurerouting.ParseTelemetryTopic(topic)
+	require.True(t, ok)
+	assert.Equal(t, testDeviceID, deviceID)
+	assert.Equal(t, "application/octet-stream", parsed.Get("$.ct"))
+	assert.Equal(t, "utf-8", parsed.Get("$.ce"))
+	assert.Equal(t, "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", parsed.Get("traceparent"))
+	assert.Empty(t, parsed.Get("$.mid"))
+}
+
+func TestCreateTwinReportedTopic(t *testing.T) {
+	assert.Equal(t, "$iothub/twin/PATCH/properties/reported/?$rid=7", azurerouting.CreateTwinReportedTopic("7"))
+}
+
+func TestParseCloudTopic(t *testing.T) {
+	deviceID, props, ok := azurerouting.ParseCloudTopic("devices/dummy-device/messages/devicebound/%24.mid=msg-1&%24.to=%2Fdevices%2Fdummy-device&app=value")
+	require.True(t, ok)
+	assert.Equal(t, testDeviceID, deviceID)
+	assert.Equal(t, "msg-1", props.Get("$.mid"))
+	assert.Equal(t, "value", props.Get("app"))
+
+	_, _, ok = azurerouting.ParseCloudTopic(azurerouting.CreateTelemetryTopic(testDeviceID, "msg-1"))
+	assert.False(t, ok)
+	_, _, ok = azurerouting.ParseTelemetryTopic("event/dummy-device")
+	assert.False(t, ok)
+	_, _, ok = azurerouting.ParseTelemetryTopic("devices//messages/events/")
+	assert.False(t, ok)
+}
+
+func TestCreateCloudTopicWithProperties(t *testing.T) {
+	props := url.Values{}
+	props.Set("$.mid", "msg-1")
+	props.Set("app", "value")
+
+	deviceID, parsed, ok := azurerouting.ParseCloudTopic(azurerouting.CreateCloudTopicWithProperties(testDeviceID, props))
+	require.True(t, ok)
+	assert.Equal(t, testDeviceID, deviceID)
+	assert.Equal(t, props, parsed)
+}
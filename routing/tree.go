@@ -0,0 +1,135 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package routing
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	wildcardSingle = "+"
+	wildcardMulti  = "#"
+)
+
+// TopicTree indexes MQTT topic filters, so that a topic is matched against all of them by walking its levels once.
+type TopicTree struct {
+	root *topicNode
+}
+
+type topicNode struct {
+	children map[string]*topicNode
+	values   []int
+}
+
+func newTopicNode() *topicNode {
+	return &topicNode{children: map[string]*topicNode{}}
+}
+
+// NewTopicTree creates an empty topic filters tree.
+func NewTopicTree() *TopicTree {
+	return &TopicTree{root: newTopicNode()}
+}
+
+// Add adds the topic filter to the tree, associated with the given value.
+func (t *TopicTree) Add(filter string, value int) {
+	node := t.root
+	for _, level := range strings.Split(filter, "/") {
+		child, ok := node.children[level]
+		if !ok {
+			child = newTopicNode()
+			node.children[level] = child
+		}
+		node = child
+	}
+	node.values = append(node.values, value)
+}
+
+// Match returns the sorted values of all filters matching the topic.
+func (t *TopicTree) Match(topic string) []int {
+	levels := strings.Split(topic, "/")
+
+	var values []int
+	t.match(t.root, levels, 0, strings.HasPrefix(topic, "$"), &values)
+	sort.Ints(values)
+	return values
+}
+
+func (t *TopicTree) match(node *topicNode, levels []string, index int, system bool, values *[]int) {
+	// the wildcards at the first level do not match topics starting with '$'
+	wildcards := !(system && index == 0)
+
+	if wildcards {
+		if multi, ok := node.children[wildcardMulti]; ok {
+			*values = append(*values, multi.values...)
+		}
+	}
+
+	if index == len(levels) {
+		*values = append(*values, node.values...)
+		return
+	}
+
+	if child, ok := node.children[levels[index]]; ok {
+		t.match(child, levels, index+1, system, values)
+	}
+	if wildcards {
+		if single, ok := node.children[wildcardSingle]; ok {
+			t.match(single, levels, index+1, system, values)
+		}
+	}
+}
+
+// CaptureTopic returns the topic levels matched by the wildcards of the filter, in order.
+// A multi-level wildcard captures all remaining levels joined with '/'. The result is nil if the topic does not match.
+func CaptureTopic(filter, topic string) []string {
+	if !MatchTopic(filter, topic) {
+		return nil
+	}
+
+	topicLevels := strings.Split(topic, "/")
+	captures := []string{}
+	for i, level := range strings.Split(filter, "/") {
+		switch level {
+		case wildcardSingle:
+			captures = append(captures, topicLevels[i])
+		case wildcardMulti:
+			if i < len(topicLevels) {
+				captures = append(captures, strings.Join(topicLevels[i:], "/"))
+			} else {
+				captures = append(captures, "")
+			}
+		}
+	}
+	return captures
+}
+
+// ValidateTopicFilter checks that the MQTT topic filter is not empty and uses the wildcards correctly.
+func ValidateTopicFilter(filter string) error {
+	if len(filter) == 0 {
+		return errors.New("empty topic filter")
+	}
+
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if strings.Contains(level, wildcardMulti) && (level != wildcardMulti || i != len(levels)-1) {
+			return errors.Errorf("invalid multi-level wildcard in topic filter '%s'", filter)
+		}
+		if strings.Contains(level, wildcardSingle) && level != wildcardSingle {
+			return errors.Errorf("invalid single-level wildcard in topic filter '%s'", filter)
+		}
+	}
+	return nil
+}
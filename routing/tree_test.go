@@ -0,0 +1,77 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package routing_test
+
+import (
+	"testing"
+
+	azurerouting "github.com/eclipse-kanto/azure-connector/routing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTopicTree(t *testing.T) {
+	filters := []string{
+		"event/#",
+		"event/+/temp",
+		"event/room1/temp",
+		"#",
+		"+/+",
+		"telemetry/+",
+		"$iothub/#",
+		"event/room1/temp",
+	}
+	tree := azurerouting.NewTopicTree()
+	for i, filter := range filters {
+		tree.Add(filter, i)
+	}
+
+	topics := []string{
+		"event/room1/temp",
+		"event",
+		"event/x",
+		"telemetry/a",
+		"telemetry/a/b",
+		"$iothub/twin",
+		"$SYS/broker",
+		"other/topic/level",
+	}
+	for _, topic := range topics {
+		var expected []int
+		for i, filter := range filters {
+			if azurerouting.MatchTopic(filter, topic) {
+				expected = append(expected, i)
+			}
+		}
+		assert.Equal(t, expected, tree.Match(topic), topic)
+	}
+
+	assert.Empty(t, azurerouting.NewTopicTree().Match("event"))
+}
+
+func TestCaptureTopic(t *testing.T) {
+	assert.Equal(t, []string{"room1", "temp"}, azurerouting.CaptureTopic("event/+/+", "event/room1/temp"))
+	assert.Equal(t, []string{"room1", "a/b"}, azurerouting.CaptureTopic("event/+/#", "event/room1/a/b"))
+	assert.Equal(t, []string{""}, azurerouting.CaptureTopic("event/#", "event"))
+	assert.Equal(t, []string{}, azurerouting.CaptureTopic("event/temp", "event/temp"))
+	assert.Nil(t, azurerouting.CaptureTopic("event/+", "telemetry/temp"))
+}
+
+func TestValidateTopicFilter(t *testing.T) {
+	for _, filter := range []string{"#", "+", "a/+/b", "a/#", "$iothub/twin/#"} {
+		assert.NoError(t, azurerouting.ValidateTopicFilter(filter), filter)
+	}
+	for _, filter := range []string{"", "a/#/b", "a/b#", "a/+b", "a/b+/c"} {
+		assert.Error(t, azurerouting.ValidateTopicFilter(filter), filter)
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package tracing
+
+import (
+	"context"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/eclipse-kanto/suite-connector/connector"
+
+	"github.com/eclipse-kanto/azure-connector/routing"
+)
+
+const (
+	attrSource       = "messaging.source.name"
+	attrMessageID    = "messaging.message.id"
+	attrMessageCount = "messaging.batch.message_count"
+)
+
+// Middleware returns a message router middleware that traces the messages processed by the handlers with the given names.
+// The trace context is extracted from the C2D message properties or the Ditto headers of the incoming message and
+// propagated as D2C message properties or Ditto headers of the produced messages.
+func (t *Tracer) Middleware(handlerNames ...string) message.HandlerMiddleware {
+	traced := make(map[string]bool, len(handlerNames))
+	for _, name := range handlerNames {
+		traced[name] = true
+	}
+
+	return func(h message.HandlerFunc) message.HandlerFunc {
+		return func(msg *message.Message) ([]*message.Message, error) {
+			handlerName := message.HandlerNameFromCtx(msg.Context())
+			if !traced[handlerName] {
+				return h(msg)
+			}
+
+			topic, _ := connector.TopicFromCtx(msg.Context())
+
+			ctx := msg.Context()
+			if _, properties, ok := routing.ParseCloudTopic(topic); ok {
+				ctx = ExtractFromProperties(ctx, properties)
+			} else {
+				ctx = ExtractFromDitto(ctx, msg.Payload)
+			}
+
+			started := time.Now()
+			ctx, span := t.tracer.Start(ctx, handlerName,
+				trace.WithSpanKind(trace.SpanKindConsumer),
+				trace.WithTimestamp(started),
+				trace.WithAttributes(attribute.String(attrSource, topic), attribute.String(attrMessageID, msg.UUID)),
+			)
+			defer span.End()
+			msg.SetContext(ctx)
+
+			produced, err := h(msg)
+			if err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				return produced, err
+			}
+
+			span.SetAttributes(attribute.Int(attrMessageCount, len(produced)))
+			for _, outgoing := range produced {
+				inject(ctx, outgoing, started)
+			}
+			return produced, nil
+		}
+	}
+}
+
+func inject(ctx context.Context, msg *message.Message, created time.Time) {
+	topic, ok := connector.TopicFromCtx(msg.Context())
+	if !ok {
+		return
+	}
+
+	if deviceID, properties, ok := routing.ParseTelemetryTopic(topic); ok {
+		InjectIntoProperties(ctx, properties, created)
+		topic = routing.CreateTelemetryTopicWithProperties(deviceID, "", properties)
+		msg.SetContext(connector.SetTopicToCtx(msg.Context(), topic))
+		return
+	}
+
+	if payload, ok := InjectIntoDitto(ctx, msg.Payload); ok {
+		msg.Payload = payload
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package tracing_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/ThreeDotsLabs/watermill/pubsub/gochannel"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/eclipse-kanto/suite-connector/connector"
+
+	"github.com/eclipse-kanto/azure-connector/routing"
+	"github.com/eclipse-kanto/azure-connector/tracing"
+)
+
+const (
+	testDeviceID    = "dummy-device"
+	testTraceParent = "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+)
+
+func newTestTracer() (*tracing.Tracer, *tracetest.SpanRecorder) {
+	recorder := tracetest.NewSpanRecorder()
+	return tracing.NewTracer(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))), recorder
+}
+
+func traceParent(sc trace.SpanContext) string {
+	return "00-" + sc.TraceID().String() + "-" + sc.SpanID().String() + "-" + sc.TraceFlags().String()
+}
+
+func TestMiddlewareTelemetry(t *testing.T) {
+	tracer, recorder := newTestTracer()
+	handler := tracer.Middleware("telemetry_handler")
+
+	out := runTracedHandler(t, handler, "telemetry_handler", "event/thing",
+		`{"topic":"ns/thing/things/twin/events/modified","headers":{"traceparent":"`+testTraceParent+`"}}`,
+		func(msg *message.Message) ([]*message.Message, error) {
+			// the span context is available to the handler
+			assert.True(t, trace.SpanContextFromContext(msg.Context()).IsValid())
+
+			outgoing := message.NewMessage(watermill.NewUUID(), msg.Payload)
+			outgoing.SetContext(connector.SetTopicToCtx(outgoing.Context(), routing.CreateTelemetryTopic(testDeviceID, "msg-1")))
+			return []*message.Message{outgoing}, nil
+		},
+	)
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 1)
+	assert.Equal(t, "telemetry_handler", spans[0].Name())
+	assert.Equal(t, trace.SpanKindConsumer, spans[0].SpanKind())
+	assert.Equal(t, "0af7651916cd43dd8448eb211c80319c", spans[0].SpanContext().TraceID().String())
+	assert.Equal(t, "b7ad6b7169203331", spans[0].Parent().SpanID().String())
+	assert.Contains(t, spans[0].Attributes(), attribute.String("messaging.source.name", "event/thing"))
+	assert.Contains(t, spans[0].Attributes(), attribute.Int("messaging.batch.message_count", 1))
+
+	topic, _ := connector.TopicFromCtx(out.Context())
+	_, props, ok := routing.ParseTelemetryTopic(topic)
+	require.True(t, ok)
+	assert.Equal(t, traceParent(spans[0].SpanContext()), props.Get(tracing.HeaderTraceParent))
+	assert.Contains(t, props.Get(tracing.HeaderTraceState), "timestamp=")
+	assert.Equal(t, "msg-1", props.Get("$.mid"))
+}
+
+func TestMiddlewareCommand(t *testing.T) {
+	tracer, recorder := newTestTracer()
+	handler := tracer.Middleware("command_handler")
+
+	out := runTracedHandler(t, handler, "command_handler",
+		"devices/dummy-device/messages/devicebound/%24.mid=c2d-1&traceparent="+testTraceParent,
+		`{"topic":"ns/thing/things/live/messages/hello","headers":{}}`,
+		func(msg *message.Message) ([]*message.Message, error) {
+			outgoing := message.NewMessage(watermill.NewUUID(), msg.Payload)
+			outgoing.SetContext(connector.SetTopicToCtx(outgoing.Context(), "command//ns:thing/req//hello"))
+			return []*message.Message{outgoing}, nil
+		},
+	)
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 1)
+	assert.Equal(t, "b7ad6b7169203331", spans[0].Parent().SpanID().String())
+
+	propagated := trace.SpanContextFromContext(tracing.ExtractFromDitto(context.Background(), out.Payload))
+	assert.Equal(t, spans[0].SpanContext().TraceID(), propagated.TraceID())
+	assert.Equal(t, spans[0].SpanContext().SpanID(), propagated.SpanID())
+}
+
+func TestMiddlewareNotTracedHandler(t *testing.T) {
+	tracer, recorder := newTestTracer()
+	handler := tracer.Middleware("telemetry_handler")
+
+	out := runTracedHandler(t, handler, "params_handler", "edge/thing/request", `{"topic":"t"}`,
+		func(msg *message.Message) ([]*message.Message, error) {
+			return []*message.Message{message.NewMessage(watermill.NewUUID(), msg.Payload)}, nil
+		},
+	)
+	assert.Empty(t, recorder.Ended())
+	assert.Equal(t, `{"topic":"t"}`, string(out.Payload))
+}
+
+type recordingPublisher struct {
+	published chan *message.Message
+}
+
+func (p *recordingPublisher) Publish(topic string, messages ...*message.Message) error {
+	for _, msg := range messages {
+		p.published <- msg
+	}
+	return nil
+}
+
+func (p *recordingPublisher) Close() error {
+	return nil
+}
+
+func runTracedHandler(
+	t *testing.T, middleware message.HandlerMiddleware, handlerName, topic, payload string, h message.HandlerFunc,
+) *message.Message {
+	router, err := message.NewRouter(message.RouterConfig{}, watermill.NopLogger{})
+	require.NoError(t, err)
+	router.AddMiddleware(func(h message.HandlerFunc) message.HandlerFunc {
+		return func(msg *message.Message) ([]*message.Message, error) {
+			msg.SetContext(connector.SetTopicToCtx(msg.Context(), topic))
+			return h(msg)
+		}
+	})
+	router.AddMiddleware(middleware)
+
+	pubSub := gochannel.NewGoChannel(gochannel.Config{}, watermill.NopLogger{})
+	defer pubSub.Close()
+
+	pub := &recordingPublisher{published: make(chan *message.Message, 1)}
+	router.AddHandler(handlerName, "in", pubSub, "out", pub, h)
+
+	go router.Run(context.Background())
+	defer router.Close()
+	<-router.Running()
+
+	require.NoError(t, pubSub.Publish("in", message.NewMessage(watermill.NewUUID(), []byte(payload))))
+
+	select {
+	case msg := <-pub.published:
+		return msg
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "message not published")
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package tracing_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/eclipse-kanto/suite-connector/logger"
+	"github.com/eclipse-kanto/suite-connector/testutil"
+
+	"github.com/eclipse-kanto/azure-connector/tracing"
+)
+
+func TestOTLPTracerProvider(t *testing.T) {
+	requests := make(chan *coltracepb.ExportTraceServiceRequest, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/collector/v1/traces", r.URL.Path)
+		assert.Equal(t, "application/x-protobuf", r.Header.Get("Content-Type"))
+
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		request := &coltracepb.ExportTraceServiceRequest{}
+		assert.NoError(t, proto.Unmarshal(body, request))
+		requests <- request
+	}))
+	defer server.Close()
+
+	provider, err := tracing.NewOTLPTracerProvider(server.URL+"/collector/", "test-service", testutil.NewLogger("tracing", logger.INFO, t))
+	require.NoError(t, err)
+
+	_, span := provider.Tracer("test").Start(context.Background(), "telemetry_handler", trace.WithSpanKind(trace.SpanKindConsumer))
+	span.SetStatus(codes.Error, errors.New("failed").Error())
+	span.End()
+
+	require.NoError(t, provider.Shutdown(context.Background()))
+
+	var request *coltracepb.ExportTraceServiceRequest
+	select {
+	case request = <-requests:
+	default:
+		require.Fail(t, "spans not exported")
+	}
+
+	require.Len(t, request.ResourceSpans, 1)
+	resourceSpans := request.ResourceSpans[0]
+	serviceName := ""
+	for _, attr := range resourceSpans.Resource.Attributes {
+		if attr.Key == "service.name" {
+			serviceName = attr.Value.GetStringValue()
+		}
+	}
+	assert.Equal(t, "test-service", serviceName)
+
+	require.Len(t, resourceSpans.ScopeSpans, 1)
+	require.Len(t, resourceSpans.ScopeSpans[0].Spans, 1)
+	exported := resourceSpans.ScopeSpans[0].Spans[0]
+	assert.Equal(t, "telemetry_handler", exported.Name)
+	assert.Equal(t, tracepb.Span_SPAN_KIND_CONSUMER, exported.Kind)
+	assert.Equal(t, span.SpanContext().SpanID().String(), trace.SpanID(*(*[8]byte)(exported.SpanId)).String())
+	assert.Equal(t, tracepb.Status_STATUS_CODE_ERROR, exported.Status.Code)
+	assert.Equal(t, "failed", exported.Status.Message)
+}
+
+func TestOTLPTracerProviderInvalidEndpoint(t *testing.T) {
+	for _, endpoint := range []string{"localhost:4318", "ftp://localhost:4318", "://invalid"} {
+		_, err := tracing.NewOTLPTracerProvider(endpoint, "test-service", testutil.NewLogger("tracing", logger.INFO, t))
+		assert.Error(t, err, endpoint)
+	}
+}
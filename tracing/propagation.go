@@ -0,0 +1,147 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// HeaderTraceParent defines the W3C trace context traceparent header.
+	HeaderTraceParent = "traceparent"
+	// HeaderTraceState defines the W3C trace context tracestate header.
+	HeaderTraceState = "tracestate"
+
+	dittoKeyTopic   = "topic"
+	dittoKeyHeaders = "headers"
+
+	iotHubTimestampKey = "timestamp"
+)
+
+var propagator = propagation.TraceContext{}
+
+// dittoHeaders carries the trace context in the headers of a Ditto protocol message, matching the header names case-insensitively.
+type dittoHeaders map[string]interface{}
+
+func (h dittoHeaders) Get(key string) string {
+	for name, value := range h {
+		if strings.EqualFold(name, key) {
+			s, _ := value.(string)
+			return s
+		}
+	}
+	return ""
+}
+
+func (h dittoHeaders) Set(key, value string) {
+	for name := range h {
+		if strings.EqualFold(name, key) {
+			delete(h, name)
+		}
+	}
+	h[key] = value
+}
+
+func (h dittoHeaders) Keys() []string {
+	keys := make([]string, 0, len(h))
+	for name := range h {
+		keys = append(keys, name)
+	}
+	return keys
+}
+
+// messageProperties carries the trace context in the Azure IoT Hub message application properties.
+type messageProperties url.Values
+
+func (p messageProperties) Get(key string) string {
+	return url.Values(p).Get(key)
+}
+
+func (p messageProperties) Set(key, value string) {
+	url.Values(p).Set(key, value)
+}
+
+func (p messageProperties) Keys() []string {
+	keys := make([]string, 0, len(p))
+	for key := range p {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// ExtractFromDitto returns a copy of the context with the remote span context from the headers of a Ditto protocol message.
+// The context is returned unchanged if the payload is not a Ditto message or there is no valid traceparent header.
+func ExtractFromDitto(ctx context.Context, payload []byte) context.Context {
+	msg := struct {
+		Headers dittoHeaders `json:"headers"`
+	}{}
+	if err := json.Unmarshal(payload, &msg); err != nil || msg.Headers == nil {
+		return ctx
+	}
+	return propagator.Extract(ctx, msg.Headers)
+}
+
+// InjectIntoDitto sets the traceparent and tracestate headers of a Ditto protocol message from the span context of the context.
+// The payload is returned unchanged with false if it is not a Ditto message.
+func InjectIntoDitto(ctx context.Context, payload []byte) ([]byte, bool) {
+	msg := map[string]json.RawMessage{}
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		return payload, false
+	}
+	if _, ok := msg[dittoKeyTopic]; !ok {
+		return payload, false
+	}
+
+	headers := dittoHeaders{}
+	if raw, ok := msg[dittoKeyHeaders]; ok {
+		if err := json.Unmarshal(raw, &headers); err != nil || headers == nil {
+			return payload, false
+		}
+	}
+	propagator.Inject(ctx, headers)
+
+	rawHeaders, err := json.Marshal(headers)
+	if err != nil {
+		return payload, false
+	}
+	msg[dittoKeyHeaders] = rawHeaders
+
+	result, err := json.Marshal(msg)
+	if err != nil {
+		return payload, false
+	}
+	return result, true
+}
+
+// ExtractFromProperties returns a copy of the context with the remote span context from the Azure IoT Hub message application properties.
+func ExtractFromProperties(ctx context.Context, properties url.Values) context.Context {
+	return propagator.Extract(ctx, messageProperties(properties))
+}
+
+// InjectIntoProperties sets the traceparent and tracestate Azure IoT Hub message application properties from the span context
+// of the context. The tracestate contains the creation timestamp used by the Azure IoT Hub distributed tracing.
+func InjectIntoProperties(ctx context.Context, properties url.Values, created time.Time) {
+	sc := trace.SpanContextFromContext(ctx)
+	if state, err := sc.TraceState().Insert(iotHubTimestampKey, strconv.FormatInt(created.Unix(), 10)); err == nil {
+		ctx = trace.ContextWithSpanContext(ctx, sc.WithTraceState(state))
+	}
+	propagator.Inject(ctx, messageProperties(properties))
+}
@@ -0,0 +1,98 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package tracing_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/eclipse-kanto/azure-connector/tracing"
+)
+
+func TestExtractFromDitto(t *testing.T) {
+	payload := `{"topic":"ns/thing/things/twin/commands/modify","headers":{"TraceParent":"` + testTraceParent + `","tracestate":"vendor=value"},"path":"/","value":{}}`
+
+	sc := trace.SpanContextFromContext(tracing.ExtractFromDitto(context.Background(), []byte(payload)))
+	assert.True(t, sc.IsValid())
+	assert.True(t, sc.IsRemote())
+	assert.Equal(t, testTraceParent, traceParent(sc))
+	assert.Equal(t, "vendor=value", sc.TraceState().String())
+
+	for _, invalid := range []string{
+		`{"topic":"ns/thing/things/twin/commands/modify"}`,
+		`{"headers":{"traceparent":"invalid"}}`,
+		`not json`,
+	} {
+		assert.False(t, trace.SpanContextFromContext(tracing.ExtractFromDitto(context.Background(), []byte(invalid))).IsValid(), invalid)
+	}
+}
+
+func TestInjectIntoDitto(t *testing.T) {
+	ctx := tracing.ExtractFromDitto(context.Background(),
+		[]byte(`{"headers":{"traceparent":"`+testTraceParent+`","tracestate":"vendor=value"}}`))
+
+	payload, ok := tracing.InjectIntoDitto(ctx, []byte(`{"topic":"ns/thing/things/live/messages/hello","headers":{"correlation-id":"cid","Traceparent":"old"},"value":42}`))
+	require.True(t, ok)
+
+	msg := struct {
+		Topic   string            `json:"topic"`
+		Headers map[string]string `json:"headers"`
+		Value   int               `json:"value"`
+	}{}
+	require.NoError(t, json.Unmarshal(payload, &msg))
+	assert.Equal(t, "ns/thing/things/live/messages/hello", msg.Topic)
+	assert.Equal(t, 42, msg.Value)
+	assert.Equal(t, map[string]string{
+		"correlation-id": "cid",
+		"traceparent":    testTraceParent,
+		"tracestate":     "vendor=value",
+	}, msg.Headers)
+
+	payload, ok = tracing.InjectIntoDitto(ctx, []byte(`{"topic":"ns/thing/things/twin/events/modified"}`))
+	require.True(t, ok)
+	assert.Equal(t, trace.SpanContextFromContext(ctx), trace.SpanContextFromContext(tracing.ExtractFromDitto(context.Background(), payload)))
+
+	for _, notDitto := range []string{`{"value":42}`, `[1,2]`, `raw`, `{"topic":"t","headers":"invalid"}`} {
+		payload, ok = tracing.InjectIntoDitto(ctx, []byte(notDitto))
+		assert.False(t, ok)
+		assert.Equal(t, notDitto, string(payload))
+	}
+}
+
+func TestPropertiesPropagation(t *testing.T) {
+	props := url.Values{}
+	props.Set(tracing.HeaderTraceParent, testTraceParent)
+	props.Set(tracing.HeaderTraceState, "timestamp=1,vendor=value")
+
+	ctx := tracing.ExtractFromProperties(context.Background(), props)
+	sc := trace.SpanContextFromContext(ctx)
+	require.True(t, sc.IsValid())
+	assert.Equal(t, "timestamp=1,vendor=value", sc.TraceState().String())
+
+	out := url.Values{}
+	tracing.InjectIntoProperties(ctx, out, time.Unix(1539243209, 0))
+	assert.Equal(t, url.Values{
+		"traceparent": {testTraceParent},
+		"tracestate":  {"timestamp=1539243209,vendor=value"},
+	}, out)
+
+	assert.False(t, trace.SpanContextFromContext(tracing.ExtractFromProperties(context.Background(), url.Values{})).IsValid())
+}
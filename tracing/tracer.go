@@ -0,0 +1,29 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+package tracing
+
+import (
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/eclipse-kanto/azure-connector"
+
+// Tracer traces the messages processed by the message handlers.
+type Tracer struct {
+	tracer trace.Tracer
+}
+
+// NewTracer creates a tracer starting the spans using the given OpenTelemetry tracer provider.
+func NewTracer(provider trace.TracerProvider) *Tracer {
+	return &Tracer{tracer: provider.Tracer(instrumentationName)}
+}